@@ -8,6 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"squish"
+	"strconv"
+
+	"code.cloudfoundry.org/bytefmt"
 )
 
 func main() {
@@ -17,6 +20,7 @@ func main() {
 
 	printVersion := flag.Bool("v", false, "print version information")
 	sortMethodArg := flag.String("m", squish.DefaultSortMethod, "Fastq read sorting method. "+sortMethodOptionStr)
+	sortKey := flag.String("key", "", "Composite sort key replacing -m, e.g. 'len:desc,gc,seq'. Fields: len, gc, seq, qual, name, tile, clump, qmean, qmedian, ee, q30, bc, umi; each optionally :asc or :desc")
 	cpuProfileFilename := flag.String("cpuProf", squish.DefaultCPUProfileFilename, "CPU profile filename")
 	memProfileFilename := flag.String("memProf", squish.DefaultMemProfileFilename, "Memory profile filename")
 	orderFilename := flag.String("orderFile", squish.DefaultOrderFilename, "File to record the order of sorted fastq reads")
@@ -24,20 +28,68 @@ func main() {
 	manifestFilename := flag.String("manifestFile", squish.DefaultManifestFilename, "Text manifest filename listing absolute paths to output FASTQ files")
 	outputDirArg := flag.String("outdir", squish.DefaultOutputDirNameBase, "Output dir")
 	sortEngine := flag.String("engine", squish.DefaultSortEngine, "Sort engine. Options: memory, external")
-	bucketStrategy := flag.String("bucket", squish.DefaultBucketStrategy, "External bucket strategy. Options: auto, sequence-prefix, quality-prefix, gc-range, hash, clump-minimizer")
+	bucketStrategy := flag.String("bucket", squish.DefaultBucketStrategy, "External bucket strategy. "+squish.BucketStrategyUsage())
+	sortParams := flag.String("sortParam", "", "Parameters of a registered sort method as comma-separated name=value pairs")
+	bucketParams := flag.String("bucketParam", "", "Parameters of a registered bucket strategy as comma-separated name=value pairs")
 	bucketCount := flag.Int("buckets", squish.DefaultExternalBucketCount, "External bucket count for bucket strategies that use a configurable count")
-	clumpKmerLen := flag.Int("clumpK", squish.DefaultClumpKmerLen, "K-mer length used by the clump minimizer")
+	clumpKmerLen := flag.String("clumpK", strconv.Itoa(squish.DefaultClumpKmerLen), "K-mer length used by the clump minimizer, or 'auto' to choose k and -clumpBorder from sampled read lengths and qualities (-m clump only; other methods use the default)")
+	clumpSeed := flag.String("clumpSeed", "", "Clump: spaced-seed mask of 1 (used) and 0 (ignored) positions, e.g. 1101101101; its length replaces -clumpK")
+	clumpMinimizerWindow := flag.Int("clumpW", 0, "Clump: pick pivots only among (w,k)-minimizers with this window size w (0 = every k-mer; -longRead default: 10)")
 	clumpMinCount := flag.Int("clumpMinCount", 0, "Clump: ignore pivot k-mers appearing fewer than this many times (0 = disabled)")
+	clumpMaxCount := flag.Int("clumpMaxCount", 0, "Clump: ignore pivot k-mers appearing more than this many times, e.g. repeats and adapters (0 = disabled)")
+	clumpBlacklist := flag.String("clumpBlacklist", "", "Clump: FASTA of adapter or repeat sequences whose k-mers are never used as pivots")
 	clumpRComp := flag.Bool("clumpRComp", true, "Clump: reverse-complement reads whose pivot k-mer was on the minus strand")
 	clumpRawPivot := flag.Bool("clumpRawPivot", false, "Clump: use lex-max canonical k-mer as pivot instead of max-hash k-mer")
 	clumpBorder := flag.Int("clumpBorder", 1, "Clump: bases to exclude from each read end during pivot selection (Clumpify default: 1)")
+	clumpMinQuality := flag.Int("clumpMinQual", 0, "Clump: skip pivot k-mers containing a base below this Phred score (0 = disabled)")
+	clumpSkipAmbiguous := flag.Bool("clumpSkipN", false, "Clump: skip pivot k-mers containing N or other non-ACGT bases")
+	headerOrder := flag.String("headerOrder", squish.DefaultHeaderOrder, "Clump: order reads with the same sequence by header. Options: off (quality, then header bytes), tokens (header in natural order, so lane, tile, and x/y compare as numbers), similarity (tokens, then chained by shared header prefix)")
+	clumpECC := flag.Bool("clumpECC", false, "Clump: replace isolated low-quality bases with the consensus of reads aligned on the same pivot (lossy)")
+	eccMinDepth := flag.Int("eccMinDepth", squish.DefaultClumpCorrectMinDepth, "Clump: reads that must agree on a consensus base before -clumpECC corrects to it")
+	eccMinQual := flag.Int("eccMinQual", squish.DefaultClumpCorrectMinQual, "Clump: -clumpECC only corrects bases below this Phred score")
+	keyTrim5 := flag.Int("keyTrim5", 0, "Bases excluded from the 5' end of each read before clump, alpha, and GC keys are extracted (e.g. inline UMIs or barcodes)")
+	barcodeTag := flag.String("barcode", "", "Cell barcode of the bc key field: pos:START-END (sequence bases), token:N (header token, negative from the end), or regex:EXPR (first capture group of the header)")
+	umiTag := flag.String("umi", "", "UMI of the umi key field, in the same forms as -barcode, e.g. token:-1 for read_UMI headers")
+	keyTrim3 := flag.Int("keyTrim3", 0, "Bases excluded from the 3' end of each read before clump, alpha, and GC keys are extracted (e.g. adapter read-through)")
+	longRead := flag.Bool("longRead", false, "Long-read (ONT/PacBio) mode: sampled minimizer pivots, length tie-breaks, -clumpK auto unless -clumpK is set, and a bucket size cap")
+	maxBucketSizeArg := flag.String("maxBucketSize", "", "Cap on the record bytes of one external bucket, e.g. 512M or 2G; larger clump buckets are split before loading. This bounds a bucket, not each read (default: unbounded, 1G with -longRead)")
+	lengthDesc := flag.Bool("lengthDesc", false, "Length sort: order longest reads first")
+	canonicalFlip := flag.Bool("canonicalFlip", false, "Canonical-alpha: reverse-complement reads whose reverse complement is their sort key, so both strands of a fragment are written alike")
+	abundanceMismatches := flag.Int("abundanceMismatches", 1, "Abundance: substitutions between a sequence and the more abundant sequence it follows (0 = exact copies only)")
+	referenceFasta := flag.String("ref", "", "Reference FASTA for -m reference: reads are sorted by approximate position from a k-mer index of it")
+	referenceKmerLen := flag.Int("refK", squish.DefaultReferenceKmerLen, "Reference: k-mer length of the reference index (1-32)")
+	referenceStride := flag.Int("refStride", 1, "Reference: index every n-th reference position to save memory on large references")
+	keyCommand := flag.String("keyCmd", "", "Key command for -m command: run with the read ID and sequence of every read as \"id\\tsequence\" lines on stdin; it must print one sort key line per read, in input order. Run without a shell; pass its arguments with -keyArg")
+	var keyArgs []string
+	flag.Func("keyArg", "Argument for the -keyCmd program, passed as is; repeat for each argument", func(value string) error {
+		keyArgs = append(keyArgs, value)
+		return nil
+	})
+	demuxSampleSheet := flag.String("demux", "", "Sample sheet (CSV or TSV with sample and index columns, or an Illumina sample sheet) to demultiplex reads by during the bucket pass; each sample gets its own sorted output, and unmatched reads go to the main output. External engine only")
+	demuxMismatches := flag.Int("demuxMismatches", 1, "Demux: substitutions allowed between a sample index and the read index")
+	demuxTag := flag.String("demuxTag", "", "Demux: where the read index is found, in the forms of -barcode; dual indexes are separated by '+' (default \""+squish.DefaultDemuxTag+"\", the last header token)")
 	quantizeQuality := flag.Bool("quantize", false, "Bin quality scores to 4 Illumina levels after sorting (lossy — reduces quality precision)")
+	dedupe := flag.String("dedupe", squish.DefaultDedupe, "Clump: duplicate handling. Options: off, mark (append a DT:Z:LB or DT:Z:SQ header tag), remove (drop duplicates, keeping the highest-quality copy)")
+	dedupeMismatches := flag.Int("dedupeMismatches", 0, "Clump: substitutions allowed between duplicate reads of equal length")
+	opticalDist := flag.Int("opticalDist", 0, "Clump: classify duplicates on the same tile within this x/y pixel distance as optical (0 = disabled; e.g. 100 unpatterned, 2500 patterned flow cells)")
 	tempDirArg := flag.String("tempdir", "tmp", "External bucket temp directory under the output dir")
 	pairedFastqArg := flag.String("paired", "", "Comma- or semicolon-separated companion FASTQ files to reorder using the primary order file")
 	pairedOutArg := flag.String("pairedOut", "", "Comma- or semicolon-separated output filenames for paired FASTQs under the output dir")
 	checkPairs := flag.Bool("checkPairs", true, "Check companion FASTQ read names against the primary FASTQ before reordering")
+	pairedRComp := flag.String("pairedRComp", squish.DefaultPairedRComp, "Clump -clumpRComp and canonical-alpha -canonicalFlip reverse-complementing with -paired inputs. Options: off (keep pair orientation), mate (flip companion reads with their primary read, giving RF pairs), primary (flip primary reads only, giving same-strand pairs)")
 	flag.Parse()
 
+	// Long-read mode chooses k from the reads unless the user picked one.
+	clumpKmerLenSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "clumpK" {
+			clumpKmerLenSet = true
+		}
+	})
+	if *longRead && !clumpKmerLenSet {
+		*clumpKmerLen = "auto"
+	}
+
 	if *printVersion {
 		fmt.Println(squish.Version)
 		return
@@ -54,15 +106,48 @@ func main() {
 		cliArgs,
 		filepath.Clean(*outputDirArg),
 		*sortMethodArg,
+		*sortKey,
 		*sortEngine,
 		*bucketStrategy,
 		*bucketCount,
+		*sortParams,
+		*bucketParams,
 		*clumpKmerLen,
+		*clumpSeed,
+		*clumpMinimizerWindow,
 		*clumpMinCount,
+		*clumpMaxCount,
+		*clumpBlacklist,
 		*clumpRComp,
 		*clumpRawPivot,
 		*clumpBorder,
+		*clumpMinQuality,
+		*clumpSkipAmbiguous,
+		*headerOrder,
+		*clumpECC,
+		*eccMinDepth,
+		*eccMinQual,
+		*keyTrim5,
+		*keyTrim3,
+		*barcodeTag,
+		*umiTag,
+		*longRead,
+		*maxBucketSizeArg,
+		*lengthDesc,
+		*canonicalFlip,
+		*abundanceMismatches,
+		*referenceFasta,
+		*referenceKmerLen,
+		*referenceStride,
+		*keyCommand,
+		keyArgs,
+		*demuxSampleSheet,
+		*demuxMismatches,
+		*demuxTag,
 		*quantizeQuality,
+		*dedupe,
+		*dedupeMismatches,
+		*opticalDist,
 		*orderFilename,
 		*reportFilename,
 		*manifestFilename,
@@ -72,6 +157,7 @@ func main() {
 		*pairedFastqArg,
 		*pairedOutArg,
 		*checkPairs,
+		*pairedRComp,
 	)
 	if err != nil {
 		slog.Error("invalid configuration", "error", err)
@@ -88,15 +174,48 @@ func configFromFlags(
 	cliArgs []string,
 	outputDir string,
 	sortMethod string,
+	sortKey string,
 	sortEngine string,
 	bucketStrategy string,
 	bucketCount int,
-	clumpKmerLen int,
+	sortParamsArg string,
+	bucketParamsArg string,
+	clumpKmerLenArg string,
+	clumpSeed string,
+	clumpMinimizerWindow int,
 	clumpMinCount int,
+	clumpMaxCount int,
+	clumpBlacklist string,
 	clumpRComp bool,
 	clumpRawPivot bool,
 	clumpBorder int,
+	clumpMinQuality int,
+	clumpSkipAmbiguous bool,
+	headerOrder string,
+	clumpECC bool,
+	eccMinDepth int,
+	eccMinQual int,
+	keyTrim5 int,
+	keyTrim3 int,
+	barcodeTag string,
+	umiTag string,
+	longRead bool,
+	maxBucketSizeArg string,
+	lengthDesc bool,
+	canonicalFlip bool,
+	abundanceMismatches int,
+	referenceFasta string,
+	referenceKmerLen int,
+	referenceStride int,
+	keyCommand string,
+	keyArgs []string,
+	demuxSampleSheet string,
+	demuxMismatches int,
+	demuxTag string,
 	quantizeQuality bool,
+	dedupe string,
+	dedupeMismatches int,
+	opticalDist int,
 	orderFilename string,
 	reportFilename string,
 	manifestFilename string,
@@ -106,10 +225,46 @@ func configFromFlags(
 	pairedFastqArg string,
 	pairedOutArg string,
 	checkPairs bool,
+	pairedRComp string,
 ) (squish.Config, error) {
 	inputFilepath := cliArgs[0]
 	outputFilenameArg := cliArgs[1]
 
+	clumpAutoK := clumpKmerLenArg == "auto"
+	clumpKmerLen := 0
+	if !clumpAutoK {
+		var err error
+		clumpKmerLen, err = strconv.Atoi(clumpKmerLenArg)
+		if err != nil {
+			return squish.Config{}, fmt.Errorf("clumpK must be an integer or 'auto', got %q", clumpKmerLenArg)
+		}
+	}
+
+	sortParams, err := squish.ParseStrategyParams(sortParamsArg)
+	if err != nil {
+		return squish.Config{}, fmt.Errorf("sortParam: %w", err)
+	}
+	bucketParams, err := squish.ParseStrategyParams(bucketParamsArg)
+	if err != nil {
+		return squish.Config{}, fmt.Errorf("bucketParam: %w", err)
+	}
+
+	var maxBucketBytes int64
+	if maxBucketSizeArg != "" {
+		bytes, err := bytefmt.ToBytes(maxBucketSizeArg)
+		if err != nil {
+			return squish.Config{}, fmt.Errorf("maxBucketSize: %w", err)
+		}
+		maxBucketBytes = int64(bytes)
+	}
+
+	var command []string
+	if keyCommand != "" {
+		command = append([]string{keyCommand}, keyArgs...)
+	} else if len(keyArgs) > 0 {
+		return squish.Config{}, fmt.Errorf("keyArg requires a key command (-keyCmd)")
+	}
+
 	outputFilepath, err := squish.OutputPath(outputDir, outputFilenameArg)
 	if err != nil {
 		return squish.Config{}, err
@@ -150,7 +305,11 @@ func configFromFlags(
 		pairedOutputPaths[i] = pairedOutputPath
 	}
 
-	profileDir, err := squish.OutputPath(outputDir, squish.DefaultProfileDirnameBase+"."+sortMethod)
+	profileMethod := sortMethod
+	if sortKey != "" {
+		profileMethod = "key"
+	}
+	profileDir, err := squish.OutputPath(outputDir, squish.DefaultProfileDirnameBase+"."+profileMethod)
 	if err != nil {
 		return squish.Config{}, err
 	}
@@ -165,6 +324,7 @@ func configFromFlags(
 
 	return squish.Config{
 		SortMethod:            sortMethod,
+		SortKey:               sortKey,
 		InputFilepath:         inputFilepath,
 		OutputFilenameArg:     outputFilenameArg,
 		OutputFilepath:        outputFilepath,
@@ -173,6 +333,10 @@ func configFromFlags(
 		PairedOutputArgs:      pairedOutputArgs,
 		PairedOutputFilepaths: pairedOutputPaths,
 		CheckPairs:            checkPairs,
+		PairedRComp:           pairedRComp,
+		Dedupe:                dedupe,
+		DedupeMismatches:      dedupeMismatches,
+		DedupeOpticalDistance: opticalDist,
 		RecordDelim:           squish.RecordDelim,
 		RecordHeaderChar:      squish.FastqHeaderChar,
 		OrderFilename:         orderFilepath,
@@ -182,11 +346,40 @@ func configFromFlags(
 		SortEngine:            sortEngine,
 		BucketStrategy:        bucketStrategy,
 		BucketCount:           bucketCount,
+		SortParams:            sortParams,
+		BucketParams:          bucketParams,
 		ClumpKmerLen:          clumpKmerLen,
+		ClumpAutoK:            clumpAutoK,
+		ClumpSeed:             clumpSeed,
+		ClumpMinimizerWindow:  clumpMinimizerWindow,
 		ClumpMinCount:         clumpMinCount,
+		ClumpMaxCount:         clumpMaxCount,
+		ClumpBlacklist:        clumpBlacklist,
 		ClumpRComp:            clumpRComp,
 		ClumpRawPivot:         clumpRawPivot,
 		ClumpBorder:           clumpBorder,
+		ClumpMinQuality:       clumpMinQuality,
+		ClumpSkipAmbiguous:    clumpSkipAmbiguous,
+		HeaderOrder:           headerOrder,
+		ClumpCorrect:          clumpECC,
+		ClumpCorrectMinDepth:  eccMinDepth,
+		ClumpCorrectMinQual:   eccMinQual,
+		KeyTrim5:              keyTrim5,
+		KeyTrim3:              keyTrim3,
+		BarcodeTag:            barcodeTag,
+		UMITag:                umiTag,
+		LongRead:              longRead,
+		MaxBucketBytes:        maxBucketBytes,
+		LengthDescending:      lengthDesc,
+		CanonicalFlip:         canonicalFlip,
+		AbundanceMismatches:   abundanceMismatches,
+		ReferenceFasta:        referenceFasta,
+		ReferenceKmerLen:      referenceKmerLen,
+		ReferenceStride:       referenceStride,
+		KeyCommand:            command,
+		DemuxSampleSheet:      demuxSampleSheet,
+		DemuxMismatches:       demuxMismatches,
+		DemuxTag:              demuxTag,
 		QuantizeQuality:       quantizeQuality,
 		TempDir:               tempDir,
 		ProfileDir:            profileDir,
@@ -24,6 +24,11 @@ const DefaultMemProfileFilename = "mem.prof"
 const DefaultOrderFilename = "order.txt"
 const DefaultReportFilename = "report.json"
 const DefaultManifestFilename = "manifest.txt"
+const DefaultFlipFilename = "flips.txt"
+const DefaultPairedRComp = "off"
+const DefaultDuplicateFilename = "duplicates.txt"
+const DefaultDedupe = "off"
+const DefaultHeaderOrder = _sort.HeaderOrderOff
 const DefaultProfileDirnameBase = "profile"
 const DefaultOutputDirNameBase = "output"
 const DefaultSortEngine = "external"
@@ -31,6 +36,12 @@ const DefaultBucketStrategy = "auto"
 const DefaultExternalBucketCount = 512
 const DefaultClumpKmerLen = _sort.DefaultClumpKmerLen
 const DefaultClumpBorder = _sort.DefaultClumpBorder
+const DefaultClumpAutoSampleReads = 10000
+const DefaultClumpCorrectMinDepth = _sort.DefaultCorrectMinDepth
+const DefaultClumpCorrectMinQual = _sort.DefaultCorrectMinQuality
+const DefaultReferenceKmerLen = _sort.DefaultReferenceKmerLen
+const DefaultLongReadMaxBucketBytes = 1 << 30
+const DefaultDemuxTag = _sort.DefaultDemuxTag
 
 type Result struct {
 	Report Report
@@ -43,6 +54,13 @@ type RunStats struct {
 	BucketCount   int
 	BucketName    string
 	BucketTempDir string
+	BucketOrdered bool
+	BucketsSplit  int
+	FlippedReads  int
+	Duplicates    _sort.DuplicateStats
+	Corrections   _sort.CorrectionStats
+	Headers       _sort.HeaderStats
+	Samples       []_sort.SampleStats // demultiplexed samples, then the undetermined reads
 }
 
 type PairedRunStats struct {
@@ -54,6 +72,16 @@ type PairedRunStats struct {
 	Reads             int
 	UncompressedBytes int
 	OutputSizeBytes   int64
+	FlippedReads      int
+}
+
+// DemuxOutput holds the output paths of one demultiplexed sample, derived from
+// the main output paths with SampleOutputPath.
+type DemuxOutput struct {
+	Sample                _sort.DemuxSample
+	OutputFilepath        string
+	OrderFilename         string
+	PairedOutputFilepaths []string
 }
 
 type SortDefinition struct {
@@ -67,6 +95,7 @@ type SortDefinition struct {
 
 type Config struct {
 	SortMethod            string
+	SortKey               string // composite key expression such as "len:desc,gc,seq"; replaces SortMethod when set
 	InputFilepath         string
 	InputFileSize         int64
 	OutputFilenameArg     string
@@ -76,22 +105,60 @@ type Config struct {
 	PairedOutputArgs      []string
 	PairedOutputFilepaths []string
 	CheckPairs            bool
+	PairedRComp           string // -clumpRComp and -canonicalFlip handling with companions: off, mate, or primary
 	RecordDelim           byte
 	RecordHeaderChar      byte
 	TimeStart             time.Time
 	OrderFilename         string
 	ReportFilename        string
 	ManifestFilename      string
+	FlipFilename          string // original indexes of flipped reads, written when PairedRComp is "mate"
+	DuplicateFilename     string // original indexes and tags of duplicates, written when Dedupe is "mark" with companions
 	OutputDir             string
 	SortEngine            string
 	BucketStrategy        string
 	BucketCount           int
+	SortParams            map[string]string // parameters of a registered sort method, checked against its schema
+	BucketParams          map[string]string // parameters of a registered bucket strategy, checked against its schema
 	ClumpKmerLen          int
-	ClumpMinCount         int  // filter pivot k-mers appearing fewer than this many times (0 = disabled)
-	ClumpRComp            bool // reverse-complement minus-strand reads after clump sort
-	ClumpRawPivot         bool // use lex-max canonical k-mer instead of max-hash pivot
-	ClumpBorder           int  // bases excluded from each read end during pivot selection (Clumpify default: 1)
-	QuantizeQuality       bool // bin quality scores to 4 Illumina levels after sorting (lossy)
+	ClumpAutoK            bool                 // clump method: choose ClumpKmerLen and ClumpBorder from sampled read lengths and qualities
+	ClumpAutoSampleReads  int                  // reads sampled for ClumpAutoK (0 = DefaultClumpAutoSampleReads)
+	ClumpMinCount         int                  // filter pivot k-mers appearing fewer than this many times (0 = disabled)
+	ClumpMaxCount         int                  // filter pivot k-mers appearing more than this many times (0 = disabled)
+	ClumpBlacklist        string               // FASTA of adapter/repeat sequences whose k-mers are never used as pivots
+	ClumpRComp            bool                 // reverse-complement minus-strand reads after clump sort
+	ClumpRawPivot         bool                 // use lex-max canonical k-mer instead of max-hash pivot
+	ClumpBorder           int                  // bases excluded from each read end during pivot selection (Clumpify default: 1)
+	ClumpMinQuality       int                  // skip pivot k-mers containing a base below this Phred score (0 = disabled)
+	ClumpSkipAmbiguous    bool                 // skip pivot k-mers containing 'N' or other non-ACGT bases
+	ClumpSeed             string               // spaced-seed mask such as "1101101101"; its length replaces ClumpKmerLen
+	ClumpCorrect          bool                 // replace isolated low-quality bases with the clump consensus (lossy)
+	ClumpCorrectMinDepth  int                  // reads that must agree on the consensus base (0 = default 4)
+	ClumpCorrectMinQual   int                  // only bases below this Phred score are corrected (0 = default 20)
+	ClumpMinimizerWindow  int                  // pick clump pivots only among (w,k)-minimizers with this w (0 = every k-mer)
+	HeaderOrder           string               // clump tie-break between reads with the same sequence: off, tokens, or similarity
+	LongRead              bool                 // ONT/PacBio mode: sampled minimizers, length tie-breaks, and a bucket size cap
+	MaxBucketBytes        int64                // cap on the record bytes of one external bucket; larger clump buckets are split before loading (0 = unbounded)
+	KeyTrim5              int                  // bases excluded from the 5' end before sequence keys are extracted (e.g. inline UMIs)
+	KeyTrim3              int                  // bases excluded from the 3' end before sequence keys are extracted (e.g. adapter read-through)
+	BarcodeTag            string               // bc key field: cell barcode spec, pos:START-END, token:N, or regex:EXPR
+	UMITag                string               // umi key field: UMI spec, in the same forms as BarcodeTag
+	LengthDescending      bool                 // length sort: longest reads first
+	CanonicalFlip         bool                 // canonical-alpha sort: reverse-complement reads whose reverse complement is the sort key
+	AbundanceMismatches   int                  // abundance sort: substitutions between a sequence and the more abundant sequence it follows (0 = exact copies only)
+	ReferenceFasta        string               // reference FASTA indexed by the reference sort method
+	ReferenceKmerLen      int                  // k-mer length of the reference index (0 = DefaultReferenceKmerLen)
+	ReferenceStride       int                  // index every n-th reference position to save memory (0 = every position)
+	KeyCommand            []string             // command sort method: program and its arguments, run without a shell, that prints one sort key per read
+	DemuxSampleSheet      string               // sample sheet to demultiplex reads by; external engine only
+	DemuxMismatches       int                  // substitutions allowed between a sample index and the read index
+	DemuxTag              string               // where the read index is found, as for BarcodeTag (empty = DefaultDemuxTag)
+	Demultiplexer         *_sort.Demultiplexer // set by normalizeConfig from DemuxSampleSheet
+	DemuxOutputs          []DemuxOutput        // set by normalizeConfig: one per sample of the sample sheet
+	QuantizeQuality       bool                 // bin quality scores to 4 Illumina levels after sorting (lossy)
+	Dedupe                string               // clump duplicate handling: off, mark (tag headers), or remove
+	DedupeMismatches      int                  // substitutions allowed between duplicate reads
+	DedupeOpticalDistance int                  // max x/y pixel distance for optical duplicates on one tile (0 = no optical classification)
 	TempDir               string
 	ProfileDir            string
 	CPUProfilePath        string
@@ -109,25 +176,180 @@ func ConfigureLogging() {
 	slog.SetDefault(logger)
 }
 
-func GetSortingMethods() (map[string]SortDefinition, string) {
-	sortMethodMap := map[string]SortDefinition{
-		"alpha": SortDefinition{"alpha", "Alphabetical sort on sequence", _sort.SortReadsSequence, _sort.AlphaSort{}},
-		"gc":    SortDefinition{"gc", "GC Content Sort", _sort.SortReadsGC, _sort.GCSort{}},
-		"qual":  SortDefinition{"qual", "Quality score sort", _sort.SortReadsQual, _sort.QualitySort{}},
-		"clump": SortDefinition{"clump", "Clump-style read clustering for better gzip compression", _sort.SortReadsClump, _sort.ClumpSort{}},
+// builtinSortMethods are registered ahead of any custom sort method, in the
+// order of the -m help text. Their constructors adapt the strategy to the
+// method-specific Config fields.
+var builtinSortMethods = []SortRegistration{
+	{Name: "clump", Description: DefaultSortDescription, DefaultBucket: "clump-minimizer", New: newClumpSort},
+	{Name: "alpha", Description: "Alphabetical sort on sequence", DefaultBucket: "sequence-prefix", DefaultBucketParams: map[string]string{"prefix": "1"}, New: func(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+		return _sort.AlphaSort{Window: config.KeyWindow()}, nil
+	}},
+	{Name: "canonical-alpha", Description: "Alphabetical sort on the smaller of the sequence and its reverse complement (-canonicalFlip writes that strand)", DefaultBucket: "canonical-prefix", DefaultBucketParams: map[string]string{"prefix": "1"}, New: func(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+		return _sort.CanonicalAlphaSort{Window: config.KeyWindow(), Flip: config.CanonicalFlip}, nil
+	}},
+	{Name: "gc", Description: "GC Content Sort", DefaultBucket: "gc-range", New: func(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+		return _sort.GCSort{Window: config.KeyWindow()}, nil
+	}},
+	builtinSortMethod("qual", "Quality score sort", _sort.SortReadsQual, _sort.QualitySort{}, "quality-prefix"),
+	builtinSortMethod("qmean", "Mean Phred quality sort, lowest first", _sort.SortReadsMeanQuality, _sort.QualityMetricSort{Metric: _sort.QualityMetricMean}, "quality-range"),
+	builtinSortMethod("qmedian", "Median Phred quality sort, lowest first", _sort.SortReadsMedianQuality, _sort.QualityMetricSort{Metric: _sort.QualityMetricMedian}, "quality-range"),
+	builtinSortMethod("ee", "Expected errors sort (sum of base error probabilities), fewest first", _sort.SortReadsExpectedErrors, _sort.QualityMetricSort{Metric: _sort.QualityMetricExpectedErrors}, "quality-range"),
+	builtinSortMethod("q30", "Fraction of bases >= Q30 sort, lowest first", _sort.SortReadsQ30, _sort.QualityMetricSort{Metric: _sort.QualityMetricQ30}, "quality-range"),
+	builtinSortMethod("name", "Read name sort with natural numeric ordering", _sort.SortReadsName, _sort.NameSort{}, "name-prefix"),
+	{Name: "length", Description: "Read length sort, shortest first (-lengthDesc for longest first)", DefaultBucket: "length-range", New: func(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+		return _sort.LengthSort{Descending: config.LengthDescending}, nil
+	}},
+	// Run replaces the strategy with one carrying the counted table.
+	{Name: "abundance", Description: "Exact-sequence abundance sort, most frequent first with near variants after each sequence", DefaultBucket: "abundance", New: func(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+		return _sort.AbundanceSort{Mismatches: config.AbundanceMismatches}, nil
+	}},
+	{Name: "reference", Description: "Approximate reference position sort using a k-mer index of the -ref FASTA", DefaultBucket: "position-range", New: newReferenceSort},
+	// Run fills in the keys printed by the -keyCmd program.
+	{Name: "command", Description: "Sort on keys printed by the -keyCmd program, in natural order", DefaultBucket: "key-range", New: func(Config, StrategyParams) (_sort.SortStrategy, error) {
+		return _sort.CommandKeySort{}, nil
+	}},
+}
+
+// builtinSortMethod registers a method whose strategy does not depend on the
+// run config, so Func can sort with it directly.
+func builtinSortMethod(name string, description string, sortFunc func(*[]fastq.FastqRead), strategy _sort.SortStrategy, defaultBucket string) SortRegistration {
+	return SortRegistration{
+		Name:          name,
+		Description:   description,
+		DefaultBucket: defaultBucket,
+		New:           func(Config, StrategyParams) (_sort.SortStrategy, error) { return strategy, nil },
+		Func:          sortFunc,
+	}
+}
+
+// newClumpSort builds the clump sorter from the clump, header order, and
+// dedupe options. With paired input, the engines attach the companion
+// sequences to each read (see ComparesMates), so a pair is only a duplicate
+// when its mates match too.
+func newClumpSort(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+	clumpSeed, err := _sort.ParseSpacedSeed(config.ClumpSeed)
+	if err != nil {
+		return nil, fmt.Errorf("clumpSeed: %w", err)
+	}
+	clumpSorter := _sort.ClumpSort{
+		K:             config.ClumpKmerLen,
+		MinCount:      config.ClumpMinCount,
+		MaxCount:      config.ClumpMaxCount,
+		RComp:         config.ClumpRComp,
+		RawPivot:      config.ClumpRawPivot,
+		Border:        config.ClumpBorder,
+		MinQuality:    config.ClumpMinQuality,
+		SkipAmbiguous: config.ClumpSkipAmbiguous,
+		Window:        config.KeyWindow(),
+		Seed:          clumpSeed,
+
+		MinimizerWindow: config.ClumpMinimizerWindow,
+		LongRead:        config.LongRead,
+		HeaderOrder:     config.HeaderOrder,
+	}
+	if config.ClumpBlacklist != "" {
+		blacklist, err := _sort.LoadKmerBlacklist(config.ClumpBlacklist, config.ClumpKmerLen, clumpSeed)
+		if err != nil {
+			return nil, fmt.Errorf("load clump blacklist: %w", err)
+		}
+		slog.Debug("clump blacklist loaded", "path", config.ClumpBlacklist, "kmers", len(blacklist))
+		clumpSorter.Blacklist = blacklist
+	}
+	if config.ClumpCorrect {
+		clumpSorter.Correct = _sort.CorrectOptions{
+			Enabled:    true,
+			MinDepth:   config.ClumpCorrectMinDepth,
+			MinQuality: config.ClumpCorrectMinQual,
+		}
+	}
+	if config.Dedupe != DefaultDedupe {
+		clumpSorter.Dedupe = _sort.DedupeOptions{
+			Enabled:         true,
+			Mismatches:      config.DedupeMismatches,
+			OpticalDistance: config.DedupeOpticalDistance,
+		}
+	}
+	return clumpSorter, nil
+}
+
+// newReferenceSort indexes the -ref FASTA for the reference sorter.
+func newReferenceSort(config Config, _ StrategyParams) (_sort.SortStrategy, error) {
+	index, err := _sort.LoadReferenceIndex(config.ReferenceFasta, config.ReferenceKmerLen, config.ReferenceStride)
+	if err != nil {
+		return nil, fmt.Errorf("load reference index: %w", err)
+	}
+	slog.Info("reference index built", "path", config.ReferenceFasta, "contigs", len(index.Contigs), "length", index.Length, "unique_kmers", index.UniqueKmers())
+	return _sort.ReferenceSort{Index: index}, nil
+}
+
+// newCompositeSort parses the -key expression, with the key window, tag
+// extractors, and clump pivot options its fields use.
+func newCompositeSort(config Config) (_sort.CompositeSort, error) {
+	composite, err := _sort.NewCompositeSort(config.SortKey)
+	if err != nil {
+		return _sort.CompositeSort{}, fmt.Errorf("key: %w", err)
+	}
+	clumpSeed, err := _sort.ParseSpacedSeed(config.ClumpSeed)
+	if err != nil {
+		return _sort.CompositeSort{}, fmt.Errorf("clumpSeed: %w", err)
+	}
+	composite.Window = config.KeyWindow()
+	if composite.Barcode, err = _sort.ParseTagExtractor(config.BarcodeTag); err != nil {
+		return _sort.CompositeSort{}, fmt.Errorf("barcode: %w", err)
+	}
+	if composite.UMI, err = _sort.ParseTagExtractor(config.UMITag); err != nil {
+		return _sort.CompositeSort{}, fmt.Errorf("umi: %w", err)
+	}
+	if err := composite.CheckTags(); err != nil {
+		return _sort.CompositeSort{}, fmt.Errorf("key: %w (-barcode, -umi)", err)
+	}
+	composite.Clump = _sort.ClumpSort{
+		K:             config.ClumpKmerLen,
+		RawPivot:      config.ClumpRawPivot,
+		Border:        config.ClumpBorder,
+		MinQuality:    config.ClumpMinQuality,
+		SkipAmbiguous: config.ClumpSkipAmbiguous,
+		Window:        composite.Window,
+		Seed:          clumpSeed,
+
+		MinimizerWindow: config.ClumpMinimizerWindow,
+	}.Options()
+	return composite, nil
+}
+
+func init() {
+	for _, registration := range builtinSortMethods {
+		if err := RegisterSortStrategy(registration); err != nil {
+			panic(err)
+		}
 	}
+}
 
-	sortMethodsDescr := map[string]string{}
-	for key, value := range sortMethodMap {
-		sortMethodsDescr[key] = value.Description
+// GetSortingMethods returns the registered sort methods with their default
+// parameters and the default run config, and the -m help text. Methods whose
+// constructor fails without parameters, such as reference without a FASTA,
+// have a nil Strategy.
+func GetSortingMethods() (map[string]SortDefinition, string) {
+	sortMethodMap := map[string]SortDefinition{}
+	for _, registration := range SortRegistrations() {
+		params, err := resolveParams("sort method", registration.Name, registration.Params, nil)
+		if err != nil {
+			sortMethodMap[registration.Name] = SortDefinition{CLIArg: registration.Name, Description: registration.Description}
+			continue
+		}
+		sortDefinition, _ := registration.definition(Config{Dedupe: DefaultDedupe}, params)
+		sortMethodMap[registration.Name] = sortDefinition
 	}
-	return sortMethodMap, fmt.Sprintf("Options: %v", sortMethodsDescr)
+	return sortMethodMap, SortMethodUsage()
 }
 
 func normalizeConfig(config Config) (Config, SortDefinition, error) {
 	if config.SortMethod == "" {
 		config.SortMethod = DefaultSortMethod
 	}
+	if config.SortKey != "" {
+		config.SortMethod = "key"
+	}
 	if config.SortEngine == "" {
 		config.SortEngine = DefaultSortEngine
 	}
@@ -143,6 +365,91 @@ func normalizeConfig(config Config) (Config, SortDefinition, error) {
 	if config.ClumpBorder == 0 {
 		config.ClumpBorder = DefaultClumpBorder
 	}
+	if config.LongRead {
+		if config.ClumpMinimizerWindow == 0 {
+			config.ClumpMinimizerWindow = _sort.DefaultLongReadMinimizerWindow
+		}
+		if config.MaxBucketBytes == 0 {
+			config.MaxBucketBytes = DefaultLongReadMaxBucketBytes
+		}
+	}
+	if config.PairedRComp == "" {
+		config.PairedRComp = DefaultPairedRComp
+	}
+	switch config.PairedRComp {
+	case "off":
+		// The default: flipping either mate alone or both together changes
+		// the pair orientation that aligners and insert-size estimation expect.
+		if len(config.PairedInputFilepaths) > 0 && config.ClumpRComp {
+			slog.Info("clump reverse-complementing disabled for paired input", "paired_rcomp", config.PairedRComp)
+			config.ClumpRComp = false
+		}
+		if len(config.PairedInputFilepaths) > 0 && config.CanonicalFlip {
+			slog.Info("canonical flipping disabled for paired input", "paired_rcomp", config.PairedRComp)
+			config.CanonicalFlip = false
+		}
+	case "mate", "primary":
+	default:
+		return Config{}, SortDefinition{}, fmt.Errorf("unknown pairedRComp mode: %s", config.PairedRComp)
+	}
+	if config.Dedupe == "" {
+		config.Dedupe = DefaultDedupe
+	}
+	switch config.Dedupe {
+	case "off", "mark", "remove":
+	default:
+		return Config{}, SortDefinition{}, fmt.Errorf("unknown dedupe mode: %s", config.Dedupe)
+	}
+	if config.Dedupe != "off" && config.SortMethod != "clump" {
+		return Config{}, SortDefinition{}, fmt.Errorf("dedupe requires the clump sort method, got %s", config.SortMethod)
+	}
+	if config.HeaderOrder == "" {
+		config.HeaderOrder = DefaultHeaderOrder
+	}
+	if !_sort.ValidHeaderOrder(config.HeaderOrder) {
+		return Config{}, SortDefinition{}, fmt.Errorf("unknown headerOrder mode: %s", config.HeaderOrder)
+	}
+	if config.HeaderOrder != "off" && config.SortMethod != "clump" {
+		return Config{}, SortDefinition{}, fmt.Errorf("headerOrder requires the clump sort method, got %s", config.SortMethod)
+	}
+	if config.ClumpCorrect && config.SortMethod != "clump" {
+		return Config{}, SortDefinition{}, fmt.Errorf("clumpECC requires the clump sort method, got %s", config.SortMethod)
+	}
+	if config.ClumpCorrect {
+		if config.ClumpCorrectMinDepth == 0 {
+			config.ClumpCorrectMinDepth = _sort.DefaultCorrectMinDepth
+		}
+		if config.ClumpCorrectMinQual == 0 {
+			config.ClumpCorrectMinQual = _sort.DefaultCorrectMinQuality
+		}
+		if config.ClumpCorrectMinDepth < 1 || config.ClumpCorrectMinQual < 1 {
+			return Config{}, SortDefinition{}, fmt.Errorf("eccMinDepth and eccMinQual must be >= 1, got %d and %d", config.ClumpCorrectMinDepth, config.ClumpCorrectMinQual)
+		}
+	}
+	if config.SortMethod == "reference" && config.ReferenceFasta == "" {
+		return Config{}, SortDefinition{}, fmt.Errorf("the reference sort method requires a reference FASTA (-ref)")
+	}
+	if config.ReferenceFasta != "" && config.SortMethod != "reference" {
+		return Config{}, SortDefinition{}, fmt.Errorf("ref requires the reference sort method, got %s", config.SortMethod)
+	}
+	if config.SortMethod == "command" && (len(config.KeyCommand) == 0 || config.KeyCommand[0] == "") {
+		return Config{}, SortDefinition{}, fmt.Errorf("the command sort method requires a key command (-keyCmd)")
+	}
+	if len(config.KeyCommand) > 0 && config.SortMethod != "command" {
+		return Config{}, SortDefinition{}, fmt.Errorf("keyCmd requires the command sort method, got %s", config.SortMethod)
+	}
+	if config.DemuxSampleSheet != "" && config.SortEngine != "external" {
+		return Config{}, SortDefinition{}, fmt.Errorf("demux requires the external sort engine, got %s", config.SortEngine)
+	}
+	if config.DemuxSampleSheet == "" && config.DemuxTag != "" {
+		return Config{}, SortDefinition{}, fmt.Errorf("demuxTag requires a sample sheet (-demux)")
+	}
+	if config.AbundanceMismatches < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("abundanceMismatches must be >= 0, got %d", config.AbundanceMismatches)
+	}
+	if config.DedupeMismatches < 0 || config.DedupeOpticalDistance < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("dedupeMismatches and opticalDist must be >= 0, got %d and %d", config.DedupeMismatches, config.DedupeOpticalDistance)
+	}
 	if config.RecordDelim == 0 {
 		config.RecordDelim = RecordDelim
 	}
@@ -157,34 +464,107 @@ func normalizeConfig(config Config) (Config, SortDefinition, error) {
 	}
 	config.OutputDir = filepath.Clean(config.OutputDir)
 
-	sortMethodMap, _ := GetSortingMethods()
-	sortDefinition, ok := sortMethodMap[config.SortMethod]
-	if !ok {
-		return Config{}, SortDefinition{}, fmt.Errorf("unknown sort method: %s", config.SortMethod)
+	var registration SortRegistration
+	if config.SortMethod == "key" {
+		if config.SortKey == "" {
+			return Config{}, SortDefinition{}, fmt.Errorf("unknown sort method: %s", config.SortMethod)
+		}
+		if len(config.SortParams) > 0 {
+			return Config{}, SortDefinition{}, fmt.Errorf("sortParam cannot be combined with key")
+		}
+	} else {
+		var ok bool
+		registration, ok = SortStrategyRegistration(config.SortMethod)
+		if !ok {
+			return Config{}, SortDefinition{}, fmt.Errorf("unknown sort method: %s", config.SortMethod)
+		}
+		params, err := resolveParams("sort method", registration.Name, registration.Params, config.SortParams)
+		if err != nil {
+			return Config{}, SortDefinition{}, err
+		}
+		config.SortParams = params
+	}
+	clumpSeed, err := _sort.ParseSpacedSeed(config.ClumpSeed)
+	if err != nil {
+		return Config{}, SortDefinition{}, fmt.Errorf("clumpSeed: %w", err)
+	}
+	if config.ClumpAutoK && config.SortMethod != "clump" {
+		// Only the clump method samples reads for its parameters; any other
+		// method, including a clump key field, keeps the clumpK default.
+		slog.Info("clumpK auto ignored", "sort_method", config.SortMethod, "k", config.ClumpKmerLen)
+		config.ClumpAutoK = false
+	}
+	if config.ClumpAutoK {
+		if !clumpSeed.IsZero() {
+			return Config{}, SortDefinition{}, fmt.Errorf("clumpK auto cannot be combined with clumpSeed")
+		}
+		if config.ClumpAutoSampleReads == 0 {
+			config.ClumpAutoSampleReads = DefaultClumpAutoSampleReads
+		}
+	}
+	if !clumpSeed.IsZero() {
+		// The seed span defines the pivot window, so record it as the k-mer
+		// length used for this run.
+		config.ClumpKmerLen = clumpSeed.Span()
 	}
 	if config.ClumpKmerLen < 1 {
 		return Config{}, SortDefinition{}, fmt.Errorf("clumpK must be >= 1, got %d", config.ClumpKmerLen)
 	}
-	if sortDefinition.CLIArg == "clump" {
-		opts := _sort.ClumpSortOptions{
-			K:        config.ClumpKmerLen,
-			MinCount: config.ClumpMinCount,
-			RComp:    config.ClumpRComp,
-			RawPivot: config.ClumpRawPivot,
-			Border:   config.ClumpBorder,
-		}
-		sortDefinition.Func = func(reads *[]fastq.FastqRead) {
-			_sort.SortReadsClumpOpts(reads, opts)
+	if config.ClumpMaxCount < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("clumpMaxCount must be >= 0, got %d", config.ClumpMaxCount)
+	}
+	if config.ClumpMaxCount > 0 && config.ClumpMinCount > config.ClumpMaxCount {
+		return Config{}, SortDefinition{}, fmt.Errorf("clumpMinCount %d is greater than clumpMaxCount %d", config.ClumpMinCount, config.ClumpMaxCount)
+	}
+	if config.ClumpMinQuality < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("clumpMinQual must be >= 0, got %d", config.ClumpMinQuality)
+	}
+	if config.ClumpMinimizerWindow < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("clumpW must be >= 0, got %d", config.ClumpMinimizerWindow)
+	}
+	if config.MaxBucketBytes < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("maxBucketSize must be >= 0, got %d", config.MaxBucketBytes)
+	}
+	if (config.BarcodeTag != "" || config.UMITag != "") && config.SortMethod != "key" {
+		return Config{}, SortDefinition{}, fmt.Errorf("barcode and umi require a -key with the bc or umi field, got sort method %s", config.SortMethod)
+	}
+	if config.KeyTrim5 < 0 || config.KeyTrim3 < 0 {
+		return Config{}, SortDefinition{}, fmt.Errorf("keyTrim5 and keyTrim3 must be >= 0, got %d and %d", config.KeyTrim5, config.KeyTrim3)
+	}
+	if config.ReferenceFasta != "" {
+		if config.ReferenceKmerLen == 0 {
+			config.ReferenceKmerLen = DefaultReferenceKmerLen
 		}
-		sortDefinition.Strategy = _sort.ClumpSort{
-			K:        config.ClumpKmerLen,
-			MinCount: config.ClumpMinCount,
-			RComp:    config.ClumpRComp,
-			RawPivot: config.ClumpRawPivot,
-			Border:   config.ClumpBorder,
+		if config.ReferenceStride < 0 {
+			return Config{}, SortDefinition{}, fmt.Errorf("refStride must be >= 0, got %d", config.ReferenceStride)
 		}
 	}
 
+	var sortDefinition SortDefinition
+	if config.SortMethod == "key" {
+		composite, err := newCompositeSort(config)
+		if err != nil {
+			return Config{}, SortDefinition{}, err
+		}
+		config.SortKey = composite.Expression()
+		sortDefinition = SortDefinition{
+			CLIArg:      "key",
+			Description: "Composite sort key " + config.SortKey,
+			Func: func(reads *[]fastq.FastqRead) {
+				_sort.SortReadsStrategy(reads, composite)
+			},
+			Strategy: composite,
+		}
+	} else if config.ClumpAutoK {
+		// Run builds the clump definition once the sampled k-mer length is
+		// known, so the blacklist is loaded only once.
+		sortDefinition = SortDefinition{CLIArg: registration.Name, Description: registration.Description}
+	} else {
+		sortDefinition, err = registration.definition(config, config.SortParams)
+		if err != nil {
+			return Config{}, SortDefinition{}, err
+		}
+	}
 	if config.OutputFilenameArg == "" && config.OutputFilepath != "" {
 		config.OutputFilenameArg = filepath.Base(config.OutputFilepath)
 	}
@@ -219,6 +599,20 @@ func normalizeConfig(config Config) (Config, SortDefinition, error) {
 		}
 		config.ManifestFilename = manifestFilename
 	}
+	if config.FlipFilename == "" {
+		flipFilename, err := OutputPath(config.OutputDir, DefaultFlipFilename)
+		if err != nil {
+			return Config{}, SortDefinition{}, err
+		}
+		config.FlipFilename = flipFilename
+	}
+	if config.DuplicateFilename == "" {
+		duplicateFilename, err := OutputPath(config.OutputDir, DefaultDuplicateFilename)
+		if err != nil {
+			return Config{}, SortDefinition{}, err
+		}
+		config.DuplicateFilename = duplicateFilename
+	}
 	if config.TempDir == "" {
 		tempDir, err := OutputPath(config.OutputDir, "tmp")
 		if err != nil {
@@ -250,6 +644,25 @@ func normalizeConfig(config Config) (Config, SortDefinition, error) {
 	if len(config.PairedOutputFilepaths) != len(config.PairedInputFilepaths) {
 		return Config{}, SortDefinition{}, fmt.Errorf("paired output path count %d does not match paired input count %d", len(config.PairedOutputFilepaths), len(config.PairedInputFilepaths))
 	}
+	if config.DemuxSampleSheet != "" {
+		demux, err := loadDemultiplexer(config)
+		if err != nil {
+			return Config{}, SortDefinition{}, err
+		}
+		config.Demultiplexer = demux
+		config.DemuxOutputs = nil
+		for _, sample := range demux.Samples {
+			output := DemuxOutput{
+				Sample:         sample,
+				OutputFilepath: SampleOutputPath(config.OutputFilepath, sample.Name),
+				OrderFilename:  SampleOutputPath(config.OrderFilename, sample.Name),
+			}
+			for _, pairedOutputPath := range config.PairedOutputFilepaths {
+				output.PairedOutputFilepaths = append(output.PairedOutputFilepaths, SampleOutputPath(pairedOutputPath, sample.Name))
+			}
+			config.DemuxOutputs = append(config.DemuxOutputs, output)
+		}
+	}
 
 	profileDir := config.ProfileDir
 	if profileDir == "" {
@@ -278,6 +691,52 @@ func normalizeConfig(config Config) (Config, SortDefinition, error) {
 	return config, sortDefinition, nil
 }
 
+// loadDemultiplexer reads the sample sheet of the run.
+func loadDemultiplexer(config Config) (*_sort.Demultiplexer, error) {
+	tag, err := _sort.ParseTagExtractor(config.DemuxTag)
+	if err != nil {
+		return nil, fmt.Errorf("demuxTag: %w", err)
+	}
+	samples, err := _sort.LoadSampleSheet(config.DemuxSampleSheet)
+	if err != nil {
+		return nil, fmt.Errorf("demux: %w", err)
+	}
+	demux, err := _sort.NewDemultiplexer(samples, config.DemuxMismatches, tag)
+	if err != nil {
+		return nil, fmt.Errorf("demux %s: %w", config.DemuxSampleSheet, err)
+	}
+	slog.Info("sample sheet loaded", "path", config.DemuxSampleSheet, "samples", len(samples), "mismatches", demux.Mismatches, "tag", demux.Tag.Spec)
+	return demux, nil
+}
+
+// FlipsMates reports whether companion reads are reverse-complemented along
+// with their flipped primary reads, which needs the flip file.
+func (config Config) FlipsMates() bool {
+	if config.PairedRComp != "mate" || len(config.PairedInputFilepaths) == 0 {
+		return false
+	}
+	return (config.ClumpRComp && config.SortMethod == "clump") || (config.CanonicalFlip && config.SortMethod == "canonical-alpha")
+}
+
+// TagsMateDuplicates reports whether companion reads are tagged along with
+// their duplicate primary reads, which needs the duplicate file. Removed
+// duplicates need no file: they are simply missing from the order file.
+func (config Config) TagsMateDuplicates() bool {
+	return config.Dedupe == "mark" && len(config.PairedInputFilepaths) > 0
+}
+
+// ComparesMates reports whether duplicate detection reads the companions in
+// step with the input, so that pairs are compared by their mates too.
+func (config Config) ComparesMates() bool {
+	return config.Dedupe != DefaultDedupe && len(config.PairedInputFilepaths) > 0
+}
+
+// KeyWindow returns the 5'/3' exclusion window applied to sequence-derived
+// sort and bucket keys.
+func (config Config) KeyWindow() _sort.KeyWindow {
+	return _sort.KeyWindow{Trim5: config.KeyTrim5, Trim3: config.KeyTrim3}
+}
+
 func ensureOutputDirs(config Config) error {
 	dirs := []string{
 		config.OutputDir,
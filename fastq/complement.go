@@ -0,0 +1,81 @@
+package fastq
+
+// complementTable maps every byte to its nucleotide complement. It covers the
+// full IUPAC alphabet in both cases, so soft-masked (lower-case) and
+// ambiguity-coded bases keep their meaning when a read is flipped. Bytes that
+// are not nucleotide codes map to themselves.
+//
+// Apart from U, which complements to A, the table is an involution:
+// complementing twice returns the original byte. That is what makes a flipped
+// read recoverable from the output; a U comes back as T.
+var complementTable = func() [256]byte {
+	var table [256]byte
+	for i := range table {
+		table[i] = byte(i)
+	}
+	pairs := []struct{ a, b byte }{
+		{'A', 'T'},
+		{'C', 'G'},
+		{'R', 'Y'}, // A/G <-> C/T
+		{'K', 'M'}, // G/T <-> A/C
+		{'B', 'V'}, // not A <-> not T
+		{'D', 'H'}, // not C <-> not G
+		{'S', 'S'}, // C/G
+		{'W', 'W'}, // A/T
+		{'N', 'N'},
+	}
+	for _, pair := range pairs {
+		table[pair.a], table[pair.b] = pair.b, pair.a
+		lowerA, lowerB := pair.a+'a'-'A', pair.b+'a'-'A'
+		table[lowerA], table[lowerB] = lowerB, lowerA
+	}
+	table['U'] = 'A'
+	table['u'] = 'a'
+	return table
+}()
+
+// ComplementBase returns the IUPAC complement of base, preserving case.
+func ComplementBase(base byte) byte {
+	return complementTable[base]
+}
+
+// ReverseComplement returns a new slice holding the reverse complement of
+// sequence.
+func ReverseComplement(sequence []byte) []byte {
+	rc := make([]byte, len(sequence))
+	ReverseComplementInto(sequence, rc)
+	return rc
+}
+
+// ReverseComplementInto writes the reverse complement of src into dst, which
+// must be at least as long as src.
+func ReverseComplementInto(src []byte, dst []byte) {
+	for i, base := range src {
+		dst[len(src)-1-i] = complementTable[base]
+	}
+}
+
+// ReverseBytes returns a new slice holding b in reverse order, such as the
+// quality string of a reverse-complemented read.
+func ReverseBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i, v := range b {
+		out[len(b)-1-i] = v
+	}
+	return out
+}
+
+// IsReverseComplement reports whether a is exactly the reverse complement of
+// b, without allocating. Each base of b is complemented and compared with a,
+// not the other way round, so a U in b matches the A it complements to.
+func IsReverseComplement(a []byte, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, base := range b {
+		if complementTable[base] != a[len(a)-1-i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,228 @@
+package fastq
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	_io "squish/fastqio"
+)
+
+// DuplicateKind classifies a read found by duplicate detection.
+type DuplicateKind uint8
+
+const (
+	DuplicateNone    DuplicateKind = iota
+	DuplicateLibrary               // PCR or library duplicate
+	DuplicateOptical               // optical duplicate: a nearby cluster on the same tile
+)
+
+// Duplicate header tags follow the SAM DT tag: LB for library duplicates and
+// SQ for sequencing (optical) duplicates. They are appended to the header
+// after a space, so NormalizedReadID still pairs tagged mates.
+const (
+	DuplicateTagLibrary = "DT:Z:LB"
+	DuplicateTagOptical = "DT:Z:SQ"
+)
+
+// DuplicateKind returns the duplicate classification set by the sorter.
+func (read FastqRead) DuplicateKind() DuplicateKind {
+	switch {
+	case read.OpticalDuplicate:
+		return DuplicateOptical
+	case read.Duplicate:
+		return DuplicateLibrary
+	default:
+		return DuplicateNone
+	}
+}
+
+// Tag returns the header tag for kind, or "" for DuplicateNone.
+func (kind DuplicateKind) Tag() string {
+	switch kind {
+	case DuplicateLibrary:
+		return DuplicateTagLibrary
+	case DuplicateOptical:
+		return DuplicateTagOptical
+	default:
+		return ""
+	}
+}
+
+// TagDuplicate appends the duplicate tag for kind to the read header.
+func TagDuplicate(read *FastqRead, kind DuplicateKind) {
+	tag := kind.Tag()
+	if tag == "" {
+		return
+	}
+	id := read.Id()
+	if hasDuplicateTag(id) {
+		return
+	}
+	tagged := make([]byte, 0, len(id)+1+len(tag))
+	tagged = append(tagged, id...)
+	tagged = append(tagged, ' ')
+	tagged = append(tagged, tag...)
+	read.OverrideId = tagged
+}
+
+// MateReader streams the companion FASTQs in step with the primary input, so
+// duplicate detection can compare the mates of each pair without loading the
+// companions up front. All companions must have as many reads as the primary.
+type MateReader struct {
+	paths   []string
+	readers []_io.InputFileReader
+	indexes []int
+	delim   byte
+}
+
+// OpenMateReader opens every companion FASTQ for reading.
+func OpenMateReader(inputFilepaths []string, delim byte) (*MateReader, error) {
+	mates := &MateReader{paths: inputFilepaths, indexes: make([]int, len(inputFilepaths)), delim: delim}
+	for _, inputFilepath := range inputFilepaths {
+		reader, err := _io.OpenReader(inputFilepath)
+		if err != nil {
+			mates.Close()
+			return nil, err
+		}
+		mates.readers = append(mates.readers, reader)
+	}
+	return mates, nil
+}
+
+// Next returns the sequence of the next record of every companion, in
+// companion order.
+func (mates *MateReader) Next() ([][]byte, error) {
+	sequences := make([][]byte, len(mates.readers))
+	for i, reader := range mates.readers {
+		read, _, err := ReadNextReadE(reader, &mates.delim, &mates.indexes[i])
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, fmt.Errorf("companion %q has fewer reads than the input", mates.paths[i])
+			}
+			return nil, fmt.Errorf("read companion %q: %w", mates.paths[i], err)
+		}
+		sequences[i] = read.Sequence()
+	}
+	return sequences, nil
+}
+
+// Done reports an error if any companion has reads left after the input
+// ended.
+func (mates *MateReader) Done() error {
+	for i, reader := range mates.readers {
+		_, _, err := ReadNextReadE(reader, &mates.delim, &mates.indexes[i])
+		if err == nil {
+			return fmt.Errorf("companion %q has more reads than the input", mates.paths[i])
+		}
+		if !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read companion %q: %w", mates.paths[i], err)
+		}
+	}
+	return nil
+}
+
+// Close closes every companion reader.
+func (mates *MateReader) Close() {
+	for _, reader := range mates.readers {
+		reader.Close()
+	}
+}
+
+// LoadMates sets Mates on reads, which must be in input order, from the
+// companion FASTQs. The memory engine uses it after loading the input.
+func LoadMates(reads []FastqRead, inputFilepaths []string, delim byte) error {
+	mates, err := OpenMateReader(inputFilepaths, delim)
+	if err != nil {
+		return err
+	}
+	defer mates.Close()
+	for i := range reads {
+		if reads[i].Mates, err = mates.Next(); err != nil {
+			return err
+		}
+	}
+	return mates.Done()
+}
+
+// SaveDuplicatesE writes the original index and tag of every duplicate, one
+// per line in output order, so companion reordering can tag mates too.
+func SaveDuplicatesE(readsBuffer *[]FastqRead, duplicateFilename string) error {
+	outputFile, err := os.Create(duplicateFilename)
+	if err != nil {
+		return fmt.Errorf("create duplicate file: %w", err)
+	}
+	defer outputFile.Close()
+
+	writer := bufio.NewWriter(outputFile)
+	defer writer.Flush()
+	for _, read := range *readsBuffer {
+		if err := WriteDuplicateRow(writer, read); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDuplicateRow writes one duplicate file row for read, or nothing if the
+// read is not a duplicate.
+func WriteDuplicateRow(writer *bufio.Writer, read FastqRead) error {
+	kind := read.DuplicateKind()
+	if kind == DuplicateNone {
+		return nil
+	}
+	if _, err := writer.WriteString(strconv.Itoa(read.I) + "\t" + kind.Tag() + "\n"); err != nil {
+		return fmt.Errorf("write duplicate row: %w", err)
+	}
+	return nil
+}
+
+// LoadDuplicates reads a duplicate file written by SaveDuplicatesE and
+// returns the duplicate kind of each original read index (0-based).
+func LoadDuplicates(duplicateFilename string, reads int) ([]DuplicateKind, error) {
+	file, err := os.Open(duplicateFilename)
+	if err != nil {
+		return nil, fmt.Errorf("open duplicate file: %w", err)
+	}
+	defer file.Close()
+
+	kinds := make([]DuplicateKind, reads)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		indexField, tag, _ := strings.Cut(line, "\t")
+		readIndex, err := strconv.Atoi(indexField)
+		if err != nil {
+			return nil, fmt.Errorf("parse duplicate row %q: %w", line, err)
+		}
+		if readIndex < 1 || readIndex > reads {
+			return nil, fmt.Errorf("duplicate file references read %d outside range [1, %d]", readIndex, reads)
+		}
+		switch tag {
+		case DuplicateTagLibrary:
+			kinds[readIndex-1] = DuplicateLibrary
+		case DuplicateTagOptical:
+			kinds[readIndex-1] = DuplicateOptical
+		default:
+			return nil, fmt.Errorf("unknown duplicate tag %q", tag)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan duplicate file: %w", err)
+	}
+	return kinds, nil
+}
+
+// hasDuplicateTag reports whether a header already ends with a duplicate tag,
+// so re-running squish on its own output does not stack tags.
+func hasDuplicateTag(id []byte) bool {
+	return bytes.HasSuffix(id, []byte(" "+DuplicateTagLibrary)) || bytes.HasSuffix(id, []byte(" "+DuplicateTagOptical))
+}
@@ -24,10 +24,13 @@ import (
 // cheap to copy during sorting while preserving fast access to the original
 // FASTQ record bytes.
 //
-// OverrideSeq and OverrideQual, when non-nil, replace the arena sequence and
-// quality bytes in all accessors and in Record(). Sort post-processing (rcomp
-// flipping, quality quantization) sets these fields rather than modifying the
-// shared arena.
+// OverrideId, OverrideSeq and OverrideQual, when non-nil, replace the arena
+// header, sequence and quality bytes in all accessors and in Record(). Sort
+// post-processing (rcomp flipping, error correction, quality quantization,
+// duplicate tags) sets these fields rather than modifying the shared arena.
+//
+// Mates holds the sequences of the companion reads of a pair, in companion
+// order. It is only set when paired duplicate detection compares mates.
 type FastqRead struct {
 	Arena              *FastqArena
 	RecordOffset       int
@@ -42,8 +45,15 @@ type FastqRead struct {
 	QualityScoreSize   int
 	I                  int // index order in the original file
 	GCContent          float64
-	OverrideSeq        []byte // non-nil replaces arena sequence (e.g. rcomp flip)
+	Quality            *QualityMetrics
+	Mates              [][]byte
+	OverrideId         []byte // non-nil replaces arena header line, without newline (e.g. duplicate tag)
+	OverrideSeq        []byte // non-nil replaces arena sequence (e.g. rcomp flip, error correction)
 	OverrideQual       []byte // non-nil replaces arena quality (e.g. rcomp flip, quantize)
+	Flipped            bool   // sequence and quality were reverse-complemented by the sorter
+	Duplicate          bool   // another read in the same clump has the same sequence (and mates)
+	OpticalDuplicate   bool   // Duplicate, and within the optical distance of its copy on the same tile
+	CorrectedBases     int    // bases replaced by clump consensus error correction
 }
 
 // FastqArena owns the raw FASTQ bytes referenced by one or more FastqRead
@@ -54,13 +64,34 @@ type FastqArena struct {
 }
 
 type ReorderStats struct {
-	Reads int
-	Bytes int
+	Reads   int
+	Bytes   int
+	Flipped int // records written reverse-complemented to follow their primary read
+	Written int // records written; fewer than Reads when duplicates were removed or reads were demultiplexed
+}
+
+// ReorderOptions configures ReorderReadsByOrderOpts.
+type ReorderOptions struct {
+	Delim          byte
+	ExpectedReads  int      // expected companion read count (0 = not checked)
+	ReferenceNames []string // normalized primary read names to check against, in input order
+	// Flipped marks, by original 0-based read index, the primary reads that
+	// the sorter reverse-complemented. The matching companion records are
+	// reverse-complemented too, so both mates keep the same relative
+	// orientation.
+	Flipped []bool
+	// Duplicates tags companion headers of primary reads marked as
+	// duplicates, by original 0-based read index.
+	Duplicates []DuplicateKind
+	// AllowSubset accepts an order file that lists only some reads, as when
+	// duplicates were removed from the primary output.
+	AllowSubset bool
 }
 
 type recordIndexEntry struct {
-	Offset int64
-	Size   int
+	Offset  int64
+	Size    int
+	Flipped bool
 }
 
 // Append adds a line or record fragment to the arena and returns the range
@@ -73,6 +104,9 @@ func (a *FastqArena) Append(line []byte) (int, int) {
 }
 
 func (read FastqRead) Id() []byte {
+	if read.OverrideId != nil {
+		return read.OverrideId
+	}
 	return bytes.TrimRight(read.Arena.Data[read.IdOffset:read.IdOffset+read.IdSize], "\r\n")
 }
 
@@ -83,6 +117,18 @@ func (read FastqRead) Sequence() []byte {
 	return bytes.TrimRight(read.Arena.Data[read.SequenceOffset:read.SequenceOffset+read.SequenceSize], "\r\n")
 }
 
+// RawSequence returns the sequence as read from the input, ignoring
+// OverrideSeq.
+func (read FastqRead) RawSequence() []byte {
+	return bytes.TrimRight(read.Arena.Data[read.SequenceOffset:read.SequenceOffset+read.SequenceSize], "\r\n")
+}
+
+// RawQualityScores returns the quality string as read from the input,
+// ignoring OverrideQual.
+func (read FastqRead) RawQualityScores() []byte {
+	return bytes.TrimRight(read.Arena.Data[read.QualityScoreOffset:read.QualityScoreOffset+read.QualityScoreSize], "\r\n")
+}
+
 func (read FastqRead) Plus() []byte {
 	return bytes.TrimRight(read.Arena.Data[read.PlusOffset:read.PlusOffset+read.PlusSize], "\r\n")
 }
@@ -95,13 +141,16 @@ func (read FastqRead) QualityScores() []byte {
 }
 
 func (read FastqRead) Record() []byte {
-	if read.OverrideSeq == nil && read.OverrideQual == nil {
+	if read.OverrideId == nil && read.OverrideSeq == nil && read.OverrideQual == nil {
 		// Fast path: no post-processing overrides, return raw arena bytes.
 		return read.Arena.Data[read.RecordOffset : read.RecordOffset+read.RecordSize]
 	}
-	// One or both fields overridden — assemble a new 4-line record.
+	// Some fields overridden — assemble a new 4-line record.
 	// id and plus already include their trailing newline from the arena.
 	id := read.Arena.Data[read.IdOffset : read.IdOffset+read.IdSize]
+	if read.OverrideId != nil {
+		id = append(append(make([]byte, 0, len(read.OverrideId)+1), read.OverrideId...), '\n')
+	}
 	plus := read.Arena.Data[read.PlusOffset : read.PlusOffset+read.PlusSize]
 	seq := read.Sequence()
 	qual := read.QualityScores()
@@ -320,6 +369,45 @@ func SaveOrderE(readsBuffer *[]FastqRead, orderFilename string) error {
 	return nil
 }
 
+// SaveFlipsE writes the original index of every flipped read, one per line in
+// output order. Paired reordering reads it back with LoadFlips.
+func SaveFlipsE(readsBuffer *[]FastqRead, flipFilename string) error {
+	outputFile, err := os.Create(flipFilename)
+	if err != nil {
+		return fmt.Errorf("create flip file: %w", err)
+	}
+	defer outputFile.Close()
+
+	writer := bufio.NewWriter(outputFile)
+	defer writer.Flush()
+	for _, read := range *readsBuffer {
+		if !read.Flipped {
+			continue
+		}
+		if _, err := writer.WriteString(strconv.Itoa(read.I) + "\n"); err != nil {
+			return fmt.Errorf("write flip row: %w", err)
+		}
+	}
+	return nil
+}
+
+// LoadFlips reads a flip file written by SaveFlipsE and returns a mask over
+// the original read indexes: flipped[i] is true when read i+1 was flipped.
+func LoadFlips(flipFilename string, reads int) ([]bool, error) {
+	indexes, err := LoadOrder(flipFilename)
+	if err != nil {
+		return nil, fmt.Errorf("load flip file: %w", err)
+	}
+	flipped := make([]bool, reads)
+	for _, readIndex := range indexes {
+		if readIndex < 1 || readIndex > reads {
+			return nil, fmt.Errorf("flip file references read %d outside range [1, %d]", readIndex, reads)
+		}
+		flipped[readIndex-1] = true
+	}
+	return flipped, nil
+}
+
 func LoadOrder(orderFilename string) ([]int, error) {
 	orderFile, err := os.Open(orderFilename)
 	if err != nil {
@@ -396,22 +484,69 @@ func ReorderReadsByOrder(
 	expectedReads int,
 	referenceNames []string,
 ) (ReorderStats, error) {
-	reader, err := _io.OpenReader(inputFilepath)
+	return ReorderReadsByOrderOpts(inputFilepath, outputFilepath, orderFilename, ReorderOptions{
+		Delim:          delim,
+		ExpectedReads:  expectedReads,
+		ReferenceNames: referenceNames,
+	})
+}
+
+// ReorderReadsByOrderOpts writes the companion FASTQ in the primary order
+// file's order. Records marked in opts.Flipped are reverse-complemented on
+// the way through.
+func ReorderReadsByOrderOpts(
+	inputFilepath string,
+	outputFilepath string,
+	orderFilename string,
+	opts ReorderOptions,
+) (ReorderStats, error) {
+	stats, err := ReorderReadsByOrders(inputFilepath, []ReorderTarget{{OutputFilepath: outputFilepath, OrderFilename: orderFilename}}, opts)
 	if err != nil {
 		return ReorderStats{}, err
 	}
+	return stats[0], nil
+}
+
+// ReorderTarget is one output of ReorderReadsByOrders and the order file
+// listing its reads.
+type ReorderTarget struct {
+	OutputFilepath string
+	OrderFilename  string
+}
+
+// ReorderReadsByOrders indexes the companion FASTQ once and writes one output
+// per target, each in the order of its order file, as when the primary reads
+// were demultiplexed into several outputs. A read may be listed by only one
+// order file, and the order files together must list every read unless
+// opts.AllowSubset is set. Reads, Bytes and the checks cover the whole
+// companion; Written and Flipped count the records of each target.
+func ReorderReadsByOrders(
+	inputFilepath string,
+	targets []ReorderTarget,
+	opts ReorderOptions,
+) ([]ReorderStats, error) {
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no reorder outputs for %s", inputFilepath)
+	}
+	delim := opts.Delim
+	expectedReads := opts.ExpectedReads
+	referenceNames := opts.ReferenceNames
+	reader, err := _io.OpenReader(inputFilepath)
+	if err != nil {
+		return nil, err
+	}
 	defer reader.Close()
 
-	tempDir, err := os.MkdirTemp(filepath.Dir(outputFilepath), ".reorder-*")
+	tempDir, err := os.MkdirTemp(filepath.Dir(targets[0].OutputFilepath), ".reorder-*")
 	if err != nil {
-		return ReorderStats{}, fmt.Errorf("create reorder temp dir: %w", err)
+		return nil, fmt.Errorf("create reorder temp dir: %w", err)
 	}
 	defer os.RemoveAll(tempDir)
 
 	tempRecordsPath := filepath.Join(tempDir, "records.fastq")
 	tempRecords, err := os.Create(tempRecordsPath)
 	if err != nil {
-		return ReorderStats{}, fmt.Errorf("create reorder temp records: %w", err)
+		return nil, fmt.Errorf("create reorder temp records: %w", err)
 	}
 
 	index := []recordIndexEntry{}
@@ -427,64 +562,93 @@ func ReorderReadsByOrder(
 				break
 			}
 			tempRecords.Close()
-			return ReorderStats{}, fmt.Errorf("read companion fastq: %w", err)
+			return nil, fmt.Errorf("read companion fastq: %w", err)
 		}
 		if len(referenceNames) > 0 {
 			if len(index) >= len(referenceNames) {
 				tempRecords.Close()
-				return ReorderStats{}, fmt.Errorf("reference read count mismatch for %s: companion has more than %d reads", inputFilepath, len(referenceNames))
+				return nil, fmt.Errorf("reference read count mismatch for %s: companion has more than %d reads", inputFilepath, len(referenceNames))
 			}
 			if got, want := NormalizedReadID(read.Id()), referenceNames[len(index)]; got != want {
 				tempRecords.Close()
-				return ReorderStats{}, fmt.Errorf("read name mismatch for %s at original read %d: got %q, want %q", inputFilepath, len(index)+1, got, want)
+				return nil, fmt.Errorf("read name mismatch for %s at original read %d: got %q, want %q", inputFilepath, len(index)+1, got, want)
 			}
 		}
 
+		if len(index) < len(opts.Duplicates) {
+			TagDuplicate(&read, opts.Duplicates[len(index)])
+		}
+		if len(index) < len(opts.Flipped) && opts.Flipped[len(index)] {
+			read.OverrideSeq = ReverseComplement(read.Sequence())
+			read.OverrideQual = ReverseBytes(read.QualityScores())
+			read.Flipped = true
+		}
+
 		offset, err := tempRecords.Seek(0, io.SeekCurrent)
 		if err != nil {
 			tempRecords.Close()
-			return ReorderStats{}, fmt.Errorf("get temp record offset: %w", err)
+			return nil, fmt.Errorf("get temp record offset: %w", err)
 		}
 		n, err := tempRecords.Write(read.Record())
 		if err != nil {
 			tempRecords.Close()
-			return ReorderStats{}, fmt.Errorf("write temp companion record: %w", err)
+			return nil, fmt.Errorf("write temp companion record: %w", err)
 		}
-		index = append(index, recordIndexEntry{Offset: offset, Size: n})
+		index = append(index, recordIndexEntry{Offset: offset, Size: n, Flipped: read.Flipped})
 		totalBytes += readSize
 	}
 	if err := tempRecords.Close(); err != nil {
-		return ReorderStats{}, fmt.Errorf("close temp companion records: %w", err)
+		return nil, fmt.Errorf("close temp companion records: %w", err)
 	}
 
 	if expectedReads > 0 && len(index) != expectedReads {
-		return ReorderStats{}, fmt.Errorf("read count mismatch for %s: got %d, want %d", inputFilepath, len(index), expectedReads)
+		return nil, fmt.Errorf("read count mismatch for %s: got %d, want %d", inputFilepath, len(index), expectedReads)
 	}
 	if len(referenceNames) > 0 && len(referenceNames) != len(index) {
-		return ReorderStats{}, fmt.Errorf("reference read count mismatch for %s: got %d reference names for %d reads", inputFilepath, len(referenceNames), len(index))
+		return nil, fmt.Errorf("reference read count mismatch for %s: got %d reference names for %d reads", inputFilepath, len(referenceNames), len(index))
 	}
 
-	orderFile, err := os.Open(orderFilename)
-	if err != nil {
-		return ReorderStats{}, fmt.Errorf("open order file: %w", err)
-	}
-	defer orderFile.Close()
-
 	tempRecordsReader, err := os.Open(tempRecordsPath)
 	if err != nil {
-		return ReorderStats{}, fmt.Errorf("open temp companion records: %w", err)
+		return nil, fmt.Errorf("open temp companion records: %w", err)
 	}
 	defer tempRecordsReader.Close()
 
 	seen := make([]bool, len(index))
-	writer, err := _io.OpenWriter(outputFilepath)
+	stats := make([]ReorderStats, len(targets))
+	written := 0
+	for i, target := range targets {
+		stats[i], err = writeReorderTarget(target, index, tempRecordsReader, seen)
+		if err != nil {
+			return nil, err
+		}
+		stats[i].Reads, stats[i].Bytes = len(index), totalBytes
+		written += stats[i].Written
+	}
+	if written != len(index) && !opts.AllowSubset {
+		return nil, fmt.Errorf("order length mismatch for %s: got %d order rows for %d reads", inputFilepath, written, len(index))
+	}
+	return stats, nil
+}
+
+// writeReorderTarget copies the indexed companion records listed by the
+// target's order file to its output. seen is shared between targets so no
+// read is written twice.
+func writeReorderTarget(target ReorderTarget, index []recordIndexEntry, records *os.File, seen []bool) (ReorderStats, error) {
+	orderFile, err := os.Open(target.OrderFilename)
+	if err != nil {
+		return ReorderStats{}, fmt.Errorf("open order file: %w", err)
+	}
+	defer orderFile.Close()
+
+	writer, err := _io.OpenWriter(target.OutputFilepath)
 	if err != nil {
 		return ReorderStats{}, err
 	}
 	defer writer.Close()
 
+	stats := ReorderStats{}
 	scanner := bufio.NewScanner(orderFile)
-	outputIndex := 0
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
@@ -494,17 +658,20 @@ func ReorderReadsByOrder(
 		if err != nil {
 			return ReorderStats{}, fmt.Errorf("parse order value %q: %w", line, err)
 		}
-		outputIndex++
+		stats.Written++
 		if originalIndex < 1 || originalIndex > len(index) {
-			return ReorderStats{}, fmt.Errorf("order row %d references read %d outside range [1, %d]", outputIndex, originalIndex, len(index))
+			return ReorderStats{}, fmt.Errorf("order row %d references read %d outside range [1, %d]", stats.Written, originalIndex, len(index))
 		}
 		if seen[originalIndex-1] {
-			return ReorderStats{}, fmt.Errorf("order row %d repeats read %d", outputIndex, originalIndex)
+			return ReorderStats{}, fmt.Errorf("order row %d repeats read %d", stats.Written, originalIndex)
 		}
 		seen[originalIndex-1] = true
 		recordIndex := index[originalIndex-1]
+		if recordIndex.Flipped {
+			stats.Flipped++
+		}
 		record := make([]byte, recordIndex.Size)
-		if _, err := tempRecordsReader.ReadAt(record, recordIndex.Offset); err != nil {
+		if _, err := records.ReadAt(record, recordIndex.Offset); err != nil {
 			return ReorderStats{}, fmt.Errorf("read temp companion record %d: %w", originalIndex, err)
 		}
 		if _, err := writer.Writer.Write(record); err != nil {
@@ -514,9 +681,5 @@ func ReorderReadsByOrder(
 	if err := scanner.Err(); err != nil {
 		return ReorderStats{}, fmt.Errorf("scan order file: %w", err)
 	}
-	if outputIndex != len(index) {
-		return ReorderStats{}, fmt.Errorf("order length mismatch for %s: got %d order rows for %d reads", inputFilepath, outputIndex, len(index))
-	}
-
-	return ReorderStats{Reads: len(index), Bytes: totalBytes}, nil
+	return stats, nil
 }
@@ -80,6 +80,111 @@ func TestReorderReadsByOrderAppliesPrimaryReadOrder(t *testing.T) {
 	}
 }
 
+func TestReorderReadsByOrderOptsFlipsMarkedMates(t *testing.T) {
+	dir := t.TempDir()
+	orderPath := filepath.Join(dir, "order.txt")
+	flipPath := filepath.Join(dir, "flips.txt")
+	r2Path := filepath.Join(dir, "r2.fastq")
+	outputPath := filepath.Join(dir, "r2.sorted.fastq.gz")
+
+	if err := os.WriteFile(orderPath, []byte("2\n1\n"), 0644); err != nil {
+		t.Fatalf("write order: %v", err)
+	}
+	if err := os.WriteFile(flipPath, []byte("2\n"), 0644); err != nil {
+		t.Fatalf("write flips: %v", err)
+	}
+	input := "" +
+		"@pair1/2\nTTTT\n+\n!!!!\n" +
+		"@pair2/2\nAACg\n+\nABCD\n"
+	if err := os.WriteFile(r2Path, []byte(input), 0644); err != nil {
+		t.Fatalf("write r2: %v", err)
+	}
+
+	flipped, err := LoadFlips(flipPath, 2)
+	if err != nil {
+		t.Fatalf("load flips: %v", err)
+	}
+	stats, err := ReorderReadsByOrderOpts(r2Path, outputPath, orderPath, ReorderOptions{
+		Delim:         '\n',
+		ExpectedReads: 2,
+		Flipped:       flipped,
+	})
+	if err != nil {
+		t.Fatalf("reorder reads: %v", err)
+	}
+	if stats.Flipped != 1 {
+		t.Fatalf("flipped = %d, want 1", stats.Flipped)
+	}
+
+	want := "" +
+		"@pair2/2\ncGTT\n+\nDCBA\n" +
+		"@pair1/2\nTTTT\n+\n!!!!\n"
+	if got := readGzipFile(t, outputPath); got != want {
+		t.Fatalf("reordered output = %q, want %q", got, want)
+	}
+
+	if _, err := LoadFlips(flipPath, 1); err == nil {
+		t.Fatalf("expected an error for a flip index outside the read range")
+	}
+}
+
+func TestReorderReadsByOrderOptsTagsDuplicatesAndAllowsSubset(t *testing.T) {
+	dir := t.TempDir()
+	orderPath := filepath.Join(dir, "order.txt")
+	duplicatePath := filepath.Join(dir, "duplicates.txt")
+	r2Path := filepath.Join(dir, "r2.fastq")
+	outputPath := filepath.Join(dir, "r2.sorted.fastq.gz")
+
+	input := "" +
+		"@pair1/2\nAAAA\n+\nIIII\n" +
+		"@pair2/2\nAAAA\n+\nIIII\n" +
+		"@pair3/2\nCCCC\n+\nIIII\n"
+	if err := os.WriteFile(r2Path, []byte(input), 0644); err != nil {
+		t.Fatalf("write r2: %v", err)
+	}
+	if err := os.WriteFile(duplicatePath, []byte("2\t"+DuplicateTagOptical+"\n"), 0644); err != nil {
+		t.Fatalf("write duplicates: %v", err)
+	}
+	duplicates, err := LoadDuplicates(duplicatePath, 3)
+	if err != nil {
+		t.Fatalf("load duplicates: %v", err)
+	}
+
+	// Mark mode: every read is written and the duplicate mate is tagged.
+	if err := os.WriteFile(orderPath, []byte("2\n1\n3\n"), 0644); err != nil {
+		t.Fatalf("write order: %v", err)
+	}
+	if _, err := ReorderReadsByOrderOpts(r2Path, outputPath, orderPath, ReorderOptions{Delim: '\n', ExpectedReads: 3, Duplicates: duplicates}); err != nil {
+		t.Fatalf("reorder reads: %v", err)
+	}
+	want := "" +
+		"@pair2/2 " + DuplicateTagOptical + "\nAAAA\n+\nIIII\n" +
+		"@pair1/2\nAAAA\n+\nIIII\n" +
+		"@pair3/2\nCCCC\n+\nIIII\n"
+	if got := readGzipFile(t, outputPath); got != want {
+		t.Fatalf("tagged output = %q, want %q", got, want)
+	}
+
+	// Remove mode: the order file skips the removed read.
+	if err := os.WriteFile(orderPath, []byte("1\n3\n"), 0644); err != nil {
+		t.Fatalf("write order: %v", err)
+	}
+	if _, err := ReorderReadsByOrderOpts(r2Path, outputPath, orderPath, ReorderOptions{Delim: '\n', ExpectedReads: 3}); err == nil {
+		t.Fatalf("expected an error for an order file missing reads")
+	}
+	stats, err := ReorderReadsByOrderOpts(r2Path, outputPath, orderPath, ReorderOptions{Delim: '\n', ExpectedReads: 3, AllowSubset: true})
+	if err != nil {
+		t.Fatalf("reorder subset: %v", err)
+	}
+	if stats.Reads != 3 || stats.Written != 2 {
+		t.Fatalf("reads/written = %d/%d, want 3/2", stats.Reads, stats.Written)
+	}
+
+	if _, err := LoadDuplicates(duplicatePath, 1); err == nil {
+		t.Fatalf("expected an error for a duplicate index outside the read range")
+	}
+}
+
 func TestReorderReadsByOrderRejectsReadCountMismatch(t *testing.T) {
 	dir := t.TempDir()
 	orderPath := filepath.Join(dir, "order.txt")
@@ -187,3 +292,122 @@ func readGzipFile(t *testing.T, path string) string {
 	}
 	return string(data)
 }
+
+func TestSampleReadStats(t *testing.T) {
+	// Quality '+' is Q10 (error 0.1) and '5' is Q20 (error 0.01).
+	input := "" +
+		"@r1\nACGT\n+\n++++\n" +
+		"@r2\nACGTACGT\n+\n55555555\n" +
+		"@r3\nACGTAC\n+\n555555\n"
+	path := filepath.Join(t.TempDir(), "sample.fastq")
+	if err := os.WriteFile(path, []byte(input), 0644); err != nil {
+		t.Fatalf("write fastq: %v", err)
+	}
+
+	stats, err := SampleReadStats(path, '\n', 2)
+	if err != nil {
+		t.Fatalf("sample stats: %v", err)
+	}
+	if stats.Reads != 2 || stats.MinLength != 4 || stats.MaxLength != 8 || stats.MedianLength != 8 {
+		t.Fatalf("stats = %+v, want 2 reads with lengths 4 and 8", stats)
+	}
+	wantError := (4*0.1 + 8*0.01) / 12
+	if diff := stats.MeanErrorRate - wantError; diff > 1e-9 || diff < -1e-9 {
+		t.Fatalf("mean error rate = %v, want %v", stats.MeanErrorRate, wantError)
+	}
+}
+
+func TestCalcQualityMetrics(t *testing.T) {
+	// '+' is Q10, '5' is Q20, '?' is Q30 and 'I' is Q40.
+	got := CalcQualityMetrics([]byte("I?5+"))
+	want := QualityMetrics{Mean: 25, Median: 25, ExpectedErrors: 0.1111, Q30Fraction: 0.5}
+	if diff := got.ExpectedErrors - want.ExpectedErrors; diff > 1e-9 || diff < -1e-9 {
+		t.Fatalf("expected errors = %v, want %v", got.ExpectedErrors, want.ExpectedErrors)
+	}
+	got.ExpectedErrors = want.ExpectedErrors
+	if got != want {
+		t.Fatalf("metrics = %+v, want %+v", got, want)
+	}
+	if got := CalcQualityMetrics([]byte("I5+")); got.Median != 20 {
+		t.Fatalf("odd-length median = %v, want 20", got.Median)
+	}
+	if got := CalcQualityMetrics(nil); got != (QualityMetrics{}) {
+		t.Fatalf("empty quality metrics = %+v, want zero", got)
+	}
+}
+
+func TestFastqReadQualityMetricsCached(t *testing.T) {
+	arena := &FastqArena{}
+	qualOffset, qualSize := arena.Append([]byte("IIII\n"))
+	read := FastqRead{Arena: arena, QualityScoreOffset: qualOffset, QualityScoreSize: qualSize}
+	if read.Quality != nil {
+		t.Fatal("metrics should not be computed before first use")
+	}
+	if got := read.QualityMetrics(); got.Mean != 40 {
+		t.Fatalf("mean = %v, want 40", got.Mean)
+	}
+	cached := read.Quality
+	read.OverrideQual = []byte("!!!!")
+	if read.QualityMetrics().Mean != 40 || read.Quality != cached {
+		t.Fatal("metrics should be cached from the input quality string")
+	}
+}
+
+func TestComplementBaseIsInvolution(t *testing.T) {
+	for i := 0; i < 256; i++ {
+		base := byte(i)
+		if base == 'U' || base == 'u' {
+			continue
+		}
+		if got := ComplementBase(ComplementBase(base)); got != base {
+			t.Fatalf("ComplementBase twice on %q = %q", base, got)
+		}
+	}
+	if got := ComplementBase('U'); got != 'A' {
+		t.Fatalf("ComplementBase('U') = %q, want 'A'", got)
+	}
+	sequence := []byte("ACGTacgtRYKMSWBDHVNrykmswbdhvn")
+	if !IsReverseComplement(ReverseComplement(sequence), sequence) {
+		t.Fatalf("IsReverseComplement rejected the reverse complement of %q", sequence)
+	}
+	if !IsReverseComplement([]byte("AAGT"), []byte("ACUU")) {
+		t.Fatalf("IsReverseComplement rejected the reverse complement of a sequence with U")
+	}
+	if IsReverseComplement([]byte("ACGT"), []byte("ACGA")) {
+		t.Fatalf("IsReverseComplement accepted a mismatching sequence")
+	}
+}
+
+func TestParseIlluminaHeader(t *testing.T) {
+	cases := []struct {
+		id   string
+		ok   bool
+		want IlluminaHeader
+	}{
+		{
+			"@A00123:8:HFLWDDSXX:2:1101:1000:2000 1:N:0:ATCACG+GTTACA",
+			true,
+			IlluminaHeader{Instrument: "A00123", Run: 8, Flowcell: "HFLWDDSXX", Lane: 2, Tile: 1101, X: 1000, Y: 2000, ReadNumber: 1, Control: 0, Index: "ATCACG+GTTACA", Casava18: true},
+		},
+		{
+			"@M01:5:000000000-A1B2C:1:2119:15:19:ACGTAC 2:Y:0:1\r\n",
+			true,
+			IlluminaHeader{Instrument: "M01", Run: 5, Flowcell: "000000000-A1B2C", Lane: 1, Tile: 2119, X: 15, Y: 19, UMI: "ACGTAC", ReadNumber: 2, Filtered: true, Index: "1", Casava18: true},
+		},
+		{
+			"@HWUSI-EAS100R:6:73:941:1973#0/1",
+			true,
+			IlluminaHeader{Instrument: "HWUSI-EAS100R", Lane: 6, Tile: 73, X: 941, Y: 1973, Index: "0", ReadNumber: 1},
+		},
+		{"@A00123:8:HFLWDDSXX:2:1101:1000:2000", true, IlluminaHeader{Instrument: "A00123", Run: 8, Flowcell: "HFLWDDSXX", Lane: 2, Tile: 1101, X: 1000, Y: 2000, Casava18: true}},
+		{"@SRR001666.1 071112_SLXA-EAS1_s_7:5:1:817:345 length=36", false, IlluminaHeader{}},
+		{"@read1", false, IlluminaHeader{}},
+		{"@A00123:8:FC:x:1101:1000:2000", false, IlluminaHeader{}},
+	}
+	for _, tc := range cases {
+		got, ok := ParseIlluminaHeader([]byte(tc.id))
+		if ok != tc.ok || got != tc.want {
+			t.Errorf("ParseIlluminaHeader(%q) = %+v, %v; want %+v, %v", tc.id, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package fastq
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// IlluminaHeader holds the fields of an Illumina read header.
+//
+// Casava 1.8+ headers look like
+//
+//	@<instrument>:<run>:<flowcell>:<lane>:<tile>:<x>:<y>[:<umi>] <read>:<filtered>:<control>:<index>
+//
+// and older headers like
+//
+//	@<instrument>:<lane>:<tile>:<x>:<y>#<index>/<read>
+//
+// Fields that the header format does not carry are left at their zero value.
+type IlluminaHeader struct {
+	Instrument string
+	Run        int
+	Flowcell   string
+	Lane       int
+	Tile       int
+	X          int
+	Y          int
+	UMI        string
+	ReadNumber int
+	Filtered   bool // Casava 1.8+ "Y": the read failed the chastity filter
+	Control    int
+	Index      string
+	Casava18   bool // parsed from the Casava 1.8+ layout
+}
+
+// ParseIlluminaHeader parses a FASTQ header line, with or without the leading
+// '@'. It reports false when the header is not in a recognised Illumina
+// layout, for example SRA-renamed or simulated reads.
+func ParseIlluminaHeader(id []byte) (IlluminaHeader, bool) {
+	id = bytes.TrimPrefix(bytes.TrimRight(id, "\r\n"), []byte{'@'})
+	name, comment, _ := bytes.Cut(id, []byte{' '})
+	if header, ok := parseCasava18(name, comment); ok {
+		return header, true
+	}
+	return parseLegacyIllumina(name)
+}
+
+func parseCasava18(name []byte, comment []byte) (IlluminaHeader, bool) {
+	fields := bytes.Split(name, []byte{':'})
+	if len(fields) != 7 && len(fields) != 8 {
+		return IlluminaHeader{}, false
+	}
+	header := IlluminaHeader{
+		Instrument: string(fields[0]),
+		Flowcell:   string(fields[2]),
+		Casava18:   true,
+	}
+	numbers := []*int{&header.Run, nil, &header.Lane, &header.Tile, &header.X, &header.Y}
+	for i, target := range numbers {
+		if target == nil {
+			continue
+		}
+		value, ok := parseHeaderInt(fields[i+1])
+		if !ok {
+			return IlluminaHeader{}, false
+		}
+		*target = value
+	}
+	if len(fields) == 8 {
+		header.UMI = string(fields[7])
+	}
+
+	// The comment is optional; a malformed one leaves the read fields unset
+	// rather than rejecting an otherwise valid header.
+	comment, _, _ = bytes.Cut(bytes.TrimSpace(comment), []byte{' '})
+	parts := bytes.Split(comment, []byte{':'})
+	if len(parts) == 4 {
+		readNumber, okRead := parseHeaderInt(parts[0])
+		control, okControl := parseHeaderInt(parts[2])
+		if okRead && okControl && (string(parts[1]) == "Y" || string(parts[1]) == "N") {
+			header.ReadNumber = readNumber
+			header.Filtered = string(parts[1]) == "Y"
+			header.Control = control
+			header.Index = string(parts[3])
+		}
+	}
+	return header, true
+}
+
+func parseLegacyIllumina(name []byte) (IlluminaHeader, bool) {
+	fields := bytes.Split(name, []byte{':'})
+	if len(fields) != 5 {
+		return IlluminaHeader{}, false
+	}
+	header := IlluminaHeader{Instrument: string(fields[0])}
+
+	last := fields[4]
+	if before, readNumber, ok := bytes.Cut(last, []byte{'/'}); ok {
+		value, ok := parseHeaderInt(readNumber)
+		if !ok {
+			return IlluminaHeader{}, false
+		}
+		header.ReadNumber = value
+		last = before
+	}
+	if before, index, ok := bytes.Cut(last, []byte{'#'}); ok {
+		header.Index = string(index)
+		last = before
+	}
+
+	for i, target := range []*int{&header.Lane, &header.Tile, &header.X, &header.Y} {
+		field := fields[i+1]
+		if i == 3 {
+			field = last
+		}
+		value, ok := parseHeaderInt(field)
+		if !ok {
+			return IlluminaHeader{}, false
+		}
+		*target = value
+	}
+	return header, true
+}
+
+func parseHeaderInt(field []byte) (int, bool) {
+	if len(field) == 0 {
+		return 0, false
+	}
+	value, err := strconv.Atoi(string(field))
+	if err != nil || value < 0 {
+		return 0, false
+	}
+	return value, true
+}
@@ -0,0 +1,83 @@
+package fastq
+
+// MaxPhredScore is the highest Phred+33 score a quality byte can encode ('~').
+const MaxPhredScore = 93
+
+// QualityMetrics summarises the Phred+33 quality string of one read. The
+// parser does not compute them; FastqRead.QualityMetrics does on first use
+// and caches them on the read, so reads that never need them pay only for a
+// nil pointer.
+type QualityMetrics struct {
+	Mean   float64 // mean Phred score
+	Median float64 // median Phred score; the mean of the two middle scores for even lengths
+	// ExpectedErrors is the sum of the per-base error probabilities, the
+	// expected number of wrong base calls in the read.
+	ExpectedErrors float64
+	Q30Fraction    float64 // fraction of bases with a Phred score >= 30
+}
+
+var phredErrorProbabilities = func() [MaxPhredScore + 1]float64 {
+	var table [MaxPhredScore + 1]float64
+	for score := range table {
+		table[score] = PhredErrorProbability(byte(score + 33))
+	}
+	return table
+}()
+
+// CalcQualityMetrics computes the quality metrics of a Phred+33 quality
+// string. Bytes outside the Phred+33 range are clamped to scores 0 and 93.
+// An empty quality string has all metrics zero.
+func CalcQualityMetrics(quality []byte) QualityMetrics {
+	if len(quality) == 0 {
+		return QualityMetrics{}
+	}
+	var histogram [MaxPhredScore + 1]int
+	sum, q30 := 0, 0
+	expectedErrors := 0.0
+	for _, q := range quality {
+		score := int(q) - 33
+		if score < 0 {
+			score = 0
+		} else if score > MaxPhredScore {
+			score = MaxPhredScore
+		}
+		histogram[score]++
+		sum += score
+		if score >= 30 {
+			q30++
+		}
+		expectedErrors += phredErrorProbabilities[score]
+	}
+
+	n := len(quality)
+	return QualityMetrics{
+		Mean:           float64(sum) / float64(n),
+		Median:         float64(histogramRank(histogram, (n-1)/2)+histogramRank(histogram, n/2)) / 2,
+		ExpectedErrors: expectedErrors,
+		Q30Fraction:    float64(q30) / float64(n),
+	}
+}
+
+// QualityMetrics returns the metrics of the input quality string of read,
+// ignoring OverrideQual like GCContent ignores OverrideSeq. The first call
+// computes them and caches them on read; later calls, and copies of read
+// made after the first call, reuse them.
+func (read *FastqRead) QualityMetrics() QualityMetrics {
+	if read.Quality == nil {
+		metrics := CalcQualityMetrics(read.RawQualityScores())
+		read.Quality = &metrics
+	}
+	return *read.Quality
+}
+
+// histogramRank returns the score at 0-based rank in the sorted scores.
+func histogramRank(histogram [MaxPhredScore + 1]int, rank int) int {
+	seen := 0
+	for score, count := range histogram {
+		seen += count
+		if seen > rank {
+			return score
+		}
+	}
+	return MaxPhredScore
+}
@@ -0,0 +1,84 @@
+package fastq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	go_sort "sort"
+
+	_io "squish/fastqio"
+)
+
+// ReadSampleStats summarises read lengths and base error rates for the first
+// reads of an input. Parameter auto-selection uses it to size k-mers to the
+// data instead of assuming short Illumina reads.
+type ReadSampleStats struct {
+	Reads        int     `json:"reads"`
+	MinLength    int     `json:"min_length"`
+	P10Length    int     `json:"p10_length"`
+	MedianLength int     `json:"median_length"`
+	MaxLength    int     `json:"max_length"`
+	MeanLength   float64 `json:"mean_length"`
+	// MeanErrorRate is the mean per-base error probability implied by the
+	// Phred+33 quality scores, 10^(-Q/10).
+	MeanErrorRate float64 `json:"mean_error_rate"`
+}
+
+// SampleReadStats streams up to limit records from the start of inputFilepath
+// and returns their length and quality statistics. A limit < 1 reads the whole
+// file.
+func SampleReadStats(inputFilepath string, delim byte, limit int) (ReadSampleStats, error) {
+	reader, err := _io.OpenReader(inputFilepath)
+	if err != nil {
+		return ReadSampleStats{}, err
+	}
+	defer reader.Close()
+
+	lengths := []int{}
+	totalLength := 0
+	totalBases := 0
+	errorSum := 0.0
+	readIndex := 0
+	for limit < 1 || len(lengths) < limit {
+		read, _, err := ReadNextReadE(reader, &delim, &readIndex)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return ReadSampleStats{}, fmt.Errorf("sample fastq reads: %w", err)
+		}
+		length := len(read.Sequence())
+		lengths = append(lengths, length)
+		totalLength += length
+		for _, q := range read.QualityScores() {
+			errorSum += PhredErrorProbability(q)
+			totalBases++
+		}
+	}
+
+	stats := ReadSampleStats{Reads: len(lengths)}
+	if len(lengths) == 0 {
+		return stats, nil
+	}
+	go_sort.Ints(lengths)
+	stats.MinLength = lengths[0]
+	stats.P10Length = lengths[len(lengths)/10]
+	stats.MedianLength = lengths[len(lengths)/2]
+	stats.MaxLength = lengths[len(lengths)-1]
+	stats.MeanLength = float64(totalLength) / float64(len(lengths))
+	if totalBases > 0 {
+		stats.MeanErrorRate = errorSum / float64(totalBases)
+	}
+	return stats, nil
+}
+
+// PhredErrorProbability converts one Phred+33 quality byte to the base-call
+// error probability it encodes.
+func PhredErrorProbability(q byte) float64 {
+	score := int(q) - 33
+	if score < 0 {
+		score = 0
+	}
+	return math.Pow(10, -float64(score)/10)
+}
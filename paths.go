@@ -54,6 +54,13 @@ func DerivePairedOutputArg(inputPath string) string {
 	return StripFastqExtensions(inputPath) + ".sorted.fastq.gz"
 }
 
+// SampleOutputPath returns the output path of one demultiplexed sample: path
+// with its file name prefixed by the sample name, such as
+// "output/S1.reads.fastq.gz" for "output/reads.fastq.gz".
+func SampleOutputPath(path string, sample string) string {
+	return filepath.Join(filepath.Dir(path), sample+"."+filepath.Base(path))
+}
+
 func GetFileSize(path string) (int64, error) {
 	fi, err := os.Stat(path)
 	if err != nil {
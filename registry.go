@@ -0,0 +1,338 @@
+package squish
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	fastq "squish/fastq"
+	_sort "squish/sort"
+)
+
+// Parameter types accepted in a StrategyParam schema.
+const (
+	ParamTypeInt    = "int"
+	ParamTypeFloat  = "float"
+	ParamTypeBool   = "bool"
+	ParamTypeString = "string"
+)
+
+// StrategyParam describes one parameter of a registered strategy. Values are
+// given as strings, from Config.SortParams and Config.BucketParams or the
+// -sortParam and -bucketParam flags, and are checked against Type before the
+// strategy is built.
+type StrategyParam struct {
+	Name        string
+	Type        string // int, float, bool, or string
+	Default     string // used when the parameter is not given; empty for none
+	Description string
+}
+
+// StrategyParams holds the parameter values passed to a strategy constructor,
+// with defaults filled in. Values have already been checked against the
+// schema, so the typed getters return the zero value only for parameters that
+// were neither given nor defaulted.
+type StrategyParams map[string]string
+
+func (p StrategyParams) String(name string) string { return p[name] }
+
+func (p StrategyParams) Int(name string) int {
+	value, _ := strconv.Atoi(p[name])
+	return value
+}
+
+func (p StrategyParams) Float(name string) float64 {
+	value, _ := strconv.ParseFloat(p[name], 64)
+	return value
+}
+
+func (p StrategyParams) Bool(name string) bool {
+	value, _ := strconv.ParseBool(p[name])
+	return value
+}
+
+// SortRegistration describes a sort method selectable with -m and
+// Config.SortMethod.
+type SortRegistration struct {
+	Name        string
+	Description string
+	Params      []StrategyParam
+	// DefaultBucket names the registered bucket strategy that -bucket auto
+	// uses for this method, with DefaultBucketParams under any -bucketParam
+	// values. When empty, auto gives key-range buckets for a method with
+	// per-read keys, and hash buckets otherwise.
+	DefaultBucket       string
+	DefaultBucketParams map[string]string
+	// New builds the strategy shared by the in-memory and external engines.
+	// It receives the normalised run config, for options outside Params.
+	New func(config Config, params StrategyParams) (_sort.SortStrategy, error)
+	// Func is an optional in-memory implementation for methods without
+	// Params; nil sorts with _sort.SortReadsStrategy.
+	Func func(*[]fastq.FastqRead)
+}
+
+// definition builds the sort definition of the method from the run config and
+// resolved parameters. Func is only used by methods without parameters, since
+// it cannot see them.
+func (registration SortRegistration) definition(config Config, params StrategyParams) (SortDefinition, error) {
+	strategy, err := registration.New(config, params)
+	if err != nil {
+		return SortDefinition{}, fmt.Errorf("sort method %s: %w", registration.Name, err)
+	}
+	sortFunc := registration.Func
+	if sortFunc == nil || len(registration.Params) > 0 {
+		sortFunc = func(reads *[]fastq.FastqRead) {
+			_sort.SortReadsStrategy(reads, strategy)
+		}
+	}
+	return SortDefinition{
+		CLIArg:      registration.Name,
+		Description: registration.Description,
+		Func:        sortFunc,
+		Strategy:    strategy,
+	}, nil
+}
+
+// BucketRegistration describes an external bucket strategy selectable with
+// -bucket and Config.BucketStrategy. New receives the normalised run config,
+// for the bucket count and input path, and the sort definition of the run.
+type BucketRegistration struct {
+	Name        string
+	Description string
+	Params      []StrategyParam
+	New         func(config Config, sortDefinition SortDefinition, params StrategyParams) (_sort.BucketStrategy, error)
+}
+
+// registry holds the built-in and user-registered strategies in registration
+// order, which is also the order of the CLI help text.
+var registry struct {
+	sync.RWMutex
+	sorts   []SortRegistration
+	buckets []BucketRegistration
+}
+
+// RegisterSortStrategy makes a custom sort method available to Run and the
+// CLI by name. It is meant to be called from an init function, before Run;
+// registering a name twice is an error.
+func RegisterSortStrategy(registration SortRegistration) error {
+	if err := checkRegistration("sort method", registration.Name, registration.Params); err != nil {
+		return err
+	}
+	if registration.Name == "key" {
+		return fmt.Errorf("sort method name %q is reserved for -key", registration.Name)
+	}
+	if registration.New == nil {
+		return fmt.Errorf("sort method %q has no constructor", registration.Name)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, existing := range registry.sorts {
+		if existing.Name == registration.Name {
+			return fmt.Errorf("sort method %q is already registered", registration.Name)
+		}
+	}
+	registry.sorts = append(registry.sorts, registration)
+	return nil
+}
+
+// RegisterBucketStrategy makes a custom external bucket strategy available to
+// Run and the CLI by name. Like RegisterSortStrategy, it is meant to be called
+// from an init function.
+func RegisterBucketStrategy(registration BucketRegistration) error {
+	if err := checkRegistration("bucket strategy", registration.Name, registration.Params); err != nil {
+		return err
+	}
+	if registration.Name == DefaultBucketStrategy {
+		return fmt.Errorf("bucket strategy name %q is reserved", registration.Name)
+	}
+	if registration.New == nil {
+		return fmt.Errorf("bucket strategy %q has no constructor", registration.Name)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for _, existing := range registry.buckets {
+		if existing.Name == registration.Name {
+			return fmt.Errorf("bucket strategy %q is already registered", registration.Name)
+		}
+	}
+	registry.buckets = append(registry.buckets, registration)
+	return nil
+}
+
+func checkRegistration(kind string, name string, params []StrategyParam) error {
+	if name == "" || strings.ContainsAny(name, " \t,=") {
+		return fmt.Errorf("invalid %s name %q", kind, name)
+	}
+	seen := map[string]bool{}
+	for _, param := range params {
+		if param.Name == "" || strings.ContainsAny(param.Name, " \t,=") {
+			return fmt.Errorf("%s %q: invalid parameter name %q", kind, name, param.Name)
+		}
+		if seen[param.Name] {
+			return fmt.Errorf("%s %q: parameter %q declared more than once", kind, name, param.Name)
+		}
+		seen[param.Name] = true
+		switch param.Type {
+		case ParamTypeInt, ParamTypeFloat, ParamTypeBool, ParamTypeString:
+		default:
+			return fmt.Errorf("%s %q: parameter %q has unknown type %q", kind, name, param.Name, param.Type)
+		}
+		if param.Default != "" {
+			if err := checkParamValue(param, param.Default); err != nil {
+				return fmt.Errorf("%s %q: default: %w", kind, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkParamValue(param StrategyParam, value string) error {
+	var err error
+	switch param.Type {
+	case ParamTypeInt:
+		_, err = strconv.Atoi(value)
+	case ParamTypeFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case ParamTypeBool:
+		_, err = strconv.ParseBool(value)
+	}
+	if err != nil {
+		return fmt.Errorf("parameter %q must be a %s, got %q", param.Name, param.Type, value)
+	}
+	return nil
+}
+
+// resolveParams checks given parameter values against a schema and fills in
+// defaults.
+func resolveParams(kind string, name string, schema []StrategyParam, given map[string]string) (StrategyParams, error) {
+	params := StrategyParams{}
+	for key := range given {
+		found := false
+		for _, param := range schema {
+			found = found || param.Name == key
+		}
+		if !found {
+			return nil, fmt.Errorf("%s %s has no parameter %q", kind, name, key)
+		}
+	}
+	for _, param := range schema {
+		value, ok := given[param.Name]
+		if !ok {
+			value = param.Default
+		}
+		if value == "" {
+			continue
+		}
+		if err := checkParamValue(param, value); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", kind, name, err)
+		}
+		params[param.Name] = value
+	}
+	return params, nil
+}
+
+// SortStrategyRegistration returns the registered sort method called name.
+func SortStrategyRegistration(name string) (SortRegistration, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, registration := range registry.sorts {
+		if registration.Name == name {
+			return registration, true
+		}
+	}
+	return SortRegistration{}, false
+}
+
+// BucketStrategyRegistration returns the registered bucket strategy called
+// name.
+func BucketStrategyRegistration(name string) (BucketRegistration, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+	for _, registration := range registry.buckets {
+		if registration.Name == name {
+			return registration, true
+		}
+	}
+	return BucketRegistration{}, false
+}
+
+// SortRegistrations returns every registered sort method in registration
+// order.
+func SortRegistrations() []SortRegistration {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]SortRegistration(nil), registry.sorts...)
+}
+
+// BucketRegistrations returns every registered bucket strategy in
+// registration order.
+func BucketRegistrations() []BucketRegistration {
+	registry.RLock()
+	defer registry.RUnlock()
+	return append([]BucketRegistration(nil), registry.buckets...)
+}
+
+// SortMethodUsage lists the registered sort methods for the -m help text.
+func SortMethodUsage() string {
+	var options []string
+	for _, registration := range SortRegistrations() {
+		options = append(options, usageEntry(registration.Name, registration.Description, registration.Params))
+	}
+	return "Options: " + strings.Join(options, "; ")
+}
+
+// BucketStrategyUsage lists auto and the registered bucket strategies for the
+// -bucket help text.
+func BucketStrategyUsage() string {
+	options := []string{DefaultBucketStrategy + ": default bucket strategy for the sort method"}
+	for _, registration := range BucketRegistrations() {
+		options = append(options, usageEntry(registration.Name, registration.Description, registration.Params))
+	}
+	return "Options: " + strings.Join(options, "; ")
+}
+
+func usageEntry(name string, description string, params []StrategyParam) string {
+	entry := name + ": " + description
+	if len(params) > 0 {
+		var names []string
+		for _, param := range params {
+			names = append(names, paramUsage(param))
+		}
+		entry += " [params: " + strings.Join(names, ", ") + "]"
+	}
+	return entry
+}
+
+func paramUsage(param StrategyParam) string {
+	usage := param.Name + " " + param.Type
+	if param.Default != "" {
+		usage += "=" + param.Default
+	}
+	if param.Description != "" {
+		usage += " (" + param.Description + ")"
+	}
+	return usage
+}
+
+// ParseStrategyParams parses a comma-separated "name=value" list, as given to
+// -sortParam and -bucketParam.
+func ParseStrategyParams(value string) (map[string]string, error) {
+	params := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, paramValue, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("parameter %q must be name=value", item)
+		}
+		if _, seen := params[name]; seen {
+			return nil, fmt.Errorf("parameter %q given more than once", name)
+		}
+		params[name] = strings.TrimSpace(paramValue)
+	}
+	return params, nil
+}
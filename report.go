@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	fastq "squish/fastq"
+	_sort "squish/sort"
 	"strings"
 )
 
@@ -28,6 +30,106 @@ type BucketReport struct {
 	Used       int    `json:"used"`
 	TempDir    string `json:"temp_dir,omitempty"`
 	OrderedFor bool   `json:"ordered_for_sorter"`
+	Split      int    `json:"split,omitempty"`
+}
+
+// ClumpAutoReport records the clump parameters chosen by -clumpK auto and the
+// read sample they were derived from.
+type ClumpAutoReport struct {
+	KmerLength int                   `json:"kmer_length"`
+	Border     int                   `json:"border"`
+	Sample     fastq.ReadSampleStats `json:"sample"`
+}
+
+// DedupeReport records the duplicate detection settings and counts. The
+// duplicate rate is relative to the input read count; Removed is the number
+// of reads dropped from the output in remove mode.
+type DedupeReport struct {
+	Mode              string  `json:"mode"`
+	Mismatches        int     `json:"mismatches"`
+	OpticalDistance   int     `json:"optical_distance,omitempty"`
+	Duplicates        int     `json:"duplicates"`
+	OpticalDuplicates int     `json:"optical_duplicates"`
+	DuplicateRate     float64 `json:"duplicate_rate"`
+	Removed           int     `json:"removed"`
+}
+
+// CorrectionReport records the clump error-correction thresholds and how many
+// bases and reads they changed.
+type CorrectionReport struct {
+	MinDepth       int `json:"min_depth"`
+	MinQuality     int `json:"min_quality"`
+	CorrectedBases int `json:"corrected_bases"`
+	CorrectedReads int `json:"corrected_reads"`
+}
+
+// HeaderOrderReport records the header tie-break of the clump sort and the
+// header bytes it lets gzip reuse. Tie groups are runs of adjacent reads with
+// the same sequence; the shared prefix bytes count the header bytes of each
+// group member that repeat the header before it, in the output order and in
+// the default quality order.
+type HeaderOrderReport struct {
+	Mode                     string  `json:"mode"`
+	TieGroups                int     `json:"tie_groups"`
+	TieReads                 int     `json:"tie_reads"`
+	HeaderBytes              int     `json:"header_bytes"`
+	SharedPrefixBytes        int     `json:"shared_prefix_bytes"`
+	DefaultSharedPrefixBytes int     `json:"default_shared_prefix_bytes"`
+	SavedBytes               int     `json:"saved_bytes"`
+	SavedRatio               float64 `json:"saved_ratio"`
+}
+
+// ReferenceReport describes the reference index used by the reference sort
+// method.
+type ReferenceReport struct {
+	Path        string `json:"path"`
+	KmerLength  int    `json:"kmer_length"`
+	Stride      int    `json:"stride"`
+	Contigs     int    `json:"contigs"`
+	Length      int    `json:"length"`
+	UniqueKmers int    `json:"unique_kmers"`
+}
+
+// KeyCommandReport records the key command of the command sort method and
+// the number of keys it printed.
+type KeyCommandReport struct {
+	Command []string `json:"command"`
+	Keys    int      `json:"keys"`
+}
+
+// DemuxReport records the sample sheet of a demultiplexed run and the reads
+// of each sample. The last sample is the undetermined reads, written to the
+// main output.
+type DemuxReport struct {
+	SampleSheet string              `json:"sample_sheet"`
+	Mismatches  int                 `json:"mismatches"`
+	Tag         string              `json:"tag"`
+	Samples     []DemuxSampleReport `json:"samples"`
+}
+
+// DemuxSampleReport records one demultiplexed sample. Written is lower than
+// Reads when duplicates were removed.
+type DemuxSampleReport struct {
+	Name          string       `json:"name"`
+	Index         string       `json:"index,omitempty"`
+	Index2        string       `json:"index2,omitempty"`
+	Reads         int          `json:"reads"`
+	Written       int          `json:"written"`
+	Output        FileReport   `json:"output"`
+	OrderFile     FileReport   `json:"order_file"`
+	PairedOutputs []FileReport `json:"paired_outputs,omitempty"`
+}
+
+// AbundanceReport records the abundance count pass. Sequences lists the
+// sequences seen at least twice in output order, with their exact counts,
+// and is truncated to the most abundant clusters on large libraries.
+type AbundanceReport struct {
+	Mismatches int                 `json:"mismatches"`
+	Uniques    int                 `json:"uniques"`
+	Singletons int                 `json:"singletons"`
+	Clusters   int                 `json:"clusters"`
+	Sequences  []_sort.UniqueCount `json:"sequences"`
+	Truncated  bool                `json:"truncated,omitempty"`
 }
 
 type PairedReport struct {
@@ -36,6 +138,7 @@ type PairedReport struct {
 	Reads             int        `json:"reads"`
 	UncompressedBytes int        `json:"uncompressed_bytes"`
 	OutputSizeBytes   int64      `json:"output_size_bytes"`
+	FlippedReads      int        `json:"flipped_reads"`
 }
 
 type Report struct {
@@ -46,22 +149,46 @@ type Report struct {
 	DurationMilliseconds int64          `json:"duration_ms"`
 	SortMethod           string         `json:"sort_method"`
 	SortDescription      string         `json:"sort_description"`
+	SortKey              string         `json:"sort_key,omitempty"`
 	SortEngine           string         `json:"sort_engine"`
 	ClumpKmerLength      int            `json:"clump_kmer_length"`
+	ClumpSeed            string         `json:"clump_seed,omitempty"`
+	ClumpMinimizerWindow int            `json:"clump_minimizer_window,omitempty"`
+	LongRead             bool           `json:"long_read,omitempty"`
+	MaxBucketBytes       int64          `json:"max_bucket_bytes,omitempty"`
+	KeyTrim5             int            `json:"key_trim5,omitempty"`
+	KeyTrim3             int            `json:"key_trim3,omitempty"`
+	BarcodeTag           string         `json:"barcode_tag,omitempty"`
+	UMITag               string         `json:"umi_tag,omitempty"`
 	Input                FileReport     `json:"input"`
 	Output               FileReport     `json:"output"`
 	OrderFile            FileReport     `json:"order_file"`
 	ReportFile           FileReport     `json:"report_file"`
 	ManifestFile         FileReport     `json:"manifest_file"`
 	PairedOutputs        []PairedReport `json:"paired_outputs,omitempty"`
+	PairedRComp          string         `json:"paired_rcomp,omitempty"`
+	FlippedPairs         int            `json:"flipped_pairs"`
 	Profile              ProfileReport  `json:"profile"`
 	Bucket               *BucketReport  `json:"bucket,omitempty"`
 	Reads                int            `json:"reads"`
+	FlippedReads         int            `json:"flipped_reads"`
 	UncompressedBytes    int            `json:"uncompressed_bytes"`
 	OutputSizeBytes      int64          `json:"output_size_bytes"`
 	SizeDifferenceBytes  int64          `json:"size_difference_bytes"`
 	CompressionRatio     float64        `json:"compression_ratio"`
 	SizeReductionRatio   float64        `json:"size_reduction_ratio"`
+
+	// Parameters and sections of the sort methods and options that use them.
+	SortParams   map[string]string  `json:"sort_params,omitempty"`
+	BucketParams map[string]string  `json:"bucket_params,omitempty"`
+	ClumpAuto    *ClumpAutoReport   `json:"clump_auto,omitempty"`
+	Dedupe       *DedupeReport      `json:"dedupe,omitempty"`
+	Correction   *CorrectionReport  `json:"correction,omitempty"`
+	HeaderOrder  *HeaderOrderReport `json:"header_order,omitempty"`
+	Reference    *ReferenceReport   `json:"reference,omitempty"`
+	Abundance    *AbundanceReport   `json:"abundance,omitempty"`
+	KeyCommand   *KeyCommandReport  `json:"key_command,omitempty"`
+	Demux        *DemuxReport       `json:"demux,omitempty"`
 }
 
 func WriteReport(report Report, reportPath string) error {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	_sort "squish/sort"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
@@ -26,6 +27,32 @@ func Run(ctx context.Context, config Config) (Result, error) {
 
 	config.InputFileSize = LogFileSize(config.InputFilepath, "Input")
 
+	var clumpAutoReport *ClumpAutoReport
+	if config.ClumpAutoK {
+		config, sortDefinition, clumpAutoReport, err = selectClumpParams(config)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if abundanceSorter, ok := sortDefinition.Strategy.(_sort.AbundanceSort); ok {
+		sortDefinition, err = countAbundance(config, sortDefinition, abundanceSorter)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if _, ok := sortDefinition.Strategy.(_sort.CommandKeySort); ok {
+		sortDefinition, err = runKeyCommand(config, sortDefinition)
+		if err != nil {
+			return Result{}, err
+		}
+		keys := sortDefinition.Strategy.(_sort.CommandKeySort).Keys
+		defer func() {
+			if err := keys.Close(); err != nil {
+				slog.Debug("could not remove key command sidecar", "error", err)
+			}
+		}()
+	}
+
 	cpuFile, memFile, err := startProfiling(config.CPUProfilePath, config.MemProfilePath)
 	if err != nil {
 		return Result{}, err
@@ -48,6 +75,11 @@ func Run(ctx context.Context, config Config) (Result, error) {
 	if err != nil {
 		return Result{}, err
 	}
+	if commandSorter, ok := sortDefinition.Strategy.(_sort.CommandKeySort); ok {
+		if err := commandSorter.Keys.Err(); err != nil {
+			return Result{}, err
+		}
+	}
 
 	pairedStats, err := RunPairedReorders(config, runStats.Reads)
 	if err != nil {
@@ -57,29 +89,120 @@ func Run(ctx context.Context, config Config) (Result, error) {
 	timeStop := time.Now()
 	timeDuration := timeStop.Sub(config.TimeStart)
 	outputFileSize := LogFileSize(config.OutputFilepath, "Output")
-	sizeDifference := config.InputFileSize - outputFileSize
+	var demuxReport *DemuxReport
+	totalOutputSize := outputFileSize
+	if config.Demultiplexer != nil {
+		demuxReport, err = buildDemuxReport(config, runStats.Samples, outputFileSize)
+		if err != nil {
+			return Result{}, err
+		}
+		// The sample outputs hold the input reads along with the main output,
+		// so the compression figures cover all of them.
+		for _, sample := range demuxReport.Samples[:len(config.DemuxOutputs)] {
+			totalOutputSize += sample.Output.SizeBytes
+		}
+	}
+	sizeDifference := config.InputFileSize - totalOutputSize
 	compressionRatio := 0.0
 	sizeReductionRatio := 0.0
 	if config.InputFileSize > 0 {
-		compressionRatio = float64(outputFileSize) / float64(config.InputFileSize)
+		compressionRatio = float64(totalOutputSize) / float64(config.InputFileSize)
 		sizeReductionRatio = float64(sizeDifference) / float64(config.InputFileSize)
 	}
 
 	var bucketReport *BucketReport
 	if config.SortEngine == "external" {
-		bucketer, err := GetBucketStrategy(config, sortDefinition)
-		if err != nil {
-			return Result{}, err
-		}
 		bucketReport = &BucketReport{
 			Strategy:   runStats.BucketName,
 			Count:      runStats.BucketCount,
 			Used:       runStats.BucketsUsed,
 			TempDir:    runStats.BucketTempDir,
-			OrderedFor: bucketer.OrderedFor(sortDefinition.Strategy),
+			OrderedFor: runStats.BucketOrdered,
+			Split:      runStats.BucketsSplit,
+		}
+	}
+
+	var dedupeReport *DedupeReport
+	if config.Dedupe != "off" {
+		dedupeReport = &DedupeReport{
+			Mode:              config.Dedupe,
+			Mismatches:        config.DedupeMismatches,
+			OpticalDistance:   config.DedupeOpticalDistance,
+			Duplicates:        runStats.Duplicates.Duplicates,
+			OpticalDuplicates: runStats.Duplicates.OpticalDuplicates,
+		}
+		if runStats.Reads > 0 {
+			dedupeReport.DuplicateRate = float64(runStats.Duplicates.Duplicates) / float64(runStats.Reads)
+		}
+		if config.Dedupe == "remove" {
+			dedupeReport.Removed = runStats.Duplicates.Duplicates
+		}
+		slog.Info("duplicates detected", "mode", config.Dedupe, "duplicates", dedupeReport.Duplicates, "optical", dedupeReport.OpticalDuplicates, "rate", dedupeReport.DuplicateRate)
+	}
+
+	var correctionReport *CorrectionReport
+	if config.ClumpCorrect {
+		correctionReport = &CorrectionReport{
+			MinDepth:       config.ClumpCorrectMinDepth,
+			MinQuality:     config.ClumpCorrectMinQual,
+			CorrectedBases: runStats.Corrections.Bases,
+			CorrectedReads: runStats.Corrections.Reads,
+		}
+		slog.Info("clump error correction", "bases", correctionReport.CorrectedBases, "reads", correctionReport.CorrectedReads)
+	}
+
+	var headerOrderReport *HeaderOrderReport
+	if config.HeaderOrder != "off" {
+		headers := runStats.Headers
+		headerOrderReport = &HeaderOrderReport{
+			Mode:                     config.HeaderOrder,
+			TieGroups:                headers.Groups,
+			TieReads:                 headers.Reads,
+			HeaderBytes:              headers.HeaderBytes,
+			SharedPrefixBytes:        headers.SharedBytes,
+			DefaultSharedPrefixBytes: headers.DefaultSharedBytes,
+			SavedBytes:               headers.SharedBytes - headers.DefaultSharedBytes,
+		}
+		if headers.HeaderBytes > 0 {
+			headerOrderReport.SavedRatio = float64(headerOrderReport.SavedBytes) / float64(headers.HeaderBytes)
+		}
+		slog.Info("header tie-break", "mode", config.HeaderOrder, "tie_groups", headers.Groups, "shared_prefix_bytes", headers.SharedBytes, "saved_bytes", headerOrderReport.SavedBytes)
+	}
+
+	var referenceReport *ReferenceReport
+	if referenceSorter, ok := sortDefinition.Strategy.(_sort.ReferenceSort); ok && referenceSorter.Index != nil {
+		index := referenceSorter.Index
+		referenceReport = &ReferenceReport{
+			Path:        config.ReferenceFasta,
+			KmerLength:  index.K,
+			Stride:      index.Stride,
+			Contigs:     len(index.Contigs),
+			Length:      index.Length,
+			UniqueKmers: index.UniqueKmers(),
 		}
 	}
 
+	var keyCommandReport *KeyCommandReport
+	if commandSorter, ok := sortDefinition.Strategy.(_sort.CommandKeySort); ok && commandSorter.Keys != nil {
+		keyCommandReport = &KeyCommandReport{
+			Command: config.KeyCommand,
+			Keys:    commandSorter.Keys.Reads,
+		}
+	}
+
+	var abundanceReport *AbundanceReport
+	if abundanceSorter, ok := sortDefinition.Strategy.(_sort.AbundanceSort); ok && abundanceSorter.Table != nil {
+		table := abundanceSorter.Table
+		abundanceReport = &AbundanceReport{
+			Mismatches: table.Mismatches,
+			Uniques:    table.Uniques,
+			Singletons: table.Singletons,
+			Clusters:   table.Clusters(),
+			Sequences:  table.Counts(_sort.DefaultAbundanceReportLimit),
+		}
+		abundanceReport.Truncated = len(abundanceReport.Sequences) < table.Uniques-table.Singletons
+	}
+
 	outputAbsolutePath, err := AbsolutePath(config.OutputFilepath)
 	if err != nil {
 		return Result{}, err
@@ -108,8 +231,21 @@ func Run(ctx context.Context, config Config) (Result, error) {
 			Reads:             pairedStat.Reads,
 			UncompressedBytes: pairedStat.UncompressedBytes,
 			OutputSizeBytes:   pairedStat.OutputSizeBytes,
+			FlippedReads:      pairedStat.FlippedReads,
 		})
 	}
+	for _, output := range config.DemuxOutputs {
+		manifestOutputPaths = append(manifestOutputPaths, output.OutputFilepath)
+		manifestOutputPaths = append(manifestOutputPaths, output.PairedOutputFilepaths...)
+	}
+	// In mate mode every companion follows the primary flips, so the first
+	// companion's count is the number of pairs flipped together.
+	flippedPairs := 0
+	pairedRComp := ""
+	if len(pairedStats) > 0 {
+		flippedPairs = pairedStats[0].FlippedReads
+		pairedRComp = config.PairedRComp
+	}
 	if err := WriteManifest(manifestOutputPaths, config.ManifestFilename); err != nil {
 		return Result{}, err
 	}
@@ -123,8 +259,20 @@ func Run(ctx context.Context, config Config) (Result, error) {
 		DurationMilliseconds: timeDuration.Milliseconds(),
 		SortMethod:           sortDefinition.CLIArg,
 		SortDescription:      sortDefinition.Description,
+		SortKey:              config.SortKey,
+		SortParams:           config.SortParams,
+		BucketParams:         config.BucketParams,
 		SortEngine:           config.SortEngine,
 		ClumpKmerLength:      config.ClumpKmerLen,
+		ClumpSeed:            config.ClumpSeed,
+		ClumpAuto:            clumpAutoReport,
+		ClumpMinimizerWindow: config.ClumpMinimizerWindow,
+		LongRead:             config.LongRead,
+		MaxBucketBytes:       config.MaxBucketBytes,
+		KeyTrim5:             config.KeyTrim5,
+		KeyTrim3:             config.KeyTrim3,
+		BarcodeTag:           config.BarcodeTag,
+		UMITag:               config.UMITag,
 		Input: FileReport{
 			Path:      config.InputFilepath,
 			SizeBytes: config.InputFileSize,
@@ -148,11 +296,21 @@ func Run(ctx context.Context, config Config) (Result, error) {
 			SizeHuman: bytefmt.ByteSize(uint64(manifestFileSize)),
 		},
 		PairedOutputs:       pairedReports,
+		PairedRComp:         pairedRComp,
+		FlippedPairs:        flippedPairs,
 		Profile:             ProfileReport{Directory: config.ProfileDir, CPUPath: config.CPUProfilePath, MemPath: config.MemProfilePath},
 		Bucket:              bucketReport,
+		Dedupe:              dedupeReport,
+		Correction:          correctionReport,
+		HeaderOrder:         headerOrderReport,
+		Reference:           referenceReport,
+		Abundance:           abundanceReport,
+		KeyCommand:          keyCommandReport,
+		Demux:               demuxReport,
 		Reads:               runStats.Reads,
+		FlippedReads:        runStats.FlippedReads,
 		UncompressedBytes:   runStats.Bytes,
-		OutputSizeBytes:     outputFileSize,
+		OutputSizeBytes:     totalOutputSize,
 		SizeDifferenceBytes: sizeDifference,
 		CompressionRatio:    compressionRatio,
 		SizeReductionRatio:  sizeReductionRatio,
@@ -164,3 +322,65 @@ func Run(ctx context.Context, config Config) (Result, error) {
 	slog.Debug("size reduced", "bytes", bytefmt.ByteSize(uint64(sizeDifference)), "ratio", sizeReductionRatio, "duration", timeDuration)
 	return Result{Report: report}, nil
 }
+
+// buildDemuxReport reports the reads and outputs of every demultiplexed
+// sample, followed by the undetermined reads in the main output.
+func buildDemuxReport(config Config, samples []_sort.SampleStats, outputFileSize int64) (*DemuxReport, error) {
+	if len(samples) != len(config.DemuxOutputs)+1 {
+		return nil, fmt.Errorf("got read counts for %d samples, want %d", len(samples), len(config.DemuxOutputs)+1)
+	}
+	report := &DemuxReport{
+		SampleSheet: config.DemuxSampleSheet,
+		Mismatches:  config.Demultiplexer.Mismatches,
+		Tag:         config.Demultiplexer.Tag.Spec,
+	}
+	for i, output := range config.DemuxOutputs {
+		sampleReport, err := demuxSampleReport(samples[i], output.OutputFilepath, output.OrderFilename, output.PairedOutputFilepaths)
+		if err != nil {
+			return nil, err
+		}
+		sampleReport.Index, sampleReport.Index2 = output.Sample.Index, output.Sample.Index2
+		report.Samples = append(report.Samples, sampleReport)
+	}
+	undetermined, err := demuxSampleReport(samples[len(samples)-1], config.OutputFilepath, config.OrderFilename, config.PairedOutputFilepaths)
+	if err != nil {
+		return nil, err
+	}
+	report.Samples = append(report.Samples, undetermined)
+	for _, sample := range report.Samples {
+		slog.Info("demultiplexed sample", "sample", sample.Name, "reads", sample.Reads, "written", sample.Written, "output", sample.Output.Path, "size", sample.Output.SizeHuman)
+	}
+	return report, nil
+}
+
+func demuxSampleReport(stats _sort.SampleStats, outputPath string, orderPath string, pairedOutputPaths []string) (DemuxSampleReport, error) {
+	absolutePath, err := AbsolutePath(outputPath)
+	if err != nil {
+		return DemuxSampleReport{}, err
+	}
+	outputSize := LogFileSize(outputPath, "Sample output")
+	report := DemuxSampleReport{
+		Name:    stats.Name,
+		Reads:   stats.Reads,
+		Written: stats.Written,
+		Output: FileReport{
+			Path:      absolutePath,
+			SizeBytes: outputSize,
+			SizeHuman: bytefmt.ByteSize(uint64(outputSize)),
+		},
+		OrderFile: FileReport{Path: orderPath},
+	}
+	for _, pairedOutputPath := range pairedOutputPaths {
+		pairedAbsolutePath, err := AbsolutePath(pairedOutputPath)
+		if err != nil {
+			return DemuxSampleReport{}, err
+		}
+		pairedSize := LogFileSize(pairedOutputPath, "Sample paired output")
+		report.PairedOutputs = append(report.PairedOutputs, FileReport{
+			Path:      pairedAbsolutePath,
+			SizeBytes: pairedSize,
+			SizeHuman: bytefmt.ByteSize(uint64(pairedSize)),
+		})
+	}
+	return report, nil
+}
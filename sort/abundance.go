@@ -0,0 +1,375 @@
+package sort
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	go_sort "sort"
+
+	fastq "squish/fastq"
+	_io "squish/fastqio"
+)
+
+// DefaultAbundanceReportLimit caps the unique sequences listed in a summary.
+const DefaultAbundanceReportLimit = 1000
+
+// unclusteredRank is the cluster rank of sequences missing from an abundance
+// table that are not a near variant of any sequence in it. They sort last.
+const unclusteredRank = math.MaxInt
+
+// AbundanceTable holds exact sequence counts and groups each sequence with
+// its most abundant near variant, in the spirit of amplicon denoisers.
+//
+// Sequences are ranked by count, most frequent first, ties broken
+// alphabetically. A sequence within Mismatches substitutions of a more
+// abundant sequence of the same length joins that sequence's cluster;
+// otherwise it starts a new cluster. Clusters are ordered by the rank of the
+// sequence that started them.
+//
+// A table built by CountAbundance only stores sequences seen at least twice.
+// Sequences missing from it count as singletons and still join the cluster of
+// a stored near variant, so the order matches a table holding every sequence.
+type AbundanceTable struct {
+	Reads      int // reads counted
+	Uniques    int // distinct sequences, singletons included
+	Singletons int // sequences seen exactly once
+	Mismatches int
+
+	uniques  []abundanceUnique // stored sequences in rank order
+	entries  map[string]int    // sequence -> index in uniques
+	segments map[abundanceSegment][]int
+	clusters int
+}
+
+type abundanceUnique struct {
+	sequence string
+	count    int
+	cluster  int // rank of the cluster, not an index into uniques
+	variant  bool
+}
+
+// abundanceSegment is one of the Mismatches+1 pieces of a sequence. Two
+// equal-length sequences within Mismatches substitutions share at least one
+// piece exactly, so candidates are found without comparing every pair.
+type abundanceSegment struct {
+	length int
+	piece  int
+	bases  string
+}
+
+// NewAbundanceTable ranks and clusters counts, a map from sequence to count.
+// Counts below 1 are ignored.
+func NewAbundanceTable(counts map[string]int, mismatches int) *AbundanceTable {
+	if mismatches < 0 {
+		mismatches = 0
+	}
+	table := &AbundanceTable{
+		Mismatches: mismatches,
+		entries:    make(map[string]int, len(counts)),
+		segments:   map[abundanceSegment][]int{},
+	}
+	for sequence, count := range counts {
+		if count < 1 {
+			continue
+		}
+		table.uniques = append(table.uniques, abundanceUnique{sequence: sequence, count: count})
+		table.Reads += count
+		table.Uniques++
+		if count == 1 {
+			table.Singletons++
+		}
+	}
+	go_sort.Slice(table.uniques, func(i, j int) bool {
+		a, b := table.uniques[i], table.uniques[j]
+		if a.count != b.count {
+			return a.count > b.count
+		}
+		return a.sequence < b.sequence
+	})
+
+	for i := range table.uniques {
+		unique := &table.uniques[i]
+		table.entries[unique.sequence] = i
+		if parent, ok := table.parent(unique.sequence, unique.count); ok {
+			unique.cluster = table.uniques[parent].cluster
+			unique.variant = true
+		} else {
+			unique.cluster = table.clusters
+			table.clusters++
+		}
+		table.addSegments(i)
+	}
+	return table
+}
+
+// NewAbundanceTableFromReads counts the sequences of reads exactly.
+func NewAbundanceTableFromReads(reads []fastq.FastqRead, mismatches int) *AbundanceTable {
+	counts := map[string]int{}
+	for _, read := range reads {
+		counts[string(read.Sequence())]++
+	}
+	return NewAbundanceTable(counts, mismatches)
+}
+
+// CountAbundance is the bounded-memory count pass for AbundanceSort. Reads are
+// streamed into hash buckets keyed on the exact sequence under tempDir, so
+// every copy of a sequence shares a bucket, and each bucket is then counted on
+// its own. Memory is bounded by the largest bucket plus the sequences seen at
+// least twice, which are the only ones kept. tempDir is removed afterwards.
+func CountAbundance(inputPath string, delim byte, tempDir string, bucketCount int, mismatches int) (*AbundanceTable, error) {
+	if err := os.RemoveAll(tempDir); err != nil {
+		return nil, fmt.Errorf("clean abundance temp dir: %w", err)
+	}
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("create abundance temp dir: %w", err)
+	}
+	reader, err := _io.OpenReader(inputPath)
+	if err != nil {
+		return nil, err
+	}
+	bucketer := NewSequenceHashBuckets(bucketCount)
+	paths, orderPaths, _, _, _, err := partitionRecords(reader, nil, nil, tempDir, delim, bucketer.BucketCount(), bucketer.BucketID)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	repeated := map[string]int{}
+	reads, uniques, singletons := 0, 0, 0
+	for bucketID := 0; bucketID < bucketer.BucketCount(); bucketID++ {
+		path, ok := paths[bucketID]
+		if !ok {
+			continue
+		}
+		bucketReads, err := loadBucket(path, orderPaths[bucketID], delim)
+		if err != nil {
+			return nil, err
+		}
+		counts := map[string]int{}
+		for _, read := range bucketReads {
+			counts[string(read.Sequence())]++
+		}
+		for sequence, count := range counts {
+			if count > 1 {
+				repeated[sequence] = count
+			} else {
+				singletons++
+			}
+		}
+		reads += len(bucketReads)
+		uniques += len(counts)
+		if err := removeBucketFiles(path, orderPaths[bucketID]); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.RemoveAll(tempDir); err != nil {
+		return nil, fmt.Errorf("remove abundance temp dir: %w", err)
+	}
+
+	table := NewAbundanceTable(repeated, mismatches)
+	table.Reads, table.Uniques, table.Singletons = reads, uniques, singletons
+	slog.Debug("abundance counted", "reads", reads, "uniques", uniques, "singletons", singletons, "clusters", table.clusters)
+	return table, nil
+}
+
+// NewSequenceHashBuckets creates hash buckets keyed on the exact sequence, so
+// all copies of a sequence share a bucket and per-bucket counts are exact.
+func NewSequenceHashBuckets(bucketCount int) HashBuckets {
+	return newHashBuckets("sequence-hash", bucketCount, func(read fastq.FastqRead) []byte {
+		return read.Sequence()
+	})
+}
+
+func (t *AbundanceTable) addSegments(i int) {
+	if t.Mismatches == 0 {
+		return
+	}
+	sequence := t.uniques[i].sequence
+	t.forEachSegment(sequence, func(segment abundanceSegment) {
+		t.segments[segment] = append(t.segments[segment], i)
+	})
+}
+
+func (t *AbundanceTable) forEachSegment(sequence string, fn func(abundanceSegment)) {
+	pieces := t.Mismatches + 1
+	if len(sequence) < pieces {
+		return
+	}
+	for piece := 0; piece < pieces; piece++ {
+		start, end := piece*len(sequence)/pieces, (piece+1)*len(sequence)/pieces
+		fn(abundanceSegment{length: len(sequence), piece: piece, bases: sequence[start:end]})
+	}
+}
+
+// parent returns the highest-ranked stored sequence with a count above count
+// that is within Mismatches substitutions of sequence.
+func (t *AbundanceTable) parent(sequence string, count int) (int, bool) {
+	best := -1
+	t.forEachSegment(sequence, func(segment abundanceSegment) {
+		for _, candidate := range t.segments[segment] {
+			if best >= 0 && candidate >= best {
+				break
+			}
+			if t.uniques[candidate].count <= count {
+				break
+			}
+			if withinMismatches([]byte(sequence), []byte(t.uniques[candidate].sequence), t.Mismatches) {
+				best = candidate
+				break
+			}
+		}
+	})
+	return best, best >= 0
+}
+
+// Clusters returns the number of clusters among the stored sequences.
+func (t *AbundanceTable) Clusters() int {
+	if t == nil {
+		return 0
+	}
+	return t.clusters
+}
+
+// abundanceKey is the sort key of one read: cluster rank, then count, most
+// frequent first, then sequence.
+type abundanceKey struct {
+	cluster int
+	count   int
+}
+
+func (t *AbundanceTable) key(sequence []byte) abundanceKey {
+	if i, ok := t.entries[string(sequence)]; ok {
+		return abundanceKey{cluster: t.uniques[i].cluster, count: t.uniques[i].count}
+	}
+	if parent, ok := t.parent(string(sequence), 1); ok {
+		return abundanceKey{cluster: t.uniques[parent].cluster, count: 1}
+	}
+	return abundanceKey{cluster: unclusteredRank, count: 1}
+}
+
+// UniqueCount is one stored sequence of an abundance table.
+type UniqueCount struct {
+	Sequence string `json:"sequence"`
+	Count    int    `json:"count"`
+	Cluster  int    `json:"cluster"`
+	Variant  bool   `json:"variant,omitempty"`
+}
+
+// Counts returns up to limit stored sequences in output order: by cluster,
+// then by count. A limit < 1 returns all of them.
+func (t *AbundanceTable) Counts(limit int) []UniqueCount {
+	if t == nil {
+		return nil
+	}
+	counts := make([]UniqueCount, len(t.uniques))
+	for i, unique := range t.uniques {
+		counts[i] = UniqueCount{Sequence: unique.sequence, Count: unique.count, Cluster: unique.cluster, Variant: unique.variant}
+	}
+	go_sort.SliceStable(counts, func(i, j int) bool { return counts[i].Cluster < counts[j].Cluster })
+	if limit > 0 && len(counts) > limit {
+		counts = counts[:limit]
+	}
+	return counts
+}
+
+// AbundanceSort orders reads by the abundance of their exact sequence, most
+// frequent first, with the near variants of each sequence right after it.
+// Amplicon and 16S libraries are dominated by copies of a few hundred
+// sequences, so this puts identical records back to back and keeps the order
+// easy to read. Copies of one sequence keep their input order.
+//
+// Table, when set, supplies the counts, as CountAbundance does for the
+// external engine; otherwise Sort counts the reads it is given. Mismatches
+// sets the variant distance of that local table.
+type AbundanceSort struct {
+	Table      *AbundanceTable
+	Mismatches int
+}
+
+func (AbundanceSort) Name() string { return "abundance" }
+
+// Less needs a table; without one it falls back to sequence order, because
+// counts are only known for a whole set of reads.
+func (s AbundanceSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	if s.Table == nil {
+		return AlphaSort{}.Less(a, b)
+	}
+	return abundanceReadLess(a, s.Table.key(a.Sequence()), b, s.Table.key(b.Sequence()))
+}
+
+// SortKeys looks up every read's cluster and count once, counting the reads
+// first when no table is set.
+func (s AbundanceSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	table := s.Table
+	if table == nil {
+		table = NewAbundanceTableFromReads(reads, s.Mismatches)
+	}
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		key := table.key(read.Sequence())
+		dst = appendKeyInt(dst, key.cluster)
+		start := len(dst)
+		dst = appendKeyInt(dst, key.count)
+		invertKey(dst[start:])
+		return appendKeyBytes(dst, read.Sequence())
+	})
+}
+
+func abundanceReadLess(a fastq.FastqRead, keyA abundanceKey, b fastq.FastqRead, keyB abundanceKey) bool {
+	if keyA.cluster != keyB.cluster {
+		return keyA.cluster < keyB.cluster
+	}
+	if keyA.count != keyB.count {
+		return keyA.count > keyB.count
+	}
+	if c := bytes.Compare(a.Sequence(), b.Sequence()); c != 0 {
+		return c < 0
+	}
+	return a.I < b.I
+}
+
+// AbundanceBuckets are ordered buckets for an AbundanceSort using table. The
+// first half of the buckets holds the clusters in rank order; the second half
+// holds unclustered sequences by their first two bases. Every copy of a
+// sequence lands in one bucket, and concatenating sorted buckets gives the
+// global abundance order.
+type AbundanceBuckets struct {
+	bucketCount int
+	table       *AbundanceTable
+}
+
+// NewAbundanceBuckets creates abundance buckets. The bucket count is at
+// least 2, one for clusters and one for unclustered sequences.
+func NewAbundanceBuckets(bucketCount int, table *AbundanceTable) AbundanceBuckets {
+	if bucketCount < 2 {
+		bucketCount = 2
+	}
+	return AbundanceBuckets{bucketCount: bucketCount, table: table}
+}
+
+func (b AbundanceBuckets) Name() string { return "abundance" }
+
+func (b AbundanceBuckets) BucketCount() int { return b.bucketCount }
+
+func (b AbundanceBuckets) BucketID(read fastq.FastqRead) int {
+	clusterBuckets := b.bucketCount / 2
+	key := b.table.key(read.Sequence())
+	if key.cluster != unclusteredRank {
+		return int(int64(key.cluster) * int64(clusterBuckets) / int64(b.table.clusters))
+	}
+	prefix := 0
+	for i, base := range read.Sequence() {
+		if i == 2 {
+			break
+		}
+		prefix |= int(base) << (8 * (1 - i))
+	}
+	return clusterBuckets + prefix*(b.bucketCount-clusterBuckets)/(1<<16)
+}
+
+// OrderedFor reports true for an AbundanceSort using the same table.
+func (b AbundanceBuckets) OrderedFor(sorter SortStrategy) bool {
+	abundanceSorter, ok := sorter.(AbundanceSort)
+	return ok && abundanceSorter.Table == b.table
+}
@@ -0,0 +1,52 @@
+package sort
+
+import (
+	"math"
+
+	fastq "squish/fastq"
+)
+
+// MinAutoClumpKmerLen is the smallest k chosen by AutoClumpParams. Shorter
+// k-mers match too many unrelated loci to be useful pivots.
+const MinAutoClumpKmerLen = 12
+
+// autoClumpMinWindows is the number of pivot candidates AutoClumpParams tries
+// to leave in a short read after the border is excluded.
+const autoClumpMinWindows = 8
+
+// AutoClumpParams picks a clump k-mer length and border from sampled reads.
+//
+// Two limits are applied and the smaller wins:
+//   - error tolerance: k is capped so that a k-mer is error-free with at least
+//     50% probability at the sampled mean error rate, which keeps noisy
+//     long reads (ONT/PacBio) from never sharing an exact pivot.
+//   - read length: the 10th-percentile read must still contain
+//     autoClumpMinWindows candidate windows. If that would push k below
+//     MinAutoClumpKmerLen, the border is dropped first.
+//
+// The result never exceeds DefaultClumpKmerLen, so clean Illumina data keeps
+// the usual k=31, border=1.
+func AutoClumpParams(stats fastq.ReadSampleStats) (k int, border int) {
+	k = DefaultClumpKmerLen
+	border = DefaultClumpBorder
+	if stats.Reads == 0 {
+		return k, border
+	}
+	if e := stats.MeanErrorRate; e > 0 && e < 1 {
+		if errorK := int(math.Log(0.5) / math.Log(1-e)); errorK < k {
+			k = errorK
+		}
+	}
+	lengthK := stats.P10Length - 2*border - (autoClumpMinWindows - 1)
+	if lengthK < MinAutoClumpKmerLen {
+		border = 0
+		lengthK = stats.P10Length - (autoClumpMinWindows - 1)
+	}
+	if lengthK < k {
+		k = lengthK
+	}
+	if k < MinAutoClumpKmerLen {
+		k = MinAutoClumpKmerLen
+	}
+	return k, border
+}
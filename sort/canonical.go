@@ -0,0 +1,72 @@
+package sort
+
+import (
+	"bytes"
+
+	fastq "squish/fastq"
+)
+
+// canonicalSequence returns the smaller of sequence and its reverse
+// complement, and whether that is the reverse complement. Palindromes are
+// their own canonical form and are never reported as reversed. The reverse
+// complement is only built when it is the smaller one.
+func canonicalSequence(sequence []byte) ([]byte, bool) {
+	n := len(sequence)
+	for i := 0; i < n; i++ {
+		forward, reverse := sequence[i], complementBase(sequence[n-1-i])
+		if forward == reverse {
+			continue
+		}
+		if reverse < forward {
+			return reverseComplement(sequence), true
+		}
+		break
+	}
+	return sequence, false
+}
+
+// CanonicalAlphaSort orders reads by the smaller of their windowed sequence
+// and its reverse complement, so a fragment and its reverse complement sort
+// next to each other instead of in opposite parts of the file.
+//
+// With Flip set, reads whose canonical form is the reverse complement are
+// written reverse-complemented, with reversed qualities, as ClumpSort does
+// with RComp. Identical fragments from both strands then become identical
+// records.
+type CanonicalAlphaSort struct {
+	Window KeyWindow
+	Flip   bool
+}
+
+func (CanonicalAlphaSort) Name() string { return "canonical-alpha" }
+
+func (s CanonicalAlphaSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	keyA, _ := canonicalSequence(s.Window.Apply(a.Sequence()))
+	keyB, _ := canonicalSequence(s.Window.Apply(b.Sequence()))
+	if c := bytes.Compare(keyA, keyB); c != 0 {
+		return c < 0
+	}
+	return a.I < b.I
+}
+
+func (s CanonicalAlphaSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		key, _ := canonicalSequence(s.Window.Apply(read.Sequence()))
+		return appendKeyBytes(dst, key)
+	})
+}
+
+// FinishSort flips the reads whose key is their reverse complement when Flip
+// is set.
+func (s CanonicalAlphaSort) FinishSort(reads []fastq.FastqRead, _ [][]byte) {
+	if !s.Flip {
+		return
+	}
+	for i := range reads {
+		if _, reversed := canonicalSequence(s.Window.Apply(reads[i].Sequence())); reversed {
+			reads[i].OverrideSeq = reverseComplement(reads[i].Sequence())
+			reads[i].OverrideQual = reverseBytes(reads[i].QualityScores())
+			reads[i].Flipped = true
+		}
+	}
+}
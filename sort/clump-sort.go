@@ -25,11 +25,32 @@ type clumpRead struct {
 
 // ClumpSortOptions controls the behaviour of SortReadsClumpOpts.
 type ClumpSortOptions struct {
-	K        int  // k-mer length; 0 falls back to DefaultClumpKmerLen
-	MinCount int  // ignore pivot k-mers appearing fewer than MinCount times (0 = disabled)
-	RComp    bool // reverse-complement reads whose pivot was on the minus strand
-	RawPivot bool // pick the lex-max canonical k-mer instead of the max-hash k-mer
-	Border   int  // number of bases excluded from each end of the read during pivot selection
+	K             int        // k-mer length; 0 falls back to DefaultClumpKmerLen
+	MinCount      int        // ignore pivot k-mers appearing fewer than MinCount times (0 = disabled)
+	MaxCount      int        // ignore pivot k-mers appearing more than MaxCount times (0 = disabled)
+	Blacklist     KmerSet    // canonical k-mers that are never used as pivots (nil = disabled)
+	RComp         bool       // reverse-complement reads whose pivot was on the minus strand
+	RawPivot      bool       // pick the lex-max canonical k-mer instead of the max-hash k-mer
+	Border        int        // number of bases excluded from each end of the read during pivot selection
+	MinQuality    int        // skip pivot k-mers containing a base below this Phred score (0 = disabled)
+	SkipAmbiguous bool       // skip pivot k-mers containing 'N' or any other non-ACGT base
+	Window        KeyWindow  // read ends excluded from pivot selection before Border is applied
+	Seed          SpacedSeed // spaced-seed mask; when set its span replaces K
+
+	// MinimizerWindow, when > 1, restricts pivot candidates to (w,k)-minimizers
+	// with w = MinimizerWindow. Long noisy reads share most of their sampled
+	// minimizers even when many exact k-mers differ.
+	MinimizerWindow int
+	// LongRead replaces the full-sequence tertiary comparisons with read length,
+	// which keeps sorting 10-100 kb reads cheap.
+	LongRead bool
+	// HeaderOrder breaks ties between reads with the same sequence on their
+	// headers: HeaderOrderOff, HeaderOrderTokens, or HeaderOrderSimilarity.
+	HeaderOrder string
+	// Correct replaces isolated low-quality bases with the clump consensus.
+	Correct CorrectOptions
+	// Dedupe marks duplicate reads within each clump after sorting.
+	Dedupe DedupeOptions
 }
 
 // SortReadsClump sorts using default k and no extra options.
@@ -44,52 +65,163 @@ func SortReadsClumpK(reads *[]fastq.FastqRead, k int) {
 
 // SortReadsClumpOpts is the full implementation that honours all options.
 func SortReadsClumpOpts(reads *[]fastq.FastqRead, opts ClumpSortOptions) {
+	keys, rcFlipped := opts.sortKeys(*reads)
+	go_sort.Sort(clumpSorter{
+		keyedSorter: keyedSorter{reads: *reads, keys: keys, tie: func(a fastq.FastqRead, b fastq.FastqRead) int {
+			return clumpTieCompare(a, b, opts.LongRead, opts.HeaderOrder)
+		}},
+		rcFlipped: rcFlipped,
+	})
+	opts.finishSort(*reads, keys, rcFlipped)
+}
+
+// clumpSorter sorts by clump key and keeps each read's pivot strand, which is
+// not part of the key, next to its read.
+type clumpSorter struct {
+	keyedSorter
+	rcFlipped []bool
+}
+
+func (s clumpSorter) Swap(i, j int) {
+	s.keyedSorter.Swap(i, j)
+	s.rcFlipped[i], s.rcFlipped[j] = s.rcFlipped[j], s.rcFlipped[i]
+}
+
+// sortKeys encodes the pivot k-mer and pivot position of the ClumpReadLess
+// order as one key per read, followed by the read length for long reads.
+// Reads with equal keys are ordered by clumpTieCompare, so the keys never
+// copy the sequence, quality, or header bytes. It also returns whether each
+// read's pivot was on the minus strand, for finishSort.
+func (opts ClumpSortOptions) sortKeys(reads []fastq.FastqRead) ([][]byte, []bool) {
 	k := opts.K
 	if k < 1 {
 		k = DefaultClumpKmerLen
 	}
+	selector := opts.selector(pivotFilter(reads, k, opts))
+	rcFlipped := make([]bool, len(reads))
+	i := 0
+	keys := readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		var quality []byte
+		if selector.minQuality > 0 {
+			quality = read.QualityScores()
+		}
+		pivot, pos, flipped := selector.pivot(read.Sequence(), quality)
+		rcFlipped[i] = flipped
+		i++
+		dst = appendKeyBytes(dst, pivot)
+		dst = appendKeyUint(dst, uint64(pos))
+		if opts.LongRead {
+			// Read length and input order replace the sequence, quality, and
+			// header comparisons: for 50 kb reads those dominate the sort and
+			// add nothing to clump locality, because noisy long reads are
+			// almost never byte-identical.
+			dst = appendKeyUint(dst, uint64(len(read.Sequence())))
+		}
+		return dst
+	})
+	return keys, rcFlipped
+}
 
-	// Build a k-mer frequency table when mincount filtering is requested.
-	// Only k-mers appearing at least MinCount times are eligible as pivots,
-	// which avoids grouping reads by error k-mers that occur only once.
-	var eligible func([]byte) bool
-	if opts.MinCount > 1 {
-		counts := countKmers(*reads, k)
-		minCount := opts.MinCount
-		eligible = func(kmer []byte) bool {
-			return counts[string(kmer)] >= minCount
+// clumpTieCompare orders reads with the same clump key: by sequence, quality,
+// and header bytes, as ClumpReadLess does, or only by header for long reads.
+// A HeaderOrder compares headers in natural order before the quality.
+func clumpTieCompare(a fastq.FastqRead, b fastq.FastqRead, longRead bool, headerOrder string) int {
+	if !longRead {
+		if c := bytes.Compare(a.Sequence(), b.Sequence()); c != 0 {
+			return c
 		}
 	}
-
-	border := opts.Border
-	if border < 0 {
-		border = 0
+	if ordersHeaders(headerOrder) {
+		if c := NaturalCompare(a.Id(), b.Id()); c != 0 {
+			return c
+		}
+		if c := bytes.Compare(a.Id(), b.Id()); c != 0 {
+			return c
+		}
+	}
+	if longRead {
+		return 0
 	}
+	if c := bytes.Compare(a.QualityScores(), b.QualityScores()); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.Id(), b.Id())
+}
 
-	clumpReads := make([]clumpRead, len(*reads))
-	for i, read := range *reads {
-		key, pos, rcFlipped := clumpMinimizerFull(read.Sequence(), k, opts.RawPivot, eligible, border)
+// finishSort chains headers, flips, corrects, and marks duplicates in reads
+// sorted by sortKeys, recovering each read's pivot from its key.
+func (opts ClumpSortOptions) finishSort(reads []fastq.FastqRead, keys [][]byte, rcFlipped []bool) {
+	clumpReads := make([]clumpRead, len(reads))
+	for i, read := range reads {
+		pivot, rest := decodeKeyBytes(keys[i])
 		clumpReads[i] = clumpRead{
 			read:      read,
-			key:       key,
-			pivotPos:  pos,
-			rcFlipped: rcFlipped,
+			key:       pivot,
+			pivotPos:  int(decodeKeyUint(rest)),
+			rcFlipped: rcFlipped[i],
 		}
 	}
 
-	go_sort.Slice(clumpReads, func(i, j int) bool {
-		return ClumpReadLess(clumpReads[i], clumpReads[j])
-	})
-
-	for i, cr := range clumpReads {
+	// Chaining runs before flipping, while tied reads still compare by their
+	// input sequences.
+	if opts.HeaderOrder == HeaderOrderSimilarity {
+		chainHeadersBySimilarity(clumpReads)
+	}
+	for i := range clumpReads {
+		cr := &clumpReads[i]
 		if opts.RComp && cr.rcFlipped {
 			// Flip reads whose pivot was on the minus strand so all reads in a
 			// clump are in the same orientation — consecutive sequence lines
 			// become more byte-similar, increasing LZ77 back-reference density.
 			cr.read.OverrideSeq = reverseComplement(cr.read.Sequence())
 			cr.read.OverrideQual = reverseBytes(cr.read.QualityScores())
+			cr.read.Flipped = true
 		}
-		(*reads)[i] = cr.read
+	}
+	// Correction runs first so reads differing only by corrected errors are
+	// exact duplicates afterwards.
+	if opts.Correct.Enabled {
+		correctClumps(clumpReads, opts.Correct, opts.span())
+	}
+	if opts.Dedupe.Enabled {
+		markDuplicates(clumpReads, opts.Dedupe, opts.span())
+	}
+	for i, cr := range clumpReads {
+		reads[i] = cr.read
+	}
+}
+
+// pivotFilter combines the count and blacklist filters into a single eligible
+// predicate for clumpMinimizerFull. A nil result means every k-mer is eligible.
+//
+// The count filters need a frequency table over the reads being sorted: only
+// k-mers appearing at least MinCount times are eligible, which avoids grouping
+// reads by error k-mers that occur only once, and k-mers appearing more than
+// MaxCount times are skipped so repeats (adapters, rRNA, poly-G) cannot pull
+// unrelated reads into one huge clump.
+func pivotFilter(reads []fastq.FastqRead, k int, opts ClumpSortOptions) func([]byte) bool {
+	var counts map[string]int
+	if opts.MinCount > 1 || opts.MaxCount > 0 {
+		counts = countKmers(reads, k, opts.Seed)
+	}
+	blacklist := opts.Blacklist
+	if counts == nil && len(blacklist) == 0 {
+		return nil
+	}
+	minCount := opts.MinCount
+	maxCount := opts.MaxCount
+	return func(kmer []byte) bool {
+		if blacklist.Contains(kmer) {
+			return false
+		}
+		if counts == nil {
+			return true
+		}
+		count := counts[string(kmer)]
+		if minCount > 1 && count < minCount {
+			return false
+		}
+		return maxCount < 1 || count <= maxCount
 	}
 }
 
@@ -133,9 +265,92 @@ func hashKmer(kmer []byte) uint64 {
 // candidates. If no k-mer passes the filter, a nil key is returned (the read
 // sorts into an unclustered group at the front).
 func clumpMinimizerFull(sequence []byte, k int, rawPivot bool, eligible func([]byte) bool, border int) (key []byte, pos int, rcFlipped bool) {
+	return pivotSelector{k: k, rawPivot: rawPivot, eligible: eligible, border: border}.pivot(sequence, nil)
+}
+
+// pivotSelector holds the per-read pivot selection settings. The memory sort
+// and the external clump-minimizer buckets both build one from
+// ClumpSortOptions so a read gets the same pivot in either place.
+type pivotSelector struct {
+	k        int
+	rawPivot bool
+	eligible func([]byte) bool
+	border   int
+	// minQuality, when > 0, rejects k-mers containing any base whose Phred+33
+	// quality is below this score.
+	minQuality int
+	// skipAmbiguous rejects k-mers containing any base other than A, C, G, T.
+	skipAmbiguous bool
+	// window restricts the search to part of the read. Returned positions are
+	// still relative to the start of the full read.
+	window KeyWindow
+	// seed, when non-zero, builds keys from masked positions of a window
+	// whose length is the seed span; k is set to that span.
+	seed SpacedSeed
+	// minimizerWindow, when > 1, limits candidates to (w,k)-minimizers.
+	minimizerWindow int
+}
+
+// selector converts clump options into a pivotSelector using eligible as the
+// count/blacklist filter.
+func (opts ClumpSortOptions) selector(eligible func([]byte) bool) pivotSelector {
+	return pivotSelector{
+		k:             opts.span(),
+		rawPivot:      opts.RawPivot,
+		eligible:      eligible,
+		border:        opts.Border,
+		minQuality:    opts.MinQuality,
+		skipAmbiguous: opts.SkipAmbiguous,
+		window:        opts.Window,
+		seed:          opts.Seed,
+
+		minimizerWindow: opts.MinimizerWindow,
+	}
+}
+
+// span is the window length scanned for each pivot candidate: the seed span
+// for spaced seeds, otherwise K (or DefaultClumpKmerLen when unset).
+func (opts ClumpSortOptions) span() int {
+	k := opts.K
+	if k < 1 {
+		k = DefaultClumpKmerLen
+	}
+	return opts.Seed.span(k)
+}
+
+// pivot selects the pivot k-mer for one read. quality may be nil when the
+// quality filter is disabled.
+//
+// The key window is applied first. If it leaves fewer than k bases, the whole
+// read is searched instead, mirroring the Border fallback for short reads.
+func (p pivotSelector) pivot(sequence []byte, quality []byte) (key []byte, pos int, rcFlipped bool) {
+	if p.window.IsZero() {
+		return p.pivotRegion(sequence, quality)
+	}
+	start, end := p.window.Bounds(len(sequence))
+	if end-start < p.k {
+		return p.pivotRegion(sequence, quality)
+	}
+	if len(quality) == len(sequence) {
+		quality = quality[start:end]
+	}
+	key, pos, rcFlipped = p.pivotRegion(sequence[start:end], quality)
+	return key, pos + start, rcFlipped
+}
+
+// pivotRegion selects the pivot within an already windowed region.
+//
+// Sequencing errors show up as 'N' calls or low-quality bases, and a pivot
+// containing one would put the read in a clump of its own. When the quality
+// or ambiguity filter rejects every window, the read falls back to the
+// unfiltered selection so it still clusters with its neighbours instead of
+// joining the nil-key group.
+func (p pivotSelector) pivotRegion(sequence []byte, quality []byte) (key []byte, pos int, rcFlipped bool) {
+	k := p.k
 	if k < 1 {
 		k = 1
 	}
+	border := p.border
 	if border < 0 {
 		border = 0
 	}
@@ -143,47 +358,98 @@ func clumpMinimizerFull(sequence []byte, k int, rawPivot bool, eligible func([]b
 	if border > 0 && len(sequence)-2*border < k {
 		border = 0
 	}
-	if len(sequence) <= k {
+	if len(sequence) < k {
 		canon := canonicalKmer(sequence)
 		rc := reverseComplement(sequence)
 		flipped := bytes.Compare(rc, sequence) < 0
-		if eligible != nil && !eligible(canon) {
+		if p.eligible != nil && !p.eligible(canon) {
 			return nil, 0, false
 		}
 		return canon, 0, flipped
 	}
 
-	rcBuf := make([]byte, k)
-	best := make([]byte, k)
+	if badPrefix := p.badBasePrefix(sequence, quality); badPrefix != nil {
+		clean := func(i int) bool { return badPrefix[i+k] == badPrefix[i] }
+		if !p.seed.IsZero() {
+			// Only the masked positions of a spaced seed enter the key, so
+			// errors at ignored positions do not disqualify the window.
+			clean = func(i int) bool {
+				for _, offset := range p.seed.positions {
+					if badPrefix[i+offset+1] != badPrefix[i+offset] {
+						return false
+					}
+				}
+				return true
+			}
+		}
+		if key, pos, rcFlipped, ok := p.scan(sequence, k, border, clean); ok {
+			return key, pos, rcFlipped
+		}
+	}
+	key, pos, rcFlipped, ok := p.scan(sequence, k, border, nil)
+	if !ok {
+		// No eligible k-mer found — return nil key so the read sorts with
+		// other unclustered reads rather than being given an arbitrary pivot.
+		return nil, 0, false
+	}
+	return key, pos, rcFlipped
+}
+
+// badBasePrefix returns prefix counts of rejected bases, so a window [i, i+k)
+// is clean when prefix[i+k] == prefix[i]. It returns nil when no quality or
+// ambiguity filtering is configured.
+func (p pivotSelector) badBasePrefix(sequence []byte, quality []byte) []int {
+	useQuality := p.minQuality > 0 && len(quality) == len(sequence)
+	if !useQuality && !p.skipAmbiguous {
+		return nil
+	}
+	prefix := make([]int, len(sequence)+1)
+	for i, base := range sequence {
+		bad := p.skipAmbiguous && !isUnambiguousBase(base)
+		if useQuality && int(quality[i])-33 < p.minQuality {
+			bad = true
+		}
+		prefix[i+1] = prefix[i]
+		if bad {
+			prefix[i+1]++
+		}
+	}
+	return prefix
+}
+
+// scan walks every window in the border-trimmed region and returns the best
+// eligible canonical k-mer. usable, when non-nil, rejects windows before the
+// canonical form is computed.
+func (p pivotSelector) scan(sequence []byte, k int, border int, usable func(int) bool) (key []byte, pos int, rcFlipped bool, ok bool) {
+	if p.minimizerWindow > 1 {
+		usable = p.minimizerSample(sequence, k, border, usable)
+	}
+	c := newCanonicalizer(k, p.seed)
+	var best []byte
 	bestPos := -1
 	var bestHash uint64
 	bestRC := false
 
 	for i := border; i+k <= len(sequence)-border; i++ {
-		kmer := sequence[i : i+k]
-		reverseComplementInto(kmer, rcBuf)
-		thisRC := bytes.Compare(rcBuf, kmer) < 0
-		var canonical []byte
-		if thisRC {
-			canonical = rcBuf
-		} else {
-			canonical = kmer
+		if usable != nil && !usable(i) {
+			continue
 		}
-		if eligible != nil && !eligible(canonical) {
+		canonical, thisRC := c.canonical(sequence[i : i+k])
+		if p.eligible != nil && !p.eligible(canonical) {
 			continue
 		}
 		if bestPos == -1 {
 			// First eligible k-mer initialises best.
-			copy(best, canonical)
+			best = append(best[:0], canonical...)
 			bestPos = i
 			bestRC = thisRC
-			if !rawPivot {
+			if !p.rawPivot {
 				bestHash = hashKmer(best)
 			}
 			continue
 		}
 		var better bool
-		if rawPivot {
+		if p.rawPivot {
 			better = bytes.Compare(canonical, best) > 0
 		} else {
 			h := hashKmer(canonical)
@@ -192,37 +458,34 @@ func clumpMinimizerFull(sequence []byte, k int, rawPivot bool, eligible func([]b
 			}
 		}
 		if better {
-			copy(best, canonical)
+			best = append(best[:0], canonical...)
 			bestPos = i
 			bestRC = thisRC
 		}
 	}
 
 	if bestPos == -1 {
-		// No eligible k-mer found — return nil key so the read sorts with
-		// other unclustered reads rather than being given an arbitrary pivot.
-		return nil, 0, false
+		return nil, 0, false, false
+	}
+	return best, bestPos, bestRC, true
+}
+
+func isUnambiguousBase(base byte) bool {
+	switch base {
+	case 'A', 'C', 'G', 'T', 'a', 'c', 'g', 't':
+		return true
+	default:
+		return false
 	}
-	return best, bestPos, bestRC
 }
 
 // countKmers builds a frequency table of all canonical k-mers across reads.
-func countKmers(reads []fastq.FastqRead, k int) map[string]int {
+func countKmers(reads []fastq.FastqRead, k int, seed SpacedSeed) map[string]int {
 	counts := make(map[string]int)
-	rcBuf := make([]byte, k)
 	for _, read := range reads {
-		seq := read.Sequence()
-		for i := 0; i+k <= len(seq); i++ {
-			kmer := seq[i : i+k]
-			reverseComplementInto(kmer, rcBuf)
-			var canonical []byte
-			if bytes.Compare(rcBuf, kmer) < 0 {
-				canonical = rcBuf
-			} else {
-				canonical = kmer
-			}
+		forEachCanonicalKmer(read.Sequence(), k, seed, func(_ int, canonical []byte, _ bool) {
 			counts[string(canonical)]++
-		}
+		})
 	}
 	return counts
 }
@@ -236,40 +499,23 @@ func canonicalKmer(kmer []byte) []byte {
 }
 
 func reverseComplement(sequence []byte) []byte {
-	rc := make([]byte, len(sequence))
-	reverseComplementInto(sequence, rc)
-	return rc
+	return fastq.ReverseComplement(sequence)
 }
 
 func reverseComplementInto(src, dst []byte) {
-	for i, base := range src {
-		dst[len(src)-1-i] = complementBase(base)
-	}
+	fastq.ReverseComplementInto(src, dst)
 }
 
 func reverseBytes(b []byte) []byte {
-	out := make([]byte, len(b))
-	for i, v := range b {
-		out[len(b)-1-i] = v
-	}
-	return out
+	return fastq.ReverseBytes(b)
 }
 
+// complementBase keeps case and IUPAC codes so a flipped read can be flipped
+// back exactly. Complementing is an involution on every base but U, which
+// complements to A, so canonical keys stay strand-independent for
+// ambiguity-coded and soft-masked k-mers too.
 func complementBase(base byte) byte {
-	switch base {
-	case 'A', 'a':
-		return 'T'
-	case 'C', 'c':
-		return 'G'
-	case 'G', 'g':
-		return 'C'
-	case 'T', 't':
-		return 'A'
-	default:
-		// Ambiguous bases are deliberately retained as an ambiguous placeholder
-		// instead of trying to force them into a two-bit A/C/G/T encoding.
-		return 'N'
-	}
+	return fastq.ComplementBase(base)
 }
 
 func ClumpCompare(a, b fastq.FastqRead) bool {
@@ -296,14 +542,9 @@ func ClumpReadLess(a, b clumpRead) bool {
 	if a.pivotPos != b.pivotPos {
 		return a.pivotPos < b.pivotPos
 	}
-	// Tertiary: full sequence and quality bytes for deterministic output.
-	if c := bytes.Compare(a.read.Sequence(), b.read.Sequence()); c != 0 {
-		return c < 0
-	}
-	if c := bytes.Compare(a.read.QualityScores(), b.read.QualityScores()); c != 0 {
-		return c < 0
-	}
-	if c := bytes.Compare(a.read.Id(), b.read.Id()); c != 0 {
+	// Tertiary: full sequence, quality, and header bytes for deterministic
+	// output.
+	if c := clumpTieCompare(a.read, b.read, false, HeaderOrderOff); c != 0 {
 		return c < 0
 	}
 	return a.read.I < b.read.I
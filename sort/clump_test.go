@@ -1,6 +1,10 @@
 package sort
 
 import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	fastq "squish/fastq"
@@ -45,6 +49,10 @@ func TestReverseComplementAllBases(t *testing.T) {
 		{"TTTT", "AAAA"},
 		{"CCCC", "GGGG"},
 		{"GCGC", "GCGC"}, // palindrome
+		{"acgtn", "nacgt"},   // soft-masked bases keep their case
+		{"RYKMBVDH", "DHBVKMRY"},
+		{"SWsw", "wsWS"},
+		{"AC-GT", "AC-GT"}, // gaps are kept
 	}
 	for _, tc := range cases {
 		got := string(reverseComplement([]byte(tc.in)))
@@ -150,3 +158,353 @@ func TestClumpReadLessByPivotPos(t *testing.T) {
 	}
 }
 
+
+// pivot filters
+
+func TestPivotFilterMaxCountExcludesRepeats(t *testing.T) {
+	// Two poly-A reads make AAA a high-count repeat k-mer; with MaxCount=2
+	// it must not be eligible, while the single-copy k-mers still are.
+	input := "" +
+		"@r1\nAAAAA\n+\nIIIII\n" +
+		"@r2\nAAAAA\n+\nIIIII\n" +
+		"@r3\nACGTC\n+\nIIIII\n"
+	reads := loadReadsFromString(t, input)
+	eligible := pivotFilter(reads, 3, ClumpSortOptions{MaxCount: 2})
+	if eligible == nil {
+		t.Fatal("expected a filter when MaxCount is set")
+	}
+	if eligible([]byte("AAA")) {
+		t.Fatal("AAA appears 6 times and should exceed MaxCount=2")
+	}
+	if !eligible([]byte("ACG")) {
+		t.Fatal("ACG appears once and should be eligible")
+	}
+}
+
+func TestPivotFilterBlacklist(t *testing.T) {
+	blacklist := KmerSet{}
+	blacklist.AddSequence([]byte("TTTT"), 3)
+	eligible := pivotFilter(nil, 3, ClumpSortOptions{Blacklist: blacklist})
+	// TTT is stored as its canonical form AAA.
+	if eligible([]byte("AAA")) {
+		t.Fatal("blacklisted canonical k-mer AAA should not be eligible")
+	}
+	if !eligible([]byte("ACG")) {
+		t.Fatal("ACG is not blacklisted and should be eligible")
+	}
+}
+
+func TestPivotFilterDisabled(t *testing.T) {
+	if pivotFilter(nil, 3, ClumpSortOptions{}) != nil {
+		t.Fatal("expected nil filter when no filtering options are set")
+	}
+}
+
+func TestLoadKmerBlacklistFasta(t *testing.T) {
+	// A multi-line record contributes k-mers spanning the line break, and
+	// lower-case input is normalised to upper case.
+	path := filepath.Join(t.TempDir(), "adapters.fa")
+	if err := os.WriteFile(path, []byte(">adapter\nac\ngt\n>polyG\nGGGG\n"), 0644); err != nil {
+		t.Fatalf("write blacklist: %v", err)
+	}
+	set, err := LoadKmerBlacklist(path, 3, SpacedSeed{})
+	if err != nil {
+		t.Fatalf("load blacklist: %v", err)
+	}
+	for _, kmer := range []string{"ACG", "CCC"} {
+		if !set.Contains([]byte(kmer)) {
+			t.Fatalf("blacklist missing canonical k-mer %s: %v", kmer, set)
+		}
+	}
+	if len(set) != 2 {
+		t.Fatalf("blacklist size = %d, want 2: %v", len(set), set)
+	}
+}
+
+func TestSortReadsClumpBlacklistSkipsPivot(t *testing.T) {
+	// Without a blacklist the max-hash pivot of "AACCC" is used; blacklisting
+	// every k-mer of the read leaves no eligible pivot, so the read falls back
+	// to the unclustered nil-key group and sorts before keyed reads.
+	blacklist := KmerSet{}
+	blacklist.AddSequence([]byte("TTTTT"), 3)
+	input := "" +
+		"@keyed\nCCGCC\n+\nIIIII\n" +
+		"@repeat\nAAAAA\n+\nIIIII\n"
+	reads := loadReadsFromString(t, input)
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 3, Blacklist: blacklist})
+	want := []string{
+		"@repeat\nAAAAA\n+\nIIIII\n",
+		"@keyed\nCCGCC\n+\nIIIII\n",
+	}
+	assertRecords(t, reads, want)
+}
+
+func TestPivotSelectorSkipsAmbiguousKmers(t *testing.T) {
+	// "ACNGT" k=2: only AC and GT avoid the N. AC is canonical AC, GT is
+	// canonical AC too (RC of GT is AC), so the pivot must be AC and never
+	// contain N.
+	p := pivotSelector{k: 2, skipAmbiguous: true}
+	key, _, _ := p.pivot([]byte("ACNGT"), nil)
+	if string(key) != "AC" {
+		t.Fatalf("key = %q, want AC", key)
+	}
+}
+
+func TestPivotSelectorSkipsLowQualityKmers(t *testing.T) {
+	// rawPivot picks the lex-max canonical k-mer, which is CG when unfiltered.
+	// Positions 2-3 are Q0 ('!'), so only the window at position 0 qualifies.
+	p := pivotSelector{k: 2, rawPivot: true, minQuality: 20}
+	key, pos, _ := p.pivot([]byte("ACGG"), []byte("II!!"))
+	if string(key) != "AC" || pos != 0 {
+		t.Fatalf("key = %q pos = %d, want AC at 0", key, pos)
+	}
+}
+
+func TestPivotSelectorQualityFallback(t *testing.T) {
+	// Every base is low quality, so no window qualifies; the selector falls
+	// back to the unfiltered pivot instead of returning a nil key.
+	p := pivotSelector{k: 2, rawPivot: true, minQuality: 20}
+	key, _, _ := p.pivot([]byte("ACGG"), []byte("!!!!"))
+	if key == nil {
+		t.Fatal("expected unfiltered fallback pivot, got nil key")
+	}
+	unfiltered, _, _ := pivotSelector{k: 2, rawPivot: true}.pivot([]byte("ACGG"), nil)
+	if string(key) != string(unfiltered) {
+		t.Fatalf("fallback key = %q, want unfiltered key %q", key, unfiltered)
+	}
+}
+
+func TestPivotSelectorWindowExcludesBarcode(t *testing.T) {
+	// rawPivot picks the lex-max canonical k-mer. Unwindowed that is TCA from
+	// the barcode at the start of the read; with Trim5=3 the search starts
+	// after the barcode, and the position stays relative to the full read.
+	sequence := []byte("TCAACGAA")
+	key, _, _ := pivotSelector{k: 3, rawPivot: true}.pivot(sequence, nil)
+	if string(key) != "TCA" {
+		t.Fatalf("unwindowed key = %q, want TCA", key)
+	}
+	key, pos, _ := pivotSelector{k: 3, rawPivot: true, window: KeyWindow{Trim5: 3}}.pivot(sequence, nil)
+	if string(key) != "GAA" || pos != 5 {
+		t.Fatalf("windowed key = %q pos = %d, want GAA at 5", key, pos)
+	}
+}
+
+// spaced seeds
+
+func TestParseSpacedSeed(t *testing.T) {
+	seed, err := ParseSpacedSeed("11-011")
+	if err != nil {
+		t.Fatalf("parse seed: %v", err)
+	}
+	if seed.Span() != 6 || seed.Weight() != 4 {
+		t.Fatalf("span = %d weight = %d, want 6 and 4", seed.Span(), seed.Weight())
+	}
+	for _, mask := range []string{"000", "11x1"} {
+		if _, err := ParseSpacedSeed(mask); err == nil {
+			t.Fatalf("expected error for mask %q", mask)
+		}
+	}
+}
+
+func TestSpacedSeedToleratesErrorAtIgnoredPosition(t *testing.T) {
+	// The two reads differ only at position 2, which the mask ignores, so
+	// they must get the same pivot key. A contiguous k-mer of the same span
+	// separates them.
+	seed, err := ParseSpacedSeed("11011")
+	if err != nil {
+		t.Fatalf("parse seed: %v", err)
+	}
+	spaced := pivotSelector{k: seed.Span(), seed: seed}
+	keyA, _, _ := spaced.pivot([]byte("ACGTA"), nil)
+	keyB, _, _ := spaced.pivot([]byte("ACTTA"), nil)
+	if string(keyA) != string(keyB) {
+		t.Fatalf("spaced keys differ: %q vs %q", keyA, keyB)
+	}
+	contiguous := pivotSelector{k: 5}
+	keyA, _, _ = contiguous.pivot([]byte("ACGTA"), nil)
+	keyB, _, _ = contiguous.pivot([]byte("ACTTA"), nil)
+	if string(keyA) == string(keyB) {
+		t.Fatalf("contiguous keys should differ, both %q", keyA)
+	}
+}
+
+func TestSpacedSeedIsStrandIndependent(t *testing.T) {
+	// A non-palindromic mask must still give a read and its reverse
+	// complement the same canonical key, with opposite strand flags.
+	seed, err := ParseSpacedSeed("1101")
+	if err != nil {
+		t.Fatalf("parse seed: %v", err)
+	}
+	p := pivotSelector{k: seed.Span(), seed: seed}
+	forward := []byte("GATTACAGG")
+	keyF, _, rcF := p.pivot(forward, nil)
+	keyR, _, rcR := p.pivot(reverseComplement(forward), nil)
+	if string(keyF) != string(keyR) {
+		t.Fatalf("keys differ across strands: %q vs %q", keyF, keyR)
+	}
+	if rcF == rcR {
+		t.Fatalf("strand flags should differ, both %v", rcF)
+	}
+}
+
+func TestSortReadsClumpSpacedSeedExternal(t *testing.T) {
+	seed, err := ParseSpacedSeed("101")
+	if err != nil {
+		t.Fatalf("parse seed: %v", err)
+	}
+	input := "" +
+		"@b\nTTTTTT\n+\nIIIIII\n" +
+		"@a\nAAAAAA\n+\nIIIIII\n" +
+		"@c\nACACAC\n+\nIIIIII\n"
+	sorter := ClumpSort{Seed: seed}
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	want := make([]string, len(reads))
+	for i, read := range reads {
+		want[i] = string(read.Record())
+	}
+	assertExternalSortOutput(t, input, sorter, NewClumpBucketsOpts(1, sorter.Options()), want)
+
+	// Reverse-complement reads share a spaced-seed key, so the bucketer must
+	// place them together regardless of the bucket count.
+	bucketer := NewClumpBucketsOpts(64, sorter.Options())
+	unsorted := loadReadsFromString(t, input)
+	if bucketer.BucketID(unsorted[0]) != bucketer.BucketID(unsorted[1]) {
+		t.Fatalf("poly-T and poly-A reads should share a clump bucket")
+	}
+}
+
+func TestClumpBucketsApplyBorder(t *testing.T) {
+	// Each pair differs only in its end bases. With a border of 1 those bases
+	// never reach a pivot, so the pair shares a pivot and must share a bucket.
+	// Without a border some pairs pivot on an end k-mer and split up.
+	var input strings.Builder
+	for i := 0; i < 32; i++ {
+		interior := string(pseudoRandomSequence(20, uint32(i)))
+		quality := strings.Repeat("I", len(interior)+2)
+		input.WriteString("@a" + strconv.Itoa(i) + "\nA" + interior + "A\n+\n" + quality + "\n")
+		input.WriteString("@c" + strconv.Itoa(i) + "\nC" + interior + "C\n+\n" + quality + "\n")
+	}
+	reads := loadReadsFromString(t, input.String())
+
+	splitPairs := func(border int) int {
+		bucketer := NewClumpBucketsOpts(1024, ClumpSortOptions{K: 8, Border: border})
+		split := 0
+		for i := 0; i < len(reads); i += 2 {
+			if bucketer.BucketID(reads[i]) != bucketer.BucketID(reads[i+1]) {
+				split++
+			}
+		}
+		return split
+	}
+	if split := splitPairs(1); split != 0 {
+		t.Fatalf("border 1 split %d pairs that differ only in their end bases", split)
+	}
+	if splitPairs(0) == 0 {
+		t.Fatalf("border 0 should let end k-mers pick some pivots")
+	}
+}
+
+// AutoClumpParams
+
+func TestAutoClumpParams(t *testing.T) {
+	cases := []struct {
+		name       string
+		stats      fastq.ReadSampleStats
+		wantK      int
+		wantBorder int
+	}{
+		{"no sample keeps defaults", fastq.ReadSampleStats{}, DefaultClumpKmerLen, DefaultClumpBorder},
+		{"clean 150bp Illumina", fastq.ReadSampleStats{Reads: 100, P10Length: 150, MeanErrorRate: 0.001}, 31, 1},
+		{"short 36bp reads shrink k", fastq.ReadSampleStats{Reads: 100, P10Length: 36, MeanErrorRate: 0.001}, 27, 1},
+		{"very short reads drop the border", fastq.ReadSampleStats{Reads: 100, P10Length: 20, MeanErrorRate: 0.001}, 13, 0},
+		{"noisy long reads shrink k", fastq.ReadSampleStats{Reads: 100, P10Length: 5000, MeanErrorRate: 0.05}, 13, 1},
+	}
+	for _, tc := range cases {
+		k, border := AutoClumpParams(tc.stats)
+		if k != tc.wantK || border != tc.wantBorder {
+			t.Errorf("%s: k=%d border=%d, want k=%d border=%d", tc.name, k, border, tc.wantK, tc.wantBorder)
+		}
+	}
+}
+
+// Long-read mode
+
+// pseudoRandomSequence returns a deterministic ACGT sequence for tests that
+// need many distinct k-mers.
+func pseudoRandomSequence(n int, seed uint32) []byte {
+	bases := []byte("ACGT")
+	sequence := make([]byte, n)
+	for i := range sequence {
+		seed = seed*1664525 + 1013904223
+		sequence[i] = bases[seed>>30]
+	}
+	return sequence
+}
+
+func TestMinimizerSampleCoversEveryWindow(t *testing.T) {
+	sequence := pseudoRandomSequence(300, 7)
+	const k, w = 15, 10
+	p := pivotSelector{k: k, minimizerWindow: w}
+	usable := p.minimizerSample(sequence, k, 0, nil)
+
+	sampled := 0
+	last := -1
+	for i := 0; i+k <= len(sequence); i++ {
+		if !usable(i) {
+			continue
+		}
+		if i-last > w {
+			t.Fatalf("gap between sampled windows %d and %d exceeds w=%d", last, i, w)
+		}
+		last = i
+		sampled++
+	}
+	if windows := len(sequence) - k + 1; sampled >= windows/2 {
+		t.Fatalf("sampled %d of %d windows; minimizers should thin candidates", sampled, windows)
+	}
+}
+
+func TestMinimizerPivotSurvivesScatteredErrors(t *testing.T) {
+	readA := pseudoRandomSequence(1500, 11)
+	opts := ClumpSortOptions{K: 15, MinimizerWindow: 10}
+	selector := opts.selector(nil)
+	keyA, posA, _ := selector.pivot(readA, nil)
+
+	// Substitute a base every 100 bp, away from the pivot, as a noisy read of
+	// the same molecule would.
+	readB := append([]byte(nil), readA...)
+	for i := 50; i < len(readB); i += 100 {
+		if i > posA-25 && i < posA+40 {
+			continue
+		}
+		readB[i] = complementBase(readB[i])
+	}
+	keyB, posB, _ := selector.pivot(readB, nil)
+	if string(keyA) != string(keyB) || posA != posB {
+		t.Fatalf("noisy copy chose pivot %q@%d, want %q@%d", keyB, posB, keyA, posA)
+	}
+}
+
+func TestSortReadsClumpLongReadOrdersByLength(t *testing.T) {
+	// Every read's pivot is AAAA at offset 0. Long-read mode then orders by
+	// length, and equal lengths by input order rather than by sequence.
+	input := "" +
+		"@long\nAAAAAA\n+\nIIIIII\n" +
+		"@t\nTTTT\n+\nIIII\n" +
+		"@a\nAAAA\n+\nIIII\n"
+	reads := loadReadsFromString(t, input)
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 4, LongRead: true})
+	assertRecords(t, reads, []string{
+		"@t\nTTTT\n+\nIIII\n",
+		"@a\nAAAA\n+\nIIII\n",
+		"@long\nAAAAAA\n+\nIIIIII\n",
+	})
+
+	// Without long-read mode equal pivots fall back to the sequence.
+	reads = loadReadsFromString(t, input)
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 4})
+	if got := string(reads[0].Id()); got != "@a" {
+		t.Fatalf("first read = %s, want @a", got)
+	}
+}
@@ -0,0 +1,224 @@
+package sort
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	fastq "squish/fastq"
+	_io "squish/fastqio"
+)
+
+// CommandKeys holds the sort keys an external key command returned for every
+// input read, indexed by the one-based read index. The keys are spilled to a
+// sidecar file, so memory holds only the 8-byte end offset of each key; Key
+// reads a key back from the file.
+type CommandKeys struct {
+	Command []string
+	Reads   int
+
+	file *os.File
+	ends []int64
+
+	errOnce sync.Once
+	err     error
+}
+
+// Key returns the key of the read with one-based index i. Reads outside the
+// input the command saw have an empty key, as do all reads once reading the
+// sidecar has failed; Err reports that failure.
+func (k *CommandKeys) Key(i int) []byte {
+	if k == nil || i < 1 || i > len(k.ends) {
+		return nil
+	}
+	start := int64(0)
+	if i > 1 {
+		start = k.ends[i-2]
+	}
+	key := make([]byte, k.ends[i-1]-start)
+	if _, err := k.file.ReadAt(key, start); err != nil {
+		k.errOnce.Do(func() { k.err = fmt.Errorf("read key %d from %s: %w", i, k.file.Name(), err) })
+		return nil
+	}
+	return key
+}
+
+// Err returns the first error reading a key back from the sidecar file.
+func (k *CommandKeys) Err() error {
+	if k == nil {
+		return nil
+	}
+	return k.err
+}
+
+// Close closes and removes the sidecar file.
+func (k *CommandKeys) Close() error {
+	if k == nil || k.file == nil {
+		return nil
+	}
+	closeErr := k.file.Close()
+	if err := os.Remove(k.file.Name()); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// RunKeyCommand streams every read of the input to command and collects one
+// sort key per read in a sidecar file under tempDir. The command reads
+// "id\tsequence" lines on stdin, with the normalised read ID, and must write
+// one key line per read, in input order, on stdout. command is the program
+// and its arguments, run directly, not through a shell. Close the returned
+// keys to remove the sidecar.
+func RunKeyCommand(inputPath string, delim byte, tempDir string, command []string) (*CommandKeys, error) {
+	if len(command) == 0 || command[0] == "" {
+		return nil, fmt.Errorf("key command is empty")
+	}
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return nil, fmt.Errorf("create key command dir: %w", err)
+	}
+	sidecar, err := os.CreateTemp(tempDir, "keys-*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("create key sidecar: %w", err)
+	}
+	keys := &CommandKeys{Command: command, file: sidecar}
+	if err := keys.collect(inputPath, delim); err != nil {
+		keys.Close()
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (k *CommandKeys) collect(inputPath string, delim byte) error {
+	command := k.Command
+	cmd := exec.Command(command[0], command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("key command stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("key command stdout: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("start key command %q: %w", strings.Join(command, " "), err)
+	}
+
+	// The reads are written from a goroutine so a command that emits keys as
+	// it goes never blocks on a full stdout pipe.
+	written := make(chan writeResult, 1)
+	go func() {
+		reads, err := writeKeyCommandInput(inputPath, delim, stdin)
+		if closeErr := stdin.Close(); err == nil {
+			err = closeErr
+		}
+		written <- writeResult{reads: reads, err: err}
+	}()
+
+	reader := bufio.NewReader(stdout)
+	writer := bufio.NewWriter(k.file)
+	var end int64
+	var readErr error
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && readErr == nil {
+			key := bytes.TrimRight(line, "\r\n")
+			if _, writeErr := writer.Write(key); writeErr != nil {
+				readErr = fmt.Errorf("write key sidecar: %w", writeErr)
+			}
+			end += int64(len(key))
+			k.ends = append(k.ends, end)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				readErr = fmt.Errorf("read key command output: %w", err)
+				io.Copy(io.Discard, stdout)
+			}
+			break
+		}
+		if readErr != nil {
+			io.Copy(io.Discard, stdout)
+			break
+		}
+	}
+	result := <-written
+	waitErr := cmd.Wait()
+
+	if waitErr != nil {
+		return fmt.Errorf("key command %q: %w: %s", strings.Join(command, " "), waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if result.err != nil {
+		return fmt.Errorf("write key command input: %w", result.err)
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("write key sidecar: %w", err)
+	}
+	if len(k.ends) != result.reads {
+		return fmt.Errorf("key command returned %d keys for %d reads", len(k.ends), result.reads)
+	}
+	k.Reads = result.reads
+	return nil
+}
+
+type writeResult struct {
+	reads int
+	err   error
+}
+
+func writeKeyCommandInput(inputPath string, delim byte, stdin io.Writer) (int, error) {
+	reader, err := _io.OpenReader(inputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	writer := bufio.NewWriter(stdin)
+	readIndex := 0
+	for {
+		read, _, err := fastq.ReadNextReadE(reader, &delim, &readIndex)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return readIndex, err
+		}
+		writer.WriteString(fastq.NormalizedReadID(read.Id()))
+		writer.WriteByte('\t')
+		writer.Write(read.Sequence())
+		if err := writer.WriteByte('\n'); err != nil {
+			return readIndex, err
+		}
+	}
+	return readIndex, writer.Flush()
+}
+
+// CommandKeySort orders reads by the keys of an external key command, in
+// the natural order of NameSort, so numbers embedded in keys such as
+// "chr2:1500" compare by value. Reads with equal keys keep their input order.
+// Keys are looked up by read index, so Keys must come from RunKeyCommand on
+// the same input.
+type CommandKeySort struct {
+	Keys *CommandKeys
+}
+
+func (CommandKeySort) Name() string { return "command" }
+
+func (s CommandKeySort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	return keyedLess(s, a, b)
+}
+
+func (s CommandKeySort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendNameKey(dst, s.Keys.Key(read.I))
+	})
+}
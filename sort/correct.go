@@ -0,0 +1,151 @@
+package sort
+
+import fastq "squish/fastq"
+
+// Default thresholds for clump consensus error correction.
+const (
+	DefaultCorrectMinDepth   = 4
+	DefaultCorrectMinQuality = 20
+)
+
+// CorrectOptions enables consensus error correction inside clumps, in the
+// spirit of Clumpify's ecc. Reads sharing a pivot are aligned on the pivot
+// offset, and a base is replaced by its column's consensus base when:
+//
+//   - its Phred score is below MinQuality,
+//   - at least MinDepth reads carry the consensus base in that column and
+//     they are a strict majority of the column, and
+//   - no other read carries the same base there, so only isolated errors are
+//     corrected. Ambiguous bases such as N are always eligible.
+//
+// Correction is lossy: the original bases cannot be recovered. Qualities are
+// left as they are.
+type CorrectOptions struct {
+	Enabled    bool
+	MinDepth   int // 0 = DefaultCorrectMinDepth
+	MinQuality int // 0 = DefaultCorrectMinQuality
+}
+
+func (opts CorrectOptions) minDepth() int {
+	if opts.MinDepth < 1 {
+		return DefaultCorrectMinDepth
+	}
+	return opts.MinDepth
+}
+
+func (opts CorrectOptions) minQuality() int {
+	if opts.MinQuality < 1 {
+		return DefaultCorrectMinQuality
+	}
+	return opts.MinQuality
+}
+
+// CorrectionStats counts the bases changed by error correction.
+type CorrectionStats struct {
+	Bases int // bases replaced by a consensus base
+	Reads int // reads with at least one corrected base
+}
+
+// CountCorrections totals the corrections recorded on reads.
+func CountCorrections(reads []fastq.FastqRead) CorrectionStats {
+	stats := CorrectionStats{}
+	for _, read := range reads {
+		if read.CorrectedBases > 0 {
+			stats.Bases += read.CorrectedBases
+			stats.Reads++
+		}
+	}
+	return stats
+}
+
+// correctClumps runs consensus correction on every clump of the sorted,
+// already flipped reads.
+func correctClumps(clumpReads []clumpRead, opts CorrectOptions, k int) {
+	minDepth := opts.minDepth()
+	forEachClump(clumpReads, func(clump []clumpRead) {
+		if len(clump) > minDepth {
+			correctClump(clump, minDepth, opts.minQuality(), k)
+		}
+	})
+}
+
+// baseIndex maps a base to its column counter; every non-ACGT base shares
+// the last slot.
+func baseIndex(base byte) int {
+	switch base {
+	case 'A', 'a':
+		return 0
+	case 'C', 'c':
+		return 1
+	case 'G', 'g':
+		return 2
+	case 'T', 't':
+		return 3
+	default:
+		return 4
+	}
+}
+
+const consensusBases = "ACGT"
+
+func correctClump(clump []clumpRead, minDepth int, minQuality int, k int) {
+	// Column c of read r holds base c + offset[r]; columns are shifted so the
+	// leftmost read starts at column 0.
+	offsets := make([]int, len(clump))
+	first, last := 0, 0
+	for i, cr := range clump {
+		offsets[i] = -orientedPivotPos(cr, k)
+		end := offsets[i] + len(cr.read.Sequence())
+		if i == 0 || offsets[i] < first {
+			first = offsets[i]
+		}
+		if i == 0 || end > last {
+			last = end
+		}
+	}
+	counts := make([][5]int, last-first)
+	for i, cr := range clump {
+		offsets[i] -= first
+		for j, base := range cr.read.Sequence() {
+			counts[offsets[i]+j][baseIndex(base)]++
+		}
+	}
+
+	for i := range clump {
+		read := &clump[i].read
+		sequence, quality := read.Sequence(), read.QualityScores()
+		var corrected []byte
+		for j, base := range sequence {
+			if j >= len(quality) || int(quality[j])-33 >= minQuality {
+				continue
+			}
+			column := counts[offsets[i]+j]
+			consensus, depth := 0, 0
+			for b := 0; b < 5; b++ {
+				depth += column[b]
+				if b < 4 && column[b] > column[consensus] {
+					consensus = b
+				}
+			}
+			own := baseIndex(base)
+			if own == consensus || column[consensus] < minDepth || 2*column[consensus] <= depth {
+				continue
+			}
+			if own < 4 && column[own] > 1 {
+				continue
+			}
+			if corrected == nil {
+				corrected = append([]byte(nil), sequence...)
+			}
+			fixed := consensusBases[consensus]
+			if base >= 'a' && base <= 'z' {
+				fixed |= 0x20
+			}
+			corrected[j] = fixed
+			read.CorrectedBases++
+		}
+		if corrected != nil {
+			read.OverrideSeq = corrected
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package sort
+
+import (
+	"bytes"
+
+	fastq "squish/fastq"
+)
+
+// DedupeOptions enables duplicate detection during clump sorting.
+//
+// Only reads within one clump are compared. Exact copies of a read share its
+// pivot k-mer, so they always sit in the same clump after sorting. A copy
+// with Mismatches substitutions is only found when none of them falls inside
+// the pivot k-mer; a substitution there gives the copy another pivot, and
+// another clump. With RComp enabled, reads are compared after flipping, so a
+// read and its reverse complement are duplicates too. Reads that carry Mates
+// are pairs, and are only duplicates when each mate is also within Mismatches
+// substitutions of the matching mate.
+type DedupeOptions struct {
+	Enabled bool
+	// Mismatches is the number of substitutions allowed between duplicates.
+	// Reads must have the same length and the same pivot offset.
+	Mismatches int
+	// OpticalDistance, when > 0, classifies a duplicate as optical when it is
+	// on the same lane and tile as the kept read and both x and y differ by at
+	// most this many pixels. Reads without Illumina headers are never optical.
+	OpticalDistance int
+}
+
+// DuplicateStats counts the reads marked by FinishDuplicates.
+type DuplicateStats struct {
+	Duplicates        int // all duplicates, optical ones included
+	OpticalDuplicates int
+}
+
+// markDuplicates sets Duplicate and OpticalDuplicate on the sorted clump
+// reads. Within each duplicate set the read with the highest quality sum is
+// kept, ties going to the earliest input read.
+func markDuplicates(clumpReads []clumpRead, opts DedupeOptions, k int) {
+	forEachClump(clumpReads, func(clump []clumpRead) {
+		markClumpDuplicates(clump, opts, k)
+	})
+}
+
+// forEachClump calls fn with each run of sorted reads sharing a pivot key.
+// Reads without a pivot are not a clump and are skipped.
+func forEachClump(clumpReads []clumpRead, fn func([]clumpRead)) {
+	for start := 0; start < len(clumpReads); {
+		end := start + 1
+		for end < len(clumpReads) && bytes.Equal(clumpReads[end].key, clumpReads[start].key) {
+			end++
+		}
+		if clumpReads[start].key != nil {
+			fn(clumpReads[start:end])
+		}
+		start = end
+	}
+}
+
+// duplicateSlot groups reads that can be compared position by position: the
+// same length, and the pivot at the same offset once flips are applied.
+type duplicateSlot struct {
+	length   int
+	pivotPos int
+}
+
+func markClumpDuplicates(clump []clumpRead, opts DedupeOptions, k int) {
+	if len(clump) < 2 {
+		return
+	}
+	// sets[i] lists the members of one duplicate set; the first member is
+	// the representative the remaining reads matched.
+	var sets [][]int
+	representatives := map[duplicateSlot][]int{}
+	for i, cr := range clump {
+		sequence := cr.read.Sequence()
+		slot := duplicateSlot{length: len(sequence), pivotPos: orientedPivotPos(cr, k)}
+		matched := false
+		for _, set := range representatives[slot] {
+			rep := clump[sets[set][0]]
+			if !matesEqual(cr.read, rep.read, opts.Mismatches) {
+				continue
+			}
+			if withinMismatches(sequence, rep.read.Sequence(), opts.Mismatches) {
+				sets[set] = append(sets[set], i)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			representatives[slot] = append(representatives[slot], len(sets))
+			sets = append(sets, []int{i})
+		}
+	}
+
+	for _, set := range sets {
+		if len(set) < 2 {
+			continue
+		}
+		keep := set[0]
+		for _, member := range set[1:] {
+			if betterDuplicate(clump[member].read, clump[keep].read) {
+				keep = member
+			}
+		}
+		kept, keptOK := fastq.IlluminaHeader{}, false
+		if opts.OpticalDistance > 0 {
+			kept, keptOK = fastq.ParseIlluminaHeader(clump[keep].read.Id())
+		}
+		for _, member := range set {
+			if member == keep {
+				continue
+			}
+			clump[member].read.Duplicate = true
+			if keptOK && isOpticalDuplicate(kept, clump[member].read, opts.OpticalDistance) {
+				clump[member].read.OpticalDuplicate = true
+			}
+		}
+	}
+}
+
+// orientedPivotPos returns the pivot offset in the read as written to the
+// output, accounting for reverse-complemented reads.
+func orientedPivotPos(cr clumpRead, k int) int {
+	if cr.read.Flipped {
+		return len(cr.read.Sequence()) - k - cr.pivotPos
+	}
+	return cr.pivotPos
+}
+
+// matesEqual reports whether every mate of a is within limit substitutions of
+// the same mate of b. Unpaired reads have no mates and always match.
+func matesEqual(a fastq.FastqRead, b fastq.FastqRead, limit int) bool {
+	if len(a.Mates) != len(b.Mates) {
+		return false
+	}
+	for i := range a.Mates {
+		if !withinMismatches(a.Mates[i], b.Mates[i], limit) {
+			return false
+		}
+	}
+	return true
+}
+
+// withinMismatches reports whether equal-length sequences differ at no more
+// than limit positions. Comparison is case-insensitive so soft-masked copies
+// still match.
+func withinMismatches(a []byte, b []byte, limit int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	mismatches := 0
+	for i := range a {
+		if a[i]|0x20 != b[i]|0x20 {
+			mismatches++
+			if mismatches > limit {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// betterDuplicate reports whether a should be kept over b.
+func betterDuplicate(a fastq.FastqRead, b fastq.FastqRead) bool {
+	qa, qb := qualitySum(a.QualityScores()), qualitySum(b.QualityScores())
+	if qa != qb {
+		return qa > qb
+	}
+	return a.I < b.I
+}
+
+func qualitySum(quality []byte) int {
+	sum := 0
+	for _, q := range quality {
+		sum += int(q)
+	}
+	return sum
+}
+
+func isOpticalDuplicate(kept fastq.IlluminaHeader, read fastq.FastqRead, distance int) bool {
+	header, ok := fastq.ParseIlluminaHeader(read.Id())
+	if !ok || header.Lane != kept.Lane || header.Tile != kept.Tile || header.Flowcell != kept.Flowcell {
+		return false
+	}
+	return absInt(header.X-kept.X) <= distance && absInt(header.Y-kept.Y) <= distance
+}
+
+func absInt(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// FinishDuplicates applies the marks set by duplicate detection: with remove
+// it drops every duplicate from reads, otherwise it appends the duplicate tag
+// to their headers. Run it after VerifyFlippedReads, before writing output.
+func FinishDuplicates(reads []fastq.FastqRead, remove bool) ([]fastq.FastqRead, DuplicateStats) {
+	stats := DuplicateStats{}
+	kept := reads[:0]
+	for _, read := range reads {
+		kind := read.DuplicateKind()
+		if kind != fastq.DuplicateNone {
+			stats.Duplicates++
+			if kind == fastq.DuplicateOptical {
+				stats.OpticalDuplicates++
+			}
+			if remove {
+				continue
+			}
+			fastq.TagDuplicate(&read, kind)
+		}
+		kept = append(kept, read)
+	}
+	return kept, stats
+}
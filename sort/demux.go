@@ -0,0 +1,269 @@
+package sort
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	fastq "squish/fastq"
+)
+
+// UndeterminedSample names the reads that match no sample of a sample sheet.
+const UndeterminedSample = "Undetermined"
+
+// DefaultDemuxTag reads the index from the last header token, as in Casava
+// 1.8+ headers such as "@M1:7:FC:1:1101:5:6 1:N:0:ACGTACGT+TTGGCCAA".
+const DefaultDemuxTag = "token:-1"
+
+// DemuxSample is one row of a sample sheet. Index2 is empty for single-index
+// samples.
+type DemuxSample struct {
+	Name   string
+	Index  string
+	Index2 string
+}
+
+// Demultiplexer assigns reads to samples by their index sequences, read from
+// the header with Tag. Dual indexes are separated by '+' in the tag. A read
+// matches a sample when each sample index is within Mismatches substitutions
+// of the start of the read index; N counts as a mismatch. Reads that match no
+// sample, or several equally well, are undetermined.
+type Demultiplexer struct {
+	Samples    []DemuxSample
+	Mismatches int
+	Tag        TagExtractor
+
+	exact map[string]int
+}
+
+// NewDemultiplexer checks the samples and builds a demultiplexer. Sample names
+// must be unique and safe in file names, and no two samples may be within
+// twice Mismatches on every index, so that a read can never match both.
+func NewDemultiplexer(samples []DemuxSample, mismatches int, tag TagExtractor) (*Demultiplexer, error) {
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("sample sheet has no samples")
+	}
+	if mismatches < 0 {
+		return nil, fmt.Errorf("demux mismatches must be >= 0, got %d", mismatches)
+	}
+	if tag.IsZero() {
+		tag, _ = ParseTagExtractor(DefaultDemuxTag)
+	}
+	d := &Demultiplexer{Samples: samples, Mismatches: mismatches, Tag: tag, exact: map[string]int{}}
+	names := map[string]bool{}
+	for i, sample := range samples {
+		if !validSampleName(sample.Name) || sample.Name == UndeterminedSample {
+			return nil, fmt.Errorf("invalid sample name %q: use letters, digits, '.', '_' and '-'", sample.Name)
+		}
+		if names[sample.Name] {
+			return nil, fmt.Errorf("sample %q appears more than once", sample.Name)
+		}
+		names[sample.Name] = true
+		if sample.Index == "" {
+			return nil, fmt.Errorf("sample %q has no index", sample.Name)
+		}
+		for _, other := range samples[:i] {
+			if indexDistance(sample.Index, other.Index) <= 2*mismatches &&
+				(sample.Index2 == "" || other.Index2 == "" || indexDistance(sample.Index2, other.Index2) <= 2*mismatches) {
+				return nil, fmt.Errorf("samples %q and %q have indexes within %d mismatches of each other; lower the demux mismatches", other.Name, sample.Name, 2*mismatches)
+			}
+		}
+		d.exact[sample.Index+"+"+sample.Index2] = i
+	}
+	return d, nil
+}
+
+func validSampleName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// indexDistance counts the substitutions between two sample indexes, with
+// the length difference counted as mismatches.
+func indexDistance(a string, b string) int {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	distance := len(b) - len(a)
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			distance++
+		}
+	}
+	return distance
+}
+
+// Assign returns the index of the sample read belongs to, or len(Samples)
+// when it is undetermined.
+func (d *Demultiplexer) Assign(read fastq.FastqRead) int {
+	index, index2, _ := strings.Cut(string(d.Tag.Extract(read)), "+")
+	if i, ok := d.exact[index+"+"+index2]; ok {
+		return i
+	}
+	if i, ok := d.exact[index+"+"]; ok {
+		return i
+	}
+	best, bestMismatches, tied := len(d.Samples), 0, false
+	for i, sample := range d.Samples {
+		mismatches, ok := d.indexMismatches(index, sample.Index)
+		if !ok {
+			continue
+		}
+		if sample.Index2 != "" {
+			mismatches2, ok := d.indexMismatches(index2, sample.Index2)
+			if !ok {
+				continue
+			}
+			mismatches += mismatches2
+		}
+		switch {
+		case best == len(d.Samples) || mismatches < bestMismatches:
+			best, bestMismatches, tied = i, mismatches, false
+		case mismatches == bestMismatches:
+			tied = true
+		}
+	}
+	if tied {
+		return len(d.Samples)
+	}
+	return best
+}
+
+// indexMismatches compares a sample index with the start of a read index.
+func (d *Demultiplexer) indexMismatches(read string, sample string) (int, bool) {
+	if len(read) < len(sample) {
+		return 0, false
+	}
+	mismatches := 0
+	for i := 0; i < len(sample); i++ {
+		if read[i] != sample[i] || read[i] == 'N' {
+			mismatches++
+			if mismatches > d.Mismatches {
+				return 0, false
+			}
+		}
+	}
+	return mismatches, true
+}
+
+// LoadSampleSheet reads samples from a CSV or tab-separated sample sheet.
+// The first row is a header naming the sample column (Sample_ID, sample_id,
+// or sample), the index column (index, index1, or i7), and optionally the
+// second index column (index2 or i5). In an Illumina sample sheet only the
+// [Data] section is read. Blank lines and lines starting with '#' are
+// skipped.
+func LoadSampleSheet(path string) ([]DemuxSample, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open sample sheet: %w", err)
+	}
+	defer file.Close()
+
+	var lines []string
+	inSections, inData := false, false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			inSections = true
+			inData = strings.HasPrefix(strings.ToLower(line), "[data]")
+			continue
+		}
+		if inSections && !inData {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read sample sheet: %w", err)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("sample sheet %s has no header row", path)
+	}
+
+	header := splitSampleSheetRow(lines[0])
+	sampleColumn, indexColumn, index2Column := -1, -1, -1
+	for i, name := range header {
+		switch strings.ToLower(name) {
+		case "sample_id", "sample":
+			sampleColumn = i
+		case "index", "index1", "i7":
+			indexColumn = i
+		case "index2", "i5":
+			index2Column = i
+		}
+	}
+	if sampleColumn < 0 || indexColumn < 0 {
+		return nil, fmt.Errorf("sample sheet %s needs sample and index columns, got %q", path, lines[0])
+	}
+
+	var samples []DemuxSample
+	for _, line := range lines[1:] {
+		row := splitSampleSheetRow(line)
+		sample := DemuxSample{
+			Name:  sampleSheetField(row, sampleColumn),
+			Index: strings.ToUpper(sampleSheetField(row, indexColumn)),
+		}
+		if index2Column >= 0 {
+			sample.Index2 = strings.ToUpper(sampleSheetField(row, index2Column))
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func splitSampleSheetRow(line string) []string {
+	separator := ","
+	if strings.Contains(line, "\t") {
+		separator = "\t"
+	}
+	fields := strings.Split(line, separator)
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields
+}
+
+func sampleSheetField(row []string, column int) string {
+	if column >= len(row) {
+		return ""
+	}
+	return row[column]
+}
+
+// demuxBuckets splits every bucket of inner by sample: bucket
+// sample*n + id holds the reads of one sample in bucket id of inner, with the
+// undetermined reads last. It counts the reads of each sample as they are
+// bucketed.
+type demuxBuckets struct {
+	inner  BucketStrategy
+	demux  *Demultiplexer
+	counts []int
+}
+
+func newDemuxBuckets(inner BucketStrategy, demux *Demultiplexer) *demuxBuckets {
+	return &demuxBuckets{inner: inner, demux: demux, counts: make([]int, len(demux.Samples)+1)}
+}
+
+func (b *demuxBuckets) Name() string { return b.inner.Name() }
+
+func (b *demuxBuckets) BucketCount() int { return (len(b.demux.Samples) + 1) * b.inner.BucketCount() }
+
+func (b *demuxBuckets) BucketID(read fastq.FastqRead) int {
+	sample := b.demux.Assign(read)
+	b.counts[sample]++
+	return sample*b.inner.BucketCount() + b.inner.BucketID(read)
+}
+
+func (b *demuxBuckets) OrderedFor(sorter SortStrategy) bool { return b.inner.OrderedFor(sorter) }
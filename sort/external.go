@@ -2,6 +2,7 @@ package sort
 
 import (
 	"bufio"
+	"bytes"
 	"container/list"
 	"errors"
 	"fmt"
@@ -10,7 +11,6 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
-	go_sort "sort"
 	"strconv"
 
 	"code.cloudfoundry.org/bytefmt"
@@ -27,22 +27,91 @@ type ExternalBucketConfig struct {
 	TempDir         string
 	RecordDelim     byte
 	QuantizeQuality bool // bin quality scores to 4 levels after sorting each bucket (lossy)
+	// MaxBucketBytes, when > 0, caps the record bytes of one bucket. Larger
+	// buckets are split again before sorting if the bucket strategy
+	// implements SplittableBuckets; other buckets, and buckets still too large
+	// after maxBucketSplitDepth splits, are loaded whole. The cap counts
+	// record bytes rather than reads, so it holds for a few 50 kb reads as
+	// well as many 150 bp reads, but it bounds a bucket, not each read.
+	MaxBucketBytes int64
+	// FlipFilepath, when set, receives the original index of every read the
+	// sorter reverse-complemented, for mate-consistent paired reordering.
+	FlipFilepath string
+	// RemoveDuplicates drops reads the sorter marked as duplicates instead of
+	// tagging their headers. Removed reads are left out of the order file.
+	RemoveDuplicates bool
+	// DuplicateFilepath, when set, receives the original index and tag of
+	// every tagged duplicate, for tagging companion reads.
+	DuplicateFilepath string
+	// MateFilepaths, when set, are companion FASTQs read in step with the
+	// input. Each read carries its mate sequences through its bucket, so
+	// duplicate detection compares pairs with one bucket of mates in memory.
+	MateFilepaths []string
+	// Demux, when set, assigns every read to a sample while the buckets are
+	// written. Reads of sample i are sorted into SampleOutputs[i], and reads
+	// that match no sample into OutputFilepath and OrderFilepath. All samples
+	// share the flip and duplicate files, whose rows carry input indexes.
+	Demux         *Demultiplexer
+	SampleOutputs []SampleOutput
+}
+
+// SampleOutput holds the sorted output and order file of one demultiplexed
+// sample.
+type SampleOutput struct {
+	OutputFilepath string
+	OrderFilepath  string
+}
+
+// SampleStats counts the reads of one demultiplexed sample. Written is lower
+// than Reads when duplicates were removed.
+type SampleStats struct {
+	Name    string `json:"name"`
+	Reads   int    `json:"reads"`
+	Written int    `json:"written"`
 }
 
 type ExternalBucketStats struct {
-	Reads        int    `json:"reads"`
-	Bytes        int    `json:"bytes"`
-	BucketsUsed  int    `json:"buckets_used"`
-	BucketCount  int    `json:"bucket_count"`
-	BucketerName string `json:"bucketer_name"`
-	TempDir      string `json:"temp_dir"`
+	Reads             int    `json:"reads"`
+	Bytes             int    `json:"bytes"`
+	BucketsUsed       int    `json:"buckets_used"`
+	BucketCount       int    `json:"bucket_count"`
+	BucketerName      string `json:"bucketer_name"`
+	TempDir           string `json:"temp_dir"`
+	SplitBuckets      int    `json:"split_buckets,omitempty"`
+	FlippedReads      int    `json:"flipped_reads,omitempty"`
+	Duplicates        int    `json:"duplicates,omitempty"`
+	OpticalDuplicates int    `json:"optical_duplicates,omitempty"`
+	CorrectedBases    int    `json:"corrected_bases,omitempty"`
+	CorrectedReads    int    `json:"corrected_reads,omitempty"`
+	// Headers measures the headers of reads with the same sequence.
+	Headers HeaderStats `json:"headers"`
+	// Samples holds one entry per demultiplexed sample, then one for the
+	// undetermined reads.
+	Samples []SampleStats `json:"samples,omitempty"`
 }
 
+// SplittableBuckets is implemented by bucket strategies that can divide an
+// oversized bucket into smaller ones. SubBucketID must send reads that the
+// sorter needs to see together, such as reads sharing a clump pivot, to the
+// same sub-bucket, and should use a different assignment for each level.
+type SplittableBuckets interface {
+	SubBucketID(read fastq.FastqRead, level int, count int) int
+}
+
+// maxBucketSplitDepth bounds recursive splitting. A bucket that is still too
+// large after this many levels is dominated by a few keys and is loaded as is.
+const maxBucketSplitDepth = 3
+
+// maxOrderRowBytes bounds one bucket order row, which holds whole mate
+// sequences when mates are carried.
+const maxOrderRowBytes = 256 << 20
+
 // bucketWriter owns the temporary FASTQ bucket and a sidecar order file.
 //
 // The order file records each read's original input index because temporary
 // FASTQ files only contain the four FASTQ lines. Restoring that index after a
-// bucket is reloaded keeps sort tie-breaks and order.txt output correct.
+// bucket is reloaded keeps sort tie-breaks and order.txt output correct. For
+// paired duplicate detection each row also carries the read's mate sequences.
 type bucketWriter struct {
 	file        *os.File
 	writer      *bufio.Writer
@@ -131,7 +200,30 @@ func RunExternalBucketSort(config ExternalBucketConfig, sorter SortStrategy, buc
 		return ExternalBucketStats{}, fmt.Errorf("create temp dir: %w", err)
 	}
 
-	bucketPaths, bucketOrderPaths, bucketSizes, totalReads, totalBytes, err := writeBuckets(config, bucketer)
+	outputs := []externalOutput{{
+		SampleOutput: SampleOutput{OutputFilepath: config.OutputFilepath, OrderFilepath: config.OrderFilepath},
+	}}
+	writeBucketer := bucketer
+	var demux *demuxBuckets
+	if config.Demux != nil {
+		if len(config.SampleOutputs) != len(config.Demux.Samples) {
+			return ExternalBucketStats{}, fmt.Errorf("got %d sample outputs for %d samples", len(config.SampleOutputs), len(config.Demux.Samples))
+		}
+		demux = newDemuxBuckets(bucketer, config.Demux)
+		writeBucketer = demux
+		// Each sample owns a run of bucketer.BucketCount() bucket IDs; the
+		// undetermined reads take the last run and the main output.
+		outputs = outputs[:0]
+		for i, sampleOutput := range config.SampleOutputs {
+			outputs = append(outputs, externalOutput{SampleOutput: sampleOutput, firstBucket: i * bucketer.BucketCount()})
+		}
+		outputs = append(outputs, externalOutput{
+			SampleOutput: SampleOutput{OutputFilepath: config.OutputFilepath, OrderFilepath: config.OrderFilepath},
+			firstBucket:  len(config.SampleOutputs) * bucketer.BucketCount(),
+		})
+	}
+
+	bucketPaths, bucketOrderPaths, bucketSizes, totalReads, totalBytes, err := writeBuckets(config, writeBucketer)
 	if err != nil {
 		return ExternalBucketStats{}, err
 	}
@@ -143,17 +235,38 @@ func RunExternalBucketSort(config ExternalBucketConfig, sorter SortStrategy, buc
 		"bucketer", bucketer.Name(),
 	)
 
-	if err := sortBucketsToOutput(config, sorter, bucketer, bucketPaths, bucketOrderPaths, bucketSizes); err != nil {
+	emitted, err := sortBucketsToOutput(config, sorter, bucketer, outputs, bucketPaths, bucketOrderPaths, bucketSizes)
+	if err != nil {
 		return ExternalBucketStats{}, err
 	}
 
+	var samples []SampleStats
+	if demux != nil {
+		for i, output := range outputs {
+			name := UndeterminedSample
+			if i < len(config.Demux.Samples) {
+				name = config.Demux.Samples[i].Name
+			}
+			samples = append(samples, SampleStats{Name: name, Reads: demux.counts[i], Written: output.written})
+		}
+		slog.Info("reads demultiplexed", "samples", len(config.Demux.Samples), "undetermined", demux.counts[len(config.Demux.Samples)])
+	}
+
 	return ExternalBucketStats{
-		Reads:        totalReads,
-		Bytes:        totalBytes,
-		BucketsUsed:  len(bucketPaths),
-		BucketCount:  bucketer.BucketCount(),
-		BucketerName: bucketer.Name(),
-		TempDir:      config.TempDir,
+		Reads:             totalReads,
+		Bytes:             totalBytes,
+		BucketsUsed:       len(bucketPaths),
+		BucketCount:       bucketer.BucketCount(),
+		BucketerName:      bucketer.Name(),
+		TempDir:           config.TempDir,
+		SplitBuckets:      emitted.splits,
+		FlippedReads:      emitted.flipped,
+		Duplicates:        emitted.duplicates.Duplicates,
+		OpticalDuplicates: emitted.duplicates.OpticalDuplicates,
+		CorrectedBases:    emitted.corrections.Bases,
+		CorrectedReads:    emitted.corrections.Reads,
+		Headers:           emitted.headers,
+		Samples:           samples,
 	}, nil
 }
 
@@ -166,6 +279,34 @@ func writeBuckets(config ExternalBucketConfig, bucketer BucketStrategy) (map[int
 	}
 	defer reader.Close()
 
+	var mates *fastq.MateReader
+	if len(config.MateFilepaths) > 0 {
+		if mates, err = fastq.OpenMateReader(config.MateFilepaths, config.RecordDelim); err != nil {
+			return nil, nil, nil, 0, 0, err
+		}
+		defer mates.Close()
+	}
+	bucketPaths, bucketOrderPaths, bucketSizes, totalReads, totalBytes, err := partitionRecords(reader, nil, mates, config.TempDir, config.RecordDelim, bucketer.BucketCount(), bucketer.BucketID)
+	if err == nil && mates != nil {
+		err = mates.Done()
+	}
+	return bucketPaths, bucketOrderPaths, bucketSizes, totalReads, totalBytes, err
+}
+
+// partitionRecords appends every record from reader to the temp bucket chosen
+// by bucketID. When order is non-nil it supplies the global input index and
+// mates of each record, as when an existing bucket is split again; otherwise
+// the index is the record's position in reader and mates, when non-nil,
+// supplies the mate sequences.
+func partitionRecords(
+	reader _io.InputFileReader,
+	order *bufio.Scanner,
+	mates *fastq.MateReader,
+	tempDir string,
+	delim byte,
+	bucketCount int,
+	bucketID func(fastq.FastqRead) int,
+) (map[int]string, map[int]string, map[int]int64, int, int, error) {
 	lru := newLRUWriters(maxOpenBucketWriters)
 	defer lru.closeAll()
 
@@ -179,50 +320,105 @@ func writeBuckets(config ExternalBucketConfig, bucketer BucketStrategy) (map[int
 	for {
 		// ReadNextRead returns a small one-record arena, so this loop does not
 		// retain the full input in memory during bucketing.
-		read, readSize, err := fastq.ReadNextReadE(reader, &config.RecordDelim, &readIndex)
+		read, readSize, err := fastq.ReadNextReadE(reader, &delim, &readIndex)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
 			return nil, nil, nil, 0, 0, fmt.Errorf("read fastq record: %w", err)
 		}
+		if order != nil {
+			if !order.Scan() {
+				return nil, nil, nil, 0, 0, fmt.Errorf("bucket order file has fewer rows than reads")
+			}
+			if read.I, read.Mates, err = parseOrderRow(order.Bytes()); err != nil {
+				return nil, nil, nil, 0, 0, err
+			}
+		} else if mates != nil {
+			if read.Mates, err = mates.Next(); err != nil {
+				return nil, nil, nil, 0, 0, err
+			}
+		}
 
-		bucketID := bucketer.BucketID(read)
-		if bucketID < 0 || bucketID >= bucketer.BucketCount() {
-			return nil, nil, nil, 0, 0, fmt.Errorf("bucket id %d outside range [0, %d)", bucketID, bucketer.BucketCount())
+		id := bucketID(read)
+		if id < 0 || id >= bucketCount {
+			return nil, nil, nil, 0, 0, fmt.Errorf("bucket id %d outside range [0, %d)", id, bucketCount)
 		}
 
-		bucket, ok := lru.get(bucketID)
+		bucket, ok := lru.get(id)
 		if !ok {
 			if lru.full() {
 				// Evict the least-recently-used bucket to stay under the
 				// descriptor cap. It will be reopened in append mode if needed.
 				lru.evictLRU()
 			}
-			bucket, err = openBucketWriter(config.TempDir, bucketID)
+			bucket, err = openBucketWriter(tempDir, id)
 			if err != nil {
 				return nil, nil, nil, 0, 0, err
 			}
-			lru.put(bucketID, bucket)
-			bucketPaths[bucketID] = bucket.path
-			bucketOrderPaths[bucketID] = bucket.orderPath
+			lru.put(id, bucket)
+			bucketPaths[id] = bucket.path
+			bucketOrderPaths[id] = bucket.orderPath
 		}
 
 		n, err := bucket.writer.Write(read.Record())
 		if err != nil {
-			return nil, nil, nil, 0, 0, fmt.Errorf("write bucket %d: %w", bucketID, err)
+			return nil, nil, nil, 0, 0, fmt.Errorf("write bucket %d: %w", id, err)
 		}
-		if _, err := bucket.orderWriter.WriteString(strconv.Itoa(read.I) + "\n"); err != nil {
-			return nil, nil, nil, 0, 0, fmt.Errorf("write bucket order %d: %w", bucketID, err)
+		if err := writeOrderRow(bucket.orderWriter, read); err != nil {
+			return nil, nil, nil, 0, 0, fmt.Errorf("write bucket order %d: %w", id, err)
 		}
-		bucketSizes[bucketID] += int64(n)
+		bucketSizes[id] += int64(n)
 		totalReads++
 		totalBytes += readSize
 	}
+	if order != nil {
+		if err := order.Err(); err != nil {
+			return nil, nil, nil, 0, 0, fmt.Errorf("scan bucket order: %w", err)
+		}
+	}
 
 	return bucketPaths, bucketOrderPaths, bucketSizes, totalReads, totalBytes, nil
 }
 
+// writeOrderRow writes the bucket order row of read: its input index, then
+// its mate sequences, separated by tabs. bufio.Writer errors are sticky, so
+// the final write reports any earlier failure.
+func writeOrderRow(writer *bufio.Writer, read fastq.FastqRead) error {
+	if _, err := writer.WriteString(strconv.Itoa(read.I)); err != nil {
+		return err
+	}
+	for _, mate := range read.Mates {
+		writer.WriteByte('\t')
+		writer.Write(mate)
+	}
+	return writer.WriteByte('\n')
+}
+
+// parseOrderRow parses a row written by writeOrderRow. The mates are copied,
+// since row is only valid until the next scan.
+func parseOrderRow(row []byte) (int, [][]byte, error) {
+	end := bytes.IndexByte(row, '\t')
+	if end < 0 {
+		end = len(row)
+	}
+	index, err := strconv.Atoi(string(row[:end]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("parse bucket order: %w", err)
+	}
+	if end == len(row) {
+		return index, nil, nil
+	}
+	return index, bytes.Split(append([]byte(nil), row[end+1:]...), []byte{'\t'}), nil
+}
+
+// newOrderScanner scans the rows of a bucket order file.
+func newOrderScanner(orderFile io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(orderFile)
+	scanner.Buffer(nil, maxOrderRowBytes)
+	return scanner
+}
+
 // openBucketWriter opens both the FASTQ bucket and its order sidecar. Files are
 // opened with O_APPEND so buckets can be closed and reopened safely.
 func openBucketWriter(tempDir string, bucketID int) (*bucketWriter, error) {
@@ -264,86 +460,282 @@ func closeBucketWriter(bucket *bucketWriter) {
 	}
 }
 
+// externalOutput is one sorted output and the first of the
+// bucketer.BucketCount() bucket IDs emitted into it. written counts the reads
+// it received.
+type externalOutput struct {
+	SampleOutput
+	firstBucket int
+	written     int
+}
+
 // sortBucketsToOutput is the bounded-memory sort phase. Each bucket is loaded
 // into the arena representation, sorted in memory, appended to the gzip output,
-// and then deleted.
+// and then deleted. The returned emitter counts buckets that had to be split to
+// stay under MaxBucketBytes and reads flipped by the sorter.
 func sortBucketsToOutput(
 	config ExternalBucketConfig,
 	sorter SortStrategy,
 	bucketer BucketStrategy,
+	outputs []externalOutput,
+	bucketPaths map[int]string,
+	bucketOrderPaths map[int]string,
+	bucketSizes map[int]int64,
+) (*bucketEmitter, error) {
+	emitter := &bucketEmitter{
+		config:   config,
+		sorter:   sorter,
+		bucketer: bucketer,
+	}
+
+	if config.FlipFilepath != "" {
+		flipFile, err := os.Create(config.FlipFilepath)
+		if err != nil {
+			return nil, fmt.Errorf("create flip file: %w", err)
+		}
+		defer flipFile.Close()
+		emitter.flipWriter = bufio.NewWriter(flipFile)
+		defer emitter.flipWriter.Flush()
+	}
+	if config.DuplicateFilepath != "" {
+		duplicateFile, err := os.Create(config.DuplicateFilepath)
+		if err != nil {
+			return nil, fmt.Errorf("create duplicate file: %w", err)
+		}
+		defer duplicateFile.Close()
+		emitter.duplicateWriter = bufio.NewWriter(duplicateFile)
+		defer emitter.duplicateWriter.Flush()
+	}
+
+	for i := range outputs {
+		if err := emitter.emitOutput(&outputs[i], bucketPaths, bucketOrderPaths, bucketSizes); err != nil {
+			return nil, err
+		}
+	}
+	return emitter, nil
+}
+
+// emitOutput sorts the buckets of one output into its files.
+func (e *bucketEmitter) emitOutput(
+	output *externalOutput,
 	bucketPaths map[int]string,
 	bucketOrderPaths map[int]string,
 	bucketSizes map[int]int64,
 ) error {
-	outputWriter, err := _io.OpenWriter(config.OutputFilepath)
+	outputWriter, err := _io.OpenWriter(output.OutputFilepath)
 	if err != nil {
 		return err
 	}
 	defer outputWriter.Close()
 
-	orderFile, err := os.Create(config.OrderFilepath)
+	orderFile, err := os.Create(output.OrderFilepath)
 	if err != nil {
 		return fmt.Errorf("create order file: %w", err)
 	}
 	defer orderFile.Close()
-	orderWriter := bufio.NewWriter(orderFile)
-	defer orderWriter.Flush()
 
-	for bucketID := 0; bucketID < bucketer.BucketCount(); bucketID++ {
+	e.outputWriter = outputWriter
+	e.orderWriter = bufio.NewWriter(orderFile)
+	e.written = 0
+	defer e.orderWriter.Flush()
+
+	// Ordered bucket strategies rely on this append order: bucket 0 first,
+	// then bucket 1, and so on. Each bucket is already internally sorted.
+	for bucketID := output.firstBucket; bucketID < output.firstBucket+e.bucketer.BucketCount(); bucketID++ {
 		bucketPath, ok := bucketPaths[bucketID]
 		if !ok {
 			continue
 		}
-
-		reads, err := loadBucket(bucketPath, bucketOrderPaths[bucketID], config.RecordDelim)
-		if err != nil {
+		if err := e.emit(bucketPath, bucketOrderPaths[bucketID], bucketSizes[bucketID], 0); err != nil {
 			return err
 		}
-		if clumpSorter, ok := sorter.(interface{ Sort([]fastq.FastqRead) }); ok {
-			// ClumpSort has a specialized Sort method that precomputes clump
-			// keys once per read. Falling back to sorter.Less would recompute
-			// minimizers during every comparison and is much slower.
-			clumpSorter.Sort(reads)
-		} else {
-			go_sort.Slice(reads, func(i, j int) bool {
-				return sorter.Less(reads[i], reads[j])
-			})
+	}
+	output.written = e.written
+	return nil
+}
+
+// bucketEmitter sorts temp buckets and appends them to the output, splitting
+// buckets that exceed the size cap first.
+type bucketEmitter struct {
+	config       ExternalBucketConfig
+	sorter       SortStrategy
+	bucketer     BucketStrategy
+	outputWriter _io.OutputFileWriter
+	orderWriter  *bufio.Writer
+	flipWriter   *bufio.Writer // nil unless FlipFilepath is set
+	// duplicateWriter is nil unless DuplicateFilepath is set.
+	duplicateWriter *bufio.Writer
+	splits          int
+	written         int // reads written to the current output
+	flipped         int
+	duplicates      DuplicateStats
+	corrections     CorrectionStats
+	headers         HeaderStats
+}
+
+// emit sorts one temp bucket into the output and removes its files.
+func (e *bucketEmitter) emit(bucketPath string, orderPath string, size int64, level int) error {
+	if e.shouldSplit(size, level) {
+		return e.split(bucketPath, orderPath, size, level)
+	}
+
+	reads, err := loadBucket(bucketPath, orderPath, e.config.RecordDelim)
+	if err != nil {
+		return err
+	}
+	// Keyed strategies, ClumpSort included, build each read's key once per
+	// bucket; SortReadsStrategy prefers them over a Less-based loop, which
+	// would recompute minimizers during every comparison.
+	SortReadsStrategy(&reads, e.sorter)
+	flipped, err := VerifyFlippedReads(reads)
+	if err != nil {
+		return err
+	}
+	e.flipped += flipped
+	corrections := CountCorrections(reads)
+	e.corrections.Bases += corrections.Bases
+	e.corrections.Reads += corrections.Reads
+	// Duplicates share a clump pivot, and clump buckets and their splits keep
+	// a pivot in one bucket, so per-bucket detection finds them all.
+	reads, duplicates := FinishDuplicates(reads, e.config.RemoveDuplicates)
+	e.duplicates.Duplicates += duplicates.Duplicates
+	e.duplicates.OpticalDuplicates += duplicates.OpticalDuplicates
+	// Reads with the same sequence share a pivot, so their runs never cross
+	// buckets.
+	e.headers = e.headers.Add(CountHeaderSharing(reads))
+	if e.config.QuantizeQuality {
+		QuantizeReads(reads)
+	}
+
+	e.written += len(reads)
+	for _, read := range reads {
+		if _, err := e.outputWriter.Writer.Write(read.Record()); err != nil {
+			return fmt.Errorf("write output record: %w", err)
 		}
-		if config.QuantizeQuality {
-			QuantizeReads(reads)
+		if _, err := e.orderWriter.WriteString(strconv.Itoa(read.I) + "\n"); err != nil {
+			return fmt.Errorf("write order record: %w", err)
 		}
-
-		// Ordered bucket strategies rely on this append order: bucket 0 first,
-		// then bucket 1, and so on. Each bucket is already internally sorted.
-		for _, read := range reads {
-			if _, err := outputWriter.Writer.Write(read.Record()); err != nil {
-				return fmt.Errorf("write output record: %w", err)
+		if read.Flipped && e.flipWriter != nil {
+			if _, err := e.flipWriter.WriteString(strconv.Itoa(read.I) + "\n"); err != nil {
+				return fmt.Errorf("write flip record: %w", err)
 			}
-			if _, err := orderWriter.WriteString(strconv.Itoa(read.I) + "\n"); err != nil {
-				return fmt.Errorf("write order record: %w", err)
+		}
+		if e.duplicateWriter != nil {
+			if err := fastq.WriteDuplicateRow(e.duplicateWriter, read); err != nil {
+				return err
 			}
 		}
+	}
 
+	slog.Debug(
+		"external bucket sorted",
+		"bucket", filepath.Base(bucketPath),
+		"reads", len(reads),
+		"size", bytefmt.ByteSize(uint64(size)),
+	)
+
+	return removeBucketFiles(bucketPath, orderPath)
+}
+
+func (e *bucketEmitter) shouldSplit(size int64, level int) bool {
+	if e.config.MaxBucketBytes <= 0 || size <= e.config.MaxBucketBytes {
+		return false
+	}
+	if _, ok := e.bucketer.(SplittableBuckets); !ok {
+		return false
+	}
+	if level >= maxBucketSplitDepth {
 		slog.Debug(
-			"external bucket sorted",
-			"bucket", bucketID,
-			"reads", len(reads),
-			"size", bytefmt.ByteSize(uint64(bucketSizes[bucketID])),
+			"bucket exceeds the size cap after maximum split depth; loading it whole",
+			"size", bytefmt.ByteSize(uint64(size)),
+			"cap", bytefmt.ByteSize(uint64(e.config.MaxBucketBytes)),
 		)
+		return false
+	}
+	return true
+}
 
-		if err := os.Remove(bucketPath); err != nil {
-			return fmt.Errorf("remove bucket %d: %w", bucketID, err)
+// split streams an oversized bucket into sub-buckets and emits them in
+// sub-bucket order. Sub-bucket order carries no sort meaning, which is why
+// only non-ordered strategies such as clump hash buckets implement
+// SplittableBuckets.
+func (e *bucketEmitter) split(bucketPath string, orderPath string, size int64, level int) error {
+	splitter := e.bucketer.(SplittableBuckets)
+	count := int((size + e.config.MaxBucketBytes - 1) / e.config.MaxBucketBytes * 2)
+	if count > maxOpenBucketWriters {
+		count = maxOpenBucketWriters
+	}
+
+	name := filepath.Base(bucketPath)
+	tempDir := filepath.Join(filepath.Dir(bucketPath), name[:len(name)-len(filepath.Ext(name))]+"-split")
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return fmt.Errorf("create split dir: %w", err)
+	}
+
+	reader, err := _io.OpenReader(bucketPath)
+	if err != nil {
+		return err
+	}
+	orderFile, err := os.Open(orderPath)
+	if err != nil {
+		reader.Close()
+		return fmt.Errorf("open bucket order file: %w", err)
+	}
+	paths, orderPaths, sizes, _, _, err := partitionRecords(
+		reader,
+		newOrderScanner(orderFile),
+		nil,
+		tempDir,
+		e.config.RecordDelim,
+		count,
+		func(read fastq.FastqRead) int { return splitter.SubBucketID(read, level, count) },
+	)
+	reader.Close()
+	orderFile.Close()
+	if err != nil {
+		return err
+	}
+	if err := removeBucketFiles(bucketPath, orderPath); err != nil {
+		return err
+	}
+
+	e.splits++
+	slog.Debug(
+		"external bucket split",
+		"bucket", name,
+		"size", bytefmt.ByteSize(uint64(size)),
+		"sub_buckets", len(paths),
+	)
+
+	next := level + 1
+	if len(paths) == 1 {
+		// Every read shares one key; splitting again cannot help.
+		next = maxBucketSplitDepth
+	}
+	for subID := 0; subID < count; subID++ {
+		subPath, ok := paths[subID]
+		if !ok {
+			continue
 		}
-		if err := os.Remove(bucketOrderPaths[bucketID]); err != nil {
-			return fmt.Errorf("remove bucket order %d: %w", bucketID, err)
+		if err := e.emit(subPath, orderPaths[subID], sizes[subID], next); err != nil {
+			return err
 		}
 	}
+	return os.Remove(tempDir)
+}
 
+func removeBucketFiles(bucketPath string, orderPath string) error {
+	if err := os.Remove(bucketPath); err != nil {
+		return fmt.Errorf("remove bucket %s: %w", bucketPath, err)
+	}
+	if err := os.Remove(orderPath); err != nil {
+		return fmt.Errorf("remove bucket order %s: %w", orderPath, err)
+	}
 	return nil
 }
 
 // loadBucket reloads one temporary FASTQ bucket into memory and restores the
-// original global read indexes from the sidecar order file.
+// original global read indexes and any mates from the sidecar order file.
 func loadBucket(bucketPath string, orderPath string, delim byte) ([]fastq.FastqRead, error) {
 	reader, err := _io.OpenReader(bucketPath)
 	if err != nil {
@@ -371,17 +763,18 @@ func restoreOriginalOrder(reads []fastq.FastqRead, orderPath string) error {
 	}
 	defer orderFile.Close()
 
-	scanner := bufio.NewScanner(orderFile)
+	scanner := newOrderScanner(orderFile)
 	i := 0
 	for scanner.Scan() {
 		if i >= len(reads) {
 			return fmt.Errorf("bucket order file has more rows than reads")
 		}
-		order, err := strconv.Atoi(scanner.Text())
+		order, mates, err := parseOrderRow(scanner.Bytes())
 		if err != nil {
-			return fmt.Errorf("parse bucket order: %w", err)
+			return err
 		}
 		reads[i].I = order
+		reads[i].Mates = mates
 		i++
 	}
 	if err := scanner.Err(); err != nil {
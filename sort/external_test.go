@@ -5,6 +5,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -50,6 +52,201 @@ func TestRunExternalBucketSortAlpha(t *testing.T) {
 	}
 }
 
+func TestRunExternalBucketSortSplitsOversizeBuckets(t *testing.T) {
+	input := ""
+	for i := 0; i < 40; i++ {
+		sequence := string(pseudoRandomSequence(60, uint32(i%8)))
+		input += "@r" + strconv.Itoa(i) + "\n" + sequence + "\n+\n" + strings.Repeat("I", len(sequence)) + "\n"
+	}
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	sorter := ClumpSort{K: 15, LongRead: true}
+	config := ExternalBucketConfig{
+		InputFilepath:  inputPath,
+		OutputFilepath: filepath.Join(dir, "output.fastq.gz"),
+		OrderFilepath:  filepath.Join(dir, "order.txt"),
+		TempDir:        filepath.Join(dir, "tmp"),
+		RecordDelim:    '\n',
+		MaxBucketBytes: 1000,
+	}
+	stats, err := RunExternalBucketSort(config, sorter, NewClumpBucketsOpts(1, sorter.Options()))
+	if err != nil {
+		t.Fatalf("external sort: %v", err)
+	}
+	if stats.SplitBuckets == 0 {
+		t.Fatalf("split buckets = 0, want the single oversize bucket split")
+	}
+
+	// Reads that share a pivot must stay adjacent after the split: the eight
+	// distinct sequences each form one run of five reads.
+	reads := loadReadsFromString(t, readGzipFile(t, config.OutputFilepath))
+	if len(reads) != 40 {
+		t.Fatalf("output reads = %d, want 40", len(reads))
+	}
+	runs := 1
+	for i := 1; i < len(reads); i++ {
+		if string(reads[i].Sequence()) != string(reads[i-1].Sequence()) {
+			runs++
+		}
+	}
+	if runs != 8 {
+		t.Fatalf("identical reads form %d runs, want 8", runs)
+	}
+
+	order, err := os.ReadFile(config.OrderFilepath)
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, line := range strings.Fields(string(order)) {
+		seen[line] = true
+	}
+	if len(seen) != 40 {
+		t.Fatalf("order file has %d distinct indexes, want 40", len(seen))
+	}
+	if entries, _ := os.ReadDir(config.TempDir); len(entries) != 0 {
+		t.Fatalf("temp dir not cleaned up: %d entries left", len(entries))
+	}
+}
+
+func TestRunExternalBucketSortRemovesDuplicatesAcrossSplits(t *testing.T) {
+	input := ""
+	for i := 0; i < 40; i++ {
+		sequence := string(pseudoRandomSequence(60, uint32(i%8)))
+		input += "@r" + strconv.Itoa(i) + "\n" + sequence + "\n+\n" + strings.Repeat("I", len(sequence)) + "\n"
+	}
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	sorter := ClumpSort{K: 15, Dedupe: DedupeOptions{Enabled: true}}
+	config := ExternalBucketConfig{
+		InputFilepath:    inputPath,
+		OutputFilepath:   filepath.Join(dir, "output.fastq.gz"),
+		OrderFilepath:    filepath.Join(dir, "order.txt"),
+		TempDir:          filepath.Join(dir, "tmp"),
+		RecordDelim:      '\n',
+		MaxBucketBytes:   1000,
+		RemoveDuplicates: true,
+	}
+	stats, err := RunExternalBucketSort(config, sorter, NewClumpBucketsOpts(1, sorter.Options()))
+	if err != nil {
+		t.Fatalf("external sort: %v", err)
+	}
+	if stats.Reads != 40 || stats.Duplicates != 32 {
+		t.Fatalf("reads/duplicates = %d/%d, want 40/32", stats.Reads, stats.Duplicates)
+	}
+
+	// Equal qualities keep the first copy of each sequence, reads 1-8.
+	order, err := os.ReadFile(config.OrderFilepath)
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	kept := strings.Fields(string(order))
+	if len(kept) != 8 {
+		t.Fatalf("order file has %d rows, want 8", len(kept))
+	}
+	for _, line := range kept {
+		if index, _ := strconv.Atoi(line); index < 1 || index > 8 {
+			t.Fatalf("kept read %d, want one of the first copies 1-8", index)
+		}
+	}
+	if reads := loadReadsFromString(t, readGzipFile(t, config.OutputFilepath)); len(reads) != 8 {
+		t.Fatalf("output reads = %d, want 8", len(reads))
+	}
+}
+
+func TestRunExternalBucketSortComparesMatesAcrossSplits(t *testing.T) {
+	input, mates := "", ""
+	for i := 0; i < 40; i++ {
+		sequence := string(pseudoRandomSequence(60, uint32(i%8)))
+		input += "@r" + strconv.Itoa(i) + "\n" + sequence + "\n+\n" + strings.Repeat("I", len(sequence)) + "\n"
+		// Sixteen distinct mates split the eight primary copies in two. The
+		// last reads carry a sequencing error in their mate, which the
+		// mismatch allowance absorbs.
+		mate := pseudoRandomSequence(40, uint32(100+i%16))
+		if i >= 32 {
+			if mate[0] == 'A' {
+				mate[0] = 'C'
+			} else {
+				mate[0] = 'A'
+			}
+		}
+		mates += "@r" + strconv.Itoa(i) + "\n" + string(mate) + "\n+\n" + strings.Repeat("I", len(mate)) + "\n"
+	}
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	matePath := filepath.Join(dir, "mates.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	if err := os.WriteFile(matePath, []byte(mates), 0644); err != nil {
+		t.Fatalf("write mates: %v", err)
+	}
+
+	sorter := ClumpSort{K: 15, Dedupe: DedupeOptions{Enabled: true, Mismatches: 1}}
+	config := ExternalBucketConfig{
+		InputFilepath:    inputPath,
+		OutputFilepath:   filepath.Join(dir, "output.fastq.gz"),
+		OrderFilepath:    filepath.Join(dir, "order.txt"),
+		TempDir:          filepath.Join(dir, "tmp"),
+		RecordDelim:      '\n',
+		MaxBucketBytes:   1000,
+		RemoveDuplicates: true,
+		MateFilepaths:    []string{matePath},
+	}
+	stats, err := RunExternalBucketSort(config, sorter, NewClumpBucketsOpts(1, sorter.Options()))
+	if err != nil {
+		t.Fatalf("external sort: %v", err)
+	}
+	if stats.Reads != 40 || stats.Duplicates != 24 || stats.SplitBuckets == 0 {
+		t.Fatalf("reads/duplicates/splits = %d/%d/%d, want 40/24/>0", stats.Reads, stats.Duplicates, stats.SplitBuckets)
+	}
+
+	if err := os.WriteFile(matePath, []byte(mates[:len(mates)/2]), 0644); err != nil {
+		t.Fatalf("write mates: %v", err)
+	}
+	if _, err := RunExternalBucketSort(config, sorter, NewClumpBucketsOpts(1, sorter.Options())); err == nil {
+		t.Fatalf("external sort with a short companion succeeded, want an error")
+	}
+}
+
+func TestLengthRangeBuckets(t *testing.T) {
+	bucketer := NewLengthRangeBuckets(8, 100000)
+	reads := loadReadsFromString(t, ""+
+		"@a\nA\n+\nI\n"+
+		"@b\n"+strings.Repeat("A", 150)+"\n+\n"+strings.Repeat("I", 150)+"\n"+
+		"@c\n"+strings.Repeat("A", 5000)+"\n+\n"+strings.Repeat("I", 5000)+"\n"+
+		"@d\n"+strings.Repeat("A", 200000)+"\n+\n"+strings.Repeat("I", 200000)+"\n")
+	previous := -1
+	for _, read := range reads {
+		id := bucketer.BucketID(read)
+		if id < 0 || id >= bucketer.BucketCount() {
+			t.Fatalf("bucket id %d outside [0, %d)", id, bucketer.BucketCount())
+		}
+		if id <= previous {
+			t.Fatalf("length %d got bucket %d, not above previous bucket %d", len(read.Sequence()), id, previous)
+		}
+		previous = id
+	}
+	if previous != bucketer.BucketCount()-1 {
+		t.Fatalf("reads longer than maxLength should use the last bucket, got %d", previous)
+	}
+	if bucketer.OrderedFor(LengthSort{Descending: true}) || !bucketer.OrderedFor(LengthSort{}) {
+		t.Fatalf("ascending length buckets must be ordered for ascending length sort only")
+	}
+	descending := bucketer.WithDescending(true)
+	if !descending.OrderedFor(LengthSort{Descending: true}) || descending.BucketID(reads[0]) != bucketer.BucketCount()-1 {
+		t.Fatalf("descending length buckets must put the shortest read in the last bucket")
+	}
+}
+
 func readGzipFile(t *testing.T, path string) string {
 	t.Helper()
 
@@ -0,0 +1,158 @@
+package sort
+
+import (
+	"bytes"
+	go_sort "sort"
+
+	fastq "squish/fastq"
+)
+
+// Header orders for reads that tie on everything but their header and
+// quality, such as identical sequences in a clump.
+const (
+	// HeaderOrderOff breaks ties on quality bytes, then header bytes.
+	HeaderOrderOff = "off"
+	// HeaderOrderTokens breaks ties on the header in natural order, so
+	// Illumina lane, tile, and x/y coordinates compare as numbers.
+	HeaderOrderTokens = "tokens"
+	// HeaderOrderSimilarity starts from the token order, then chains each run
+	// of tied reads so every header follows the one it shares the longest
+	// prefix with.
+	HeaderOrderSimilarity = "similarity"
+)
+
+// headerSimilarityMaxGroup caps the runs HeaderOrderSimilarity reorders; the
+// greedy chain is quadratic, and larger runs keep the token order.
+const headerSimilarityMaxGroup = 256
+
+// ValidHeaderOrder reports whether order is one of the header orders. The
+// empty string means HeaderOrderOff.
+func ValidHeaderOrder(order string) bool {
+	switch order {
+	case "", HeaderOrderOff, HeaderOrderTokens, HeaderOrderSimilarity:
+		return true
+	}
+	return false
+}
+
+// ordersHeaders reports whether order breaks ties on the header before the
+// quality bytes.
+func ordersHeaders(order string) bool {
+	return order == HeaderOrderTokens || order == HeaderOrderSimilarity
+}
+
+// HeaderStats measures how well the headers of tied reads compress in the
+// output order. A tie group is a run of two or more adjacent reads with the
+// same sequence; SharedBytes counts the header bytes of each group member
+// that repeat the prefix of the header before it, and DefaultSharedBytes the
+// same in the default order, quality bytes then header bytes. Their
+// difference is the header prefix the chosen order gives LZ77 to reuse.
+type HeaderStats struct {
+	Groups             int
+	Reads              int
+	HeaderBytes        int
+	SharedBytes        int
+	DefaultSharedBytes int
+}
+
+// Add returns the sum of two stats, for totals across buckets.
+func (s HeaderStats) Add(other HeaderStats) HeaderStats {
+	return HeaderStats{
+		Groups:             s.Groups + other.Groups,
+		Reads:              s.Reads + other.Reads,
+		HeaderBytes:        s.HeaderBytes + other.HeaderBytes,
+		SharedBytes:        s.SharedBytes + other.SharedBytes,
+		DefaultSharedBytes: s.DefaultSharedBytes + other.DefaultSharedBytes,
+	}
+}
+
+// CountHeaderSharing measures the tie groups of sorted reads.
+func CountHeaderSharing(reads []fastq.FastqRead) HeaderStats {
+	stats := HeaderStats{}
+	for start := 0; start < len(reads); {
+		end := start + 1
+		for end < len(reads) && bytes.Equal(reads[end].Sequence(), reads[start].Sequence()) {
+			end++
+		}
+		if group := reads[start:end]; len(group) > 1 {
+			stats.Groups++
+			stats.Reads += len(group)
+			for _, read := range group {
+				stats.HeaderBytes += len(read.Id())
+			}
+			stats.SharedBytes += sharedHeaderBytes(group)
+			defaultOrder := append([]fastq.FastqRead(nil), group...)
+			go_sort.Slice(defaultOrder, func(x, y int) bool {
+				a, b := defaultOrder[x], defaultOrder[y]
+				if c := bytes.Compare(a.QualityScores(), b.QualityScores()); c != 0 {
+					return c < 0
+				}
+				if c := bytes.Compare(a.Id(), b.Id()); c != 0 {
+					return c < 0
+				}
+				return a.I < b.I
+			})
+			stats.DefaultSharedBytes += sharedHeaderBytes(defaultOrder)
+		}
+		start = end
+	}
+	return stats
+}
+
+func sharedHeaderBytes(reads []fastq.FastqRead) int {
+	shared := 0
+	for i := 1; i < len(reads); i++ {
+		shared += commonPrefixLength(reads[i-1].Id(), reads[i].Id())
+	}
+	return shared
+}
+
+func commonPrefixLength(a []byte, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// chainHeadersBySimilarity reorders each run of sorted clump reads with the
+// same pivot, pivot position, and sequence: starting from the header closest
+// to the read before the run, each next read is the remaining one sharing
+// the longest header prefix with the last, ties going to the earlier read.
+// The runs arrive in token order, which the chain only refines.
+func chainHeadersBySimilarity(clumpReads []clumpRead) {
+	for start := 0; start < len(clumpReads); {
+		end := start + 1
+		for end < len(clumpReads) && sameClumpSequence(clumpReads[start], clumpReads[end]) {
+			end++
+		}
+		if end-start > 1 && end-start <= headerSimilarityMaxGroup {
+			var previous []byte
+			if start > 0 {
+				previous = clumpReads[start-1].read.Id()
+			}
+			chainGroup(clumpReads[start:end], previous)
+		}
+		start = end
+	}
+}
+
+func sameClumpSequence(a clumpRead, b clumpRead) bool {
+	return a.pivotPos == b.pivotPos && bytes.Equal(a.key, b.key) && bytes.Equal(a.read.Sequence(), b.read.Sequence())
+}
+
+func chainGroup(group []clumpRead, previous []byte) {
+	for i := range group {
+		best, bestShared := i, -1
+		for j := i; j < len(group); j++ {
+			if shared := commonPrefixLength(previous, group[j].read.Id()); shared > bestShared {
+				best, bestShared = j, shared
+			}
+		}
+		// Moving best to i keeps the remaining reads in token order.
+		chosen := group[best]
+		copy(group[i+1:best+1], group[i:best])
+		group[i] = chosen
+		previous = chosen.read.Id()
+	}
+}
@@ -0,0 +1,379 @@
+package sort
+
+import (
+	"fmt"
+	"strings"
+
+	fastq "squish/fastq"
+)
+
+// Key fields accepted by ParseKeyExpression. Aliases map to these names.
+const (
+	KeyFieldLength   = "len"
+	KeyFieldGC       = "gc"
+	KeyFieldSequence = "seq"
+	KeyFieldQuality  = "qual"
+	KeyFieldName     = "name"
+	KeyFieldTile     = "tile"
+	KeyFieldClump    = "clump"
+	KeyFieldBarcode  = "bc"
+	KeyFieldUMI      = "umi"
+	KeyFieldQMean    = QualityMetricMean
+	KeyFieldQMedian  = QualityMetricMedian
+	KeyFieldEE       = QualityMetricExpectedErrors
+	KeyFieldQ30      = QualityMetricQ30
+)
+
+var keyFieldAliases = map[string]string{
+	"len":      KeyFieldLength,
+	"length":   KeyFieldLength,
+	"gc":       KeyFieldGC,
+	"seq":      KeyFieldSequence,
+	"sequence": KeyFieldSequence,
+	"alpha":    KeyFieldSequence,
+	"qual":     KeyFieldQuality,
+	"quality":  KeyFieldQuality,
+	"name":     KeyFieldName,
+	"tile":     KeyFieldTile,
+	"clump":    KeyFieldClump,
+	"bc":       KeyFieldBarcode,
+	"barcode":  KeyFieldBarcode,
+	"cb":       KeyFieldBarcode,
+	"umi":      KeyFieldUMI,
+	"ub":       KeyFieldUMI,
+	"qmean":    KeyFieldQMean,
+	"qmedian":  KeyFieldQMedian,
+	"ee":       KeyFieldEE,
+	"q30":      KeyFieldQ30,
+}
+
+// KeyField is one component of a composite sort key.
+type KeyField struct {
+	Field      string
+	Descending bool
+}
+
+func (f KeyField) String() string {
+	if f.Descending {
+		return f.Field + ":desc"
+	}
+	return f.Field
+}
+
+// ParseKeyExpression parses a comma-separated key expression such as
+// "len:desc,gc,seq". Each field may carry an ":asc" or ":desc" suffix; the
+// default is ascending. A field may appear only once.
+func ParseKeyExpression(expression string) ([]KeyField, error) {
+	var fields []KeyField
+	seen := map[string]bool{}
+	for _, part := range strings.Split(expression, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, direction, _ := strings.Cut(part, ":")
+		field, ok := keyFieldAliases[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown key field %q", name)
+		}
+		if seen[field] {
+			return nil, fmt.Errorf("key field %q appears more than once", field)
+		}
+		seen[field] = true
+
+		keyField := KeyField{Field: field}
+		switch strings.ToLower(strings.TrimSpace(direction)) {
+		case "", "asc":
+		case "desc":
+			keyField.Descending = true
+		default:
+			return nil, fmt.Errorf("unknown direction %q for key field %q, want asc or desc", direction, field)
+		}
+		fields = append(fields, keyField)
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty key expression %q", expression)
+	}
+	return fields, nil
+}
+
+// CompositeSort orders reads by a list of key fields, comparing each field in
+// turn and falling back to input order, like the single-field sorters.
+//
+// Fields:
+//
+//	len   sequence length
+//	gc    GC content of the windowed sequence
+//	seq   windowed sequence bytes
+//	qual  quality bytes
+//	name  header in natural numeric order
+//	tile  Illumina lane, tile, x, y
+//	clump clump pivot k-mer, then pivot offset
+//	bc    cell barcode, from Barcode
+//	umi   UMI, from UMI
+//	qmean, qmedian, ee, q30
+//	      quality metrics, as for QualityMetricSort
+//
+// The clump field uses Clump's pivot settings without the count filters,
+// which need a frequency table, and without reverse-complementing reads.
+type CompositeSort struct {
+	Fields []KeyField
+	// Window applies to the seq and gc fields, as for AlphaSort and GCSort.
+	Window KeyWindow
+	// Clump configures pivot selection for the clump field.
+	Clump ClumpSortOptions
+	// Barcode and UMI extract the tags of the bc and umi fields. A key such
+	// as "bc,umi,clump" keeps molecule families together before clumping.
+	Barcode TagExtractor
+	UMI     TagExtractor
+}
+
+// NewCompositeSort parses expression into a CompositeSort.
+func NewCompositeSort(expression string) (CompositeSort, error) {
+	fields, err := ParseKeyExpression(expression)
+	if err != nil {
+		return CompositeSort{}, err
+	}
+	return CompositeSort{Fields: fields}, nil
+}
+
+func (CompositeSort) Name() string { return "key" }
+
+// CheckTags returns an error when the bc or umi field is used without its
+// extractor.
+func (s CompositeSort) CheckTags() error {
+	for _, field := range s.Fields {
+		if field.Field == KeyFieldBarcode && s.Barcode.IsZero() {
+			return fmt.Errorf("key field %s requires a barcode tag", field.Field)
+		}
+		if field.Field == KeyFieldUMI && s.UMI.IsZero() {
+			return fmt.Errorf("key field %s requires a UMI tag", field.Field)
+		}
+	}
+	return nil
+}
+
+// Expression returns the normalised key expression, e.g. "len:desc,gc,seq".
+func (s CompositeSort) Expression() string {
+	parts := make([]string, len(s.Fields))
+	for i, field := range s.Fields {
+		parts[i] = field.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// clumpSelector returns the pivot selector for the clump field. Like
+// NewClumpBucketsOpts it honours the blacklist but not the count filters.
+func (s CompositeSort) clumpSelector() pivotSelector {
+	var eligible func([]byte) bool
+	if len(s.Clump.Blacklist) > 0 {
+		blacklist := s.Clump.Blacklist
+		eligible = func(kmer []byte) bool { return !blacklist.Contains(kmer) }
+	}
+	return s.Clump.selector(eligible)
+}
+
+func (s CompositeSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	return keyedLess(s, a, b)
+}
+
+// SortKeys concatenates the keys of the fields in turn, complementing the
+// descending ones. Quality metric fields share one cached scan per read.
+func (s CompositeSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	selector := s.clumpSelector()
+	for _, field := range s.Fields {
+		if IsQualityMetric(field.Field) {
+			cacheQualityMetrics(reads)
+			break
+		}
+	}
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		for _, field := range s.Fields {
+			start := len(dst)
+			dst = s.appendField(dst, field.Field, read, selector)
+			if field.Descending {
+				invertKey(dst[start:])
+			}
+		}
+		return dst
+	})
+}
+
+func (s CompositeSort) appendField(dst []byte, field string, read fastq.FastqRead, selector pivotSelector) []byte {
+	switch field {
+	case KeyFieldLength:
+		return appendLengthKey(dst, len(read.Sequence()), false)
+	case KeyFieldGC:
+		return appendKeyFloat(dst, s.Window.gcContent(read))
+	case KeyFieldSequence:
+		return appendKeyBytes(dst, s.Window.Apply(read.Sequence()))
+	case KeyFieldQuality:
+		return appendKeyBytes(dst, read.QualityScores())
+	case KeyFieldName:
+		return appendNameKey(dst, read.Id())
+	case KeyFieldTile:
+		return appendTileKey(dst, read)
+	case KeyFieldClump:
+		var quality []byte
+		if selector.minQuality > 0 {
+			quality = read.QualityScores()
+		}
+		pivot, pos, _ := selector.pivot(read.Sequence(), quality)
+		dst = appendKeyBytes(dst, pivot)
+		return appendKeyUint(dst, uint64(pos))
+	case KeyFieldQMean, KeyFieldQMedian, KeyFieldEE, KeyFieldQ30:
+		return appendKeyFloat(dst, qualityMetric(&read, field))
+	case KeyFieldBarcode:
+		return appendKeyBytes(dst, s.Barcode.Extract(read))
+	case KeyFieldUMI:
+		return appendKeyBytes(dst, s.UMI.Extract(read))
+	default:
+		return dst
+	}
+}
+
+// sameKeys reports whether s and other build the same key for every read.
+func (s CompositeSort) sameKeys(other CompositeSort) bool {
+	if len(s.Fields) != len(other.Fields) || s.Window != other.Window {
+		return false
+	}
+	for i := range s.Fields {
+		if s.Fields[i] != other.Fields[i] {
+			return false
+		}
+	}
+	if s.Barcode.Spec != other.Barcode.Spec || s.UMI.Spec != other.UMI.Spec {
+		return false
+	}
+	a, b := s.Clump, other.Clump
+	return a.K == b.K && a.RawPivot == b.RawPivot && a.Border == b.Border &&
+		a.MinQuality == b.MinQuality && a.SkipAmbiguous == b.SkipAmbiguous &&
+		a.Window == b.Window && a.Seed.String() == b.Seed.String() &&
+		a.MinimizerWindow == b.MinimizerWindow && sameKmerSet(a.Blacklist, b.Blacklist)
+}
+
+func sameKmerSet(a KmerSet, b KmerSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for kmer := range a {
+		if _, ok := b[kmer]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// leadingSorter returns the single-field ascending sorter equivalent to the
+// leading key field. Its default bucket strategy orders the leading key.
+func (s CompositeSort) leadingSorter() SortStrategy {
+	if len(s.Fields) == 0 {
+		return nil
+	}
+	switch s.Fields[0].Field {
+	case KeyFieldLength:
+		return LengthSort{}
+	case KeyFieldGC:
+		return GCSort{Window: s.Window}
+	case KeyFieldSequence:
+		return AlphaSort{Window: s.Window}
+	case KeyFieldQuality:
+		return QualitySort{}
+	case KeyFieldName:
+		return NameSort{}
+	case KeyFieldTile:
+		return TileSort{}
+	case KeyFieldClump:
+		return ClumpSort{
+			K:             s.Clump.K,
+			Blacklist:     s.Clump.Blacklist,
+			RawPivot:      s.Clump.RawPivot,
+			Border:        s.Clump.Border,
+			MinQuality:    s.Clump.MinQuality,
+			SkipAmbiguous: s.Clump.SkipAmbiguous,
+			Window:        s.Clump.Window,
+			Seed:          s.Clump.Seed,
+
+			MinimizerWindow: s.Clump.MinimizerWindow,
+		}
+	case KeyFieldQMean, KeyFieldQMedian, KeyFieldEE, KeyFieldQ30:
+		return QualityMetricSort{Metric: s.Fields[0].Field}
+	default:
+		return nil
+	}
+}
+
+// LeadingKeyBuckets derives a bucket strategy from the leading key field: the
+// ordered buckets of the equivalent single-field sorter, with bucket IDs
+// reversed for a descending field. The result is ordered for s whenever the
+// underlying buckets are ordered for the leading field, so concatenated
+// buckets give an exact global sort. A leading clump field gives plain clump
+// hash buckets, which only keep clumps together.
+//
+// sampledNames, when the leading field is name or tile, places the
+// name-prefix bucket boundaries or picks the lane-tile buckets; without it
+// name keys share a single bucket and tile keys one bucket for parsed headers.
+func (s CompositeSort) LeadingKeyBuckets(bucketCount int, sampledNames [][]byte) BucketStrategy {
+	leading := s.leadingSorter()
+	var inner BucketStrategy
+	switch s.Fields[0].Field {
+	case KeyFieldLength:
+		inner = NewLengthRangeBuckets(bucketCount, DefaultMaxReadLength)
+	case KeyFieldGC:
+		inner = NewGCRangeBuckets(bucketCount).WithWindow(s.Window)
+	case KeyFieldSequence:
+		inner = NewSequencePrefixBuckets(1).WithWindow(s.Window)
+	case KeyFieldQuality:
+		inner = NewQualityPrefixBuckets(1)
+	case KeyFieldName:
+		inner = NewNamePrefixBuckets(bucketCount, sampledNames)
+	case KeyFieldTile:
+		inner = NewLaneTileBuckets(bucketCount, sampledNames)
+	case KeyFieldClump:
+		// Hash buckets have no order to reverse; returning them unwrapped
+		// keeps them splittable under a bucket size cap.
+		return NewClumpBucketsOpts(bucketCount, leading.(ClumpSort).Options())
+	case KeyFieldQMean, KeyFieldQMedian, KeyFieldEE, KeyFieldQ30:
+		inner = NewQualityRangeBuckets(bucketCount, s.Fields[0].Field)
+	default:
+		return NewHashBuckets(bucketCount)
+	}
+	return leadingKeyBuckets{inner: inner, leading: leading, field: s.Fields[0], window: s.Window}
+}
+
+// leadingKeyBuckets wraps the buckets of the leading key field, reversing
+// bucket IDs for descending fields.
+type leadingKeyBuckets struct {
+	inner   BucketStrategy
+	leading SortStrategy
+	field   KeyField
+	window  KeyWindow
+}
+
+func (b leadingKeyBuckets) Name() string {
+	if b.field.Descending {
+		return b.inner.Name() + "-desc"
+	}
+	return b.inner.Name()
+}
+
+func (b leadingKeyBuckets) BucketCount() int { return b.inner.BucketCount() }
+
+func (b leadingKeyBuckets) BucketID(read fastq.FastqRead) int {
+	id := b.inner.BucketID(read)
+	if b.field.Descending {
+		return b.inner.BucketCount() - 1 - id
+	}
+	return id
+}
+
+func (b leadingKeyBuckets) OrderedFor(sorter SortStrategy) bool {
+	composite, ok := sorter.(CompositeSort)
+	if !ok || len(composite.Fields) == 0 {
+		return false
+	}
+	if composite.Fields[0] != b.field || composite.Window != b.window {
+		return false
+	}
+	return b.inner.OrderedFor(b.leading)
+}
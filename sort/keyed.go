@@ -0,0 +1,310 @@
+package sort
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	go_sort "sort"
+
+	fastq "squish/fastq"
+	_io "squish/fastqio"
+)
+
+// KeyedStrategy is a SortStrategy whose order is given by one
+// byte-comparable key per read: reads are ordered by bytes.Compare of their
+// keys, and reads with equal keys by input index. Keys are built once per
+// read, so sorting never calls Less, and the same keys can place bucket
+// boundaries or be sorted by radix.
+//
+// Keys depend only on the read itself, except where a strategy documents
+// otherwise: ClumpSort's count filters and AbundanceSort without a table
+// count k-mers or sequences over the reads passed to SortKeys.
+type KeyedStrategy interface {
+	SortStrategy
+	// SortKeys returns the key of every read, in the order of reads.
+	SortKeys(reads []fastq.FastqRead) [][]byte
+}
+
+// FinishingStrategy is a KeyedStrategy that rewrites reads once they are in
+// key order, such as CanonicalAlphaSort flipping the reads whose key is their
+// reverse complement.
+type FinishingStrategy interface {
+	KeyedStrategy
+	// FinishSort is called with the sorted reads and their keys.
+	FinishSort(reads []fastq.FastqRead, keys [][]byte)
+}
+
+// TieBreakingStrategy is a KeyedStrategy that orders reads with equal keys
+// itself before the input index, so its keys need not copy the sequence or
+// quality bytes the tie-break compares.
+type TieBreakingStrategy interface {
+	KeyedStrategy
+	// TieCompare compares two reads whose keys are equal and returns -1, 0,
+	// or +1.
+	TieCompare(a fastq.FastqRead, b fastq.FastqRead) int
+}
+
+// SortReadsKeyed sorts reads by the keys of sorter, then by the tie-break of
+// a TieBreakingStrategy and input index, and lets a FinishingStrategy rewrite
+// the sorted reads. A ClumpSort goes through SortReadsClumpOpts, which keeps
+// the pivot strands its keys leave out for flipping, correction, and
+// duplicate marking.
+func SortReadsKeyed(reads []fastq.FastqRead, sorter KeyedStrategy) {
+	if clump, ok := sorter.(ClumpSort); ok {
+		SortReadsClumpOpts(&reads, clump.Options())
+		return
+	}
+	keys := sorter.SortKeys(reads)
+	go_sort.Sort(newKeyedSorter(reads, keys, sorter))
+	if finisher, ok := sorter.(FinishingStrategy); ok {
+		finisher.FinishSort(reads, keys)
+	}
+}
+
+type keyedSorter struct {
+	reads []fastq.FastqRead
+	keys  [][]byte
+	tie   func(a fastq.FastqRead, b fastq.FastqRead) int // nil without a tie-break
+}
+
+func newKeyedSorter(reads []fastq.FastqRead, keys [][]byte, sorter KeyedStrategy) keyedSorter {
+	s := keyedSorter{reads: reads, keys: keys}
+	if tieBreaker, ok := sorter.(TieBreakingStrategy); ok {
+		s.tie = tieBreaker.TieCompare
+	}
+	return s
+}
+
+func (s keyedSorter) Len() int { return len(s.reads) }
+
+func (s keyedSorter) Less(i, j int) bool {
+	if c := bytes.Compare(s.keys[i], s.keys[j]); c != 0 {
+		return c < 0
+	}
+	if s.tie != nil {
+		if c := s.tie(s.reads[i], s.reads[j]); c != 0 {
+			return c < 0
+		}
+	}
+	return s.reads[i].I < s.reads[j].I
+}
+
+func (s keyedSorter) Swap(i, j int) {
+	s.reads[i], s.reads[j] = s.reads[j], s.reads[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// keyedLess compares two reads by their keys, built as a batch of the two.
+func keyedLess(sorter KeyedStrategy, a fastq.FastqRead, b fastq.FastqRead) bool {
+	keys := sorter.SortKeys([]fastq.FastqRead{a, b})
+	return newKeyedSorter([]fastq.FastqRead{a, b}, keys, sorter).Less(0, 1)
+}
+
+// readKeys builds the key of every read with appendKey, packing all keys into
+// one buffer instead of allocating each one.
+func readKeys(reads []fastq.FastqRead, appendKey func(dst []byte, read fastq.FastqRead) []byte) [][]byte {
+	var buffer []byte
+	ends := make([]int, len(reads))
+	for i, read := range reads {
+		buffer = appendKey(buffer, read)
+		ends[i] = len(buffer)
+	}
+	keys := make([][]byte, len(reads))
+	start := 0
+	for i, end := range ends {
+		keys[i] = buffer[start:end:end]
+		start = end
+	}
+	return keys
+}
+
+// Keys are built from components that compare bytewise in the same order as
+// their values, and that are prefix-free, so concatenated components compare
+// field by field and complementing a component reverses its order.
+
+// appendKeyBytes appends value with every 0x00 escaped as 0x00 0xFF and a
+// 0x00 0x01 terminator, so a shorter value sorts before its extensions.
+func appendKeyBytes(dst []byte, value []byte) []byte {
+	for _, b := range value {
+		if b == 0 {
+			dst = append(dst, 0, 0xFF)
+			continue
+		}
+		dst = append(dst, b)
+	}
+	return append(dst, 0, 1)
+}
+
+// decodeKeyBytes reverses appendKeyBytes at the start of key and returns the
+// value and the rest of the key.
+func decodeKeyBytes(key []byte) ([]byte, []byte) {
+	var value []byte
+	for i := 0; i+1 < len(key); i++ {
+		if key[i] != 0 {
+			value = append(value, key[i])
+			continue
+		}
+		if key[i+1] == 1 {
+			return value, key[i+2:]
+		}
+		value = append(value, 0)
+		i++
+	}
+	return value, nil
+}
+
+func appendKeyUint(dst []byte, value uint64) []byte {
+	return append(dst,
+		byte(value>>56), byte(value>>48), byte(value>>40), byte(value>>32),
+		byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func decodeKeyUint(key []byte) uint64 {
+	var value uint64
+	for _, b := range key[:8] {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// appendKeyInt flips the sign bit so negative values sort first.
+func appendKeyInt(dst []byte, value int) []byte {
+	return appendKeyUint(dst, uint64(value)^(1<<63))
+}
+
+// appendKeyFloat maps the IEEE 754 bits so that bytewise order matches
+// numeric order: positive values get the sign bit set, negative values are
+// complemented.
+func appendKeyFloat(dst []byte, value float64) []byte {
+	bits := math.Float64bits(value)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return appendKeyUint(dst, bits)
+}
+
+func appendKeyBool(dst []byte, value bool) []byte {
+	if value {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+// invertKey complements key in place, reversing the order of a prefix-free
+// component.
+func invertKey(key []byte) {
+	for i := range key {
+		key[i] = ^key[i]
+	}
+}
+
+// KeysPerRead reports whether sorter is a KeyedStrategy whose keys depend
+// only on each read, so keys built one read at a time order any batch.
+// ClumpSort is excluded even without count filters because its clumps must
+// stay in one bucket for correction and duplicate marking.
+func KeysPerRead(sorter SortStrategy) bool {
+	switch s := sorter.(type) {
+	case ClumpSort:
+		return false
+	case AbundanceSort:
+		return s.Table != nil
+	}
+	_, ok := sorter.(KeyedStrategy)
+	return ok
+}
+
+// DefaultKeyRangeSampleReads is the number of reads sampled to place the
+// key-range bucket boundaries.
+const DefaultKeyRangeSampleReads = 10000
+
+// KeyRangeBuckets are ordered buckets for any KeyedStrategy whose keys depend
+// only on each read. Like NamePrefixBuckets, the boundaries are splitter keys
+// taken from a sample of reads, so buckets are roughly equal in size whatever
+// the key layout, and bucket i holds the keys between splitter i-1 and
+// splitter i. Reads with equal keys always share a bucket.
+type KeyRangeBuckets struct {
+	sorter    KeyedStrategy
+	splitters [][]byte
+}
+
+// NewKeyRangeBuckets picks up to bucketCount-1 splitters from the keys of
+// sampled reads. With no samples every read goes to bucket 0.
+func NewKeyRangeBuckets(bucketCount int, sorter KeyedStrategy, sampled []fastq.FastqRead) KeyRangeBuckets {
+	keys := sorter.SortKeys(sampled)
+	go_sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	splitters := [][]byte{}
+	for i := 1; i < bucketCount && len(keys) > 0; i++ {
+		splitter := keys[i*len(keys)/bucketCount]
+		if len(splitters) > 0 && bytes.Equal(splitters[len(splitters)-1], splitter) {
+			continue
+		}
+		splitters = append(splitters, splitter)
+	}
+	return KeyRangeBuckets{sorter: sorter, splitters: splitters}
+}
+
+// SampleKeyRangeBuckets builds key-range buckets from a uniform sample of
+// sampleReads reads drawn from the whole input.
+func SampleKeyRangeBuckets(inputFilepath string, delim byte, bucketCount int, sampleReads int, sorter KeyedStrategy) (KeyRangeBuckets, error) {
+	if sampleReads < 1 {
+		sampleReads = DefaultKeyRangeSampleReads
+	}
+	reader, err := _io.OpenReader(inputFilepath)
+	if err != nil {
+		return KeyRangeBuckets{}, err
+	}
+	defer reader.Close()
+
+	// A fixed seed keeps the bucket layout identical between runs, as for
+	// SampleReadNames.
+	rng := rand.New(rand.NewSource(1))
+	sample := make([]fastq.FastqRead, 0, sampleReads)
+	readIndex := 0
+	for seen := 0; ; seen++ {
+		read, _, err := fastq.ReadNextReadE(reader, &delim, &readIndex)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return KeyRangeBuckets{}, fmt.Errorf("sample key-range buckets: %w", err)
+		}
+		if len(sample) < sampleReads {
+			sample = append(sample, read)
+		} else if r := rng.Intn(seen + 1); r < sampleReads {
+			sample[r] = read
+		}
+	}
+	return NewKeyRangeBuckets(bucketCount, sorter, sample), nil
+}
+
+func (b KeyRangeBuckets) Name() string { return "key-range" }
+
+func (b KeyRangeBuckets) BucketCount() int { return len(b.splitters) + 1 }
+
+func (b KeyRangeBuckets) BucketID(read fastq.FastqRead) int {
+	key := b.sorter.SortKeys([]fastq.FastqRead{read})[0]
+	return go_sort.Search(len(b.splitters), func(i int) bool {
+		return bytes.Compare(key, b.splitters[i]) < 0
+	})
+}
+
+// OrderedFor reports true for the sorter the buckets were sampled with, when
+// its keys depend only on each read.
+func (b KeyRangeBuckets) OrderedFor(sorter SortStrategy) bool {
+	if !KeysPerRead(sorter) {
+		return false
+	}
+	if composite, ok := sorter.(CompositeSort); ok {
+		sampled, ok := b.sorter.(CompositeSort)
+		return ok && composite.sameKeys(sampled)
+	}
+	// The other per-read keyed strategies are comparable values, whose
+	// tables, indexes, and command keys compare by pointer.
+	return sorter == SortStrategy(b.sorter)
+}
@@ -0,0 +1,105 @@
+package sort
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	_io "squish/fastqio"
+)
+
+// KmerSet holds canonical k-mers keyed by their string form. It is used to
+// exclude known repeat or adapter k-mers from clump pivot selection.
+type KmerSet map[string]struct{}
+
+// Contains reports whether the canonical k-mer is in the set. A nil set
+// contains nothing, so callers can check it without a separate nil test.
+func (s KmerSet) Contains(kmer []byte) bool {
+	if len(s) == 0 {
+		return false
+	}
+	_, ok := s[string(kmer)]
+	return ok
+}
+
+// AddSequence adds every canonical k-mer of sequence to the set. Sequences
+// shorter than k contribute nothing because they cannot match a pivot.
+func (s KmerSet) AddSequence(sequence []byte, k int) {
+	s.AddSequenceSeed(sequence, k, SpacedSeed{})
+}
+
+// AddSequenceSeed is AddSequence for a spaced seed: keys are built from the
+// seed's masked positions so they match spaced-seed pivots.
+func (s KmerSet) AddSequenceSeed(sequence []byte, k int, seed SpacedSeed) {
+	forEachCanonicalKmer(sequence, k, seed, func(_ int, canonical []byte, _ bool) {
+		s[string(canonical)] = struct{}{}
+	})
+}
+
+// LoadKmerBlacklist reads a FASTA file of adapters, repeats, or individual
+// k-mers and returns every canonical k-mer of length k found in it. A non-zero
+// seed stores spaced-seed keys instead, matching a spaced-seed ClumpSort.
+//
+// Multi-line FASTA records are joined before k-mers are extracted so k-mers
+// spanning line breaks are included. Lines that appear before the first '>'
+// header are treated as one sequence each, which also accepts a plain
+// newline-delimited k-mer list. Gzip-compressed files are supported.
+func LoadKmerBlacklist(path string, k int, seed SpacedSeed) (KmerSet, error) {
+	if seed.span(k) < 1 {
+		return nil, fmt.Errorf("blacklist k-mer length must be >= 1, got %d", k)
+	}
+	reader, err := _io.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	set := KmerSet{}
+	var record []byte
+	inRecord := false
+	for {
+		line, err := reader.Reader.ReadBytes('\n')
+		if len(line) > 0 {
+			// Upper-case the input so soft-masked adapter files produce the
+			// same canonical k-mers as upper-case read sequences.
+			line = bytes.ToUpper(bytes.TrimSpace(line))
+			switch {
+			case len(line) == 0:
+			case line[0] == '>':
+				set.AddSequenceSeed(record, k, seed)
+				record = record[:0]
+				inRecord = true
+			case inRecord:
+				record = append(record, line...)
+			default:
+				set.AddSequenceSeed(line, k, seed)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("read blacklist %q: %w", path, err)
+		}
+	}
+	set.AddSequenceSeed(record, k, seed)
+	return set, nil
+}
+
+// forEachCanonicalKmer calls fn for every k-mer window in sequence with the
+// window start, the canonical key, and whether the canonical form came from
+// the reverse complement. A non-zero seed replaces the contiguous k-mer with
+// the seed's masked positions. The canonical slice is reused between calls,
+// so fn must copy it if it needs to retain the bytes.
+func forEachCanonicalKmer(sequence []byte, k int, seed SpacedSeed, fn func(pos int, canonical []byte, rc bool)) {
+	span := seed.span(k)
+	if span < 1 || len(sequence) < span {
+		return
+	}
+	c := newCanonicalizer(span, seed)
+	for i := 0; i+span <= len(sequence); i++ {
+		canonical, rc := c.canonical(sequence[i : i+span])
+		fn(i, canonical, rc)
+	}
+}
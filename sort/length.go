@@ -0,0 +1,115 @@
+package sort
+
+import (
+	"math"
+
+	fastq "squish/fastq"
+)
+
+// DefaultMaxReadLength is the upper bound of the length-range buckets. Longer
+// reads are clamped into the last bucket.
+const DefaultMaxReadLength = 1 << 20
+
+// LengthSort orders reads by sequence length, shortest first unless
+// Descending is set. Amplicon, small RNA, and adapter-trimmed libraries have
+// very variable lengths; grouping equal lengths keeps the quality and
+// sequence lines of neighbouring records aligned and eases batching by length
+// downstream. Reads of equal length keep their input order.
+type LengthSort struct {
+	Descending bool
+}
+
+func (LengthSort) Name() string { return "length" }
+
+func (s LengthSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	if la, lb := len(a.Sequence()), len(b.Sequence()); la != lb {
+		if s.Descending {
+			return la > lb
+		}
+		return la < lb
+	}
+	return a.I < b.I
+}
+
+func (s LengthSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendLengthKey(dst, len(read.Sequence()), s.Descending)
+	})
+}
+
+func appendLengthKey(dst []byte, length int, descending bool) []byte {
+	start := len(dst)
+	dst = appendKeyUint(dst, uint64(length))
+	if descending {
+		invertKey(dst[start:])
+	}
+	return dst
+}
+
+// sorterDescending reports whether a sorter emits keys from high to low.
+// Ordered bucket strategies must then emit buckets in reverse key order.
+func sorterDescending(sorter SortStrategy) bool {
+	if s, ok := sorter.(LengthSort); ok {
+		return s.Descending
+	}
+	return false
+}
+
+// LengthRangeBuckets assigns reads to geometrically spaced read-length ranges
+// between 1 and maxLength. Geometric ranges keep bucket sizes balanced for
+// long-read data, whose lengths span several orders of magnitude, and bucket
+// IDs increase with read length, or decrease with WithDescending.
+type LengthRangeBuckets struct {
+	bucketCount int
+	maxLength   int
+	descending  bool
+}
+
+// NewLengthRangeBuckets creates length-range buckets. A maxLength < 2 falls
+// back to DefaultMaxReadLength.
+func NewLengthRangeBuckets(bucketCount int, maxLength int) LengthRangeBuckets {
+	if bucketCount < 1 {
+		bucketCount = 1
+	}
+	if maxLength < 2 {
+		maxLength = DefaultMaxReadLength
+	}
+	return LengthRangeBuckets{bucketCount: bucketCount, maxLength: maxLength}
+}
+
+// WithDescending reverses the bucket IDs so longer reads get lower IDs,
+// matching LengthSort{Descending: true}.
+func (b LengthRangeBuckets) WithDescending(descending bool) LengthRangeBuckets {
+	b.descending = descending
+	return b
+}
+
+func (b LengthRangeBuckets) Name() string { return "length-range" }
+
+func (b LengthRangeBuckets) BucketCount() int { return b.bucketCount }
+
+func (b LengthRangeBuckets) BucketID(read fastq.FastqRead) int {
+	bucketID := b.lengthBucket(len(read.Sequence()))
+	if b.descending {
+		return b.bucketCount - 1 - bucketID
+	}
+	return bucketID
+}
+
+func (b LengthRangeBuckets) lengthBucket(length int) int {
+	if length <= 1 {
+		return 0
+	}
+	bucketID := int(math.Log(float64(length)) / math.Log(float64(b.maxLength)) * float64(b.bucketCount))
+	if bucketID >= b.bucketCount {
+		return b.bucketCount - 1
+	}
+	return bucketID
+}
+
+// OrderedFor reports true for LengthSort in the same direction. Bucket IDs
+// never decrease with length, so concatenating sorted buckets is a global
+// length sort.
+func (b LengthRangeBuckets) OrderedFor(sorter SortStrategy) bool {
+	return sorter.Name() == "length" && sorterDescending(sorter) == b.descending
+}
@@ -0,0 +1,69 @@
+package sort
+
+import "math"
+
+// DefaultLongReadMinimizerWindow is the (w,k)-minimizer window used in
+// long-read mode when no window is configured.
+const DefaultLongReadMinimizerWindow = 10
+
+// minimizerSample restricts pivot candidates to the (w,k)-minimizers of the
+// scanned region: in every run of w consecutive k-mer windows, only the window
+// with the smallest sampling hash is kept.
+//
+// Two long reads that overlap share almost all of their minimizers even when
+// errors destroy many individual k-mers, so picking the pivot from this
+// sample keeps noisy reads from the same locus together. It also cuts the
+// number of eligibility lookups and pivot comparisons per read by about w/2.
+//
+// The sampling hash is a remix of the pivot hash. Using the pivot hash itself
+// would make every sampled k-mer a local minimum of the very value the pivot
+// search maximises.
+func (p pivotSelector) minimizerSample(sequence []byte, k int, border int, usable func(int) bool) func(int) bool {
+	lo, hi := border, len(sequence)-border-k+1
+	if hi-lo <= p.minimizerWindow {
+		// The region holds no more than one window: keep every candidate.
+		return usable
+	}
+
+	hashes := make([]uint64, hi-lo)
+	c := newCanonicalizer(k, p.seed)
+	for i := lo; i < hi; i++ {
+		if usable != nil && !usable(i) {
+			hashes[i-lo] = math.MaxUint64
+			continue
+		}
+		canonical, _ := c.canonical(sequence[i : i+k])
+		hashes[i-lo] = mixHash(hashKmer(canonical))
+	}
+
+	// Sliding-window minimum with a monotone deque of window offsets.
+	sampled := make([]bool, hi-lo)
+	deque := make([]int, 0, p.minimizerWindow)
+	w := p.minimizerWindow
+	for i := range hashes {
+		for len(deque) > 0 && hashes[deque[len(deque)-1]] >= hashes[i] {
+			deque = deque[:len(deque)-1]
+		}
+		deque = append(deque, i)
+		if deque[0] <= i-w {
+			deque = deque[1:]
+		}
+		if i >= w-1 && hashes[deque[0]] != math.MaxUint64 {
+			sampled[deque[0]] = true
+		}
+	}
+	return func(i int) bool {
+		return i >= lo && i < hi && sampled[i-lo]
+	}
+}
+
+// mixHash is the SplitMix64 finalizer. It decorrelates the minimizer sampling
+// order from the FNV pivot hash.
+func mixHash(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,246 @@
+package sort
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	go_sort "sort"
+
+	fastq "squish/fastq"
+	_io "squish/fastqio"
+)
+
+// DefaultNameBucketSampleReads is the number of headers sampled to place the
+// name-prefix bucket boundaries.
+const DefaultNameBucketSampleReads = 10000
+
+// namePrefixLen is the number of natural-key bytes name-prefix buckets look
+// at. Reads whose keys share this prefix always land in the same bucket.
+const namePrefixLen = 32
+
+// NameSort orders reads by header with natural numeric ordering, so
+// "read2" sorts before "read10" and Illumina headers sort by lane, tile, x
+// and y as numbers. Runs of digits compare by value; everything else compares
+// bytewise.
+type NameSort struct{}
+
+func (NameSort) Name() string { return "name" }
+
+func (NameSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	if c := NaturalCompare(a.Id(), b.Id()); c != 0 {
+		return c < 0
+	}
+	// Headers equal in value but not in bytes, such as "r01" and "r1", fall
+	// back to bytewise order, then to input order.
+	if c := bytes.Compare(a.Id(), b.Id()); c != 0 {
+		return c < 0
+	}
+	return a.I < b.I
+}
+
+func (NameSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendNameKey(dst, read.Id())
+	})
+}
+
+// appendNameKey appends the natural key of id, then id itself for headers
+// that are equal in value but not in bytes.
+func appendNameKey(dst []byte, id []byte) []byte {
+	dst = appendKeyBytes(dst, naturalKey(id))
+	return appendKeyBytes(dst, id)
+}
+
+// NaturalCompare compares a and b treating each run of ASCII digits as one
+// number. Numbers compare by value, ignoring leading zeros; a number compared
+// with any other byte compares as '0'. It returns -1, 0, or +1.
+//
+// The result always matches bytes.Compare on naturalKey(a) and
+// naturalKey(b), which is what lets name-prefix buckets stay ordered.
+func NaturalCompare(a []byte, b []byte) int {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a[i]) || !isDigit(b[j]) {
+			ca, cb := naturalByte(a[i]), naturalByte(b[j])
+			if ca != cb {
+				if ca < cb {
+					return -1
+				}
+				return 1
+			}
+			i++
+			j++
+			continue
+		}
+		runA, nextI := digitRun(a, i)
+		runB, nextJ := digitRun(b, j)
+		if len(runA) != len(runB) {
+			if len(runA) < len(runB) {
+				return -1
+			}
+			return 1
+		}
+		if c := bytes.Compare(runA, runB); c != 0 {
+			return c
+		}
+		i, j = nextI, nextJ
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	default:
+		return 0
+	}
+}
+
+// naturalKey encodes id so that bytewise order of the encoding equals
+// NaturalCompare order. Each digit run becomes '0', the number of significant
+// digits, then the significant digits. Runs longer than 255 digits are not
+// expected in read names and are truncated.
+func naturalKey(id []byte) []byte {
+	key := make([]byte, 0, len(id)+8)
+	for i := 0; i < len(id); {
+		if !isDigit(id[i]) {
+			key = append(key, id[i])
+			i++
+			continue
+		}
+		run, next := digitRun(id, i)
+		if len(run) > 255 {
+			run = run[:255]
+		}
+		key = append(key, '0', byte(len(run)))
+		key = append(key, run...)
+		i = next
+	}
+	return key
+}
+
+// digitRun returns the digits of the run starting at start without leading
+// zeros, and the index just after the run.
+func digitRun(s []byte, start int) ([]byte, int) {
+	end := start
+	for end < len(s) && isDigit(s[end]) {
+		end++
+	}
+	significant := start
+	for significant < end && s[significant] == '0' {
+		significant++
+	}
+	return s[significant:end], end
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func naturalByte(c byte) byte {
+	if isDigit(c) {
+		return '0'
+	}
+	return c
+}
+
+// NamePrefixBuckets assigns reads to ordered buckets by the first
+// namePrefixLen bytes of their natural header key.
+//
+// Read headers usually share a long common prefix (instrument, run, flowcell),
+// so fixed byte-prefix buckets would put every read in one bucket. Instead the
+// bucket boundaries are splitter keys taken from a sample of headers: bucket i
+// holds the keys between splitter i-1 and splitter i. Bucket IDs therefore
+// follow NameSort order and buckets are roughly equal in size.
+type NamePrefixBuckets struct {
+	splitters [][]byte
+}
+
+// NewNamePrefixBuckets picks up to bucketCount-1 splitters from sampled
+// headers. With no samples every read goes to bucket 0.
+func NewNamePrefixBuckets(bucketCount int, sampledIDs [][]byte) NamePrefixBuckets {
+	keys := make([][]byte, 0, len(sampledIDs))
+	for _, id := range sampledIDs {
+		keys = append(keys, truncateKey(naturalKey(id)))
+	}
+	go_sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	splitters := [][]byte{}
+	for i := 1; i < bucketCount && len(keys) > 0; i++ {
+		splitter := keys[i*len(keys)/bucketCount]
+		if len(splitters) > 0 && bytes.Equal(splitters[len(splitters)-1], splitter) {
+			continue
+		}
+		splitters = append(splitters, splitter)
+	}
+	return NamePrefixBuckets{splitters: splitters}
+}
+
+// SampleNamePrefixBuckets builds name-prefix buckets from a sample of
+// sampleReads headers drawn by SampleReadNames.
+func SampleNamePrefixBuckets(inputFilepath string, delim byte, bucketCount int, sampleReads int) (NamePrefixBuckets, error) {
+	sample, err := SampleReadNames(inputFilepath, delim, sampleReads)
+	if err != nil {
+		return NamePrefixBuckets{}, err
+	}
+	return NewNamePrefixBuckets(bucketCount, sample), nil
+}
+
+// SampleReadNames draws a uniform reservoir sample of sampleReads headers
+// from the whole input. The whole file is read because inputs are often
+// already in name or tile order, so the first reads alone would not cover the
+// key range.
+func SampleReadNames(inputFilepath string, delim byte, sampleReads int) ([][]byte, error) {
+	if sampleReads < 1 {
+		sampleReads = DefaultNameBucketSampleReads
+	}
+	reader, err := _io.OpenReader(inputFilepath)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// A fixed seed keeps the bucket layout, and so the temp files, identical
+	// between runs on the same input.
+	rng := rand.New(rand.NewSource(1))
+	sample := make([][]byte, 0, sampleReads)
+	readIndex := 0
+	for seen := 0; ; seen++ {
+		read, _, err := fastq.ReadNextReadE(reader, &delim, &readIndex)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("sample read names: %w", err)
+		}
+		if len(sample) < sampleReads {
+			sample = append(sample, append([]byte(nil), read.Id()...))
+		} else if r := rng.Intn(seen + 1); r < sampleReads {
+			sample[r] = append(sample[r][:0], read.Id()...)
+		}
+	}
+	return sample, nil
+}
+
+func truncateKey(key []byte) []byte {
+	if len(key) > namePrefixLen {
+		return key[:namePrefixLen]
+	}
+	return key
+}
+
+func (b NamePrefixBuckets) Name() string { return "name-prefix" }
+
+func (b NamePrefixBuckets) BucketCount() int { return len(b.splitters) + 1 }
+
+func (b NamePrefixBuckets) BucketID(read fastq.FastqRead) int {
+	key := truncateKey(naturalKey(read.Id()))
+	// Truncation and the upper-bound search are both monotone in the key, so
+	// bucket IDs never decrease in NameSort order.
+	return go_sort.Search(len(b.splitters), func(i int) bool {
+		return bytes.Compare(key, b.splitters[i]) < 0
+	})
+}
+
+func (b NamePrefixBuckets) OrderedFor(sorter SortStrategy) bool {
+	return sorter.Name() == "name"
+}
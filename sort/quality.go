@@ -0,0 +1,144 @@
+package sort
+
+import (
+	"math"
+
+	fastq "squish/fastq"
+)
+
+// Quality metrics accepted by QualityMetricSort and QualityRangeBuckets. They
+// double as sort method names.
+const (
+	QualityMetricMean           = "qmean"
+	QualityMetricMedian         = "qmedian"
+	QualityMetricExpectedErrors = "ee"
+	QualityMetricQ30            = "q30"
+)
+
+// DefaultMaxExpectedErrors is the upper bound of the expected-error range
+// buckets. Reads with more expected errors are clamped into the last bucket.
+const DefaultMaxExpectedErrors = 1 << 16
+
+// IsQualityMetric reports whether metric names a quality metric.
+func IsQualityMetric(metric string) bool {
+	switch metric {
+	case QualityMetricMean, QualityMetricMedian, QualityMetricExpectedErrors, QualityMetricQ30:
+		return true
+	default:
+		return false
+	}
+}
+
+// qualityMetric returns the metric of read from its cached quality metrics.
+// An unknown metric falls back to the mean Phred score.
+func qualityMetric(read *fastq.FastqRead, metric string) float64 {
+	quality := read.QualityMetrics()
+	switch metric {
+	case QualityMetricMedian:
+		return quality.Median
+	case QualityMetricExpectedErrors:
+		return quality.ExpectedErrors
+	case QualityMetricQ30:
+		return quality.Q30Fraction
+	default:
+		return quality.Mean
+	}
+}
+
+// QualityMetricSort orders reads by a numeric quality metric, lowest first:
+//
+//	qmean    mean Phred score
+//	qmedian  median Phred score
+//	ee       expected errors, the sum of per-base error probabilities
+//	q30      fraction of bases at Q30 or above
+//
+// Unlike QualitySort, which compares raw quality bytes and so mostly the
+// first cycles, these summarise the whole read. Reads with equal values keep
+// their input order. An empty Metric means qmean.
+type QualityMetricSort struct {
+	Metric string
+}
+
+func (s QualityMetricSort) Name() string {
+	if !IsQualityMetric(s.Metric) {
+		return QualityMetricMean
+	}
+	return s.Metric
+}
+
+func (s QualityMetricSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	if va, vb := qualityMetric(&a, s.Metric), qualityMetric(&b, s.Metric); va != vb {
+		return va < vb
+	}
+	return a.I < b.I
+}
+
+// SortKeys caches the quality metrics on reads, so a later Less on the same
+// reads does not scan the quality strings again.
+func (s QualityMetricSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	cacheQualityMetrics(reads)
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendKeyFloat(dst, qualityMetric(&read, s.Metric))
+	})
+}
+
+// cacheQualityMetrics computes the quality metrics of every read once and
+// caches them on the read.
+func cacheQualityMetrics(reads []fastq.FastqRead) {
+	for i := range reads {
+		reads[i].QualityMetrics()
+	}
+}
+
+// QualityRangeBuckets divides the range of a quality metric into fixed
+// ranges. Phred metrics span 0-93 linearly and q30 spans 0-1; expected errors
+// use a log scale up to DefaultMaxExpectedErrors, which keeps most buckets for
+// the low error counts of short reads. Bucket IDs increase with the metric, so
+// the buckets are ordered for a QualityMetricSort on the same metric.
+type QualityRangeBuckets struct {
+	bucketCount int
+	metric      string
+}
+
+// NewQualityRangeBuckets creates quality-range buckets for metric. An unknown
+// metric falls back to qmean.
+func NewQualityRangeBuckets(bucketCount int, metric string) QualityRangeBuckets {
+	if bucketCount < 1 {
+		bucketCount = 1
+	}
+	if !IsQualityMetric(metric) {
+		metric = QualityMetricMean
+	}
+	return QualityRangeBuckets{bucketCount: bucketCount, metric: metric}
+}
+
+func (b QualityRangeBuckets) Name() string { return "quality-range" }
+
+func (b QualityRangeBuckets) BucketCount() int { return b.bucketCount }
+
+func (b QualityRangeBuckets) BucketID(read fastq.FastqRead) int {
+	value := qualityMetric(&read, b.metric)
+	var fraction float64
+	switch b.metric {
+	case QualityMetricQ30:
+		fraction = value
+	case QualityMetricExpectedErrors:
+		fraction = math.Log1p(value) / math.Log1p(DefaultMaxExpectedErrors)
+	default:
+		fraction = value / fastq.MaxPhredScore
+	}
+	bucketID := int(fraction * float64(b.bucketCount))
+	if bucketID < 0 {
+		return 0
+	}
+	if bucketID >= b.bucketCount {
+		return b.bucketCount - 1
+	}
+	return bucketID
+}
+
+// OrderedFor reports true for a QualityMetricSort on the same metric.
+func (b QualityRangeBuckets) OrderedFor(sorter SortStrategy) bool {
+	_, ok := sorter.(QualityMetricSort)
+	return ok && sorter.Name() == b.metric
+}
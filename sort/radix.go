@@ -0,0 +1,166 @@
+package sort
+
+import (
+	"bytes"
+	go_sort "sort"
+
+	fastq "squish/fastq"
+)
+
+// radixInsertionCutoff is the group size below which the radix sort falls
+// back to a comparison sort of the remaining packed bytes.
+const radixInsertionCutoff = 32
+
+// radixItem is one read in the radix sort: its windowed sequence packed four
+// bases per byte, first base in the high bits, with A=0, C=1, G=2, T=3. The
+// last byte is padded with A.
+type radixItem struct {
+	packed []byte
+	length int
+	index  int // position in the unsorted reads
+	i      int // input index, the tie-break
+}
+
+// radixCode maps A, C, G and T to their 2-bit code, and every other byte to
+// 0xFF. The codes keep the byte order of the bases.
+var radixCode = func() [256]byte {
+	var code [256]byte
+	for i := range code {
+		code[i] = 0xFF
+	}
+	code['A'], code['C'], code['G'], code['T'] = 0, 1, 2, 3
+	return code
+}()
+
+// packSequence appends sequence packed four bases per byte to dst. It
+// reports false, leaving dst unchanged, when the sequence has a byte other
+// than A, C, G or T.
+func packSequence(dst []byte, sequence []byte) ([]byte, bool) {
+	start := len(dst)
+	var current byte
+	for i, base := range sequence {
+		code := radixCode[base]
+		if code == 0xFF {
+			return dst[:start], false
+		}
+		current |= code << (6 - 2*(i%4))
+		if i%4 == 3 {
+			dst = append(dst, current)
+			current = 0
+		}
+	}
+	if len(sequence)%4 != 0 {
+		dst = append(dst, current)
+	}
+	return dst, true
+}
+
+// SortReadsAlphaRadix sorts reads in AlphaSort order: by windowed sequence
+// bytes, a prefix before its extensions, then by input index. Sequences of A,
+// C, G and T are packed two bits per base and sorted by an MSD radix sort, one
+// byte (four bases) per pass. Sequences with N, IUPAC codes or lowercase
+// bases take an escape path: they are compared as bytes and merged with the
+// radix-sorted reads.
+func SortReadsAlphaRadix(reads []fastq.FastqRead, window KeyWindow) {
+	var buffer []byte
+	ends := make([]int, 0, len(reads))
+	packed := make([]radixItem, 0, len(reads))
+	escaped := []int{}
+	for index, read := range reads {
+		sequence := window.Apply(read.Sequence())
+		var ok bool
+		if buffer, ok = packSequence(buffer, sequence); !ok {
+			escaped = append(escaped, index)
+			continue
+		}
+		ends = append(ends, len(buffer))
+		packed = append(packed, radixItem{length: len(sequence), index: index, i: read.I})
+	}
+	// Slice the packed bytes only once the buffer has stopped growing.
+	start := 0
+	for n, end := range ends {
+		packed[n].packed = buffer[start:end:end]
+		start = end
+	}
+
+	radixSort(packed, make([]radixItem, len(packed)), 0)
+
+	less := func(a int, b int) bool {
+		if c := bytes.Compare(window.Apply(reads[a].Sequence()), window.Apply(reads[b].Sequence())); c != 0 {
+			return c < 0
+		}
+		return reads[a].I < reads[b].I
+	}
+	go_sort.Slice(escaped, func(x, y int) bool { return less(escaped[x], escaped[y]) })
+
+	sorted := make([]fastq.FastqRead, 0, len(reads))
+	p, e := 0, 0
+	for p < len(packed) || e < len(escaped) {
+		if e == len(escaped) || (p < len(packed) && less(packed[p].index, escaped[e])) {
+			sorted = append(sorted, reads[packed[p].index])
+			p++
+			continue
+		}
+		sorted = append(sorted, reads[escaped[e]])
+		e++
+	}
+	copy(reads, sorted)
+}
+
+// radixSort sorts items that share their first depth packed bytes. Items
+// with no byte at depth hold exactly those bytes, so their sequences are
+// prefixes of the others: they come first, by length and then input index.
+// The rest are distributed by the byte at depth, stably, through scratch.
+func radixSort(items []radixItem, scratch []radixItem, depth int) {
+	if len(items) <= radixInsertionCutoff {
+		go_sort.Slice(items, func(x, y int) bool { return radixLess(items[x], items[y], depth) })
+		return
+	}
+
+	var counts [257]int
+	for _, item := range items {
+		counts[radixDigit(item, depth)]++
+	}
+	var offsets [257]int
+	for digit := 1; digit < len(offsets); digit++ {
+		offsets[digit] = offsets[digit-1] + counts[digit-1]
+	}
+	next := offsets
+	for _, item := range items {
+		digit := radixDigit(item, depth)
+		scratch[next[digit]] = item
+		next[digit]++
+	}
+	copy(items, scratch[:len(items)])
+
+	ended := items[:counts[0]]
+	go_sort.Slice(ended, func(x, y int) bool { return radixLess(ended[x], ended[y], depth) })
+	for digit := 1; digit < len(offsets); digit++ {
+		if counts[digit] > 1 {
+			group := offsets[digit]
+			radixSort(items[group:group+counts[digit]], scratch[group:group+counts[digit]], depth+1)
+		}
+	}
+}
+
+// radixDigit returns 0 for items that end before depth, and 1 plus the
+// packed byte at depth otherwise.
+func radixDigit(item radixItem, depth int) int {
+	if depth >= len(item.packed) {
+		return 0
+	}
+	return int(item.packed[depth]) + 1
+}
+
+// radixLess compares items that share their first depth packed bytes. A
+// byte padded with A compares equal to a byte ending in real A bases, and the
+// shorter sequence, the prefix, then comes first.
+func radixLess(a radixItem, b radixItem, depth int) bool {
+	if c := bytes.Compare(a.packed[depth:], b.packed[depth:]); c != 0 {
+		return c < 0
+	}
+	if a.length != b.length {
+		return a.length < b.length
+	}
+	return a.i < b.i
+}
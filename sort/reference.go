@@ -0,0 +1,343 @@
+package sort
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	fastq "squish/fastq"
+	_io "squish/fastqio"
+)
+
+// DefaultReferenceKmerLen is the k-mer length of the reference index. Odd
+// lengths have no palindromic k-mers, so every k-mer has a strand.
+const DefaultReferenceKmerLen = 21
+
+// ambiguousReferenceKmer marks index entries whose k-mer occurs more than
+// once in the reference. They carry no position and never vote.
+const ambiguousReferenceKmer = ^uint64(0)
+
+// ReferenceContig is one FASTA record of the reference. Offset is the
+// position of its first base in the concatenated reference coordinates.
+type ReferenceContig struct {
+	Name   string
+	Offset int
+	Length int
+}
+
+// ReferenceIndex maps the canonical k-mers of a reference to their position
+// and strand. Contigs are laid end to end, so a position is a single global
+// coordinate. K-mers occurring more than once are kept only as ambiguous
+// markers, so repeats do not pull reads towards an arbitrary copy.
+//
+// The index holds every unique k-mer in memory, roughly 40 bytes each, so it
+// suits bacterial, viral, and amplicon references. A Stride above 1 indexes
+// only every Stride-th reference position to save memory; reads still find
+// hits as long as they are at least K+Stride-1 bases long.
+type ReferenceIndex struct {
+	K       int
+	Stride  int
+	Contigs []ReferenceContig
+	Length  int // total bases across all contigs
+
+	kmers map[uint64]uint64 // canonical k-mer -> position<<1 | reverse
+}
+
+// NewReferenceIndex returns an empty index for k-mers of length k, indexing
+// every stride-th position. A stride < 1 is treated as 1.
+func NewReferenceIndex(k int, stride int) (*ReferenceIndex, error) {
+	if k < 1 || k > 32 {
+		return nil, fmt.Errorf("reference k-mer length must be between 1 and 32, got %d", k)
+	}
+	if stride < 1 {
+		stride = 1
+	}
+	return &ReferenceIndex{K: k, Stride: stride, kmers: map[uint64]uint64{}}, nil
+}
+
+// LoadReferenceIndex reads a FASTA reference and indexes its k-mers. Multi-line
+// records are joined, soft-masked bases are upper-cased, and k-mers containing
+// N or other non-ACGT bases are skipped. Gzip-compressed files are supported.
+func LoadReferenceIndex(path string, k int, stride int) (*ReferenceIndex, error) {
+	index, err := NewReferenceIndex(k, stride)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := _io.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var name string
+	var record []byte
+	inRecord := false
+	for {
+		line, err := reader.Reader.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimSpace(line)
+			switch {
+			case len(line) == 0:
+			case line[0] == '>':
+				if inRecord {
+					index.AddContig(name, record)
+				}
+				name = contigName(line[1:])
+				record = record[:0]
+				inRecord = true
+			case inRecord:
+				record = append(record, bytes.ToUpper(line)...)
+			default:
+				return nil, fmt.Errorf("read reference %q: sequence before the first FASTA header", path)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("read reference %q: %w", path, err)
+		}
+	}
+	if inRecord {
+		index.AddContig(name, record)
+	}
+	if len(index.Contigs) == 0 {
+		return nil, fmt.Errorf("read reference %q: no FASTA records found", path)
+	}
+	return index, nil
+}
+
+// contigName returns the first word of a FASTA header line.
+func contigName(header []byte) string {
+	if fields := bytes.Fields(header); len(fields) > 0 {
+		return string(fields[0])
+	}
+	return ""
+}
+
+// AddContig appends a contig to the reference and indexes its k-mers.
+// K-mers never span two contigs.
+func (index *ReferenceIndex) AddContig(name string, sequence []byte) {
+	offset := index.Length
+	index.Contigs = append(index.Contigs, ReferenceContig{Name: name, Offset: offset, Length: len(sequence)})
+	index.Length += len(sequence)
+	forEachEncodedKmer(sequence, index.K, func(pos int, canonical uint64, reverse bool) {
+		if pos%index.Stride != 0 {
+			return
+		}
+		if _, seen := index.kmers[canonical]; seen {
+			index.kmers[canonical] = ambiguousReferenceKmer
+			return
+		}
+		entry := uint64(offset+pos) << 1
+		if reverse {
+			entry |= 1
+		}
+		index.kmers[canonical] = entry
+	})
+}
+
+// UniqueKmers returns the number of indexed k-mers that occur once in the
+// reference.
+func (index *ReferenceIndex) UniqueKmers() int {
+	if index == nil {
+		return 0
+	}
+	unique := 0
+	for _, entry := range index.kmers {
+		if entry != ambiguousReferenceKmer {
+			unique++
+		}
+	}
+	return unique
+}
+
+// ReferenceHit is the approximate reference placement of a read. Position is
+// the global coordinate of the read's first aligned base on the forward
+// strand, and may fall slightly outside the reference when the read overhangs
+// a contig end. Reverse is set when the read matches the minus strand.
+type ReferenceHit struct {
+	Mapped   bool
+	Position int
+	Reverse  bool
+}
+
+// Locate places a read on the reference. Every k-mer of the read that is
+// unique in the reference votes for the read start it implies, and the start
+// with the most votes wins; ties go to the lower position, then the forward
+// strand. Reads without any unique k-mer hit are unmapped.
+func (index *ReferenceIndex) Locate(sequence []byte) ReferenceHit {
+	if index == nil || len(index.kmers) == 0 {
+		return ReferenceHit{}
+	}
+	votes := map[ReferenceHit]int{}
+	forEachEncodedKmer(sequence, index.K, func(pos int, canonical uint64, readReverse bool) {
+		entry, ok := index.kmers[canonical]
+		if !ok || entry == ambiguousReferenceKmer {
+			return
+		}
+		refPos := int(entry >> 1)
+		hit := ReferenceHit{Mapped: true, Reverse: readReverse != (entry&1 == 1)}
+		if hit.Reverse {
+			// The reverse complement of the read is on the forward strand, and
+			// this k-mer starts len-k-pos bases into it.
+			hit.Position = refPos - (len(sequence) - index.K - pos)
+		} else {
+			hit.Position = refPos - pos
+		}
+		votes[hit]++
+	})
+
+	best, bestVotes := ReferenceHit{}, 0
+	for hit, count := range votes {
+		if count > bestVotes || (count == bestVotes && referenceHitLess(hit, best)) {
+			best, bestVotes = hit, count
+		}
+	}
+	return best
+}
+
+// referenceHitLess orders mapped hits by position and then strand, forward
+// first, and unmapped hits after every mapped hit.
+func referenceHitLess(a ReferenceHit, b ReferenceHit) bool {
+	if a.Mapped != b.Mapped {
+		return a.Mapped
+	}
+	if a.Position != b.Position {
+		return a.Position < b.Position
+	}
+	return !a.Reverse && b.Reverse
+}
+
+// forEachEncodedKmer calls fn for every k-mer of sequence made only of ACGT,
+// with its start, its 2-bit canonical encoding, and whether the canonical form
+// is the reverse complement. Palindromic k-mers have no strand and are
+// skipped. k must be at most 32.
+func forEachEncodedKmer(sequence []byte, k int, fn func(pos int, canonical uint64, reverse bool)) {
+	if k < 1 || k > 32 || len(sequence) < k {
+		return
+	}
+	mask := ^uint64(0)
+	if k < 32 {
+		mask = 1<<(2*uint(k)) - 1
+	}
+	shift := 2 * uint(k-1)
+	var forward, reverse uint64
+	valid := 0
+	for i, base := range sequence {
+		code, ok := twoBitCode(base)
+		if !ok {
+			valid = 0
+			continue
+		}
+		forward = (forward<<2 | code) & mask
+		reverse = reverse>>2 | (3-code)<<shift
+		valid++
+		if valid < k {
+			continue
+		}
+		switch {
+		case forward < reverse:
+			fn(i-k+1, forward, false)
+		case reverse < forward:
+			fn(i-k+1, reverse, true)
+		}
+	}
+}
+
+func twoBitCode(base byte) (uint64, bool) {
+	switch base {
+	case 'A', 'a':
+		return 0, true
+	case 'C', 'c':
+		return 1, true
+	case 'G', 'g':
+		return 2, true
+	case 'T', 't':
+		return 3, true
+	default:
+		return 0, false
+	}
+}
+
+// ReferenceSort orders reads by their approximate reference position, like a
+// coordinate-sorted alignment file without the alignments. Reads from
+// neighbouring loci, and not only from the same clump, end up next to each
+// other, so gzip windows follow genomic locality. At equal positions forward
+// reads come first; unmapped reads follow all mapped reads in input order.
+//
+// Reads keep their orientation: the strand only breaks ties.
+type ReferenceSort struct {
+	Index *ReferenceIndex
+}
+
+func (ReferenceSort) Name() string { return "reference" }
+
+func (s ReferenceSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	return referenceReadLess(a, s.Index.Locate(a.Sequence()), b, s.Index.Locate(b.Sequence()))
+}
+
+// SortKeys locates every read once instead of twice per comparison.
+func (s ReferenceSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		hit := s.Index.Locate(read.Sequence())
+		if !hit.Mapped {
+			return appendKeyBool(dst, true)
+		}
+		dst = appendKeyBool(dst, false)
+		dst = appendKeyInt(dst, hit.Position)
+		return appendKeyBool(dst, hit.Reverse)
+	})
+}
+
+func referenceReadLess(a fastq.FastqRead, hitA ReferenceHit, b fastq.FastqRead, hitB ReferenceHit) bool {
+	if hitA != hitB {
+		return referenceHitLess(hitA, hitB)
+	}
+	return a.I < b.I
+}
+
+// PositionRangeBuckets splits the reference coordinates into equal ranges,
+// one bucket each, with a last bucket for unmapped reads. Bucket IDs increase
+// with position, so the buckets are ordered for a ReferenceSort on the same
+// index.
+type PositionRangeBuckets struct {
+	bucketCount int
+	index       *ReferenceIndex
+}
+
+// NewPositionRangeBuckets creates position-range buckets over index. The
+// bucket count includes the unmapped bucket and is at least 2.
+func NewPositionRangeBuckets(bucketCount int, index *ReferenceIndex) PositionRangeBuckets {
+	if bucketCount < 2 {
+		bucketCount = 2
+	}
+	return PositionRangeBuckets{bucketCount: bucketCount, index: index}
+}
+
+func (b PositionRangeBuckets) Name() string { return "position-range" }
+
+func (b PositionRangeBuckets) BucketCount() int { return b.bucketCount }
+
+func (b PositionRangeBuckets) BucketID(read fastq.FastqRead) int {
+	hit := b.index.Locate(read.Sequence())
+	if !hit.Mapped {
+		return b.bucketCount - 1
+	}
+	// Clamping keeps overhanging reads in range without reordering them.
+	position := hit.Position
+	if position < 0 {
+		position = 0
+	}
+	if position >= b.index.Length {
+		position = b.index.Length - 1
+	}
+	return int(int64(position) * int64(b.bucketCount-1) / int64(b.index.Length))
+}
+
+// OrderedFor reports true for a ReferenceSort using the same index.
+func (b PositionRangeBuckets) OrderedFor(sorter SortStrategy) bool {
+	referenceSorter, ok := sorter.(ReferenceSort)
+	return ok && referenceSorter.Index == b.index
+}
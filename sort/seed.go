@@ -0,0 +1,101 @@
+package sort
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// SpacedSeed selects which positions of a k-mer window contribute to the
+// pivot key. A mask such as "1101101101" spans 10 bases but only compares the
+// 7 positions marked '1', so a sequencing error at a '0' position does not
+// change the key and reads from the same locus stay in the same clump.
+//
+// The zero value is a contiguous seed: every position of a K-length window is
+// used, which matches the classic clump minimizer.
+type SpacedSeed struct {
+	mask      string
+	positions []int
+}
+
+// ParseSpacedSeed parses a mask of '1' (used) and '0' or '-' (ignored)
+// characters. An empty mask returns the zero, contiguous seed.
+func ParseSpacedSeed(mask string) (SpacedSeed, error) {
+	if mask == "" {
+		return SpacedSeed{}, nil
+	}
+	positions := make([]int, 0, len(mask))
+	for i, c := range mask {
+		switch c {
+		case '1':
+			positions = append(positions, i)
+		case '0', '-':
+		default:
+			return SpacedSeed{}, fmt.Errorf("spaced seed mask %q: invalid character %q at position %d (use 1, 0, or -)", mask, c, i)
+		}
+	}
+	if len(positions) == 0 {
+		return SpacedSeed{}, fmt.Errorf("spaced seed mask %q has no '1' positions", mask)
+	}
+	return SpacedSeed{mask: mask, positions: positions}, nil
+}
+
+// IsZero reports whether this is the contiguous (unspaced) seed.
+func (s SpacedSeed) IsZero() bool { return len(s.positions) == 0 }
+
+// Span is the number of bases covered by one seed window.
+func (s SpacedSeed) Span() int { return len(s.mask) }
+
+// Weight is the number of positions that contribute to the key.
+func (s SpacedSeed) Weight() int { return len(s.positions) }
+
+func (s SpacedSeed) String() string { return s.mask }
+
+// span returns the window length for k-mer extraction: the mask length for a
+// spaced seed, or k for a contiguous one.
+func (s SpacedSeed) span(k int) int {
+	if s.IsZero() {
+		return k
+	}
+	return s.Span()
+}
+
+// canonicalizer computes canonical k-mer keys for one seed shape, reusing its
+// buffers between windows. The returned key is only valid until the next call.
+//
+// For a spaced seed the mask is applied to the forward window and to the
+// reverse-complemented window. A read from the opposite strand sees exactly
+// those two keys swapped, so the canonical (smaller) key is strand-independent
+// even when the mask itself is not palindromic.
+type canonicalizer struct {
+	seed   SpacedSeed
+	rcBuf  []byte
+	fwdKey []byte
+	rcKey  []byte
+}
+
+func newCanonicalizer(span int, seed SpacedSeed) *canonicalizer {
+	c := &canonicalizer{seed: seed, rcBuf: make([]byte, span)}
+	if !seed.IsZero() {
+		c.fwdKey = make([]byte, seed.Weight())
+		c.rcKey = make([]byte, seed.Weight())
+	}
+	return c
+}
+
+// canonical returns the canonical key of window and whether it came from the
+// reverse complement. window must be exactly one seed span long.
+func (c *canonicalizer) canonical(window []byte) ([]byte, bool) {
+	reverseComplementInto(window, c.rcBuf)
+	fwd, rc := window, c.rcBuf
+	if !c.seed.IsZero() {
+		for i, p := range c.seed.positions {
+			c.fwdKey[i] = window[p]
+			c.rcKey[i] = c.rcBuf[p]
+		}
+		fwd, rc = c.fwdKey, c.rcKey
+	}
+	if bytes.Compare(rc, fwd) < 0 {
+		return rc, true
+	}
+	return fwd, false
+}
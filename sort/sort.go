@@ -1,14 +1,14 @@
 package sort
 
 import (
+	"fmt"
 	go_sort "sort"
 	fastq "squish/fastq"
 )
 
 // using built-in Go sort methods
 func SortReadsSequence(reads *[]fastq.FastqRead) {
-	sorter := AlphaSort{}
-	go_sort.Slice((*reads), func(i, j int) bool { return sorter.Less((*reads)[i], (*reads)[j]) })
+	SortReadsAlphaRadix(*reads, KeyWindow{})
 }
 
 func SortReadsGC(reads *[]fastq.FastqRead) {
@@ -21,6 +21,98 @@ func SortReadsQual(reads *[]fastq.FastqRead) {
 	go_sort.Slice((*reads), func(i, j int) bool { return sorter.Less((*reads)[i], (*reads)[j]) })
 }
 
+func SortReadsName(reads *[]fastq.FastqRead) {
+	sorter := NameSort{}
+	go_sort.Slice((*reads), func(i, j int) bool { return sorter.Less((*reads)[i], (*reads)[j]) })
+}
+
+func SortReadsLength(reads *[]fastq.FastqRead) {
+	sorter := LengthSort{}
+	go_sort.Slice((*reads), func(i, j int) bool { return sorter.Less((*reads)[i], (*reads)[j]) })
+}
+
+func SortReadsMeanQuality(reads *[]fastq.FastqRead) {
+	SortReadsStrategy(reads, QualityMetricSort{Metric: QualityMetricMean})
+}
+
+func SortReadsMedianQuality(reads *[]fastq.FastqRead) {
+	SortReadsStrategy(reads, QualityMetricSort{Metric: QualityMetricMedian})
+}
+
+func SortReadsExpectedErrors(reads *[]fastq.FastqRead) {
+	SortReadsStrategy(reads, QualityMetricSort{Metric: QualityMetricExpectedErrors})
+}
+
+func SortReadsQ30(reads *[]fastq.FastqRead) {
+	SortReadsStrategy(reads, QualityMetricSort{Metric: QualityMetricQ30})
+}
+
+func SortReadsCanonicalAlpha(reads *[]fastq.FastqRead) {
+	SortReadsStrategy(reads, CanonicalAlphaSort{})
+}
+
+func SortReadsAbundance(reads *[]fastq.FastqRead) {
+	SortReadsStrategy(reads, AbundanceSort{})
+}
+
+// SortReadsStrategy sorts reads with any SortStrategy. AlphaSort uses the
+// packed radix sort, and any other KeyedStrategy is sorted on its keys,
+// computed once per read; other strategies fall back to a Less-based loop.
+func SortReadsStrategy(reads *[]fastq.FastqRead, sorter SortStrategy) {
+	if alpha, ok := sorter.(AlphaSort); ok {
+		SortReadsAlphaRadix(*reads, alpha.Window)
+		return
+	}
+	if keyed, ok := sorter.(KeyedStrategy); ok {
+		SortReadsKeyed(*reads, keyed)
+		return
+	}
+	go_sort.Slice((*reads), func(i, j int) bool { return sorter.Less((*reads)[i], (*reads)[j]) })
+}
+
+// VerifyFlippedReads checks that every read flipped by the sorter is the
+// exact reverse complement of its input record: the sequence complements back
+// base for base, case and IUPAC codes included, and the quality string is
+// reversed. Bases changed by error correction are the only allowed
+// differences. It returns the number of flipped reads. Run it before
+// QuantizeReads, which replaces the quality string.
+func VerifyFlippedReads(reads []fastq.FastqRead) (int, error) {
+	flipped := 0
+	for _, read := range reads {
+		if !read.Flipped {
+			continue
+		}
+		flipped++
+		if !isCorrectedReverseComplement(read) {
+			return flipped, fmt.Errorf("flipped read %d (%s) is not the reverse complement of its input sequence", read.I, read.Id())
+		}
+		quality, rawQuality := read.QualityScores(), read.RawQualityScores()
+		if len(quality) != len(rawQuality) {
+			return flipped, fmt.Errorf("flipped read %d (%s) changed quality length from %d to %d", read.I, read.Id(), len(rawQuality), len(quality))
+		}
+		for i, q := range quality {
+			if q != rawQuality[len(rawQuality)-1-i] {
+				return flipped, fmt.Errorf("flipped read %d (%s) is not the reverse of its input quality", read.I, read.Id())
+			}
+		}
+	}
+	return flipped, nil
+}
+
+// isCorrectedReverseComplement reports whether the read sequence is the
+// reverse complement of its input sequence apart from at most CorrectedBases
+// positions.
+func isCorrectedReverseComplement(read fastq.FastqRead) bool {
+	if read.CorrectedBases == 0 {
+		return fastq.IsReverseComplement(read.Sequence(), read.RawSequence())
+	}
+	sequence, raw := read.Sequence(), read.RawSequence()
+	if len(sequence) != len(raw) {
+		return false
+	}
+	return withinMismatches(sequence, reverseComplement(raw), read.CorrectedBases)
+}
+
 // QuantizeReads bins quality scores to four Illumina levels. This is lossy —
 // the original quality values cannot be recovered. The four output levels are
 // Q2, Q11, Q25, Q37 (Phred+33 encoded as '#', ',', ':', 'F'). Reducing the
@@ -43,7 +135,7 @@ func quantizeByte(q byte) byte {
 	score := int(q) - 33
 	switch {
 	case score < 6:
-		return byte(2 + 33)  // Q2  → '#'
+		return byte(2 + 33) // Q2  → '#'
 	case score < 15:
 		return byte(11 + 33) // Q11 → ','
 	case score < 27:
@@ -1,10 +1,15 @@
 package sort
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	go_sort "sort"
 	fastq "squish/fastq"
 	_io "squish/fastqio"
+	"strings"
 	"testing"
 )
 
@@ -272,3 +277,1112 @@ func joinRecords(records []string) string {
 	}
 	return output
 }
+
+func TestSortReadsAlphaKeyWindow(t *testing.T) {
+	// The first two bases are an inline barcode. With Trim5=2 the reads are
+	// ordered by the bases after the barcode, in memory and external mode.
+	input := "" +
+		"@bc_aa\nAATTTT\n+\nIIIIII\n" +
+		"@bc_tt\nTTAAAA\n+\nIIIIII\n"
+	sorter := AlphaSort{Window: KeyWindow{Trim5: 2}}
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	want := []string{
+		"@bc_tt\nTTAAAA\n+\nIIIIII\n",
+		"@bc_aa\nAATTTT\n+\nIIIIII\n",
+	}
+	assertRecords(t, reads, want)
+	assertExternalSortOutput(t, input, sorter, NewSequencePrefixBuckets(1).WithWindow(sorter.Window), want)
+}
+
+func TestSortReadsGCKeyWindow(t *testing.T) {
+	// The trailing adapter GGGG would make high_tail the most GC-rich read;
+	// with Trim3=4 only the first four bases count.
+	input := "" +
+		"@high_tail\nAAAAGGGG\n+\nIIIIIIII\n" +
+		"@high_head\nGCGCAAAA\n+\nIIIIIIII\n"
+	sorter := GCSort{Window: KeyWindow{Trim3: 4}}
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	want := []string{
+		"@high_tail\nAAAAGGGG\n+\nIIIIIIII\n",
+		"@high_head\nGCGCAAAA\n+\nIIIIIIII\n",
+	}
+	assertRecords(t, reads, want)
+	assertExternalSortOutput(t, input, sorter, NewGCRangeBuckets(4).WithWindow(sorter.Window), want)
+}
+
+func TestPrefixBucketsWindowMustMatchSorter(t *testing.T) {
+	window := KeyWindow{Trim5: 3}
+	if NewSequencePrefixBuckets(1).OrderedFor(AlphaSort{Window: window}) {
+		t.Fatal("unwindowed prefix buckets should not be ordered for a windowed alpha sort")
+	}
+	if !NewSequencePrefixBuckets(1).WithWindow(window).OrderedFor(AlphaSort{Window: window}) {
+		t.Fatal("prefix buckets with the same window should be ordered for alpha sort")
+	}
+}
+
+func TestSortReadsClumpRCompKeepsCaseAndIUPAC(t *testing.T) {
+	// The poly-T read is on the minus strand of the poly-A pivot, so it flips.
+	reads := loadReadsFromString(t, "@r1\ntttRYtTT\n+\nABCDEFGH\n")
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 3, RComp: true})
+
+	if got, want := string(reads[0].QualityScores()), "HGFEDCBA"; got != want {
+		t.Fatalf("flipped quality = %q, want %q", got, want)
+	}
+	if !reads[0].Flipped {
+		t.Fatalf("read should be flipped")
+	}
+	if got, want := string(reads[0].Sequence()), "AAaRYaaa"; got != want {
+		t.Fatalf("flipped sequence = %q, want %q", got, want)
+	}
+	flipped, err := VerifyFlippedReads(reads)
+	if err != nil || flipped != 1 {
+		t.Fatalf("VerifyFlippedReads = %d, %v; want 1, nil", flipped, err)
+	}
+}
+
+func TestSortReadsClumpRCompFlipsUracil(t *testing.T) {
+	// U complements to A, which complements back to T, so the flip check must
+	// complement the input rather than the output.
+	reads := loadReadsFromString(t, "@r1\nTTTTTTTU\n+\nABCDEFGH\n@r2\nACGTACGT\n+\nABCDEFGH\n")
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 3, RComp: true})
+
+	var read fastq.FastqRead
+	for _, r := range reads {
+		if r.I == 1 {
+			read = r
+		}
+	}
+	if !read.Flipped {
+		t.Fatalf("read with U should be flipped")
+	}
+	if got, want := string(read.Sequence()), "AAAAAAAA"; got != want {
+		t.Fatalf("flipped sequence = %q, want %q", got, want)
+	}
+	if flipped, err := VerifyFlippedReads(reads); err != nil || flipped != 1 {
+		t.Fatalf("VerifyFlippedReads = %d, %v; want 1, nil", flipped, err)
+	}
+}
+
+func TestVerifyFlippedReadsRejectsCorruptedFlip(t *testing.T) {
+	reads := loadReadsFromString(t, "@r1\nAACG\n+\nABCD\n")
+	reads[0].Flipped = true
+	reads[0].OverrideSeq = []byte("CGNT") // wrong: N should be T
+	reads[0].OverrideQual = []byte("DCBA")
+	if _, err := VerifyFlippedReads(reads); err == nil {
+		t.Fatalf("expected an error for a sequence that is not the reverse complement")
+	}
+
+	reads[0].OverrideSeq = []byte("CGTT")
+	reads[0].OverrideQual = []byte("ABCD")
+	if _, err := VerifyFlippedReads(reads); err == nil {
+		t.Fatalf("expected an error for a quality string that was not reversed")
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"read2", "read10", -1},
+		{"read10", "read2", 1},
+		{"read01", "read1", 0},
+		{"a1b", "a1c", -1},
+		{"a2z", "a10b", -1},
+		{"a1", "a1x", -1},
+		{"a9", "ab", -1},
+		{"@M1:5:FC:1:1101:900:20", "@M1:5:FC:1:1101:1000:3", -1},
+		{"@M1:5:FC:1:2101:1:1", "@M1:5:FC:1:1101:9999:9999", 1},
+	}
+	for _, tc := range cases {
+		if got := NaturalCompare([]byte(tc.a), []byte(tc.b)); got != tc.want {
+			t.Errorf("NaturalCompare(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		// The bucket key encoding must order names exactly like the comparator.
+		keyCompare := bytes.Compare(naturalKey([]byte(tc.a)), naturalKey([]byte(tc.b)))
+		if keyCompare != tc.want {
+			t.Errorf("naturalKey order for %q, %q = %d, want %d", tc.a, tc.b, keyCompare, tc.want)
+		}
+	}
+}
+
+func TestSortReadsNameNatural(t *testing.T) {
+	input := "" +
+		"@read10\nAAAA\n+\nIIII\n" +
+		"@read2\nCCCC\n+\nIIII\n" +
+		"@read1\nGGGG\n+\nIIII\n"
+	want := []string{
+		"@read1\nGGGG\n+\nIIII\n",
+		"@read2\nCCCC\n+\nIIII\n",
+		"@read10\nAAAA\n+\nIIII\n",
+	}
+	reads := loadReadsFromString(t, input)
+	SortReadsName(&reads)
+	assertRecords(t, reads, want)
+
+	// With sampled splitters the reads span several ordered buckets and the
+	// external output still matches the in-memory sort.
+	sampled := [][]byte{[]byte("@read1"), []byte("@read2"), []byte("@read10")}
+	bucketer := NewNamePrefixBuckets(3, sampled)
+	if bucketer.BucketCount() != 3 {
+		t.Fatalf("bucket count = %d, want 3", bucketer.BucketCount())
+	}
+	if !bucketer.OrderedFor(NameSort{}) {
+		t.Fatalf("name-prefix buckets should be ordered for name sort")
+	}
+	assertExternalSortOutput(t, input, NameSort{}, bucketer, want)
+}
+
+func TestSampleNamePrefixBucketsKeepsOrder(t *testing.T) {
+	input := ""
+	for i := 200; i > 0; i-- {
+		input += fmt.Sprintf("@M1:5:FC:1:%d:%d:7\nACGT\n+\nIIII\n", 1100+i%3, i)
+	}
+	inputPath := filepath.Join(t.TempDir(), "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	bucketer, err := SampleNamePrefixBuckets(inputPath, '\n', 8, 50)
+	if err != nil {
+		t.Fatalf("sample buckets: %v", err)
+	}
+	if bucketer.BucketCount() < 4 {
+		t.Fatalf("bucket count = %d, want the sample to spread reads over several buckets", bucketer.BucketCount())
+	}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsName(&reads)
+	previous := 0
+	for _, read := range reads {
+		id := bucketer.BucketID(read)
+		if id < previous {
+			t.Fatalf("%s in bucket %d after bucket %d", read.Id(), id, previous)
+		}
+		previous = id
+	}
+}
+
+func TestSortReadsTileOrdersByLaneTileAndCoordinates(t *testing.T) {
+	input := "" +
+		"@read9\nAAAA\n+\nIIII\n" +
+		"@M1:5:FC:2:1101:10:5 1:N:0:1\nCCCC\n+\nIIII\n" +
+		"@M1:5:FC:1:1102:3:3 1:N:0:1\nGGGG\n+\nIIII\n" +
+		"@M1:5:FC:1:1101:200:1 1:N:0:1\nTTTT\n+\nIIII\n" +
+		"@M1:5:FC:1:1101:30:9 1:N:0:1\nACGT\n+\nIIII\n"
+	want := []string{
+		"@M1:5:FC:1:1101:30:9 1:N:0:1\nACGT\n+\nIIII\n",
+		"@M1:5:FC:1:1101:200:1 1:N:0:1\nTTTT\n+\nIIII\n",
+		"@M1:5:FC:1:1102:3:3 1:N:0:1\nGGGG\n+\nIIII\n",
+		"@M1:5:FC:2:1101:10:5 1:N:0:1\nCCCC\n+\nIIII\n",
+		"@read9\nAAAA\n+\nIIII\n",
+	}
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, TileSort{})
+	assertRecords(t, reads, want)
+
+	composite, err := NewCompositeSort("tile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reads = loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, composite)
+	assertRecords(t, reads, want)
+
+	var sampled [][]byte
+	for _, read := range loadReadsFromString(t, input) {
+		sampled = append(sampled, read.Id())
+	}
+	bucketer := composite.LeadingKeyBuckets(64, sampled)
+	if bucketer.BucketCount() != 4 {
+		t.Fatalf("bucket count = %d, want 3 sampled tiles plus unparsed", bucketer.BucketCount())
+	}
+	if !bucketer.OrderedFor(composite) {
+		t.Fatalf("lane-tile buckets should be ordered for the tile key")
+	}
+	assertExternalSortOutput(t, input, composite, bucketer, want)
+}
+
+func TestLaneTileBucketsSizedToSampledTiles(t *testing.T) {
+	sampled := [][]byte{
+		[]byte("@M1:5:FC:1:1101:1:1 1:N:0:1"),
+		[]byte("@M1:5:FC:1:1101:2:2 1:N:0:1"),
+		[]byte("@M1:5:FC:1:1103:1:1 1:N:0:1"),
+		[]byte("@M1:5:FC:2:1101:1:1 1:N:0:1"),
+		[]byte("@read1"),
+	}
+	bucketer := NewLaneTileBuckets(64, sampled)
+	if bucketer.BucketCount() != 4 {
+		t.Fatalf("bucket count = %d, want 4", bucketer.BucketCount())
+	}
+	reads := loadReadsFromString(t, ""+
+		"@M1:5:FC:1:1100:1:1\nA\n+\nI\n"+
+		"@M1:5:FC:1:1101:9:9\nA\n+\nI\n"+
+		"@M1:5:FC:1:1102:1:1\nA\n+\nI\n"+
+		"@M1:5:FC:1:1103:1:1\nA\n+\nI\n"+
+		"@M1:5:FC:3:1101:1:1\nA\n+\nI\n"+
+		"@read2\nA\n+\nI\n")
+	// Unsampled tiles join the bucket of the sampled tile before them.
+	want := []int{0, 0, 0, 1, 2, 3}
+	for i, read := range reads {
+		if got := bucketer.BucketID(read); got != want[i] {
+			t.Fatalf("%s in bucket %d, want %d", read.Id(), got, want[i])
+		}
+	}
+
+	if merged := NewLaneTileBuckets(3, sampled); merged.BucketCount() != 3 {
+		t.Fatalf("merged bucket count = %d, want 3", merged.BucketCount())
+	}
+	if empty := NewLaneTileBuckets(64, nil); empty.BucketCount() != 2 {
+		t.Fatalf("empty bucket count = %d, want 2", empty.BucketCount())
+	}
+}
+
+func TestSortReadsClumpDedupe(t *testing.T) {
+	input := "" +
+		"@M1:1:FC:1:1101:1000:1000\nACGTTGCAAGGTCAGT\n+\nIIIIIIIIIIIIIIII\n" +
+		"@M1:1:FC:1:1101:1010:1005\nACGTTGCAAGGTCAGT\n+\nJJJJJJJJJJJJJJJJ\n" +
+		"@M1:1:FC:1:1102:1000:1000\nACGTTGCAAGGTCAGT\n+\n################\n" +
+		"@r4\nACGTTGCAAGGTCAGA\n+\nIIIIIIIIIIIIIIII\n" +
+		"@r5\nTTTTGGGGCCCCAAAA\n+\nIIIIIIIIIIIIIIII\n"
+
+	duplicateKinds := func(reads []fastq.FastqRead) map[int]fastq.DuplicateKind {
+		kinds := map[int]fastq.DuplicateKind{}
+		for _, read := range reads {
+			kinds[read.I] = read.DuplicateKind()
+		}
+		return kinds
+	}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 5, Dedupe: DedupeOptions{Enabled: true, OpticalDistance: 100}})
+	want := map[int]fastq.DuplicateKind{1: fastq.DuplicateOptical, 2: fastq.DuplicateNone, 3: fastq.DuplicateLibrary, 4: fastq.DuplicateNone, 5: fastq.DuplicateNone}
+	if got := duplicateKinds(reads); !reflect.DeepEqual(got, want) {
+		t.Fatalf("exact duplicate kinds = %v, want %v", got, want)
+	}
+
+	reads = loadReadsFromString(t, input)
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 5, Dedupe: DedupeOptions{Enabled: true, Mismatches: 1}})
+	want = map[int]fastq.DuplicateKind{1: fastq.DuplicateLibrary, 2: fastq.DuplicateNone, 3: fastq.DuplicateLibrary, 4: fastq.DuplicateLibrary, 5: fastq.DuplicateNone}
+	if got := duplicateKinds(reads); !reflect.DeepEqual(got, want) {
+		t.Fatalf("one-mismatch duplicate kinds = %v, want %v", got, want)
+	}
+
+	// withMates gives every read the same mate, except read 3 which gets
+	// mate3.
+	withMates := func(mate3 string) []fastq.FastqRead {
+		reads := loadReadsFromString(t, input)
+		for i := range reads {
+			mate := "AAAACCCCGGGG"
+			if reads[i].I == 3 {
+				mate = mate3
+			}
+			reads[i].Mates = [][]byte{[]byte(mate)}
+		}
+		return reads
+	}
+
+	// Read 3's mate differs, so the pair is not a duplicate.
+	reads = withMates("TTTTCCCCGGGG")
+	SortReadsClumpOpts(&reads, ClumpSortOptions{K: 5, Dedupe: DedupeOptions{Enabled: true}})
+	want = map[int]fastq.DuplicateKind{1: fastq.DuplicateLibrary, 2: fastq.DuplicateNone, 3: fastq.DuplicateNone, 4: fastq.DuplicateNone, 5: fastq.DuplicateNone}
+	if got := duplicateKinds(reads); !reflect.DeepEqual(got, want) {
+		t.Fatalf("paired duplicate kinds = %v, want %v", got, want)
+	}
+
+	// Mates get the same mismatch allowance as the primary reads.
+	paired := withMates("AAAACCCCGGGA")
+	SortReadsClumpOpts(&paired, ClumpSortOptions{K: 5, Dedupe: DedupeOptions{Enabled: true, Mismatches: 1}})
+	want = map[int]fastq.DuplicateKind{1: fastq.DuplicateLibrary, 2: fastq.DuplicateNone, 3: fastq.DuplicateLibrary, 4: fastq.DuplicateLibrary, 5: fastq.DuplicateNone}
+	if got := duplicateKinds(paired); !reflect.DeepEqual(got, want) {
+		t.Fatalf("one-mismatch paired duplicate kinds = %v, want %v", got, want)
+	}
+
+	marked, stats := FinishDuplicates(append([]fastq.FastqRead(nil), reads...), false)
+	if len(marked) != 5 || stats.Duplicates != 1 || stats.OpticalDuplicates != 0 {
+		t.Fatalf("mark kept %d reads with stats %+v, want 5 reads and 1 duplicate", len(marked), stats)
+	}
+	for _, read := range marked {
+		if read.I == 1 && string(read.Id()) != "@M1:1:FC:1:1101:1000:1000 "+fastq.DuplicateTagLibrary {
+			t.Fatalf("marked header = %q", read.Id())
+		}
+	}
+	removed, _ := FinishDuplicates(reads, true)
+	if len(removed) != 4 {
+		t.Fatalf("remove kept %d reads, want 4", len(removed))
+	}
+	for _, read := range removed {
+		if read.I == 1 {
+			t.Fatalf("duplicate read 1 was not removed")
+		}
+	}
+}
+
+func TestSortReadsClumpDedupeMissesPivotMismatch(t *testing.T) {
+	// A substitution inside the pivot k-mer moves the read to another clump,
+	// so dedupe never compares it with its copy, even with mismatches allowed.
+	opts := ClumpSortOptions{K: 5, Dedupe: DedupeOptions{Enabled: true, Mismatches: 1}}
+	sequence := []byte("ACGTTGCAAGGTCAGT")
+	pivot, _, _ := opts.selector(nil).pivot(sequence, nil)
+	at := bytes.Index(sequence, pivot)
+	if at < 0 {
+		at = bytes.Index(sequence, reverseComplement(pivot))
+	}
+	variant := append([]byte(nil), sequence...)
+	variant[at+2] = map[byte]byte{'A': 'C', 'C': 'A', 'G': 'T', 'T': 'G'}[variant[at+2]]
+	if variantPivot, _, _ := opts.selector(nil).pivot(variant, nil); bytes.Equal(variantPivot, pivot) {
+		t.Fatalf("variant %s kept pivot %s", variant, pivot)
+	}
+
+	input := "" +
+		"@r1\n" + string(sequence) + "\n+\nIIIIIIIIIIIIIIII\n" +
+		"@r2\n" + string(variant) + "\n+\nIIIIIIIIIIIIIIII\n"
+	reads := loadReadsFromString(t, input)
+	SortReadsClumpOpts(&reads, opts)
+	for _, read := range reads {
+		if read.DuplicateKind() != fastq.DuplicateNone {
+			t.Fatalf("read %d marked %v; a pivot mismatch should not be found", read.I, read.DuplicateKind())
+		}
+	}
+}
+
+func TestSortReadsClumpCorrect(t *testing.T) {
+	input := ""
+	for i := 0; i < 5; i++ {
+		input += fmt.Sprintf("@r%d\nACGTTGCAAGGTCAGT\n+\nIIIIIIIIIIIIIIII\n", i)
+	}
+	input += "" +
+		"@low\nACGTTGCAAGGTCAGA\n+\nIIIIIIIIIIIIIII#\n" +
+		"@high\nACGTTGCAAGGTCAGC\n+\nIIIIIIIIIIIIIIII\n"
+
+	sequences := func(opts CorrectOptions) (map[string]string, CorrectionStats) {
+		reads := loadReadsFromString(t, input)
+		SortReadsClumpOpts(&reads, ClumpSortOptions{K: 5, Correct: opts})
+		got := map[string]string{}
+		for _, read := range reads {
+			got[string(read.Id())] = string(read.Sequence())
+		}
+		return got, CountCorrections(reads)
+	}
+
+	got, stats := sequences(CorrectOptions{Enabled: true})
+	if got["@low"] != "ACGTTGCAAGGTCAGT" {
+		t.Fatalf("low-quality error not corrected: %q", got["@low"])
+	}
+	if got["@high"] != "ACGTTGCAAGGTCAGC" {
+		t.Fatalf("high-quality base was corrected: %q", got["@high"])
+	}
+	if stats != (CorrectionStats{Bases: 1, Reads: 1}) {
+		t.Fatalf("correction stats = %+v, want 1 base in 1 read", stats)
+	}
+
+	if got, stats := sequences(CorrectOptions{Enabled: true, MinDepth: 6}); got["@low"] != "ACGTTGCAAGGTCAGA" || stats.Bases != 0 {
+		t.Fatalf("corrected with only 5 supporting reads: %q, %+v", got["@low"], stats)
+	}
+}
+
+func TestSortReadsLength(t *testing.T) {
+	input := "" +
+		"@long\nACGTACGT\n+\nIIIIIIII\n" +
+		"@short\nAC\n+\nII\n" +
+		"@mid1\nACGTA\n+\nIIIII\n" +
+		"@mid2\nTTTTT\n+\nIIIII\n"
+	ascending := []string{
+		"@short\nAC\n+\nII\n",
+		"@mid1\nACGTA\n+\nIIIII\n",
+		"@mid2\nTTTTT\n+\nIIIII\n",
+		"@long\nACGTACGT\n+\nIIIIIIII\n",
+	}
+	descending := []string{ascending[3], ascending[1], ascending[2], ascending[0]}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsLength(&reads)
+	assertRecords(t, reads, ascending)
+
+	reads = loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, LengthSort{Descending: true})
+	assertRecords(t, reads, descending)
+
+	assertExternalSortOutput(t, input, LengthSort{}, NewLengthRangeBuckets(16, 100), ascending)
+	assertExternalSortOutput(t, input, LengthSort{Descending: true}, NewLengthRangeBuckets(16, 100).WithDescending(true), descending)
+}
+
+func TestQualityMetricSort(t *testing.T) {
+	// '#' is Q2, '+' is Q10, '5' is Q20 and 'I' is Q40.
+	records := map[rune]string{
+		'a': "@a\nACGT\n+\nIIII\n",
+		'b': "@b\nACGT\n+\n++++\n",
+		'c': "@c\nACGT\n+\n#III\n",
+		'd': "@d\nACGT\n+\n55II\n",
+	}
+	input := records['a'] + records['b'] + records['c'] + records['d']
+	tests := []struct {
+		metric string
+		want   string
+	}{
+		{QualityMetricMean, "bdca"},
+		{QualityMetricMedian, "bdac"},
+		{QualityMetricExpectedErrors, "adbc"},
+		{QualityMetricQ30, "bdca"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.metric, func(t *testing.T) {
+			var want []string
+			for _, name := range tc.want {
+				want = append(want, records[name])
+			}
+			sorter := QualityMetricSort{Metric: tc.metric}
+			reads := loadReadsFromString(t, input)
+			SortReadsStrategy(&reads, sorter)
+			assertRecords(t, reads, want)
+
+			bucketer := NewQualityRangeBuckets(16, sorter.Name())
+			if bucketer.Name() != "quality-range" || !bucketer.OrderedFor(sorter) {
+				t.Fatalf("default buckets %q are not ordered for %s", bucketer.Name(), tc.metric)
+			}
+			assertExternalSortOutput(t, input, sorter, bucketer, want)
+		})
+	}
+	if NewQualityRangeBuckets(16, QualityMetricMean).OrderedFor(QualityMetricSort{Metric: QualityMetricQ30}) {
+		t.Fatalf("qmean buckets should not be ordered for a q30 sort")
+	}
+}
+
+func TestParseKeyExpression(t *testing.T) {
+	fields, err := ParseKeyExpression("length:desc, GC ,alpha:asc")
+	if err != nil {
+		t.Fatalf("parse key expression: %v", err)
+	}
+	want := []KeyField{{Field: KeyFieldLength, Descending: true}, {Field: KeyFieldGC}, {Field: KeyFieldSequence}}
+	if !reflect.DeepEqual(fields, want) {
+		t.Fatalf("fields = %+v, want %+v", fields, want)
+	}
+	if got := (CompositeSort{Fields: fields}).Expression(); got != "len:desc,gc,seq" {
+		t.Fatalf("expression = %q", got)
+	}
+	for _, bad := range []string{"", "len,len", "size", "gc:up"} {
+		if _, err := ParseKeyExpression(bad); err == nil {
+			t.Fatalf("expected an error for key expression %q", bad)
+		}
+	}
+}
+
+func TestCompositeSortMatchesExternal(t *testing.T) {
+	input := "" +
+		"@a\nACGT\n+\nIIII\n" +
+		"@b\nTTTTTT\n+\nIIIIII\n" +
+		"@c\nAAAA\n+\n####\n" +
+		"@d\nAAAA\n+\nIIII\n" +
+		"@e\nGGGGGG\n+\nIIIIII\n"
+	sorter, err := NewCompositeSort("len:desc,seq,qual")
+	if err != nil {
+		t.Fatalf("new composite sort: %v", err)
+	}
+	want := []string{
+		"@e\nGGGGGG\n+\nIIIIII\n",
+		"@b\nTTTTTT\n+\nIIIIII\n",
+		"@c\nAAAA\n+\n####\n",
+		"@d\nAAAA\n+\nIIII\n",
+		"@a\nACGT\n+\nIIII\n",
+	}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	assertRecords(t, reads, want)
+
+	// Less must agree with the precomputed-key Sort.
+	reads = loadReadsFromString(t, input)
+	go_sort.Slice(reads, func(i, j int) bool { return sorter.Less(reads[i], reads[j]) })
+	assertRecords(t, reads, want)
+
+	bucketer := sorter.LeadingKeyBuckets(16, nil)
+	if !bucketer.OrderedFor(sorter) {
+		t.Fatalf("%s buckets should be ordered for %s", bucketer.Name(), sorter.Expression())
+	}
+	if other, _ := NewCompositeSort("len,seq"); bucketer.OrderedFor(other) {
+		t.Fatalf("descending length buckets must not be ordered for an ascending key")
+	}
+	assertExternalSortOutput(t, input, sorter, bucketer, want)
+}
+
+func TestReferenceSortOrdersByPosition(t *testing.T) {
+	genome := pseudoRandomSequence(2000, 11)
+	index, err := NewReferenceIndex(DefaultReferenceKmerLen, 1)
+	if err != nil {
+		t.Fatalf("new reference index: %v", err)
+	}
+	index.AddContig("chr1", genome[:1200])
+	index.AddContig("chr2", genome[1200:])
+
+	fastqRecord := func(name string, sequence []byte) string {
+		return "@" + name + "\n" + string(sequence) + "\n+\n" + strings.Repeat("I", len(sequence)) + "\n"
+	}
+	late := genome[1500:1560]
+	minus := reverseComplement(genome[300:360])
+	early := append([]byte(nil), genome[40:100]...)
+	early[30] = 'N' // a gap in the k-mers must not lose the read
+	unmapped := pseudoRandomSequence(60, 99)
+	plus := genome[300:360]
+
+	if hit := index.Locate(minus); hit != (ReferenceHit{Mapped: true, Position: 300, Reverse: true}) {
+		t.Fatalf("Locate(minus) = %+v, want position 300 on the reverse strand", hit)
+	}
+	input := fastqRecord("late", late) +
+		fastqRecord("minus", minus) +
+		fastqRecord("unmapped", unmapped) +
+		fastqRecord("early", early) +
+		fastqRecord("plus", plus)
+	want := []string{
+		fastqRecord("early", early),
+		fastqRecord("plus", plus),
+		fastqRecord("minus", minus),
+		fastqRecord("late", late),
+		fastqRecord("unmapped", unmapped),
+	}
+	sorter := ReferenceSort{Index: index}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	assertRecords(t, reads, want)
+
+	bucketer := NewPositionRangeBuckets(4, sorter.Index)
+	if bucketer.Name() != "position-range" || !bucketer.OrderedFor(sorter) {
+		t.Fatalf("default reference buckets = %s, want ordered position-range buckets", bucketer.Name())
+	}
+	if bucketer.OrderedFor(ReferenceSort{}) {
+		t.Fatalf("position-range buckets must not be ordered for a sorter using another index")
+	}
+	assertExternalSortOutput(t, input, sorter, bucketer, want)
+}
+
+func TestReferenceIndexSkipsRepeatedKmers(t *testing.T) {
+	repeat := pseudoRandomSequence(40, 5)
+	index, err := NewReferenceIndex(21, 1)
+	if err != nil {
+		t.Fatalf("new reference index: %v", err)
+	}
+	index.AddContig("a", append(append([]byte(nil), repeat...), pseudoRandomSequence(100, 6)...))
+	index.AddContig("b", reverseComplement(repeat))
+
+	if hit := index.Locate(repeat); hit.Mapped {
+		t.Fatalf("Locate(repeat) = %+v, want unmapped", hit)
+	}
+	if _, err := NewReferenceIndex(33, 1); err == nil {
+		t.Fatalf("expected an error for k > 32")
+	}
+}
+
+func TestAbundanceSortGroupsNearVariants(t *testing.T) {
+	record := func(name string, sequence string) string {
+		return "@" + name + "\n" + sequence + "\n+\n" + strings.Repeat("I", len(sequence)) + "\n"
+	}
+	const top, topVariant = "ACGTACGTAC", "ACGTTCGTAC"
+	const second, other = "GGGGCCCCAA", "TTTTAAAACC"
+	input := record("v1", topVariant) +
+		record("s1", second) +
+		record("t1", top) +
+		record("o1", other) +
+		record("t2", top) +
+		record("s2", second) +
+		record("t3", top)
+	want := []string{
+		record("t1", top),
+		record("t2", top),
+		record("t3", top),
+		record("v1", topVariant),
+		record("s1", second),
+		record("s2", second),
+		record("o1", other),
+	}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, AbundanceSort{Mismatches: 1})
+	assertRecords(t, reads, want)
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	table, err := CountAbundance(inputPath, '\n', filepath.Join(dir, "count"), 4, 1)
+	if err != nil {
+		t.Fatalf("count abundance: %v", err)
+	}
+	if table.Reads != 7 || table.Uniques != 4 || table.Singletons != 2 || table.Clusters() != 2 {
+		t.Fatalf("table reads/uniques/singletons/clusters = %d/%d/%d/%d, want 7/4/2/2", table.Reads, table.Uniques, table.Singletons, table.Clusters())
+	}
+	wantCounts := []UniqueCount{{Sequence: top, Count: 3, Cluster: 0}, {Sequence: second, Count: 2, Cluster: 1}}
+	if got := table.Counts(0); !reflect.DeepEqual(got, wantCounts) {
+		t.Fatalf("counts = %+v, want %+v", got, wantCounts)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "count")); !os.IsNotExist(err) {
+		t.Fatalf("count pass left its temp dir behind: %v", err)
+	}
+
+	// Singletons are not stored, but the table order matches the local one.
+	sorter := AbundanceSort{Table: table}
+	bucketer := NewAbundanceBuckets(8, table)
+	if bucketer.Name() != "abundance" || !bucketer.OrderedFor(sorter) {
+		t.Fatalf("default abundance buckets = %s, want ordered abundance buckets", bucketer.Name())
+	}
+	assertExternalSortOutput(t, input, sorter, bucketer, want)
+
+	// Without variant matching the variant is an unclustered singleton.
+	reads = loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, AbundanceSort{})
+	assertRecords(t, reads, []string{want[0], want[1], want[2], want[4], want[5], want[3], want[6]})
+}
+
+func TestCanonicalAlphaSort(t *testing.T) {
+	input := "" +
+		"@a\nTTTT\n+\nABCD\n" +
+		"@b\nCCCC\n+\nIIII\n" +
+		"@c\nAAAC\n+\nIIII\n" +
+		"@d\nGTTT\n+\nABCD\n"
+	want := []string{
+		"@a\nTTTT\n+\nABCD\n",
+		"@c\nAAAC\n+\nIIII\n",
+		"@d\nGTTT\n+\nABCD\n",
+		"@b\nCCCC\n+\nIIII\n",
+	}
+	wantFlipped := []string{
+		"@a\nAAAA\n+\nDCBA\n",
+		want[1],
+		"@d\nAAAC\n+\nDCBA\n",
+		want[3],
+	}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsCanonicalAlpha(&reads)
+	assertRecords(t, reads, want)
+
+	sorter := CanonicalAlphaSort{Flip: true}
+	reads = loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	assertRecords(t, reads, wantFlipped)
+	if flipped, err := VerifyFlippedReads(reads); err != nil || flipped != 2 {
+		t.Fatalf("VerifyFlippedReads = %d, %v; want 2 flipped reads", flipped, err)
+	}
+
+	bucketer := NewCanonicalPrefixBuckets(1)
+	if bucketer.Name() != "canonical-prefix" || !bucketer.OrderedFor(sorter) {
+		t.Fatalf("default canonical-alpha buckets = %s, want ordered canonical-prefix buckets", bucketer.Name())
+	}
+	if NewSequencePrefixBuckets(1).OrderedFor(sorter) {
+		t.Fatalf("sequence-prefix buckets must not be ordered for canonical-alpha")
+	}
+	assertExternalSortOutput(t, input, sorter, NewCanonicalPrefixBuckets(2), wantFlipped)
+}
+
+func TestSortReadsClumpMatchesClumpReadLess(t *testing.T) {
+	// Short reads and a short k give many reads the same pivot at the same
+	// position on opposite strands. The keyed sort must order those by
+	// sequence, like ClumpReadLess, not by strand.
+	var input strings.Builder
+	for i := 0; i < 300; i++ {
+		sequence := pseudoRandomSequence(8, uint32(i))
+		fmt.Fprintf(&input, "@r%d\n%s\n+\nIIIIIIII\n", i, sequence)
+	}
+
+	byLess := loadReadsFromString(t, input.String())
+	go_sort.SliceStable(byLess, func(i, j int) bool { return ClumpCompareK(byLess[i], byLess[j], 3) })
+	byKey := loadReadsFromString(t, input.String())
+	SortReadsClumpK(&byKey, 3)
+	for i := range byLess {
+		if byLess[i].I != byKey[i].I {
+			t.Fatalf("read %d by key = %s, by ClumpReadLess = %s", i, byKey[i].Id(), byLess[i].Id())
+		}
+	}
+}
+
+func TestDeprecatedStrategyForName(t *testing.T) {
+	for _, name := range []string{"alpha", "gc", "qual", "clump"} {
+		sorter, ok := StrategyForName(name)
+		if !ok || sorter.Name() != name {
+			t.Fatalf("StrategyForName(%q) = %v, %v", name, sorter, ok)
+		}
+		bucketer := DefaultBucketStrategy(sorter, 4)
+		if name != "clump" && !bucketer.OrderedFor(sorter) {
+			t.Fatalf("%s buckets %s are not ordered", name, bucketer.Name())
+		}
+	}
+	if _, ok := StrategyForName("no-such-method"); ok {
+		t.Fatal("unknown names must not resolve")
+	}
+	if got := DefaultBucketStrategy(LengthSort{}, 4).Name(); got != "hash" {
+		t.Fatalf("length buckets = %s, want hash", got)
+	}
+}
+
+func TestSortKeysMatchLess(t *testing.T) {
+	var input strings.Builder
+	tiles := []string{"1101", "1102", "2101"}
+	for i := 0; i < 60; i++ {
+		sequence := pseudoRandomSequence(8+i%7, uint32(i%23))
+		quality := make([]byte, len(sequence))
+		for j := range quality {
+			quality[j] = byte('#' + (i*7+j*3)%40)
+		}
+		name := fmt.Sprintf("M1:7:FC:1:%s:%d:%d", tiles[i%3], (i*37)%50, i%11)
+		if i%5 == 0 {
+			name = fmt.Sprintf("read%d", (i*13)%20)
+		}
+		fmt.Fprintf(&input, "@%s\n%s\n+\n%s\n", name, sequence, quality)
+	}
+
+	sorters := []SortStrategy{
+		AlphaSort{},
+		AlphaSort{Window: KeyWindow{Trim5: 2, Trim3: 1}},
+		GCSort{},
+		QualitySort{},
+		QualityMetricSort{Metric: QualityMetricExpectedErrors},
+		LengthSort{Descending: true},
+		NameSort{},
+		TileSort{},
+		CanonicalAlphaSort{},
+	}
+	for _, sorter := range sorters {
+		keyed, ok := sorter.(KeyedStrategy)
+		if !ok {
+			t.Fatalf("%s is not a KeyedStrategy", sorter.Name())
+		}
+		byLess := loadReadsFromString(t, input.String())
+		go_sort.SliceStable(byLess, func(i, j int) bool { return sorter.Less(byLess[i], byLess[j]) })
+		byKey := loadReadsFromString(t, input.String())
+		SortReadsKeyed(byKey, keyed)
+		for i := range byLess {
+			if byLess[i].I != byKey[i].I {
+				t.Fatalf("%s: read %d by key = %d, by Less = %d", sorter.Name(), i, byKey[i].I, byLess[i].I)
+			}
+		}
+	}
+
+	// ClumpSort.Less builds keys for the pair instead of panicking.
+	reads := loadReadsFromString(t, input.String())
+	clump := DefaultClumpSort()
+	if clump.Less(reads[0], reads[1]) == clump.Less(reads[1], reads[0]) {
+		t.Fatalf("clump Less must order distinct reads one way")
+	}
+}
+
+func TestSortKeyEncoding(t *testing.T) {
+	values := [][]byte{{}, {0}, {0, 0}, {0, 1}, {1}, []byte("A"), []byte("AA")}
+	for i := 1; i < len(values); i++ {
+		a := appendKeyBytes(nil, values[i-1])
+		b := appendKeyBytes(nil, values[i])
+		if bytes.Compare(a, b) >= 0 {
+			t.Fatalf("key %q must sort before %q", values[i-1], values[i])
+		}
+		if decoded, rest := decodeKeyBytes(append(b, 7)); !bytes.Equal(decoded, values[i]) || !bytes.Equal(rest, []byte{7}) {
+			t.Fatalf("decode %q = %q, rest %v", values[i], decoded, rest)
+		}
+	}
+
+	floats := []float64{-2.5, -0.5, 0, 0.25, 3}
+	for i := 1; i < len(floats); i++ {
+		if bytes.Compare(appendKeyFloat(nil, floats[i-1]), appendKeyFloat(nil, floats[i])) >= 0 {
+			t.Fatalf("float key %v must sort before %v", floats[i-1], floats[i])
+		}
+	}
+	if bytes.Compare(appendKeyInt(nil, -1), appendKeyInt(nil, 0)) >= 0 {
+		t.Fatalf("int key -1 must sort before 0")
+	}
+}
+
+func TestKeyRangeBuckets(t *testing.T) {
+	input := "" +
+		"@a\nACGT\n+\nIIII\n" +
+		"@b\nTTTTTT\n+\nIIIIII\n" +
+		"@c\nAAAA\n+\n####\n" +
+		"@d\nAAAA\n+\nIIII\n" +
+		"@e\nGGGGGG\n+\nIIIIII\n" +
+		"@f\nCC\n+\nII\n"
+	sorter, err := NewCompositeSort("len:desc,seq")
+	if err != nil {
+		t.Fatalf("new composite sort: %v", err)
+	}
+	want := []string{
+		"@e\nGGGGGG\n+\nIIIIII\n",
+		"@b\nTTTTTT\n+\nIIIIII\n",
+		"@c\nAAAA\n+\n####\n",
+		"@d\nAAAA\n+\nIIII\n",
+		"@a\nACGT\n+\nIIII\n",
+		"@f\nCC\n+\nII\n",
+	}
+
+	bucketer := NewKeyRangeBuckets(3, sorter, loadReadsFromString(t, input))
+	if bucketer.BucketCount() != 3 {
+		t.Fatalf("bucket count = %d, want 3", bucketer.BucketCount())
+	}
+	if !bucketer.OrderedFor(sorter) {
+		t.Fatalf("key-range buckets should be ordered for their sorter")
+	}
+	if other, _ := NewCompositeSort("len,seq"); bucketer.OrderedFor(other) {
+		t.Fatalf("key-range buckets must not be ordered for a different key")
+	}
+	if NewKeyRangeBuckets(3, DefaultClumpSort(), nil).OrderedFor(DefaultClumpSort()) {
+		t.Fatalf("key-range buckets must not be ordered for clump")
+	}
+	clumpKey, _ := NewCompositeSort("clump,seq")
+	clumpKey.Clump.Blacklist = KmerSet{"AAAA": {}}
+	sameClumpKey, _ := NewCompositeSort("clump,seq")
+	sameClumpKey.Clump.Blacklist = KmerSet{"AAAA": {}}
+	if !NewKeyRangeBuckets(3, clumpKey, nil).OrderedFor(sameClumpKey) {
+		t.Fatalf("key-range buckets should be ordered for an equal key with its own blacklist")
+	}
+	sameClumpKey.Clump.Blacklist = KmerSet{"CCCC": {}}
+	if NewKeyRangeBuckets(3, clumpKey, nil).OrderedFor(sameClumpKey) {
+		t.Fatalf("key-range buckets must not be ordered for a different blacklist")
+	}
+	if length := NewKeyRangeBuckets(3, LengthSort{}, nil); !length.OrderedFor(LengthSort{}) || length.OrderedFor(LengthSort{Descending: true}) {
+		t.Fatalf("key-range buckets should be ordered only for the sampled length direction")
+	}
+	assertExternalSortOutput(t, input, sorter, bucketer, want)
+}
+
+func TestSortReadsAlphaRadixMatchesLess(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 400; i++ {
+		// Few distinct seeds and short lengths give many duplicates and
+		// sequences that are prefixes of each other.
+		sequence := pseudoRandomSequence(1+(i*7)%13, uint32(i%9))
+		switch i % 17 {
+		case 3:
+			sequence[len(sequence)/2] = 'N'
+		case 11:
+			sequence[0] = 'a'
+		}
+		fmt.Fprintf(&input, "@r%d\n%s\n+\n%s\n", i, sequence, strings.Repeat("I", len(sequence)))
+	}
+
+	for _, sorter := range []AlphaSort{{}, {Window: KeyWindow{Trim5: 1, Trim3: 2}}} {
+		byLess := loadReadsFromString(t, input.String())
+		go_sort.Slice(byLess, func(i, j int) bool { return sorter.Less(byLess[i], byLess[j]) })
+		byRadix := loadReadsFromString(t, input.String())
+		SortReadsStrategy(&byRadix, sorter)
+		for i := range byLess {
+			if byLess[i].I != byRadix[i].I {
+				t.Fatalf("window %+v: read %d by radix = %d, by Less = %d", sorter.Window, i, byRadix[i].I, byLess[i].I)
+			}
+		}
+	}
+}
+
+func writeKeyScript(t *testing.T, body string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "keys.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+		t.Fatalf("write key script: %v", err)
+	}
+	return path
+}
+
+func TestCommandKeySort(t *testing.T) {
+	input := "" +
+		"@r1 extra\nAAAA\n+\nIIII\n" +
+		"@r2\nCCCC\n+\nIIII\n" +
+		"@r3\nGGGG\n+\nIIII\n" +
+		"@r4\nTTTT\n+\nIIII\n"
+	inputPath := filepath.Join(t.TempDir(), "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input fastq: %v", err)
+	}
+
+	// Keys mimic mapping positions: chr10 sorts after chr2, and r4 ties with
+	// r1 on chr2:5.
+	script := writeKeyScript(t, `awk -F '\t' '{
+		if ($1 == "r1" && $2 == "AAAA") print "chr2:5"
+		else if ($1 == "r2") print "chr10:1"
+		else if ($1 == "r3") print "chr2:40"
+		else print "chr2:5"
+	}'`)
+	keyDir := t.TempDir()
+	keys, err := RunKeyCommand(inputPath, '\n', keyDir, []string{script})
+	if err != nil {
+		t.Fatalf("run key command: %v", err)
+	}
+	if keys.Reads != 4 || string(keys.Key(2)) != "chr10:1" || string(keys.Key(4)) != "chr2:5" {
+		t.Fatalf("keys = %d reads, key 2 %q, key 4 %q", keys.Reads, keys.Key(2), keys.Key(4))
+	}
+	defer func() {
+		if err := keys.Close(); err != nil {
+			t.Fatalf("close keys: %v", err)
+		}
+		if entries, _ := os.ReadDir(keyDir); len(entries) != 0 {
+			t.Fatalf("key sidecar left behind: %v", entries)
+		}
+	}()
+
+	sorter := CommandKeySort{Keys: keys}
+	want := []string{
+		"@r1 extra\nAAAA\n+\nIIII\n",
+		"@r4\nTTTT\n+\nIIII\n",
+		"@r3\nGGGG\n+\nIIII\n",
+		"@r2\nCCCC\n+\nIIII\n",
+	}
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	assertRecords(t, reads, want)
+	assertExternalSortOutput(t, input, sorter, NewKeyRangeBuckets(3, sorter, loadReadsFromString(t, input)), want)
+	if err := keys.Err(); err != nil {
+		t.Fatalf("read keys: %v", err)
+	}
+
+	for name, body := range map[string]string{
+		"too few keys": "head -n 2 | cut -f 1",
+		"failure":      "cat >/dev/null; echo broken >&2; exit 3",
+	} {
+		if _, err := RunKeyCommand(inputPath, '\n', keyDir, []string{writeKeyScript(t, body)}); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestTagExtractor(t *testing.T) {
+	reads := loadReadsFromString(t, ""+
+		"@M1:7:FC:1:1101:5:6:GATTACA 1:N:0:ACGT CB:Z:TTTG\nACGTACGTAC\n+\nIIIIIIIIII\n"+
+		"@read9_CCAA\nAC\n+\nII\n")
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"pos:2-6", []string{"GTAC", ""}},
+		{"token:7", []string{"GATTACA", ""}},
+		{"token:-1", []string{"TTTG", "CCAA"}},
+		{"regex:CB:Z:([ACGTN]+)", []string{"TTTG", ""}},
+		{"regex:_[ACGT]+$", []string{"", "_CCAA"}},
+	}
+	for _, test := range tests {
+		extractor, err := ParseTagExtractor(test.spec)
+		if err != nil {
+			t.Fatalf("parse %q: %v", test.spec, err)
+		}
+		for i, read := range reads {
+			if got := string(extractor.Extract(read)); got != test.want[i] {
+				t.Fatalf("%s: read %d tag = %q, want %q", test.spec, i, got, test.want[i])
+			}
+		}
+	}
+	for _, bad := range []string{"pos", "pos:5-2", "token:x", "regex:(", "seq:1-2"} {
+		if _, err := ParseTagExtractor(bad); err == nil {
+			t.Fatalf("expected an error for tag %q", bad)
+		}
+	}
+}
+
+func TestCompositeSortGroupsByBarcodeAndUMI(t *testing.T) {
+	input := "" +
+		"@r1_BB_U2\nTTTT\n+\nIIII\n" +
+		"@r2_AA_U1\nGGGG\n+\nIIII\n" +
+		"@r3_BB_U1\nCCCC\n+\nIIII\n" +
+		"@r4_AA_U1\nAAAA\n+\nIIII\n" +
+		"@r5_BB_U2\nAAAA\n+\nIIII\n"
+	sorter, err := NewCompositeSort("bc,umi,seq")
+	if err != nil {
+		t.Fatalf("new composite sort: %v", err)
+	}
+	if err := sorter.CheckTags(); err == nil {
+		t.Fatalf("expected bc and umi fields to require tags")
+	}
+	sorter.Barcode, _ = ParseTagExtractor("token:1")
+	sorter.UMI, _ = ParseTagExtractor("token:2")
+	if err := sorter.CheckTags(); err != nil {
+		t.Fatalf("check tags: %v", err)
+	}
+	want := []string{
+		"@r4_AA_U1\nAAAA\n+\nIIII\n",
+		"@r2_AA_U1\nGGGG\n+\nIIII\n",
+		"@r3_BB_U1\nCCCC\n+\nIIII\n",
+		"@r5_BB_U2\nAAAA\n+\nIIII\n",
+		"@r1_BB_U2\nTTTT\n+\nIIII\n",
+	}
+
+	reads := loadReadsFromString(t, input)
+	SortReadsStrategy(&reads, sorter)
+	assertRecords(t, reads, want)
+	assertExternalSortOutput(t, input, sorter, NewKeyRangeBuckets(2, sorter, loadReadsFromString(t, input)), want)
+}
+
+func TestDemultiplexer(t *testing.T) {
+	sheetPath := filepath.Join(t.TempDir(), "SampleSheet.csv")
+	sheet := "" +
+		"[Header]\nIEMFileVersion,5\n\n" +
+		"[Data]\nLane,Sample_ID,index,index2\n" +
+		"1,S1,AAAAAA,CCCC\n" +
+		"1,S2,GGGGGG,TTTT\n"
+	if err := os.WriteFile(sheetPath, []byte(sheet), 0644); err != nil {
+		t.Fatalf("write sample sheet: %v", err)
+	}
+	samples, err := LoadSampleSheet(sheetPath)
+	if err != nil {
+		t.Fatalf("load sample sheet: %v", err)
+	}
+	if want := []DemuxSample{{"S1", "AAAAAA", "CCCC"}, {"S2", "GGGGGG", "TTTT"}}; !reflect.DeepEqual(samples, want) {
+		t.Fatalf("samples = %+v, want %+v", samples, want)
+	}
+	demux, err := NewDemultiplexer(samples, 1, TagExtractor{})
+	if err != nil {
+		t.Fatalf("new demultiplexer: %v", err)
+	}
+
+	reads := loadReadsFromString(t, ""+
+		"@r1 1:N:0:AAAAAA+CCCC\nA\n+\nI\n"+
+		"@r2 1:N:0:GGGGTG+TTTT\nA\n+\nI\n"+
+		"@r3 1:N:0:AAAAAN+CCCA\nA\n+\nI\n"+
+		"@r4 1:N:0:GGGGGGAT+TTTTCG\nA\n+\nI\n"+
+		"@r5 1:N:0:AAAAAA\nA\n+\nI\n"+
+		"@r6 1:N:0:CCCCCC+CCCC\nA\n+\nI\n")
+	// Mismatches are allowed per index, so r3 still matches S1; r4 has longer
+	// indexes than the sheet, r5 has no second index, and r6 matches neither
+	// sample.
+	want := []int{0, 1, 0, 1, 2, 2}
+	for i, read := range reads {
+		if got := demux.Assign(read); got != want[i] {
+			t.Fatalf("read %d assigned to %d, want %d", i+1, got, want[i])
+		}
+	}
+
+	if _, err := NewDemultiplexer([]DemuxSample{{Name: "S1", Index: "AAAA"}, {Name: "S2", Index: "AATT"}}, 1, TagExtractor{}); err == nil {
+		t.Fatalf("expected indexes two mismatches apart to collide with 1 mismatch allowed")
+	}
+	if _, err := NewDemultiplexer([]DemuxSample{{Name: "../S1", Index: "AAAA"}}, 0, TagExtractor{}); err == nil {
+		t.Fatalf("expected an error for a sample name with a path")
+	}
+}
+
+func TestClumpHeaderOrder(t *testing.T) {
+	records := map[string]string{
+		"a": "@M1:1:FC:1:1101:10:1\nACGTTGCA\n+\nIIIIIIII\n",
+		"b": "@M1:1:FC:1:1101:95:1\nACGTTGCA\n+\n########\n",
+		"c": "@M1:1:FC:1:1101:9:1\nACGTTGCA\n+\n55555555\n",
+		"d": "@M1:1:FC:1:1102:9:1\nACGTTGCA\n+\n++++++++\n",
+	}
+	input := records["a"] + records["b"] + records["c"] + records["d"]
+	tests := []struct {
+		order  string
+		want   string
+		shared int
+	}{
+		{HeaderOrderOff, "bdca", 44},
+		{HeaderOrderTokens, "cabd", 46},
+		{HeaderOrderSimilarity, "cbad", 47},
+	}
+	for _, test := range tests {
+		var want []string
+		for _, name := range test.want {
+			want = append(want, records[string(name)])
+		}
+		sorter := ClumpSort{K: 4, HeaderOrder: test.order}
+		reads := loadReadsFromString(t, input)
+		SortReadsStrategy(&reads, sorter)
+		assertRecords(t, reads, want)
+		assertExternalSortOutput(t, input, sorter, NewClumpBuckets(4, 4), want)
+
+		stats := CountHeaderSharing(reads)
+		if want := (HeaderStats{Groups: 1, Reads: 4, HeaderBytes: 78, SharedBytes: test.shared, DefaultSharedBytes: 44}); stats != want {
+			t.Fatalf("%s: header stats = %+v, want %+v", test.order, stats, want)
+		}
+	}
+}
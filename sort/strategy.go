@@ -11,7 +11,8 @@ import (
 //
 // The in-memory sorter and the external bucket sorter both use this interface,
 // which keeps "how reads are compared" independent from "where reads are
-// stored while sorting".
+// stored while sorting". Built-in strategies are also KeyedStrategy values,
+// whose per-read keys the sorters use in place of Less.
 type SortStrategy interface {
 	Name() string
 	Less(a fastq.FastqRead, b fastq.FastqRead) bool
@@ -32,12 +33,15 @@ type BucketStrategy interface {
 }
 
 // AlphaSort orders reads by sequence bytes.
-type AlphaSort struct{}
+type AlphaSort struct {
+	// Window excludes read ends (e.g. inline barcodes) from the compared bytes.
+	Window KeyWindow
+}
 
 func (AlphaSort) Name() string { return "alpha" }
 
-func (AlphaSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
-	if c := bytes.Compare(a.Sequence(), b.Sequence()); c != 0 {
+func (s AlphaSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	if c := bytes.Compare(s.Window.Apply(a.Sequence()), s.Window.Apply(b.Sequence())); c != 0 {
 		return c < 0
 	}
 	// Tie-break on input order so memory and external sorts are reproducible
@@ -45,17 +49,34 @@ func (AlphaSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
 	return a.I < b.I
 }
 
+func (s AlphaSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendKeyBytes(dst, s.Window.Apply(read.Sequence()))
+	})
+}
+
 // GCSort orders reads by precomputed GC content.
-type GCSort struct{}
+type GCSort struct {
+	// Window restricts the GC calculation to part of the read. A zero window
+	// uses the GC content precomputed by the parser.
+	Window KeyWindow
+}
 
 func (GCSort) Name() string { return "gc" }
 
-func (GCSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
-	if a.GCContent == b.GCContent {
+func (s GCSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	gcA, gcB := s.Window.gcContent(a), s.Window.gcContent(b)
+	if gcA == gcB {
 		// Keep equal-GC reads deterministic across bucket boundaries.
 		return a.I < b.I
 	}
-	return a.GCContent < b.GCContent
+	return gcA < gcB
+}
+
+func (s GCSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendKeyFloat(dst, s.Window.gcContent(read))
+	})
 }
 
 // QualitySort orders reads by quality score bytes.
@@ -71,6 +92,12 @@ func (QualitySort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
 	return a.I < b.I
 }
 
+func (QualitySort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendKeyBytes(dst, read.QualityScores())
+	})
+}
+
 // ClumpSort reuses the clump comparator, which is intended to group similar
 // reads for better compression rather than to model a biological ordering.
 type ClumpSort struct {
@@ -82,6 +109,16 @@ type ClumpSort struct {
 	// usually sequencing errors; excluding them avoids tiny isolated clumps
 	// and concentrates reads around confirmed genomic positions.
 	MinCount int
+	// MaxCount, when > 0, filters out pivot k-mers that appear more than
+	// MaxCount times. Very common k-mers usually come from repeats, adapters,
+	// rRNA, or poly-G tails; letting them become pivots builds huge clumps of
+	// otherwise unrelated reads.
+	MaxCount int
+	// Blacklist holds canonical k-mers that must never be used as pivots, for
+	// example k-mers taken from a known adapter FASTA. Unlike the count
+	// filters it needs no frequency table, so the external clump-minimizer
+	// buckets honour it too.
+	Blacklist KmerSet
 	// RComp, when true, reverse-complements reads whose pivot k-mer was chosen
 	// from the minus strand. This normalises orientation within each clump so
 	// consecutive sequence lines are more byte-similar, increasing LZ77 density.
@@ -95,28 +132,86 @@ type ClumpSort struct {
 	// selecting the pivot k-mer. Read ends are more error-prone; excluding them
 	// avoids pivot k-mers that contain sequencing errors. Clumpify defaults to 1.
 	Border int
+	// MinQuality, when > 0, skips pivot k-mers containing any base whose Phred
+	// score is below this threshold, so sequencing errors do not define clumps.
+	MinQuality int
+	// SkipAmbiguous skips pivot k-mers containing 'N' or other non-ACGT bases.
+	SkipAmbiguous bool
+	// Window excludes read ends from pivot selection before Border is applied,
+	// so inline barcodes or adapter read-through never become pivots.
+	Window KeyWindow
+	// Seed, when non-zero, replaces the contiguous K-mer with a spaced seed:
+	// only the mask's '1' positions enter the pivot key, so a single error at
+	// an ignored position no longer moves the read to a different clump. The
+	// seed span replaces K.
+	Seed SpacedSeed
+	// MinimizerWindow, when > 1, picks the pivot only among (w,k)-minimizers
+	// with w = MinimizerWindow. Overlapping noisy long reads share most of
+	// their minimizers even when exact k-mers rarely match.
+	MinimizerWindow int
+	// LongRead orders reads with the same pivot by length and input order
+	// instead of comparing full sequence, quality, and header bytes.
+	LongRead bool
+	// HeaderOrder breaks ties between reads with the same sequence, which
+	// otherwise come out in quality order, on their headers. HeaderOrderTokens
+	// sorts them by header in natural order, keeping reads from one tile and
+	// nearby coordinates together; HeaderOrderSimilarity then chains them by
+	// shared header prefix. Sequence clustering is unchanged.
+	HeaderOrder string
+	// Correct, when enabled, replaces isolated low-quality bases with the
+	// consensus of the reads aligned on the same pivot (lossy).
+	Correct CorrectOptions
+	// Dedupe, when enabled, marks duplicates within each clump. The sorter
+	// only sets Duplicate and OpticalDuplicate; FinishDuplicates tags or
+	// removes the marked reads.
+	Dedupe DedupeOptions
 }
 
 func (ClumpSort) Name() string { return "clump" }
 
-// Less exists only to satisfy SortStrategy. ClumpSort cannot implement a
-// correct O(1) comparison without precomputed keys, so all sort paths bypass
-// this method: the memory engine calls SortReadsClumpOpts directly, and the
-// external engine type-asserts to Sort(). The panic catches any future code
-// that accidentally routes clump through a generic Less-based sort loop,
-// which would silently recompute the minimizer on every comparison.
+// Less compares the clump keys of a and b. It selects both pivots on every
+// call, and the count filters only see a and b, so sorts use SortKeys
+// instead.
 func (s ClumpSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
-	panic("ClumpSort.Less must not be used in a sort loop; call Sort() to get O(n log n) key precomputation")
+	return keyedLess(s, a, b)
 }
 
-func (s ClumpSort) Sort(reads []fastq.FastqRead) {
-	SortReadsClumpOpts(&reads, ClumpSortOptions{
-		K:        s.k(),
-		MinCount: s.MinCount,
-		RComp:    s.RComp,
-		RawPivot: s.RawPivot,
-		Border:   s.Border,
-	})
+// SortKeys selects every read's pivot once. With MinCount or MaxCount set,
+// the pivot k-mer counts are taken over reads. The keys leave out the pivot
+// strand, so SortReadsKeyed sorts a ClumpSort with SortReadsClumpOpts, which
+// keeps the strand for flipping.
+func (s ClumpSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	keys, _ := s.Options().sortKeys(reads)
+	return keys
+}
+
+// TieCompare orders reads with equal clump keys by their sequence, quality,
+// and header bytes.
+func (s ClumpSort) TieCompare(a fastq.FastqRead, b fastq.FastqRead) int {
+	return clumpTieCompare(a, b, s.LongRead, s.HeaderOrder)
+}
+
+// Options returns the SortReadsClumpOpts settings equivalent to this sorter.
+func (s ClumpSort) Options() ClumpSortOptions {
+	return ClumpSortOptions{
+		K:             s.k(),
+		MinCount:      s.MinCount,
+		MaxCount:      s.MaxCount,
+		Blacklist:     s.Blacklist,
+		RComp:         s.RComp,
+		RawPivot:      s.RawPivot,
+		Border:        s.Border,
+		MinQuality:    s.MinQuality,
+		SkipAmbiguous: s.SkipAmbiguous,
+		Window:        s.Window,
+		Seed:          s.Seed,
+
+		MinimizerWindow: s.MinimizerWindow,
+		LongRead:        s.LongRead,
+		HeaderOrder:     s.HeaderOrder,
+		Correct:         s.Correct,
+		Dedupe:          s.Dedupe,
+	}
 }
 
 func (s ClumpSort) k() int {
@@ -131,6 +226,7 @@ type BytePrefixBuckets struct {
 	field      string
 	prefixLen  int
 	bucketSize int
+	window     KeyWindow
 }
 
 // NewSequencePrefixBuckets creates lexicographically ordered buckets using the
@@ -139,6 +235,13 @@ func NewSequencePrefixBuckets(prefixLen int) BytePrefixBuckets {
 	return newBytePrefixBuckets("sequence-prefix", "sequence", prefixLen)
 }
 
+// NewCanonicalPrefixBuckets creates lexicographically ordered buckets using the
+// first prefixLen bytes of the canonical sequence, the smaller of the sequence
+// and its reverse complement.
+func NewCanonicalPrefixBuckets(prefixLen int) BytePrefixBuckets {
+	return newBytePrefixBuckets("canonical-prefix", "canonical", prefixLen)
+}
+
 // NewQualityPrefixBuckets creates lexicographically ordered buckets using the
 // first prefixLen bytes of the read quality string.
 func NewQualityPrefixBuckets(prefixLen int) BytePrefixBuckets {
@@ -156,6 +259,15 @@ func newBytePrefixBuckets(name string, field string, prefixLen int) BytePrefixBu
 	return BytePrefixBuckets{name: name, field: field, prefixLen: prefixLen, bucketSize: bucketSize}
 }
 
+// WithWindow returns a copy whose sequence prefix is taken after applying
+// window. It has no effect on quality-prefix buckets.
+func (b BytePrefixBuckets) WithWindow(window KeyWindow) BytePrefixBuckets {
+	if b.field != "quality" {
+		b.window = window
+	}
+	return b
+}
+
 func (b BytePrefixBuckets) Name() string { return b.name }
 
 func (b BytePrefixBuckets) BucketCount() int { return b.bucketSize }
@@ -165,8 +277,10 @@ func (b BytePrefixBuckets) BucketID(read fastq.FastqRead) int {
 	switch b.field {
 	case "quality":
 		key = read.QualityScores()
+	case "canonical":
+		key, _ = canonicalSequence(b.window.Apply(read.Sequence()))
 	default:
-		key = read.Sequence()
+		key = b.window.Apply(read.Sequence())
 	}
 
 	bucketID := 0
@@ -185,13 +299,17 @@ func (b BytePrefixBuckets) OrderedFor(sorter SortStrategy) bool {
 	// Prefix buckets are globally ordered only when the bucketed field matches
 	// the sort key. For example, sequence-prefix works for alpha sort but not
 	// for quality sort.
-	return (b.field == "sequence" && sorter.Name() == "alpha") ||
+	// The sequence window must also match, otherwise the prefix is taken from
+	// different bytes than the ones the sorter compares.
+	return (b.field == "sequence" && sorter.Name() == "alpha" && sorterWindow(sorter) == b.window) ||
+		(b.field == "canonical" && sorter.Name() == "canonical-alpha" && sorterWindow(sorter) == b.window) ||
 		(b.field == "quality" && sorter.Name() == "qual")
 }
 
 // GCRangeBuckets divides the [0.0, 1.0] GC-content interval into fixed ranges.
 type GCRangeBuckets struct {
 	bucketCount int
+	window      KeyWindow
 }
 
 // NewGCRangeBuckets creates ordered GC buckets. More buckets reduce the maximum
@@ -203,12 +321,19 @@ func NewGCRangeBuckets(bucketCount int) GCRangeBuckets {
 	return GCRangeBuckets{bucketCount: bucketCount}
 }
 
+// WithWindow returns a copy that buckets by the GC content of the windowed
+// sequence, matching a GCSort with the same window.
+func (b GCRangeBuckets) WithWindow(window KeyWindow) GCRangeBuckets {
+	b.window = window
+	return b
+}
+
 func (b GCRangeBuckets) Name() string { return "gc-range" }
 
 func (b GCRangeBuckets) BucketCount() int { return b.bucketCount }
 
 func (b GCRangeBuckets) BucketID(read fastq.FastqRead) int {
-	bucketID := int(read.GCContent * float64(b.bucketCount))
+	bucketID := int(b.window.gcContent(read) * float64(b.bucketCount))
 	if bucketID < 0 {
 		return 0
 	}
@@ -219,7 +344,7 @@ func (b GCRangeBuckets) BucketID(read fastq.FastqRead) int {
 }
 
 func (b GCRangeBuckets) OrderedFor(sorter SortStrategy) bool {
-	return sorter.Name() == "gc"
+	return sorter.Name() == "gc" && sorterWindow(sorter) == b.window
 }
 
 // HashBuckets spreads records across a fixed number of buckets using sequence
@@ -251,6 +376,27 @@ func NewClumpBuckets(bucketCount int, k int) HashBuckets {
 	})
 }
 
+// NewClumpBucketsOpts hashes the pivot chosen with the same border, pivot mode,
+// and blacklist as the clump sorter, so a read lands in the bucket of the clump
+// it is later sorted into. The count filters are not applied because they need
+// a frequency table that does not exist while records are being streamed.
+func NewClumpBucketsOpts(bucketCount int, opts ClumpSortOptions) HashBuckets {
+	var eligible func([]byte) bool
+	if len(opts.Blacklist) > 0 {
+		blacklist := opts.Blacklist
+		eligible = func(kmer []byte) bool { return !blacklist.Contains(kmer) }
+	}
+	selector := opts.selector(eligible)
+	return newHashBuckets("clump-minimizer", bucketCount, func(read fastq.FastqRead) []byte {
+		var quality []byte
+		if selector.minQuality > 0 {
+			quality = read.QualityScores()
+		}
+		key, _, _ := selector.pivot(read.Sequence(), quality)
+		return key
+	})
+}
+
 func newHashBuckets(name string, bucketCount int, keyFunc func(fastq.FastqRead) []byte) HashBuckets {
 	if bucketCount < 1 {
 		bucketCount = 1
@@ -268,15 +414,38 @@ func (b HashBuckets) BucketID(read fastq.FastqRead) int {
 	return int(h.Sum32() % uint32(b.bucketCount))
 }
 
+// SubBucketID rehashes the same key with a per-level salt, so reads that
+// shared a bucket because of their key still share a sub-bucket.
+func (b HashBuckets) SubBucketID(read fastq.FastqRead, level int, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte{byte(level + 1)})
+	h.Write(b.keyFunc(read))
+	return int(h.Sum32() % uint32(count))
+}
+
 func (b HashBuckets) OrderedFor(sorter SortStrategy) bool {
 	// Clump sorting is a compression-oriented grouping pass, so deterministic
 	// hash buckets are acceptable even though they are not globally ordered.
 	return sorter.Name() == "clump"
 }
 
-// StrategyForName maps CLI sort method names to reusable strategy objects.
-// The returned ClumpSort is fully initialised with compression-optimal defaults
-// so callers do not need to know which fields matter.
+// DefaultClumpSort returns a ClumpSort configured with compression-optimal
+// defaults: k=31, border=1, rcomp enabled.
+func DefaultClumpSort() ClumpSort {
+	return ClumpSort{
+		K:      DefaultClumpKmerLen,
+		Border: DefaultClumpBorder,
+		RComp:  true,
+	}
+}
+
+// StrategyForName maps the original CLI sort method names to reusable
+// strategy objects. The returned ClumpSort is fully initialised with
+// compression-optimal defaults.
+//
+// Deprecated: use squish.SortStrategyRegistration, which knows every
+// registered method and its parameters. StrategyForName only knows alpha, gc,
+// qual, and clump.
 func StrategyForName(name string) (SortStrategy, bool) {
 	switch name {
 	case "alpha":
@@ -292,35 +461,26 @@ func StrategyForName(name string) (SortStrategy, bool) {
 	}
 }
 
-// DefaultClumpSort returns a ClumpSort configured with compression-optimal
-// defaults: k=31, border=1, rcomp enabled.
-func DefaultClumpSort() ClumpSort {
-	return ClumpSort{
-		K:      DefaultClumpKmerLen,
-		Border: DefaultClumpBorder,
-		RComp:  true,
-	}
-}
-
-// DefaultBucketStrategy chooses the most natural external bucket layout for a
-// sort strategy. These defaults favor correctness first: alpha, GC, and quality
-// get ordered buckets; clump gets deterministic hash buckets.
+// DefaultBucketStrategy chooses an external bucket layout for the strategies
+// StrategyForName returns: ordered buckets for alpha, GC, and quality, clump
+// hash buckets for clump, and plain hash buckets for anything else.
+//
+// Deprecated: use squish.GetBucketStrategy, which applies the default bucket
+// of every registered method and samples the input where its buckets need it.
 func DefaultBucketStrategy(sorter SortStrategy, bucketCount int) BucketStrategy {
 	switch sorter.Name() {
 	case "alpha":
-		return NewSequencePrefixBuckets(1)
+		return NewSequencePrefixBuckets(1).WithWindow(sorterWindow(sorter))
 	case "gc":
-		return NewGCRangeBuckets(bucketCount)
+		return NewGCRangeBuckets(bucketCount).WithWindow(sorterWindow(sorter))
 	case "qual":
 		return NewQualityPrefixBuckets(1)
 	case "clump":
-		// Preserve the configured clump k-mer length when auto-selecting the
-		// external bucket strategy for clump sort.
 		clumpSorter, ok := sorter.(ClumpSort)
 		if !ok {
 			return NewClumpBuckets(bucketCount, DefaultClumpKmerLen)
 		}
-		return NewClumpBuckets(bucketCount, clumpSorter.k())
+		return NewClumpBucketsOpts(bucketCount, clumpSorter.Options())
 	default:
 		return NewHashBuckets(bucketCount)
 	}
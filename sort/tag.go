@@ -0,0 +1,137 @@
+package sort
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	fastq "squish/fastq"
+)
+
+// Sources of a TagExtractor.
+const (
+	TagSourcePosition = "pos"
+	TagSourceToken    = "token"
+	TagSourceRegex    = "regex"
+)
+
+// TagExtractor pulls a cell barcode or UMI out of a read, for the bc and umi
+// composite key fields. It is parsed from a spec:
+//
+//	pos:START-END  sequence bases [START, END), 0-based, e.g. pos:0-16
+//	token:N        header token N, 0-based, or counted from the end when
+//	               negative; tokens are split on whitespace, ':' and '_',
+//	               after the leading '@'
+//	regex:EXPR     first capture group of EXPR in the header line, or the
+//	               whole match without groups, e.g. regex:CB:Z:([ACGTN]+)
+//
+// Reads without the tag, because they are too short, have too few tokens, or
+// do not match, get an empty tag. The zero TagExtractor extracts nothing.
+type TagExtractor struct {
+	Spec string
+
+	source  string
+	start   int
+	end     int
+	token   int
+	pattern *regexp.Regexp
+}
+
+// ParseTagExtractor parses a tag spec. An empty spec gives the zero
+// extractor.
+func ParseTagExtractor(spec string) (TagExtractor, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return TagExtractor{}, nil
+	}
+	source, value, ok := strings.Cut(spec, ":")
+	if !ok || value == "" {
+		return TagExtractor{}, fmt.Errorf("tag %q must be pos:START-END, token:N, or regex:EXPR", spec)
+	}
+	extractor := TagExtractor{Spec: spec, source: source}
+	switch source {
+	case TagSourcePosition:
+		startValue, endValue, ok := strings.Cut(value, "-")
+		start, startErr := strconv.Atoi(startValue)
+		end, endErr := strconv.Atoi(endValue)
+		if !ok || startErr != nil || endErr != nil || start < 0 || end <= start {
+			return TagExtractor{}, fmt.Errorf("tag %q: want pos:START-END with 0 <= START < END", spec)
+		}
+		extractor.start, extractor.end = start, end
+	case TagSourceToken:
+		token, err := strconv.Atoi(value)
+		if err != nil {
+			return TagExtractor{}, fmt.Errorf("tag %q: token index must be an integer", spec)
+		}
+		extractor.token = token
+	case TagSourceRegex:
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return TagExtractor{}, fmt.Errorf("tag %q: %w", spec, err)
+		}
+		extractor.pattern = pattern
+	default:
+		return TagExtractor{}, fmt.Errorf("tag %q: unknown source %q, want pos, token, or regex", spec, source)
+	}
+	return extractor, nil
+}
+
+// IsZero reports whether the extractor has no spec.
+func (e TagExtractor) IsZero() bool { return e.source == "" }
+
+// Extract returns the tag of read, or nil when the read does not have one.
+func (e TagExtractor) Extract(read fastq.FastqRead) []byte {
+	switch e.source {
+	case TagSourcePosition:
+		sequence := read.Sequence()
+		if len(sequence) < e.end {
+			return nil
+		}
+		return sequence[e.start:e.end]
+	case TagSourceToken:
+		tokens := headerTokens(read.Id())
+		index := e.token
+		if index < 0 {
+			index += len(tokens)
+		}
+		if index < 0 || index >= len(tokens) {
+			return nil
+		}
+		return tokens[index]
+	case TagSourceRegex:
+		match := e.pattern.FindSubmatch(read.Id())
+		if match == nil {
+			return nil
+		}
+		if len(match) > 1 {
+			return match[1]
+		}
+		return match[0]
+	default:
+		return nil
+	}
+}
+
+// headerTokens splits a header line, without its leading '@', on whitespace,
+// ':' and '_'.
+func headerTokens(id []byte) [][]byte {
+	if len(id) > 0 && id[0] == '@' {
+		id = id[1:]
+	}
+	var tokens [][]byte
+	start := -1
+	for i, b := range id {
+		separator := b == ' ' || b == '\t' || b == ':' || b == '_'
+		if separator && start >= 0 {
+			tokens = append(tokens, id[start:i])
+			start = -1
+		} else if !separator && start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, id[start:])
+	}
+	return tokens
+}
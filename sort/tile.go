@@ -0,0 +1,189 @@
+package sort
+
+import (
+	go_sort "sort"
+
+	fastq "squish/fastq"
+)
+
+// tileKey is the coordinate key of one read. Reads whose header is not an
+// Illumina header have parsed == false and sort after all parsed reads.
+type tileKey struct {
+	parsed bool
+	lane   int
+	tile   int
+	x      int
+	y      int
+}
+
+func readTileKey(read fastq.FastqRead) tileKey {
+	header, ok := fastq.ParseIlluminaHeader(read.Id())
+	if !ok {
+		return tileKey{}
+	}
+	return tileKey{parsed: true, lane: header.Lane, tile: header.Tile, x: header.X, y: header.Y}
+}
+
+// compareTileKeys orders parsed keys by lane, tile, x, then y. x comes before
+// y because it comes first in the header, so neighbouring headers share a
+// longer prefix.
+func compareTileKeys(a tileKey, b tileKey) int {
+	if a.parsed != b.parsed {
+		if a.parsed {
+			return -1
+		}
+		return 1
+	}
+	for _, pair := range [][2]int{{a.lane, b.lane}, {a.tile, b.tile}, {a.x, b.x}, {a.y, b.y}} {
+		if pair[0] != pair[1] {
+			if pair[0] < pair[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// TileSort orders reads by Illumina lane and tile, then by the x/y cluster
+// coordinates within the tile. It is the single-field sorter of the tile key
+// field; use the composite key to combine tile with other fields. Headers of
+// neighbouring clusters differ only in their last digits, which shortens gzip
+// back-references for the header line, and optical duplicates end up next to
+// each other.
+//
+// Reads without a parseable Illumina header follow in natural name order.
+type TileSort struct{}
+
+func (TileSort) Name() string { return "tile" }
+
+func (TileSort) Less(a fastq.FastqRead, b fastq.FastqRead) bool {
+	return tileReadLess(a, readTileKey(a), b, readTileKey(b))
+}
+
+// SortKeys parses every header once instead of twice per comparison.
+func (TileSort) SortKeys(reads []fastq.FastqRead) [][]byte {
+	return readKeys(reads, func(dst []byte, read fastq.FastqRead) []byte {
+		return appendTileKey(dst, read)
+	})
+}
+
+// appendTileKey appends the lane, tile, x, and y of a parsed header, or the
+// natural key of any other header after a marker that sorts it last.
+func appendTileKey(dst []byte, read fastq.FastqRead) []byte {
+	key := readTileKey(read)
+	if !key.parsed {
+		dst = appendKeyBool(dst, true)
+		return appendKeyBytes(dst, naturalKey(read.Id()))
+	}
+	dst = appendKeyBool(dst, false)
+	for _, value := range []int{key.lane, key.tile, key.x, key.y} {
+		dst = appendKeyInt(dst, value)
+	}
+	return dst
+}
+
+func tileReadLess(a fastq.FastqRead, keyA tileKey, b fastq.FastqRead, keyB tileKey) bool {
+	if c := compareTileKeys(keyA, keyB); c != 0 {
+		return c < 0
+	}
+	if !keyA.parsed {
+		if c := NaturalCompare(a.Id(), b.Id()); c != 0 {
+			return c < 0
+		}
+	}
+	return a.I < b.I
+}
+
+// laneTile is one Illumina lane and tile pair, the unit of LaneTileBuckets.
+type laneTile struct {
+	lane int
+	tile int
+}
+
+func (a laneTile) less(b laneTile) bool {
+	if a.lane != b.lane {
+		return a.lane < b.lane
+	}
+	return a.tile < b.tile
+}
+
+// LaneTileBuckets gives each lane and tile seen in a sample of headers its
+// own bucket. A tile missing from the sample shares the bucket of the nearest
+// sampled tile before it, so bucket IDs still increase with lane and then
+// tile and the buckets are ordered for the tile key. Reads without a
+// parseable header share the last bucket, matching the tile key, which places
+// them after all parsed reads.
+type LaneTileBuckets struct {
+	tiles []laneTile
+}
+
+// NewLaneTileBuckets collects the distinct lanes and tiles of the sampled
+// headers. When more than bucketCount-1 are seen, neighbouring tiles share
+// buckets. With no Illumina headers in the sample every read goes to one of
+// two buckets.
+func NewLaneTileBuckets(bucketCount int, sampledIDs [][]byte) LaneTileBuckets {
+	seen := map[laneTile]bool{}
+	var tiles []laneTile
+	for _, id := range sampledIDs {
+		header, ok := fastq.ParseIlluminaHeader(id)
+		if !ok {
+			continue
+		}
+		tile := laneTile{lane: header.Lane, tile: header.Tile}
+		if !seen[tile] {
+			seen[tile] = true
+			tiles = append(tiles, tile)
+		}
+	}
+	go_sort.Slice(tiles, func(i, j int) bool { return tiles[i].less(tiles[j]) })
+
+	if slots := bucketCount - 1; slots >= 1 && len(tiles) > slots {
+		merged := make([]laneTile, slots)
+		for i := range merged {
+			merged[i] = tiles[i*len(tiles)/slots]
+		}
+		tiles = merged
+	}
+	return LaneTileBuckets{tiles: tiles}
+}
+
+// SampleLaneTileBuckets builds lane-tile buckets from a sample of sampleReads
+// headers drawn by SampleReadNames.
+func SampleLaneTileBuckets(inputFilepath string, delim byte, bucketCount int, sampleReads int) (LaneTileBuckets, error) {
+	sample, err := SampleReadNames(inputFilepath, delim, sampleReads)
+	if err != nil {
+		return LaneTileBuckets{}, err
+	}
+	return NewLaneTileBuckets(bucketCount, sample), nil
+}
+
+func (LaneTileBuckets) Name() string { return "lane-tile" }
+
+// BucketCount is one bucket per sampled tile, at least one, plus the bucket
+// for unparsed headers.
+func (b LaneTileBuckets) BucketCount() int {
+	if len(b.tiles) == 0 {
+		return 2
+	}
+	return len(b.tiles) + 1
+}
+
+func (b LaneTileBuckets) BucketID(read fastq.FastqRead) int {
+	key := readTileKey(read)
+	if !key.parsed {
+		return b.BucketCount() - 1
+	}
+	// The bucket of the last sampled tile at or before the read's tile; tiles
+	// before the first sampled one join bucket 0.
+	tile := laneTile{lane: key.lane, tile: key.tile}
+	id := go_sort.Search(len(b.tiles), func(i int) bool { return tile.less(b.tiles[i]) }) - 1
+	if id < 0 {
+		return 0
+	}
+	return id
+}
+
+func (LaneTileBuckets) OrderedFor(sorter SortStrategy) bool {
+	return sorter.Name() == "tile"
+}
@@ -0,0 +1,72 @@
+package sort
+
+import fastq "squish/fastq"
+
+// KeyWindow excludes a fixed number of bases from the 5' and 3' ends of a read
+// before a sequence-derived sort key is extracted.
+//
+// Inline UMIs, barcodes, and adapter read-through are not part of the
+// biological fragment, so letting them drive clustering scatters reads from
+// the same locus. The window is applied consistently by the clump pivot
+// search, the alpha and GC comparators, and their external bucket strategies,
+// so memory and external sorts agree.
+type KeyWindow struct {
+	Trim5 int // bases excluded from the start of the read
+	Trim3 int // bases excluded from the end of the read
+}
+
+// IsZero reports whether the window keeps the whole read.
+func (w KeyWindow) IsZero() bool { return w.Trim5 <= 0 && w.Trim3 <= 0 }
+
+// Bounds returns the [start, end) range kept from a read of length n. Reads
+// shorter than the combined trim produce an empty range at start.
+func (w KeyWindow) Bounds(n int) (int, int) {
+	start := w.Trim5
+	if start < 0 {
+		start = 0
+	}
+	end := n
+	if w.Trim3 > 0 {
+		end -= w.Trim3
+	}
+	if start > n {
+		start = n
+	}
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// Apply returns the windowed view of sequence without copying.
+func (w KeyWindow) Apply(sequence []byte) []byte {
+	start, end := w.Bounds(len(sequence))
+	return sequence[start:end]
+}
+
+// gcContent returns the GC fraction of the windowed sequence. The full-read
+// value is precomputed by the parser, so only trimmed windows are rescanned.
+func (w KeyWindow) gcContent(read fastq.FastqRead) float64 {
+	if w.IsZero() {
+		return read.GCContent
+	}
+	return fastq.CalcGCContent(w.Apply(read.Sequence()))
+}
+
+// sorterWindow returns the key window used by sorters that support one.
+// Ordered bucket strategies compare it with their own window, because buckets
+// built from a different part of the read are not ordered for the sorter.
+func sorterWindow(sorter SortStrategy) KeyWindow {
+	switch s := sorter.(type) {
+	case AlphaSort:
+		return s.Window
+	case CanonicalAlphaSort:
+		return s.Window
+	case GCSort:
+		return s.Window
+	case ClumpSort:
+		return s.Window
+	default:
+		return KeyWindow{}
+	}
+}
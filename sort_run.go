@@ -18,27 +18,42 @@ func RunSort(config Config, sortDefinition SortDefinition) (RunStats, error) {
 	}
 	defer reader.Close()
 
-	writer, err := _io.OpenWriter(config.OutputFilepath)
-	if err != nil {
-		return RunStats{}, err
-	}
-	defer writer.Close()
-
 	reads := []fastq.FastqRead{}
 	totalByteSize, err := fastq.LoadReadsE(&reads, reader, &config.RecordDelim)
 	if err != nil {
 		return RunStats{}, err
 	}
 	slog.Info("reads loaded", "count", len(reads), "size", bytefmt.ByteSize(uint64(totalByteSize)))
+	if config.ComparesMates() {
+		if err := fastq.LoadMates(reads, config.PairedInputFilepaths, config.RecordDelim); err != nil {
+			return RunStats{}, fmt.Errorf("load companion reads for dedupe: %w", err)
+		}
+	}
 
 	slog.Debug("starting read sort")
 	sortDefinition.Func(&reads)
 	slog.Debug("reads after sorting", "count", len(reads))
+	flippedReads, err := _sort.VerifyFlippedReads(reads)
+	if err != nil {
+		return RunStats{}, err
+	}
+	corrections := _sort.CountCorrections(reads)
+	inputReads := len(reads)
+	reads, duplicates := _sort.FinishDuplicates(reads, config.Dedupe == "remove")
+	headers := _sort.CountHeaderSharing(reads)
 
 	if config.QuantizeQuality {
 		_sort.QuantizeReads(reads)
 	}
 
+	// The output is only created once the sort has been verified, so a failed
+	// run leaves no partial file behind.
+	writer, err := _io.OpenWriter(config.OutputFilepath)
+	if err != nil {
+		return RunStats{}, err
+	}
+	defer writer.Close()
+
 	slog.Debug("writing to output file", "path", config.OutputFilepath)
 	if err := fastq.WriteReadsE(&reads, writer); err != nil {
 		return RunStats{}, err
@@ -46,8 +61,80 @@ func RunSort(config Config, sortDefinition SortDefinition) (RunStats, error) {
 	if err := fastq.SaveOrderE(&reads, config.OrderFilename); err != nil {
 		return RunStats{}, err
 	}
+	if config.FlipsMates() {
+		if err := fastq.SaveFlipsE(&reads, config.FlipFilename); err != nil {
+			return RunStats{}, err
+		}
+	}
+
+	if config.TagsMateDuplicates() {
+		if err := fastq.SaveDuplicatesE(&reads, config.DuplicateFilename); err != nil {
+			return RunStats{}, err
+		}
+	}
+
+	return RunStats{Reads: inputReads, Bytes: totalByteSize, FlippedReads: flippedReads, Duplicates: duplicates, Corrections: corrections, Headers: headers}, nil
+}
+
+// countAbundance runs the abundance count pass over the input and returns the
+// sort definition with the counted table attached, so both engines and the
+// abundance buckets share exact global counts.
+func countAbundance(config Config, sortDefinition SortDefinition, sorter _sort.AbundanceSort) (SortDefinition, error) {
+	tempDir := filepath.Join(config.TempDir, "abundance-count")
+	table, err := _sort.CountAbundance(config.InputFilepath, config.RecordDelim, tempDir, config.BucketCount, sorter.Mismatches)
+	if err != nil {
+		return SortDefinition{}, fmt.Errorf("count sequence abundance: %w", err)
+	}
+	slog.Info("sequence abundance counted", "reads", table.Reads, "uniques", table.Uniques, "singletons", table.Singletons, "clusters", table.Clusters())
+	sorter.Table = table
+	sortDefinition.Func = func(reads *[]fastq.FastqRead) {
+		_sort.SortReadsStrategy(reads, sorter)
+	}
+	sortDefinition.Strategy = sorter
+	return sortDefinition, nil
+}
+
+// selectClumpParams samples the input for ClumpAutoK and builds the clump
+// definition with the chosen k-mer length and border. normalizeConfig only
+// validates the options, so it never reads the input and leaves the
+// definition to this step. The returned report records the choice.
+func selectClumpParams(config Config) (Config, SortDefinition, *ClumpAutoReport, error) {
+	sample, err := fastq.SampleReadStats(config.InputFilepath, config.RecordDelim, config.ClumpAutoSampleReads)
+	if err != nil {
+		return Config{}, SortDefinition{}, nil, fmt.Errorf("sample reads for clumpK auto: %w", err)
+	}
+	config.ClumpKmerLen, config.ClumpBorder = _sort.AutoClumpParams(sample)
+	slog.Info("clump parameters selected from sampled reads", "k", config.ClumpKmerLen, "border", config.ClumpBorder, "sampled_reads", sample.Reads, "median_length", sample.MedianLength, "mean_error_rate", sample.MeanErrorRate)
 
-	return RunStats{Reads: len(reads), Bytes: totalByteSize}, nil
+	registration, ok := SortStrategyRegistration(config.SortMethod)
+	if !ok {
+		return Config{}, SortDefinition{}, nil, fmt.Errorf("unknown sort method: %s", config.SortMethod)
+	}
+	sortDefinition, err := registration.definition(config, config.SortParams)
+	if err != nil {
+		return Config{}, SortDefinition{}, nil, err
+	}
+	report := &ClumpAutoReport{KmerLength: config.ClumpKmerLen, Border: config.ClumpBorder, Sample: sample}
+	return config, sortDefinition, report, nil
+}
+
+// runKeyCommand runs the key command over the input and returns the sort
+// definition with its keys attached, so both engines and key-range buckets
+// look up the same keys. The keys live in a sidecar file under the temp dir
+// until they are closed.
+func runKeyCommand(config Config, sortDefinition SortDefinition) (SortDefinition, error) {
+	tempDir := filepath.Join(config.TempDir, "key-command")
+	keys, err := _sort.RunKeyCommand(config.InputFilepath, config.RecordDelim, tempDir, config.KeyCommand)
+	if err != nil {
+		return SortDefinition{}, fmt.Errorf("run key command: %w", err)
+	}
+	slog.Info("sort keys read from key command", "command", config.KeyCommand, "keys", keys.Reads)
+	sorter := _sort.CommandKeySort{Keys: keys}
+	sortDefinition.Func = func(reads *[]fastq.FastqRead) {
+		_sort.SortReadsStrategy(reads, sorter)
+	}
+	sortDefinition.Strategy = sorter
+	return sortDefinition, nil
 }
 
 func RunPairedReorders(config Config, expectedReads int) ([]PairedRunStats, error) {
@@ -67,15 +154,48 @@ func RunPairedReorders(config Config, expectedReads int) ([]PairedRunStats, erro
 		}
 	}
 
+	var flipped []bool
+	if config.FlipsMates() {
+		flipped, err = fastq.LoadFlips(config.FlipFilename, expectedReads)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var duplicates []fastq.DuplicateKind
+	if config.TagsMateDuplicates() {
+		duplicates, err = fastq.LoadDuplicates(config.DuplicateFilename, expectedReads)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	pairedStats := make([]PairedRunStats, 0, len(config.PairedInputFilepaths))
 	for i, inputPath := range config.PairedInputFilepaths {
 		outputPath := config.PairedOutputFilepaths[i]
 		slog.Debug("reordering paired fastq", "input", inputPath, "output", outputPath, "order", config.OrderFilename, "check_pairs", config.CheckPairs)
 
-		stats, err := fastq.ReorderReadsByOrder(inputPath, outputPath, config.OrderFilename, config.RecordDelim, expectedReads, referenceNames)
+		// Demultiplexed samples each have an order file listing their own
+		// reads, so the companion is indexed once and split between them.
+		targets := []fastq.ReorderTarget{{OutputFilepath: outputPath, OrderFilename: config.OrderFilename}}
+		for _, output := range config.DemuxOutputs {
+			targets = append(targets, fastq.ReorderTarget{OutputFilepath: output.PairedOutputFilepaths[i], OrderFilename: output.OrderFilename})
+		}
+		targetStats, err := fastq.ReorderReadsByOrders(inputPath, targets, fastq.ReorderOptions{
+			Delim:          config.RecordDelim,
+			ExpectedReads:  expectedReads,
+			ReferenceNames: referenceNames,
+			Flipped:        flipped,
+			Duplicates:     duplicates,
+			AllowSubset:    config.Dedupe == "remove",
+		})
 		if err != nil {
 			return nil, fmt.Errorf("reorder paired FASTQ %q: %w", inputPath, err)
 		}
+		stats := targetStats[0]
+		for _, sampleStats := range targetStats[1:] {
+			stats.Flipped += sampleStats.Flipped
+		}
 		inputSize := LogFileSize(inputPath, "Paired input")
 		outputSize := LogFileSize(outputPath, "Paired output")
 		pairedStats = append(pairedStats, PairedRunStats{
@@ -87,6 +207,7 @@ func RunPairedReorders(config Config, expectedReads int) ([]PairedRunStats, erro
 			Reads:             stats.Reads,
 			UncompressedBytes: stats.Bytes,
 			OutputSizeBytes:   outputSize,
+			FlippedReads:      stats.Flipped,
 		})
 	}
 	return pairedStats, nil
@@ -101,6 +222,27 @@ func RunExternalSort(config Config, sortDefinition SortDefinition) (RunStats, er
 		TempDir:         tempDir,
 		RecordDelim:     config.RecordDelim,
 		QuantizeQuality: config.QuantizeQuality,
+		MaxBucketBytes:  config.MaxBucketBytes,
+
+		RemoveDuplicates: config.Dedupe == "remove",
+	}
+	if config.FlipsMates() {
+		sortConfig.FlipFilepath = config.FlipFilename
+	}
+	if config.TagsMateDuplicates() {
+		sortConfig.DuplicateFilepath = config.DuplicateFilename
+	}
+	if config.ComparesMates() {
+		sortConfig.MateFilepaths = config.PairedInputFilepaths
+	}
+	if config.Demultiplexer != nil {
+		sortConfig.Demux = config.Demultiplexer
+		for _, output := range config.DemuxOutputs {
+			sortConfig.SampleOutputs = append(sortConfig.SampleOutputs, _sort.SampleOutput{
+				OutputFilepath: output.OutputFilepath,
+				OrderFilepath:  output.OrderFilename,
+			})
+		}
 	}
 	bucketer, err := GetBucketStrategy(config, sortDefinition)
 	if err != nil {
@@ -118,24 +260,192 @@ func RunExternalSort(config Config, sortDefinition SortDefinition) (RunStats, er
 		BucketCount:   stats.BucketCount,
 		BucketName:    stats.BucketerName,
 		BucketTempDir: stats.TempDir,
+		BucketOrdered: bucketer.OrderedFor(sortDefinition.Strategy),
+		BucketsSplit:  stats.SplitBuckets,
+		FlippedReads:  stats.FlippedReads,
+		Duplicates: _sort.DuplicateStats{
+			Duplicates:        stats.Duplicates,
+			OpticalDuplicates: stats.OpticalDuplicates,
+		},
+		Corrections: _sort.CorrectionStats{
+			Bases: stats.CorrectedBases,
+			Reads: stats.CorrectedReads,
+		},
+		Headers: stats.Headers,
+		Samples: stats.Samples,
 	}, nil
 }
 
-func GetBucketStrategy(config Config, sortDefinition SortDefinition) (_sort.BucketStrategy, error) {
-	switch config.BucketStrategy {
-	case "auto":
-		return _sort.DefaultBucketStrategy(sortDefinition.Strategy, config.BucketCount), nil
-	case "sequence-prefix":
-		return _sort.NewSequencePrefixBuckets(2), nil
-	case "quality-prefix":
+// prefixBucketParams sets the number of leading bases of sequence prefix
+// buckets.
+var prefixBucketParams = []StrategyParam{
+	{Name: "prefix", Type: ParamTypeInt, Default: "2", Description: "leading bases per bucket key"},
+}
+
+// builtinBucketStrategies are registered ahead of any custom bucket strategy,
+// in the order of the -bucket help text.
+var builtinBucketStrategies = []BucketRegistration{
+	{Name: "sequence-prefix", Description: "ordered buckets by sequence prefix", Params: prefixBucketParams, New: func(config Config, _ SortDefinition, params StrategyParams) (_sort.BucketStrategy, error) {
+		if params.Int("prefix") < 1 {
+			return nil, fmt.Errorf("prefix must be >= 1, got %d", params.Int("prefix"))
+		}
+		return _sort.NewSequencePrefixBuckets(params.Int("prefix")).WithWindow(config.KeyWindow()), nil
+	}},
+	{Name: "canonical-prefix", Description: "ordered buckets by canonical sequence prefix", Params: prefixBucketParams, New: func(config Config, _ SortDefinition, params StrategyParams) (_sort.BucketStrategy, error) {
+		if params.Int("prefix") < 1 {
+			return nil, fmt.Errorf("prefix must be >= 1, got %d", params.Int("prefix"))
+		}
+		return _sort.NewCanonicalPrefixBuckets(params.Int("prefix")).WithWindow(config.KeyWindow()), nil
+	}},
+	{Name: "quality-prefix", Description: "ordered buckets by quality prefix", New: func(Config, SortDefinition, StrategyParams) (_sort.BucketStrategy, error) {
 		return _sort.NewQualityPrefixBuckets(1), nil
-	case "gc-range":
-		return _sort.NewGCRangeBuckets(config.BucketCount), nil
-	case "hash":
+	}},
+	{Name: "quality-range", Description: "ordered buckets by the quality metric of the sort method", New: func(config Config, sortDefinition SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		metric := _sort.QualityMetricMean
+		if qualitySorter, ok := sortDefinition.Strategy.(_sort.QualityMetricSort); ok {
+			metric = qualitySorter.Name()
+		}
+		return _sort.NewQualityRangeBuckets(config.BucketCount, metric), nil
+	}},
+	{Name: "gc-range", Description: "ordered buckets by GC range", New: func(config Config, _ SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		return _sort.NewGCRangeBuckets(config.BucketCount).WithWindow(config.KeyWindow()), nil
+	}},
+	{Name: "length-range", Description: "ordered buckets by read length on a log scale", New: func(config Config, _ SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		return _sort.NewLengthRangeBuckets(config.BucketCount, _sort.DefaultMaxReadLength).WithDescending(config.LengthDescending), nil
+	}},
+	{Name: "name-prefix", Description: "ordered buckets by read header, split at sampled headers", New: func(config Config, _ SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		return sampleNamePrefixBuckets(config)
+	}},
+	{Name: "lane-tile", Description: "ordered buckets by Illumina lane and tile, one per sampled tile", New: func(config Config, _ SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		bucketer, err := _sort.SampleLaneTileBuckets(config.InputFilepath, config.RecordDelim, config.BucketCount, _sort.DefaultNameBucketSampleReads)
+		if err != nil {
+			return nil, fmt.Errorf("sample lane-tile buckets: %w", err)
+		}
+		return bucketer, nil
+	}},
+	{Name: "abundance", Description: "ordered buckets by abundance cluster; abundance sort only", New: func(config Config, sortDefinition SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		abundanceSorter, ok := sortDefinition.Strategy.(_sort.AbundanceSort)
+		if !ok || abundanceSorter.Table == nil {
+			return nil, fmt.Errorf("abundance buckets require the abundance sort method, got %s", sortDefinition.CLIArg)
+		}
+		return _sort.NewAbundanceBuckets(config.BucketCount, abundanceSorter.Table), nil
+	}},
+	{Name: "position-range", Description: "ordered buckets by reference position; reference sort only", New: func(config Config, sortDefinition SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		referenceSorter, ok := sortDefinition.Strategy.(_sort.ReferenceSort)
+		if !ok || referenceSorter.Index == nil {
+			return nil, fmt.Errorf("position-range buckets require the reference sort method, got %s", sortDefinition.CLIArg)
+		}
+		return _sort.NewPositionRangeBuckets(config.BucketCount, referenceSorter.Index), nil
+	}},
+	{Name: "key-range", Description: "ordered buckets by sort key, split at sampled keys", New: func(config Config, sortDefinition SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		return sampleKeyRangeBuckets(config, sortDefinition)
+	}},
+	{Name: "hash", Description: "fixed-count hash buckets", New: func(config Config, _ SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
 		return _sort.NewHashBuckets(config.BucketCount), nil
-	case "clump-minimizer":
+	}},
+	{Name: "clump-minimizer", Description: "hash buckets on the clump pivot k-mer", New: func(config Config, sortDefinition SortDefinition, _ StrategyParams) (_sort.BucketStrategy, error) {
+		if clumpSorter, ok := sortDefinition.Strategy.(_sort.ClumpSort); ok {
+			return _sort.NewClumpBucketsOpts(config.BucketCount, clumpSorter.Options()), nil
+		}
 		return _sort.NewClumpBuckets(config.BucketCount, config.ClumpKmerLen), nil
-	default:
-		return nil, fmt.Errorf("unknown bucket strategy: %s", config.BucketStrategy)
+	}},
+}
+
+func init() {
+	for _, registration := range builtinBucketStrategies {
+		if err := RegisterBucketStrategy(registration); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// GetBucketStrategy builds the bucket strategy named by config.BucketStrategy.
+// With auto, a sort method registered with a DefaultBucket uses that bucket
+// strategy and its DefaultBucketParams; composite keys get buckets ordered on
+// their leading field, and other methods key-range or hash buckets.
+func GetBucketStrategy(config Config, sortDefinition SortDefinition) (_sort.BucketStrategy, error) {
+	name := config.BucketStrategy
+	given := config.BucketParams
+	if name == DefaultBucketStrategy {
+		sortRegistration, _ := SortStrategyRegistration(sortDefinition.CLIArg)
+		if sortRegistration.DefaultBucket == "" {
+			if len(config.BucketParams) > 0 {
+				return nil, fmt.Errorf("bucketParam requires a named bucket strategy, not %s", name)
+			}
+			return autoBucketStrategy(config, sortDefinition)
+		}
+		name = sortRegistration.DefaultBucket
+		given = map[string]string{}
+		for key, value := range sortRegistration.DefaultBucketParams {
+			given[key] = value
+		}
+		for key, value := range config.BucketParams {
+			given[key] = value
+		}
+	}
+	registration, ok := BucketStrategyRegistration(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown bucket strategy: %s", name)
+	}
+	params, err := resolveParams("bucket strategy", registration.Name, registration.Params, given)
+	if err != nil {
+		return nil, err
+	}
+	return registration.New(config, sortDefinition, params)
+}
+
+func autoBucketStrategy(config Config, sortDefinition SortDefinition) (_sort.BucketStrategy, error) {
+	if composite, ok := sortDefinition.Strategy.(_sort.CompositeSort); ok {
+		return compositeBuckets(config, composite)
+	}
+	if _sort.KeysPerRead(sortDefinition.Strategy) {
+		// Sorters without ordered buckets of their own, such as registered
+		// ones, still get an exact global sort from their keys.
+		return sampleKeyRangeBuckets(config, sortDefinition)
+	}
+	return _sort.NewHashBuckets(config.BucketCount), nil
+}
+
+// sampleKeyRangeBuckets places key-range bucket boundaries from a sample of
+// the input reads.
+func sampleKeyRangeBuckets(config Config, sortDefinition SortDefinition) (_sort.BucketStrategy, error) {
+	keyed, ok := sortDefinition.Strategy.(_sort.KeyedStrategy)
+	if !ok || !_sort.KeysPerRead(keyed) {
+		return nil, fmt.Errorf("key-range buckets require a sort method with per-read keys, got %s", sortDefinition.CLIArg)
+	}
+	bucketer, err := _sort.SampleKeyRangeBuckets(config.InputFilepath, config.RecordDelim, config.BucketCount, _sort.DefaultKeyRangeSampleReads, keyed)
+	if err != nil {
+		return nil, fmt.Errorf("sample key-range buckets: %w", err)
+	}
+	return bucketer, nil
+}
+
+// compositeBuckets derives buckets ordered on the leading key field. A
+// leading name or tile field needs sampled headers to place its buckets.
+// Barcode and UMI fields have no buckets of their own, so a leading tag gets
+// key-range buckets on the whole key.
+func compositeBuckets(config Config, composite _sort.CompositeSort) (_sort.BucketStrategy, error) {
+	switch composite.Fields[0].Field {
+	case _sort.KeyFieldBarcode, _sort.KeyFieldUMI:
+		return sampleKeyRangeBuckets(config, SortDefinition{CLIArg: "key", Strategy: composite})
+	}
+	var sampledNames [][]byte
+	if field := composite.Fields[0].Field; field == _sort.KeyFieldName || field == _sort.KeyFieldTile {
+		var err error
+		sampledNames, err = _sort.SampleReadNames(config.InputFilepath, config.RecordDelim, _sort.DefaultNameBucketSampleReads)
+		if err != nil {
+			return nil, fmt.Errorf("sample %s buckets: %w", field, err)
+		}
+	}
+	return composite.LeadingKeyBuckets(config.BucketCount, sampledNames), nil
+}
+
+// sampleNamePrefixBuckets places name-prefix bucket boundaries from a sample
+// of the input headers.
+func sampleNamePrefixBuckets(config Config) (_sort.BucketStrategy, error) {
+	bucketer, err := _sort.SampleNamePrefixBuckets(config.InputFilepath, config.RecordDelim, config.BucketCount, _sort.DefaultNameBucketSampleReads)
+	if err != nil {
+		return nil, fmt.Errorf("sample name-prefix buckets: %w", err)
 	}
+	return bucketer, nil
 }
@@ -1,9 +1,14 @@
 package squish
 
 import (
+	"compress/gzip"
 	"context"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	fastq "squish/fastq"
+	_sort "squish/sort"
 	"strings"
 	"testing"
 )
@@ -87,3 +92,925 @@ func TestRunExternalAlphaWritesReportManifestAndPairedOutput(t *testing.T) {
 		t.Fatalf("manifest missing paired output: %q", manifestText)
 	}
 }
+
+func TestRunClumpAutoKRecordsSample(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "short.fastq")
+	input := "" +
+		"@r1\nACGTACGTACGTACGTACGTACGTACGTACGTACGT\n+\nIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII\n" +
+		"@r2\nTTTTACGTACGTACGTACGTACGTACGTACGTACGT\n+\nIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII\n"
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	result, err := Run(context.Background(), Config{
+		SortMethod:        "clump",
+		SortEngine:        "memory",
+		ClumpAutoK:        true,
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "short.clump.fastq.gz",
+		OutputDir:         filepath.Join(dir, "out"),
+	})
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+
+	auto := result.Report.ClumpAuto
+	if auto == nil {
+		t.Fatal("report should include clump_auto when -clumpK auto is used")
+	}
+	if auto.Sample.Reads != 2 || auto.Sample.MedianLength != 36 {
+		t.Fatalf("sample = %+v, want 2 reads of length 36", auto.Sample)
+	}
+	// 36 bp reads leave room for k=27 with border 1 and 8 candidate windows.
+	if auto.KmerLength != 27 || result.Report.ClumpKmerLength != 27 {
+		t.Fatalf("auto k = %d (report %d), want 27", auto.KmerLength, result.Report.ClumpKmerLength)
+	}
+}
+
+func TestRunClumpAutoKIgnoredForOtherMethods(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "short.fastq")
+	input := "" +
+		"@r1\nTTTTACGTACGT\n+\nIIIIIIIIIIII\n" +
+		"@r2\nACGTACGTACGT\n+\nIIIIIIIIIIII\n"
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	// normalizeConfig validates without sampling, so a missing input is not
+	// read until Run.
+	_, sortDefinition, err := normalizeConfig(Config{
+		SortMethod:        "clump",
+		ClumpAutoK:        true,
+		InputFilepath:     filepath.Join(dir, "missing.fastq"),
+		OutputFilenameArg: "missing.fastq.gz",
+		OutputDir:         filepath.Join(dir, "missing"),
+	})
+	if err != nil {
+		t.Fatalf("normalize clump auto: %v", err)
+	}
+	if sortDefinition.Strategy != nil {
+		t.Fatalf("normalizeConfig should leave the clump definition to Run")
+	}
+
+	for _, config := range []Config{
+		{SortMethod: "alpha"},
+		{SortMethod: "key", SortKey: "clump"},
+	} {
+		config.SortEngine = "memory"
+		config.ClumpAutoK = true
+		config.InputFilepath = inputPath
+		config.OutputFilenameArg = "short.sorted.fastq.gz"
+		config.OutputDir = filepath.Join(dir, "out-"+config.SortMethod)
+		result, err := Run(context.Background(), config)
+		if err != nil {
+			t.Fatalf("%s: run squish: %v", config.SortMethod, err)
+		}
+		if result.Report.ClumpAuto != nil {
+			t.Fatalf("%s: report should not include clump_auto", config.SortMethod)
+		}
+		if got := result.Report.ClumpKmerLength; got != DefaultClumpKmerLen {
+			t.Fatalf("%s: clump k = %d, want default %d", config.SortMethod, got, DefaultClumpKmerLen)
+		}
+	}
+}
+
+func TestRunLongReadSplitsBucketsOverBudget(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "long.fastq")
+	input := ""
+	for i, sequence := range []string{
+		strings.Repeat("ACGTTGCAAG", 30),
+		strings.Repeat("TTGACCAGTA", 30),
+		strings.Repeat("GGCATCAATC", 30),
+		strings.Repeat("CAGTAGGTCA", 30),
+	} {
+		input += fmt.Sprintf("@r%d\n%s\n+\n%s\n", i+1, sequence, strings.Repeat("I", len(sequence)))
+	}
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	result, err := Run(context.Background(), Config{
+		SortMethod:        "clump",
+		SortEngine:        "external",
+		BucketStrategy:    "clump-minimizer",
+		BucketCount:       1,
+		LongRead:          true,
+		MaxBucketBytes:    700,
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "long.clump.fastq.gz",
+		OutputDir:         filepath.Join(dir, "out"),
+	})
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+
+	report := result.Report
+	if !report.LongRead || report.ClumpMinimizerWindow != 10 {
+		t.Fatalf("long_read = %v, minimizer window = %d, want true and 10", report.LongRead, report.ClumpMinimizerWindow)
+	}
+	if report.Bucket == nil || report.Bucket.Split == 0 {
+		t.Fatalf("bucket report = %+v, want the oversize bucket split", report.Bucket)
+	}
+	if report.Reads != 4 {
+		t.Fatalf("reads = %d, want 4", report.Reads)
+	}
+}
+
+func TestRunPairedRCompModes(t *testing.T) {
+	r1 := "" +
+		"@pair1/1\nTTTTTT\n+\nABCDEF\n" +
+		"@pair2/1\nAAAAAC\n+\nIIIIII\n"
+	r2 := "" +
+		"@pair1/2\nGGCCAT\n+\n123456\n" +
+		"@pair2/2\nCCCCCC\n+\nIIIIII\n"
+	cases := []struct {
+		mode         string
+		wantR1       string
+		wantR2       string
+		wantFlipped  int
+		wantPairs    int
+		wantFlipFile bool
+	}{
+		{"off", "TTTTTT", "GGCCAT", 0, 0, false},
+		{"mate", "AAAAAA", "ATGGCC", 1, 1, true},
+		// The default keeps every pair in its input orientation.
+		{"", "TTTTTT", "GGCCAT", 0, 0, false},
+		{"primary", "AAAAAA", "GGCCAT", 1, 0, false},
+	}
+	// TTTTTT is flipped by both sorters: its pivot is on the minus strand and
+	// AAAAAA is its canonical sequence.
+	for _, method := range []string{"clump", "canonical-alpha"} {
+		for _, tc := range cases {
+			t.Run(method+"/"+tc.mode, func(t *testing.T) {
+				dir := t.TempDir()
+				r1Path := filepath.Join(dir, "r1.fastq")
+				r2Path := filepath.Join(dir, "r2.fastq")
+				outDir := filepath.Join(dir, "out")
+				if err := os.WriteFile(r1Path, []byte(r1), 0644); err != nil {
+					t.Fatalf("write r1: %v", err)
+				}
+				if err := os.WriteFile(r2Path, []byte(r2), 0644); err != nil {
+					t.Fatalf("write r2: %v", err)
+				}
+
+				result, err := Run(context.Background(), Config{
+					SortMethod:           method,
+					SortEngine:           "external",
+					ClumpKmerLen:         3,
+					ClumpRComp:           true,
+					CanonicalFlip:        true,
+					PairedRComp:          tc.mode,
+					InputFilepath:        r1Path,
+					OutputFilenameArg:    "r1.sorted.fastq.gz",
+					OutputDir:            outDir,
+					PairedInputFilepaths: []string{r2Path},
+					CheckPairs:           true,
+				})
+				if err != nil {
+					t.Fatalf("run squish: %v", err)
+				}
+
+				r1Out := readGzipRecords(t, filepath.Join(outDir, "r1.sorted.fastq.gz"))
+				r2Out := readGzipRecords(t, filepath.Join(outDir, "r2.sorted.fastq.gz"))
+				if got := r1Out["@pair1/1"]; got != tc.wantR1 {
+					t.Fatalf("pair1 R1 = %q, want %q", got, tc.wantR1)
+				}
+				if got := r2Out["@pair1/2"]; got != tc.wantR2 {
+					t.Fatalf("pair1 R2 = %q, want %q", got, tc.wantR2)
+				}
+				if got := r2Out["@pair2/2"]; got != "CCCCCC" {
+					t.Fatalf("pair2 R2 = %q, want it unchanged", got)
+				}
+				if result.Report.FlippedReads != tc.wantFlipped || result.Report.FlippedPairs != tc.wantPairs {
+					t.Fatalf("flipped reads/pairs = %d/%d, want %d/%d", result.Report.FlippedReads, result.Report.FlippedPairs, tc.wantFlipped, tc.wantPairs)
+				}
+				if _, err := os.Stat(filepath.Join(outDir, DefaultFlipFilename)); (err == nil) != tc.wantFlipFile {
+					t.Fatalf("flip file exists = %v, want %v", err == nil, tc.wantFlipFile)
+				}
+			})
+		}
+	}
+}
+
+func TestRunDedupePairs(t *testing.T) {
+	r1 := "" +
+		"@pair1/1\nACGTTGCAAGGTCAGT\n+\nJJJJJJJJJJJJJJJJ\n" +
+		"@pair2/1\nACGTTGCAAGGTCAGT\n+\nIIIIIIIIIIIIIIII\n" +
+		"@pair3/1\nACGTTGCAAGGTCAGT\n+\nIIIIIIIIIIIIIIII\n"
+	r2 := "" +
+		"@pair1/2\nTTTTGGGGCCCCAAAA\n+\nIIIIIIIIIIIIIIII\n" +
+		"@pair2/2\nTTTTGGGGCCCCAAAA\n+\nIIIIIIIIIIIIIIII\n" +
+		"@pair3/2\nGGGGTTTTCCCCAAAA\n+\nIIIIIIIIIIIIIIII\n"
+	for _, tc := range []struct{ mode, engine string }{{"mark", "memory"}, {"remove", "external"}} {
+		t.Run(tc.mode, func(t *testing.T) {
+			dir := t.TempDir()
+			r1Path := filepath.Join(dir, "r1.fastq")
+			r2Path := filepath.Join(dir, "r2.fastq")
+			outDir := filepath.Join(dir, "out")
+			if err := os.WriteFile(r1Path, []byte(r1), 0644); err != nil {
+				t.Fatalf("write r1: %v", err)
+			}
+			if err := os.WriteFile(r2Path, []byte(r2), 0644); err != nil {
+				t.Fatalf("write r2: %v", err)
+			}
+
+			result, err := Run(context.Background(), Config{
+				SortMethod:           "clump",
+				SortEngine:           tc.engine,
+				ClumpKmerLen:         5,
+				Dedupe:               tc.mode,
+				InputFilepath:        r1Path,
+				OutputFilenameArg:    "r1.sorted.fastq.gz",
+				OutputDir:            outDir,
+				PairedInputFilepaths: []string{r2Path},
+				CheckPairs:           true,
+			})
+			if err != nil {
+				t.Fatalf("run squish: %v", err)
+			}
+			dedupe := result.Report.Dedupe
+			if dedupe == nil || dedupe.Duplicates != 1 || dedupe.DuplicateRate != 1.0/3 {
+				t.Fatalf("dedupe report = %+v, want 1 duplicate of 3 reads", dedupe)
+			}
+
+			r1Out := readGzipRecords(t, filepath.Join(outDir, "r1.sorted.fastq.gz"))
+			r2Out := readGzipRecords(t, filepath.Join(outDir, "r2.sorted.fastq.gz"))
+			_, r1Tagged := r1Out["@pair2/1 "+fastq.DuplicateTagLibrary]
+			_, r2Tagged := r2Out["@pair2/2 "+fastq.DuplicateTagLibrary]
+			switch tc.mode {
+			case "mark":
+				if len(r1Out) != 3 || len(r2Out) != 3 || !r1Tagged || !r2Tagged {
+					t.Fatalf("mark outputs = %v / %v, want pair2 tagged in both", r1Out, r2Out)
+				}
+			case "remove":
+				_, r1Kept := r1Out["@pair2/1"]
+				_, r2Kept := r2Out["@pair2/2"]
+				if len(r1Out) != 2 || len(r2Out) != 2 || r1Kept || r2Kept || dedupe.Removed != 1 {
+					t.Fatalf("remove outputs = %v / %v, want pair2 dropped from both", r1Out, r2Out)
+				}
+			}
+		})
+	}
+}
+
+func TestRunClumpCorrectReportsChangedBases(t *testing.T) {
+	input := ""
+	for i := 0; i < 5; i++ {
+		input += fmt.Sprintf("@r%d\nACGTTGCAAGGTCAGT\n+\nIIIIIIIIIIIIIIII\n", i)
+	}
+	// The reverse complement of the consensus with a low-quality error, so the
+	// corrected base lands in a reverse-complemented read.
+	input += "@low\nTCTGACCTTGCAACGT\n+\n#IIIIIIIIIIIIIII\n"
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	outDir := filepath.Join(dir, "out")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	for _, engine := range []string{"memory", "external"} {
+		result, err := Run(context.Background(), Config{
+			SortMethod:        "clump",
+			SortEngine:        engine,
+			ClumpKmerLen:      5,
+			ClumpRComp:        true,
+			ClumpCorrect:      true,
+			InputFilepath:     inputPath,
+			OutputFilenameArg: "output.fastq.gz",
+			OutputDir:         outDir,
+		})
+		if err != nil {
+			t.Fatalf("run squish with %s engine: %v", engine, err)
+		}
+		correction := result.Report.Correction
+		if correction == nil || correction.CorrectedBases != 1 || correction.CorrectedReads != 1 {
+			t.Fatalf("%s correction report = %+v, want 1 base in 1 read", engine, correction)
+		}
+		records := readGzipRecords(t, filepath.Join(outDir, "output.fastq.gz"))
+		if records["@low"] != records["@r0"] {
+			t.Fatalf("%s corrected read = %q, want %q", engine, records["@low"], records["@r0"])
+		}
+	}
+}
+
+func TestRunSortKeyUsesLeadingKeyBuckets(t *testing.T) {
+	input := "" +
+		"@short\nAC\n+\nII\n" +
+		"@long\nACGTACGT\n+\nIIIIIIII\n" +
+		"@mid\nACGTA\n+\nIIIII\n"
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	outDir := filepath.Join(dir, "out")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	result, err := Run(context.Background(), Config{
+		SortKey:           "length:desc,seq",
+		SortEngine:        "external",
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         outDir,
+	})
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+	report := result.Report
+	if report.SortMethod != "key" || report.SortKey != "len:desc,seq" {
+		t.Fatalf("sort method/key = %q/%q, want key/len:desc,seq", report.SortMethod, report.SortKey)
+	}
+	if report.Bucket == nil || !report.Bucket.OrderedFor || report.Bucket.Strategy != "length-range-desc" {
+		t.Fatalf("bucket report = %+v, want ordered length-range-desc buckets", report.Bucket)
+	}
+
+	order, err := os.ReadFile(filepath.Join(outDir, DefaultOrderFilename))
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if got := string(order); got != "2\n3\n1\n" {
+		t.Fatalf("order = %q, want longest first", got)
+	}
+}
+
+func TestRunKeyRangeBuckets(t *testing.T) {
+	input := "" +
+		"@c\nAAAA\n+\nIIII\n" +
+		"@a\nTTTT\n+\n####\n" +
+		"@b\nGGGG\n+\n5555\n"
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	config := Config{
+		SortKey:           "qual,name",
+		SortEngine:        "external",
+		BucketStrategy:    "key-range",
+		BucketCount:       2,
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         filepath.Join(dir, "out"),
+	}
+	result, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+	if report := result.Report; report.Bucket == nil || !report.Bucket.OrderedFor || report.Bucket.Strategy != "key-range" {
+		t.Fatalf("bucket report = %+v, want ordered key-range buckets", report.Bucket)
+	}
+	order, err := os.ReadFile(filepath.Join(config.OutputDir, DefaultOrderFilename))
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if got := string(order); got != "2\n3\n1\n" {
+		t.Fatalf("order = %q, want lowest quality first", got)
+	}
+
+	config.SortKey = ""
+	config.SortMethod = "clump"
+	config.OutputDir = filepath.Join(dir, "clump")
+	if _, err := Run(context.Background(), config); err == nil {
+		t.Fatalf("expected key-range buckets to be rejected for clump")
+	}
+}
+
+func TestRunKeyCommandUsesKeyRangeBuckets(t *testing.T) {
+	input := "" +
+		"@a\nAAAA\n+\nIIII\n" +
+		"@b\nCCCC\n+\nIIII\n" +
+		"@c\nGGGG\n+\nIIII\n"
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	scriptPath := filepath.Join(dir, "keys.sh")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	// Reverse the reads by printing descending keys. The argument holds a
+	// space, so it only matches when passed through unsplit.
+	script := "#!/bin/sh\n[ \"$1\" = \"reverse order\" ] || exit 1\nawk '{ print 100 - NR }'\n"
+	if err := os.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		t.Fatalf("write key script: %v", err)
+	}
+
+	config := Config{
+		SortMethod:        "command",
+		KeyCommand:        []string{scriptPath, "reverse order"},
+		SortEngine:        "external",
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         filepath.Join(dir, "out"),
+	}
+	result, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+	report := result.Report
+	if report.Bucket == nil || !report.Bucket.OrderedFor || report.Bucket.Strategy != "key-range" {
+		t.Fatalf("bucket report = %+v, want ordered key-range buckets", report.Bucket)
+	}
+	if report.KeyCommand == nil || report.KeyCommand.Keys != 3 || len(report.KeyCommand.Command) != 2 {
+		t.Fatalf("key command report = %+v, want 3 keys", report.KeyCommand)
+	}
+	order, err := os.ReadFile(filepath.Join(config.OutputDir, DefaultOrderFilename))
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if got := string(order); got != "3\n2\n1\n" {
+		t.Fatalf("order = %q, want reversed input", got)
+	}
+
+	if entries, err := os.ReadDir(filepath.Join(config.OutputDir, "tmp", "key-command")); err != nil || len(entries) != 0 {
+		t.Fatalf("key sidecar left behind: %v, %v", entries, err)
+	}
+
+	config.KeyCommand = nil
+	if _, err := Run(context.Background(), config); err == nil {
+		t.Fatalf("expected the command sort method to require -keyCmd")
+	}
+}
+
+func TestRunBarcodeUMIKeyReordersCompanionReads(t *testing.T) {
+	dir := t.TempDir()
+	r1Path := filepath.Join(dir, "r1.fastq")
+	r2Path := filepath.Join(dir, "r2.fastq")
+	outDir := filepath.Join(dir, "out")
+
+	// 10x-style pairs: R1 holds a 4 base barcode and a 2 base UMI, R2 the
+	// cDNA.
+	r1 := "" +
+		"@m1/1\nTTTTAC\n+\nIIIIII\n" +
+		"@m2/1\nCCCCGG\n+\nIIIIII\n" +
+		"@m3/1\nTTTTAA\n+\nIIIIII\n" +
+		"@m4/1\nCCCCGG\n+\nIIIIII\n"
+	r2 := "" +
+		"@m1/2\nACGTACGT\n+\nIIIIIIII\n" +
+		"@m2/2\nGGGGCCCC\n+\nIIIIIIII\n" +
+		"@m3/2\nTTTTAAAA\n+\nIIIIIIII\n" +
+		"@m4/2\nCCCCGGGG\n+\nIIIIIIII\n"
+	if err := os.WriteFile(r1Path, []byte(r1), 0644); err != nil {
+		t.Fatalf("write r1: %v", err)
+	}
+	if err := os.WriteFile(r2Path, []byte(r2), 0644); err != nil {
+		t.Fatalf("write r2: %v", err)
+	}
+
+	result, err := Run(context.Background(), Config{
+		SortKey:               "bc,umi",
+		BarcodeTag:            "pos:0-4",
+		UMITag:                "pos:4-6",
+		SortEngine:            "external",
+		InputFilepath:         r1Path,
+		OutputFilenameArg:     "r1.sorted.fastq.gz",
+		OutputDir:             outDir,
+		PairedInputArgs:       []string{r2Path},
+		PairedInputFilepaths:  []string{r2Path},
+		PairedOutputArgs:      []string{"r2.sorted.fastq.gz"},
+		PairedOutputFilepaths: []string{filepath.Join(outDir, "r2.sorted.fastq.gz")},
+		CheckPairs:            true,
+	})
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+	report := result.Report
+	if report.Bucket == nil || !report.Bucket.OrderedFor || report.Bucket.Strategy != "key-range" {
+		t.Fatalf("bucket report = %+v, want ordered key-range buckets", report.Bucket)
+	}
+	if report.BarcodeTag != "pos:0-4" || report.UMITag != "pos:4-6" {
+		t.Fatalf("report tags = %q/%q", report.BarcodeTag, report.UMITag)
+	}
+	order, err := os.ReadFile(filepath.Join(outDir, DefaultOrderFilename))
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if got := string(order); got != "2\n4\n3\n1\n" {
+		t.Fatalf("order = %q, want barcode then UMI order", got)
+	}
+	if r2Out := readGzipRecords(t, filepath.Join(outDir, "r2.sorted.fastq.gz")); r2Out["@m4/2"] != "CCCCGGGG" {
+		t.Fatalf("paired output = %v", r2Out)
+	}
+
+	if _, err := Run(context.Background(), Config{
+		SortKey:           "bc,seq",
+		InputFilepath:     r1Path,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         filepath.Join(dir, "missing"),
+	}); err == nil {
+		t.Fatalf("expected the bc field to require -barcode")
+	}
+}
+
+func TestRunDemuxWritesSampleOutputs(t *testing.T) {
+	dir := t.TempDir()
+	r1Path := filepath.Join(dir, "r1.fastq")
+	r2Path := filepath.Join(dir, "r2.fastq")
+	sheetPath := filepath.Join(dir, "samples.tsv")
+	outDir := filepath.Join(dir, "out")
+
+	r1 := "" +
+		"@p1/1 1:N:0:AAAA\nTTTT\n+\nIIII\n" +
+		"@p2/1 1:N:0:CCCC\nGGGG\n+\nIIII\n" +
+		"@p3/1 1:N:0:AAAT\nCCCC\n+\nIIII\n" +
+		"@p4/1 1:N:0:GGGG\nAAAA\n+\nIIII\n" +
+		"@p5/1 1:N:0:CCCC\nACAC\n+\nIIII\n"
+	r2 := "" +
+		"@p1/2 2:N:0:AAAA\nAAAT\n+\nIIII\n" +
+		"@p2/2 2:N:0:CCCC\nCCCT\n+\nIIII\n" +
+		"@p3/2 2:N:0:AAAT\nGGGT\n+\nIIII\n" +
+		"@p4/2 2:N:0:GGGG\nTTTA\n+\nIIII\n" +
+		"@p5/2 2:N:0:CCCC\nGTGT\n+\nIIII\n"
+	sheet := "sample\tindex\nS1\tAAAA\nS2\tCCCC\n"
+	for path, text := range map[string]string{r1Path: r1, r2Path: r2, sheetPath: sheet} {
+		if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+	}
+
+	config := Config{
+		SortMethod:            "alpha",
+		SortEngine:            "external",
+		DemuxSampleSheet:      sheetPath,
+		DemuxMismatches:       1,
+		InputFilepath:         r1Path,
+		OutputFilenameArg:     "r1.sorted.fastq.gz",
+		OutputDir:             outDir,
+		PairedInputArgs:       []string{r2Path},
+		PairedInputFilepaths:  []string{r2Path},
+		PairedOutputArgs:      []string{"r2.sorted.fastq.gz"},
+		PairedOutputFilepaths: []string{filepath.Join(outDir, "r2.sorted.fastq.gz")},
+		CheckPairs:            true,
+	}
+	result, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+
+	wantOrders := map[string]string{
+		"S1." + DefaultOrderFilename: "3\n1\n",
+		"S2." + DefaultOrderFilename: "5\n2\n",
+		DefaultOrderFilename:         "4\n",
+	}
+	for name, want := range wantOrders {
+		order, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatalf("read order: %v", err)
+		}
+		if got := string(order); got != want {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if r2Out := readGzipRecords(t, filepath.Join(outDir, "S1.r2.sorted.fastq.gz")); len(r2Out) != 2 || r2Out["@p3/2 2:N:0:AAAT"] != "GGGT" {
+		t.Fatalf("S1 paired output = %v", r2Out)
+	}
+	if r2Out := readGzipRecords(t, filepath.Join(outDir, "r2.sorted.fastq.gz")); len(r2Out) != 1 || r2Out["@p4/2 2:N:0:GGGG"] != "TTTA" {
+		t.Fatalf("undetermined paired output = %v", r2Out)
+	}
+
+	manifest, err := os.ReadFile(filepath.Join(outDir, DefaultManifestFilename))
+	if err != nil {
+		t.Fatalf("read manifest: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(manifest)), "\n"); len(lines) != 6 || !strings.HasSuffix(lines[2], "S1.r1.sorted.fastq.gz") {
+		t.Fatalf("manifest = %q, want the main, sample, and paired outputs", manifest)
+	}
+
+	demux := result.Report.Demux
+	if demux == nil || demux.Tag != DefaultDemuxTag || len(demux.Samples) != 3 {
+		t.Fatalf("demux report = %+v", demux)
+	}
+	for i, want := range []struct {
+		name  string
+		reads int
+	}{{"S1", 2}, {"S2", 2}, {"Undetermined", 1}} {
+		sample := demux.Samples[i]
+		if sample.Name != want.name || sample.Reads != want.reads || sample.Written != want.reads || len(sample.PairedOutputs) != 1 {
+			t.Fatalf("demux sample %d = %+v, want %s with %d reads", i, sample, want.name, want.reads)
+		}
+	}
+
+	config.SortEngine = "memory"
+	config.OutputDir = filepath.Join(dir, "memory")
+	config.PairedOutputFilepaths = nil
+	if _, err := Run(context.Background(), config); err == nil {
+		t.Fatalf("expected demux to require the external engine")
+	}
+}
+
+func TestRunHeaderOrderReportsSavings(t *testing.T) {
+	input := "" +
+		"@M1:1:FC:1:1101:10:1\nACGTTGCA\n+\nIIIIIIII\n" +
+		"@M1:1:FC:1:1101:95:1\nACGTTGCA\n+\n########\n" +
+		"@M1:1:FC:1:1101:9:1\nACGTTGCA\n+\n55555555\n" +
+		"@M1:1:FC:1:1102:9:1\nACGTTGCA\n+\n++++++++\n"
+
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	outDir := filepath.Join(dir, "out")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	for _, engine := range []string{"memory", "external"} {
+		result, err := Run(context.Background(), Config{
+			SortMethod:        "clump",
+			SortEngine:        engine,
+			ClumpKmerLen:      4,
+			HeaderOrder:       "similarity",
+			InputFilepath:     inputPath,
+			OutputFilenameArg: "output.fastq.gz",
+			OutputDir:         outDir,
+		})
+		if err != nil {
+			t.Fatalf("run squish with %s engine: %v", engine, err)
+		}
+		order, err := os.ReadFile(filepath.Join(outDir, DefaultOrderFilename))
+		if err != nil {
+			t.Fatalf("read order: %v", err)
+		}
+		if got := string(order); got != "3\n2\n1\n4\n" {
+			t.Fatalf("%s order = %q, want headers chained by shared prefix", engine, got)
+		}
+		report := result.Report.HeaderOrder
+		if report == nil || report.TieGroups != 1 || report.SharedPrefixBytes != 47 || report.DefaultSharedPrefixBytes != 44 || report.SavedBytes != 3 {
+			t.Fatalf("%s header order report = %+v, want 3 saved bytes", engine, report)
+		}
+	}
+
+	if _, err := Run(context.Background(), Config{
+		SortMethod:        "alpha",
+		HeaderOrder:       "tokens",
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         filepath.Join(dir, "alpha"),
+	}); err == nil {
+		t.Fatalf("expected headerOrder to require the clump sort method")
+	}
+}
+
+func TestAutoBucketStrategiesFromRegistrations(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	input := "" +
+		"@A00:1:FC:1:1101:10:20 1:N:0:1\nACGTACGTACGTACGTACGTACGTACGTACGTACGT\n+\nIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIIII\n" +
+		"@A00:1:FC:1:1102:30:40 1:N:0:1\nTTTTACGTACGTACGTACGTACGTACGTACGTACGT\n+\n####################################\n"
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+
+	// Each built-in method gets its registered DefaultBucket; alpha keeps
+	// one-base prefix buckets through DefaultBucketParams.
+	for _, tc := range []struct {
+		method     string
+		bucketer   string
+		buckets    int
+		unordered  bool
+		lengthDesc bool
+	}{
+		{method: "clump", bucketer: "clump-minimizer", buckets: 8, unordered: true},
+		{method: "alpha", bucketer: "sequence-prefix", buckets: 256},
+		{method: "canonical-alpha", bucketer: "canonical-prefix", buckets: 256},
+		{method: "gc", bucketer: "gc-range", buckets: 8},
+		{method: "qmean", bucketer: "quality-range", buckets: 8},
+		{method: "name", bucketer: "name-prefix", buckets: 3},
+		{method: "length", bucketer: "length-range", buckets: 8, lengthDesc: true},
+	} {
+		config, sortDefinition, err := normalizeConfig(Config{
+			SortMethod:        tc.method,
+			BucketCount:       8,
+			LengthDescending:  tc.lengthDesc,
+			InputFilepath:     inputPath,
+			OutputFilenameArg: "out.fastq.gz",
+			OutputDir:         filepath.Join(dir, "out"),
+		})
+		if err != nil {
+			t.Fatalf("%s: normalize config: %v", tc.method, err)
+		}
+		bucketer, err := GetBucketStrategy(config, sortDefinition)
+		if err != nil {
+			t.Fatalf("%s: bucket strategy: %v", tc.method, err)
+		}
+		if bucketer.Name() != tc.bucketer || bucketer.BucketCount() != tc.buckets {
+			t.Fatalf("%s: auto buckets = %s x%d, want %s x%d", tc.method, bucketer.Name(), bucketer.BucketCount(), tc.bucketer, tc.buckets)
+		}
+		if !tc.unordered && !bucketer.OrderedFor(sortDefinition.Strategy) {
+			t.Fatalf("%s: auto %s buckets should be ordered for the sorter", tc.method, bucketer.Name())
+		}
+	}
+}
+
+func TestRunRegisteredStrategies(t *testing.T) {
+	// Registrations are global, so a repeated test run reuses them.
+	if _, ok := SortStrategyRegistration("test-length"); !ok {
+		err := RegisterBucketStrategy(BucketRegistration{
+			Name:        "test-length-range",
+			Description: "length buckets following the test-length direction",
+			Params:      []StrategyParam{{Name: "maxLength", Type: ParamTypeInt, Default: "1000"}},
+			New: func(config Config, sortDefinition SortDefinition, params StrategyParams) (_sort.BucketStrategy, error) {
+				descending := sortDefinition.Strategy.(_sort.LengthSort).Descending
+				return _sort.NewLengthRangeBuckets(config.BucketCount, params.Int("maxLength")).WithDescending(descending), nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("register bucket strategy: %v", err)
+		}
+		err = RegisterSortStrategy(SortRegistration{
+			Name:          "test-length",
+			Description:   "length sort with a direction parameter",
+			Params:        []StrategyParam{{Name: "desc", Type: ParamTypeBool, Default: "false", Description: "longest first"}},
+			DefaultBucket: "test-length-range",
+			New: func(_ Config, params StrategyParams) (_sort.SortStrategy, error) {
+				return _sort.LengthSort{Descending: params.Bool("desc")}, nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("register sort strategy: %v", err)
+		}
+	}
+	if err := RegisterSortStrategy(SortRegistration{Name: "test-length", New: builtinSortMethods[0].New}); err == nil {
+		t.Fatalf("expected an error registering test-length twice")
+	}
+	if err := RegisterSortStrategy(SortRegistration{Name: "key", New: builtinSortMethods[0].New}); err == nil {
+		t.Fatalf("expected an error registering the reserved key method")
+	}
+	if usage := SortMethodUsage(); !strings.Contains(usage, "test-length: length sort with a direction parameter [params: desc bool=false (longest first)]") {
+		t.Fatalf("sort method usage does not list test-length: %s", usage)
+	}
+
+	input := "" +
+		"@short\nAC\n+\nII\n" +
+		"@long\nACGTACGT\n+\nIIIIIIII\n" +
+		"@mid\nACGTA\n+\nIIIII\n"
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	config := Config{
+		SortMethod:        "test-length",
+		SortParams:        map[string]string{"desc": "true"},
+		SortEngine:        "external",
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         filepath.Join(dir, "out"),
+	}
+	result, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+	report := result.Report
+	if report.SortMethod != "test-length" || report.SortParams["desc"] != "true" {
+		t.Fatalf("sort method/params = %q/%v, want test-length with desc=true", report.SortMethod, report.SortParams)
+	}
+	if report.Bucket == nil || !report.Bucket.OrderedFor || report.Bucket.Strategy != "length-range" {
+		t.Fatalf("bucket report = %+v, want ordered length-range buckets", report.Bucket)
+	}
+	order, err := os.ReadFile(filepath.Join(config.OutputDir, DefaultOrderFilename))
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if got := string(order); got != "2\n3\n1\n" {
+		t.Fatalf("order = %q, want longest first", got)
+	}
+
+	for _, params := range []map[string]string{{"desc": "maybe"}, {"reverse": "true"}} {
+		config.SortParams = params
+		config.OutputDir = filepath.Join(dir, "bad")
+		if _, err := Run(context.Background(), config); err == nil {
+			t.Fatalf("expected an error for sort params %v", params)
+		}
+	}
+}
+
+func TestRunReferenceSortsByPosition(t *testing.T) {
+	reference := ">chr1 test\n" +
+		"CCGTAATGCCTTTCCCTAACAGAGTTTTTCGAACTCGTGTTGTCGAGCG\n" +
+		"ACGGAATTAGATCAGTTAAATGGCAGAAAACTGGCAGGGCT\n"
+	input := "" +
+		"@pos60\nTCAGTTAAATGGCAGAAAAC\n+\nIIIIIIIIIIIIIIIIIIII\n" +
+		"@pos10_minus\nGAAAAACTCTGTTAGGGAAA\n+\nIIIIIIIIIIIIIIIIIIII\n" +
+		"@unmapped\nNNNNNNNNNNNN\n+\n############\n" +
+		"@pos30\nGAACTCGTGTTGTCGAGCGA\n+\nIIIIIIIIIIIIIIIIIIII\n"
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.fastq")
+	referencePath := filepath.Join(dir, "reference.fa")
+	outDir := filepath.Join(dir, "out")
+	if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+		t.Fatalf("write input: %v", err)
+	}
+	if err := os.WriteFile(referencePath, []byte(reference), 0644); err != nil {
+		t.Fatalf("write reference: %v", err)
+	}
+
+	if _, err := Run(context.Background(), Config{
+		SortMethod:        "reference",
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         outDir,
+	}); err == nil {
+		t.Fatalf("expected an error for the reference sort method without a reference")
+	}
+
+	result, err := Run(context.Background(), Config{
+		SortMethod:        "reference",
+		SortEngine:        "external",
+		ReferenceFasta:    referencePath,
+		ReferenceKmerLen:  11,
+		InputFilepath:     inputPath,
+		OutputFilenameArg: "output.fastq.gz",
+		OutputDir:         outDir,
+	})
+	if err != nil {
+		t.Fatalf("run squish: %v", err)
+	}
+	report := result.Report
+	if report.Reference == nil || report.Reference.Contigs != 1 || report.Reference.Length != 90 || report.Reference.KmerLength != 11 {
+		t.Fatalf("reference report = %+v, want one 90 base contig indexed with k=11", report.Reference)
+	}
+	if report.Bucket == nil || !report.Bucket.OrderedFor || report.Bucket.Strategy != "position-range" {
+		t.Fatalf("bucket report = %+v, want ordered position-range buckets", report.Bucket)
+	}
+
+	order, err := os.ReadFile(filepath.Join(outDir, DefaultOrderFilename))
+	if err != nil {
+		t.Fatalf("read order: %v", err)
+	}
+	if got := string(order); got != "2\n4\n1\n3\n" {
+		t.Fatalf("order = %q, want reference position order with the unmapped read last", got)
+	}
+}
+
+func TestRunAbundanceReportsCounts(t *testing.T) {
+	input := "" +
+		"@r1\nGGGGCCCC\n+\nIIIIIIII\n" +
+		"@r2\nACGTACGT\n+\nIIIIIIII\n" +
+		"@r3\nGGGGCCCC\n+\nIIIIIIII\n" +
+		"@r4\nACGTACGT\n+\nIIIIIIII\n" +
+		"@r5\nACGTACGT\n+\nIIIIIIII\n" +
+		"@r6\nACGAACGT\n+\nIIIIIIII\n"
+	for _, engine := range []string{"memory", "external"} {
+		t.Run(engine, func(t *testing.T) {
+			dir := t.TempDir()
+			inputPath := filepath.Join(dir, "input.fastq")
+			outDir := filepath.Join(dir, "out")
+			if err := os.WriteFile(inputPath, []byte(input), 0644); err != nil {
+				t.Fatalf("write input: %v", err)
+			}
+
+			result, err := Run(context.Background(), Config{
+				SortMethod:          "abundance",
+				SortEngine:          engine,
+				AbundanceMismatches: 1,
+				InputFilepath:       inputPath,
+				OutputFilenameArg:   "output.fastq.gz",
+				OutputDir:           outDir,
+			})
+			if err != nil {
+				t.Fatalf("run squish: %v", err)
+			}
+			abundance := result.Report.Abundance
+			if abundance == nil || abundance.Uniques != 3 || abundance.Singletons != 1 || abundance.Clusters != 2 {
+				t.Fatalf("abundance report = %+v, want 3 uniques, 1 singleton, 2 clusters", abundance)
+			}
+			if len(abundance.Sequences) != 2 || abundance.Sequences[0].Sequence != "ACGTACGT" || abundance.Sequences[0].Count != 3 {
+				t.Fatalf("abundance sequences = %+v, want ACGTACGT x3 first", abundance.Sequences)
+			}
+
+			order, err := os.ReadFile(filepath.Join(outDir, DefaultOrderFilename))
+			if err != nil {
+				t.Fatalf("read order: %v", err)
+			}
+			if got := string(order); got != "2\n4\n5\n6\n1\n3\n" {
+				t.Fatalf("order = %q, want most abundant sequence and its variant first", got)
+			}
+		})
+	}
+}
+
+// readGzipRecords maps each header line of a gzipped FASTQ to its sequence.
+func readGzipRecords(t *testing.T, path string) map[string]string {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open gzip: %v", err)
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("create gzip reader: %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read gzip: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	records := map[string]string{}
+	for i := 0; i+1 < len(lines); i += 4 {
+		records[lines[i]] = lines[i+1]
+	}
+	return records
+}